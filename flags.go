@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// waitFlag is a boolean flag that optionally takes a timeout, so both
+// -wait-for-backends and -wait-for-backends=2m work.
+type waitFlag struct {
+	enabled bool
+	timeout time.Duration
+}
+
+func (f *waitFlag) String() string {
+	if !f.enabled {
+		return "false"
+	}
+	if f.timeout == 0 {
+		return "true"
+	}
+	return f.timeout.String()
+}
+
+func (f *waitFlag) Set(value string) error {
+	enabled, err := strconv.ParseBool(value)
+	if err == nil {
+		f.enabled, f.timeout = enabled, 0
+		return nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return fmt.Errorf("expected a boolean or a positive duration, got %q", value)
+	}
+	f.enabled, f.timeout = true, timeout
+	return nil
+}
+
+func (f *waitFlag) IsBoolFlag() bool {
+	return true
+}
@@ -2,4 +2,8 @@ module github.com/lumasepa/kube-apiserver-lb
 
 go 1.15
 
-require gopkg.in/yaml.v2 v2.2.2
+require (
+	github.com/spiffe/go-spiffe/v2 v2.0.0
+	google.golang.org/grpc v1.33.2
+	gopkg.in/yaml.v2 v2.2.2
+)
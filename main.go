@@ -1,223 +1,85 @@
+// Command kube-apiserver-lb is the CLI of the load balancer in pkg/lb.
 package main
 
 import (
-	"crypto/tls"
-	"errors"
 	"flag"
-	"fmt"
-	"gopkg.in/yaml.v2"
-	"io"
-	"io/ioutil"
 	"log"
-	"net"
-	"net/http"
-	"time"
-)
-
-type HealthCheck struct {
-	Period int `yaml:"check_period"`
-	UpThreshold int `yaml:"up_threshold"`
-	DownThreshold int `yaml:"down_threshold"`
-}
+	"os"
+	"os/signal"
+	"syscall"
 
-type Configuration struct {
-	KubeApiServers []string `yaml:"kube_apiservers"`
-	ListenAddr string `yaml:"listen_addr"`
-	HealthCheck HealthCheck `yaml:"health_check"`
-}
+	"github.com/lumasepa/kube-apiserver-lb/pkg/lb"
+	"github.com/lumasepa/kube-apiserver-lb/pkg/mockserver"
+)
 
-func readConfiguration(path string) (*Configuration, error) {
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "manifest" {
+		lb.RunManifest(os.Args[2:])
+		return
 	}
-	config := &Configuration{}
-	err = yaml.Unmarshal(data, &config)
-	if err != nil {
-		return nil, err
+	if len(os.Args) > 1 && os.Args[1] == "kubeadm" {
+		lb.RunKubeadm(os.Args[2:])
+		return
 	}
-	return config, nil
-}
-
-type apiServerLb struct {
-	Local  string
-	RemoteServers []string
-	HealthyServersChan chan[]string
-	rrCounter int
-	healthCheckRules HealthCheck
-	httpClient *http.Client
-}
-
-func (lb *apiServerLb) startHealthChecks(healthyServersChan chan []string) {
-	for {
-		newHealthyServers := make([]string, 0)
-		for _, server := range lb.RemoteServers {
-			resp, err := lb.httpClient.Get(fmt.Sprintf("https://%s/healthz", server))
-
-			if err == nil && resp.StatusCode == 200 {
-				newHealthyServers = append(newHealthyServers, server)
-			} else {
-				var errStr string
-
-				if err != nil {
-					errStr = err.Error()
-				} else {
-					errStr = fmt.Sprintf("HTTP status code : %d", resp.StatusCode)
-				}
-				log.Printf("kube-apiserver %s is not healthy : %s", server, errStr)
-			}
-		}
-
-		healthyServersChan <- newHealthyServers
-		time.Sleep(time.Duration(lb.healthCheckRules.Period) * time.Second)
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		lb.RunBench(os.Args[2:])
+		return
 	}
-}
-
-func (lb *apiServerLb) chooseHealthyRemote(HealthyServers []string) (string, error) {
-	numberOfHealthyRemotes := len(HealthyServers)
-	if numberOfHealthyRemotes == 0 {
-		return "", errors.New("no remote servers are Healthy")
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		lb.RunReplay(os.Args[2:])
+		return
 	}
-	pickedIdx := lb.rrCounter % numberOfHealthyRemotes
-	picked :=  HealthyServers[pickedIdx]
-
-	lb.rrCounter += 1
-
-	return picked, nil
-}
-
-func (lb *apiServerLb) chooseRemote() (string, error) {
-
-	numberOfRemotes := len(lb.RemoteServers)
-	if numberOfRemotes == 0 {
-		return "", errors.New("no remote servers")
+	if len(os.Args) > 1 && os.Args[1] == "audit-verify" {
+		lb.RunAuditVerify(os.Args[2:])
+		return
 	}
-	pickedIdx := lb.rrCounter % numberOfRemotes
-	picked :=  lb.RemoteServers[pickedIdx]
-
-	lb.rrCounter += 1
-
-	return picked, nil
-}
-
-func (lb *apiServerLb) removeHealthyRemote(HealthyServers []string, remote string) []string {
-	newHealthyServers := make([]string, 0)
-
-	for _, server := range HealthyServers {
-		if server != remote {
-			newHealthyServers = append(newHealthyServers, server)
-		}
+	if len(os.Args) > 1 && os.Args[1] == "mockserver" {
+		mockserver.Run(os.Args[2:])
+		return
 	}
 
-	return newHealthyServers
-}
+	path := flag.String("config", "./config.yaml", "config file, or env:NAME to read it from an environment variable")
+	wait := &waitFlag{}
+	flag.Var(wait, "wait-for-backends", "wait for a healthy kube-apiserver before listening, optionally up to a timeout like 2m")
+	chaos := flag.Bool("chaos", false, "inject the failures of the chaos block of the configuration, for staging only")
+	checkConfig := flag.Bool("check-config", false, "only read and validate the configuration, then exit")
+	allowUnknown := flag.Bool("allow-unknown-fields", false, "log unknown configuration keys instead of failing on them")
+	user := flag.String("user", "", "user to switch to once the listeners are bound, overrides user in the configuration")
+	group := flag.String("group", "", "group to switch to once the listeners are bound, overrides group in the configuration")
+	maxProcs := flag.Int("gomaxprocs", 0, "GOMAXPROCS to run with, by default the CPU quota of the cgroup unless GOMAXPROCS is set")
+	flag.Parse()
 
-func acceptAsChan(listener net.Listener, acceptChan chan net.Conn) {
-	for {
-		localConn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Error accepting connections in lb : %s", err)
-		}
-		acceptChan <- localConn
+	read := lb.ReadConfiguration
+	if *allowUnknown {
+		read = lb.ReadConfigurationLenient
 	}
-}
-
-func (lb *apiServerLb) Start() error {
-	HealthyServersChan := make(chan []string)
-
-	go lb.startHealthChecks(HealthyServersChan)
-
-	listener, err := net.Listen("tcp", lb.Local)
+	config, err := read(*path)
 	if err != nil {
-		return err
+		log.Fatalf("error reading configuration : %s", err)
 	}
-	defer listener.Close()
-
-	healthyServers := lb.RemoteServers
-	connChan := make(chan net.Conn)
-
-	go acceptAsChan(listener, connChan)
-
-	for {
-		select {
-		case conn := <- connChan: {
-			remote, err := lb.chooseHealthyRemote(healthyServers)
-			if err != nil {
-				log.Printf("Error selecting healthy server: %s\n", err)
-				remote, err = lb.chooseRemote()
-
-				if err != nil {
-					log.Printf("Error selecting server: %s\n", err)
-					continue
-				}
-			}
-
-			remoteConn, err := net.Dial("tcp", remote)
-			if err != nil {
-				log.Printf("Error trying to forward: %s\n", err)
-				healthyServers = lb.removeHealthyRemote(healthyServers, remote)
-				continue
-			}
-
-			go lb.forward(conn, remoteConn)
-		}
-		case healthyServers = <- HealthyServersChan:
-		}
+	if *user != "" {
+		config.User = *user
 	}
-}
-
-func CloseAndLog(conn net.Conn) {
-	err := conn.Close()
-	if err != nil {
-		log.Printf("Error closing socket: %s", err)
+	if *group != "" {
+		config.Group = *group
 	}
-}
-
-func (lb *apiServerLb) forward(localConn net.Conn, remoteConn net.Conn) {
-
-	copyConn := func (writer, reader net.Conn) {
-		defer CloseAndLog(writer)
-		defer CloseAndLog(reader)
-		_, err := io.Copy(writer, reader)
-		if err != nil {
-			log.Printf("io.Copy error: %s", err)
-		}
+	if *checkConfig {
+		log.Printf("Configuration %s is valid", *path)
+		return
 	}
-
-	go copyConn(localConn, remoteConn)
-	go copyConn(remoteConn, localConn)
-}
-
-
-func main() {
-	path := flag.String("config", "./config.yaml", "config file")
-	flag.Parse()
-
-	config, err := readConfiguration(*path)
+	lb.SetMaxProcs(*maxProcs)
+
+	shutdown := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, shutting down", sig)
+		close(shutdown)
+	}()
+
+	err = lb.Run(config, lb.Options{WaitForBackends: wait.enabled, WaitTimeout: wait.timeout, Chaos: *chaos}, shutdown)
 	if err != nil {
-		log.Fatalf("error reading configuration : %s", err)
-	}
-
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
-		Timeout: 5 * time.Second,
-	}
-
-	for {
-		lb := apiServerLb{
-			Local: config.ListenAddr,
-			RemoteServers: config.KubeApiServers,
-			rrCounter: 1,
-			healthCheckRules: config.HealthCheck,
-			httpClient: client,
-		}
-		err := lb.Start()
-		if err != nil {
-			log.Printf("Restarting lb because of HARD error: %s", err)
-		}
-
-		time.Sleep(1 * time.Second)
+		log.Fatal(err)
 	}
 }
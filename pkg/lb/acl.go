@@ -0,0 +1,75 @@
+package lb
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+var clientRejectedTotal = newCounter("client_rejected_connections_total",
+	"Connections closed because the client address is not allowed by allowed_cidrs and denied_cidrs.",
+	"listener")
+
+// clientACL decides which client addresses may connect. denied_cidrs win
+// over allowed_cidrs, and an empty allowed_cidrs allows everything else.
+type clientACL struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+// newClientACL returns nil when neither list is set.
+func newClientACL(allowed []string, denied []string) (*clientACL, error) {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil, nil
+	}
+	acl := &clientACL{}
+	var err error
+	acl.allowed, err = parseCIDRs(allowed)
+	if err != nil {
+		return nil, fmt.Errorf("allowed_cidrs: %s", err)
+	}
+	acl.denied, err = parseCIDRs(denied)
+	if err != nil {
+		return nil, fmt.Errorf("denied_cidrs: %s", err)
+	}
+	return acl, nil
+}
+
+// check returns why ip may not connect, or an empty string.
+func (a *clientACL) check(ip net.IP) string {
+	if containsIP(a.denied, ip) {
+		return "in denied_cidrs"
+	}
+	if len(a.allowed) > 0 && !containsIP(a.allowed, ip) {
+		return "not in allowed_cidrs"
+	}
+	return ""
+}
+
+// aclListener closes the connections of clients the acl rejects, before
+// they take a backend.
+type aclListener struct {
+	net.Listener
+	acl  *clientACL
+	name string
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return conn, nil
+		}
+		reason := l.acl.check(addr.IP)
+		if reason == "" {
+			return conn, nil
+		}
+		clientRejectedTotal.inc(l.name)
+		log.Printf("Rejected connection from %s on %s: %s", addr, l.Addr(), reason)
+		CloseAndLog(conn)
+	}
+}
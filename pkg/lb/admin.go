@@ -0,0 +1,138 @@
+package lb
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var listenersBoundGauge = newGauge("listeners_bound",
+	"Listeners currently bound and accepting traffic.")
+
+// boundListeners holds the backend state of every listener currently bound,
+// by listener name.
+var boundListeners = struct {
+	sync.Mutex
+	states map[string]*lbState
+}{states: make(map[string]*lbState)}
+
+// listenerBound records a listener as bound until the returned func is
+// called.
+func listenerBound(name string, state *lbState) func() {
+	boundListeners.Lock()
+	defer boundListeners.Unlock()
+	boundListeners.states[name] = state
+	listenersBoundGauge.set(float64(len(boundListeners.states)))
+	return func() {
+		boundListeners.Lock()
+		defer boundListeners.Unlock()
+		delete(boundListeners.states, name)
+		listenersBoundGauge.set(float64(len(boundListeners.states)))
+	}
+}
+
+func listenersBound() int {
+	boundListeners.Lock()
+	defer boundListeners.Unlock()
+	return len(boundListeners.states)
+}
+
+// backendsHealthy reports whether all listeners are bound and each has at
+// least one healthy backend, which is what makes this instance fit to hold
+// a virtual IP.
+func backendsHealthy(listeners int) bool {
+	boundListeners.Lock()
+	defer boundListeners.Unlock()
+	if len(boundListeners.states) < listeners {
+		return false
+	}
+	for _, state := range boundListeners.states {
+		if len(state.healthyServers()) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// startAdminServer serves the metrics, a /healthz that only tells the
+// process is responsive, so a liveness probe doesn't restart the lb while
+// the apiservers are down, and a /readyz that waits for all listeners to
+// be bound. Envoy can also fetch the backends and their health with xDS
+// EDS over REST from it, and /status tells how this instance sees each
+// backend, /status/peers how every instance of status_peers does. POSTing
+// to /backends replaces the backends of a listener, which is only served
+// with admin_auth or on a loopback addr. With admin_auth, all but /healthz
+// and /readyz require a token. With admin_tls it is all served over HTTPS.
+func startAdminServer(addr string, listeners int, peers []string, authConfig *AdminAuthConfig, tlsConfig *AdminTLSConfig, policy tlsPolicy) error {
+	var serverTLS, peerTLS *tls.Config
+	if tlsConfig != nil {
+		var err error
+		serverTLS, peerTLS, err = tlsConfig.configs(policy)
+		if err != nil {
+			return err
+		}
+	}
+	auth := newAdminAuth(authConfig)
+	peerTokenFile := ""
+	if authConfig != nil {
+		peerTokenFile = authConfig.PeerTokenFile
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", auth.require(scopeRead, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		registry.write(w)
+	}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		bound := listenersBound()
+		if bound < listeners {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "%d of %d listeners bound\n", bound, listeners)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc(edsPath, auth.require(scopeRead, serveEDS))
+	mux.HandleFunc("/status", auth.require(scopeRead, serveStatus))
+	mux.HandleFunc("/status/peers", auth.require(scopeRead, peerStatusHandler(peers, peerTokenFile, peerTLS)))
+	if auth != nil || isLoopbackAddr(addr) {
+		mux.HandleFunc("/backends", auth.require(scopeAdmin, serveSwap))
+	} else {
+		log.Printf("Warning: backend swaps are disabled, they require admin_auth unless admin_addr is a loopback address")
+	}
+
+	// Listening here reports a port conflict to Run.
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: addr, Handler: mux, TLSConfig: serverTLS}
+	go func() {
+		var err error
+		if serverTLS != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		log.Printf("Error serving the admin API : %s", err)
+	}()
+	return nil
+}
+
+// isLoopbackAddr tells whether addr can only be reached from this host.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,101 @@
+package lb
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	scopeRead  = "read"
+	scopeAdmin = "admin"
+)
+
+var adminRejectedTotal = newCounter("admin_requests_rejected_total",
+	"Admin API requests rejected for a missing, unknown or insufficient token.",
+	"reason")
+
+// AdminAuthConfig requires a bearer token on the admin API, except on
+// /healthz and /readyz for the probes. Tokens of read_token_files can read
+// /metrics, /status and the xDS endpoints, the ones of admin_token_files
+// can also change the backends. Each file holds one token and is read again
+// when it changes, so tokens rotate without a restart. peer_token_file is
+// sent to status_peers.
+type AdminAuthConfig struct {
+	ReadTokenFiles  []string `yaml:"read_token_files"`
+	AdminTokenFiles []string `yaml:"admin_token_files"`
+	PeerTokenFile   string   `yaml:"peer_token_file"`
+}
+
+func (c *AdminAuthConfig) validate() error {
+	if len(c.ReadTokenFiles) == 0 && len(c.AdminTokenFiles) == 0 {
+		return errors.New("admin_auth requires read_token_files or admin_token_files")
+	}
+	return nil
+}
+
+// adminAuth checks the tokens of admin API requests. Its methods let every
+// request through on a nil adminAuth, which is what newAdminAuth returns
+// without admin_auth.
+type adminAuth struct {
+	read  []*tokenFile
+	admin []*tokenFile
+}
+
+func newAdminAuth(config *AdminAuthConfig) *adminAuth {
+	if config == nil {
+		return nil
+	}
+	a := &adminAuth{}
+	for _, path := range config.ReadTokenFiles {
+		a.read = append(a.read, newTokenFile(path))
+	}
+	for _, path := range config.AdminTokenFiles {
+		a.admin = append(a.admin, newTokenFile(path))
+	}
+	return a
+}
+
+// matches tells whether token is one of tokens. Files that can't be read
+// are logged and skipped, so one bad file doesn't lock everyone out.
+func matches(tokens []*tokenFile, token string) bool {
+	for _, t := range tokens {
+		want, err := t.read()
+		if err != nil {
+			log.Printf("Error reading admin token file %s: %s", t.path, err)
+			continue
+		}
+		if want != "" && subtle.ConstantTimeCompare([]byte(want), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// require serves next only to requests with a token of scope, or of the
+// admin scope, which includes read.
+func (a *adminAuth) require(scope string, next http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		switch {
+		case token == "" || token == r.Header.Get("Authorization"):
+			adminRejectedTotal.inc("missing")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "a bearer token is required", http.StatusUnauthorized)
+		case matches(a.admin, token) || (scope == scopeRead && matches(a.read, token)):
+			next(w, r)
+		case matches(a.read, token):
+			adminRejectedTotal.inc("scope")
+			http.Error(w, "the token is read only", http.StatusForbidden)
+		default:
+			adminRejectedTotal.inc("unknown")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unknown token", http.StatusUnauthorized)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package lb
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"sync"
+)
+
+// AdminTLSConfig serves the admin API over HTTPS, so that the tokens of
+// admin_auth, peer_token_file included, don't cross the network in
+// cleartext. The certificate is loaded again whenever cert_file changes.
+// status_peers, which must serve HTTPS too, are verified with ca_file, or
+// the system roots without it.
+type AdminTLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	CAFile   string `yaml:"ca_file"`
+}
+
+func (c *AdminTLSConfig) validate() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("admin_tls requires cert_file and key_file")
+	}
+	return nil
+}
+
+// configs returns the config of the admin server and the one fetching the
+// status of the peers, both following the policy of the tls block.
+func (c *AdminTLSConfig) configs(policy tlsPolicy) (*tls.Config, *tls.Config, error) {
+	cert := &adminCertificate{certFile: c.CertFile, keyFile: c.KeyFile}
+	_, err := cert.get(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	peers := policy.apply(&tls.Config{})
+	if c.CAFile != "" {
+		peers.RootCAs, err = loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return policy.apply(&tls.Config{GetCertificate: cert.get}), peers, nil
+}
+
+// adminCertificate is the serving certificate of admin_tls, loaded again
+// whenever cert_file is replaced or modified.
+type adminCertificate struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	info os.FileInfo
+}
+
+func (c *adminCertificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && os.SameFile(info, c.info) && info.ModTime().Equal(c.info.ModTime()) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c.cert = &cert
+	c.info = info
+	return c.cert, nil
+}
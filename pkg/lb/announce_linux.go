@@ -0,0 +1,224 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	etherTypeARP   = 0x0806
+	etherTypeIPv4  = 0x0800
+	arpRequest     = 1
+	arpReply       = 2
+	icmpv6NeighSol = 135
+	icmpv6NeighAdv = 136
+	ndpOverride    = 0x20
+	ndpSourceLLA   = 1
+	ndpTargetLLA   = 2
+)
+
+// announceAddress tells the link that ip now lives at the MAC of iface,
+// with a gratuitous ARP request for IPv4 or an unsolicited neighbor
+// advertisement for IPv6, so switches and peers don't keep sending to the
+// previous holder until their caches expire.
+func announceAddress(iface *net.Interface, ip net.IP) error {
+	if len(iface.HardwareAddr) != 6 {
+		return errors.New("interface has no ethernet address")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return sendGratuitousARP(iface, ip4)
+	}
+	return sendUnsolicitedNA(iface, ip.To16())
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func sendGratuitousARP(iface *net.Interface, ip net.IP) error {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, int(htons(etherTypeARP)))
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	frame := make([]byte, 0, 42)
+	frame = append(frame, broadcast...)
+	frame = append(frame, iface.HardwareAddr...)
+	frame = appendUint16(frame, etherTypeARP)
+	frame = appendUint16(frame, 1)
+	frame = appendUint16(frame, etherTypeIPv4)
+	frame = append(frame, 6, 4)
+	frame = appendUint16(frame, arpRequest)
+	frame = append(frame, iface.HardwareAddr...)
+	frame = append(frame, ip...)
+	frame = append(frame, make([]byte, 6)...)
+	frame = append(frame, ip...)
+
+	addr := &syscall.SockaddrLinklayer{Protocol: htons(etherTypeARP), Ifindex: iface.Index, Halen: 6}
+	copy(addr.Addr[:], broadcast)
+	return syscall.Sendto(fd, frame, 0, addr)
+}
+
+func sendUnsolicitedNA(iface *net.Interface, ip net.IP) error {
+	conn, err := net.ListenIP("ip6:ipv6-icmp", &net.IPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	controlErr := rawConn.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255)
+		if err == nil {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, iface.Index)
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// The kernel fills in the ICMPv6 checksum.
+	msg := []byte{icmpv6NeighAdv, 0, 0, 0, ndpOverride, 0, 0, 0}
+	msg = append(msg, ip...)
+	msg = append(msg, ndpTargetLLA, 1)
+	msg = append(msg, iface.HardwareAddr...)
+	_, err = conn.WriteTo(msg, &net.IPAddr{IP: net.IPv6linklocalallnodes, Zone: iface.Name})
+	return err
+}
+
+// addressInUse probes the link for another host holding ip: an ARP probe
+// (RFC 5227) for IPv4, a neighbor solicitation for IPv6. It reports true
+// when another ethernet address answers within timeout.
+func addressInUse(iface *net.Interface, ip net.IP, timeout time.Duration) (bool, error) {
+	if len(iface.HardwareAddr) != 6 {
+		return false, errors.New("interface has no ethernet address")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return probeARP(iface, ip4, timeout)
+	}
+	return probeNeighbor(iface, ip.To16(), timeout)
+}
+
+func probeARP(iface *net.Interface, ip net.IP, timeout time.Duration) (bool, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, int(htons(etherTypeARP)))
+	if err != nil {
+		return false, err
+	}
+	defer syscall.Close(fd)
+	err = syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(etherTypeARP), Ifindex: iface.Index})
+	if err != nil {
+		return false, err
+	}
+
+	// A probe has an all zero sender address, so it doesn't update the ARP
+	// caches of the hosts receiving it.
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	frame := make([]byte, 0, 42)
+	frame = append(frame, broadcast...)
+	frame = append(frame, iface.HardwareAddr...)
+	frame = appendUint16(frame, etherTypeARP)
+	frame = appendUint16(frame, 1)
+	frame = appendUint16(frame, etherTypeIPv4)
+	frame = append(frame, 6, 4)
+	frame = appendUint16(frame, arpRequest)
+	frame = append(frame, iface.HardwareAddr...)
+	frame = append(frame, make([]byte, 4+6)...)
+	frame = append(frame, ip...)
+	addr := &syscall.SockaddrLinklayer{Protocol: htons(etherTypeARP), Ifindex: iface.Index, Halen: 6}
+	copy(addr.Addr[:], broadcast)
+	err = syscall.Sendto(fd, frame, 0, addr)
+	if err != nil {
+		return false, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false, nil
+		}
+		tv := syscall.NsecToTimeval(remaining.Nanoseconds())
+		err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+		if err != nil {
+			return false, err
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		packet := buf[:n]
+		if len(packet) < 42 || packet[12] != etherTypeARP>>8 || packet[13] != etherTypeARP&0xff {
+			continue
+		}
+		op := uint16(packet[20])<<8 | uint16(packet[21])
+		sender := net.HardwareAddr(packet[22:28])
+		if (op == arpReply || op == arpRequest) && net.IP(packet[28:32]).Equal(ip) && !bytes.Equal(sender, iface.HardwareAddr) {
+			return true, nil
+		}
+	}
+}
+
+func probeNeighbor(iface *net.Interface, ip net.IP, timeout time.Duration) (bool, error) {
+	conn, err := net.ListenIP("ip6:ipv6-icmp", &net.IPAddr{IP: net.IPv6unspecified, Zone: iface.Name})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+	controlErr := rawConn.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255)
+		if err == nil {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, iface.Index)
+		}
+	})
+	if controlErr != nil {
+		return false, controlErr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Sent to the solicited-node multicast group of ip, the holder answers
+	// with a neighbor advertisement.
+	solicited := net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0xff, ip[13], ip[14], ip[15]}
+	msg := []byte{icmpv6NeighSol, 0, 0, 0, 0, 0, 0, 0}
+	msg = append(msg, ip...)
+	msg = append(msg, ndpSourceLLA, 1)
+	msg = append(msg, iface.HardwareAddr...)
+	_, err = conn.WriteTo(msg, &net.IPAddr{IP: solicited, Zone: iface.Name})
+	if err != nil {
+		return false, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return false, nil
+			}
+			return false, err
+		}
+		if n >= 24 && buf[0] == icmpv6NeighAdv && net.IP(buf[8:24]).Equal(ip) {
+			return true, nil
+		}
+	}
+}
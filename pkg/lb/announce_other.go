@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package lb
+
+import (
+	"net"
+	"time"
+)
+
+func announceAddress(iface *net.Interface, ip net.IP) error {
+	return errVIPUnsupported
+}
+
+func addressInUse(iface *net.Interface, ip net.IP, timeout time.Duration) (bool, error) {
+	return false, errVIPUnsupported
+}
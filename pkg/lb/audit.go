@@ -0,0 +1,248 @@
+package lb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	auditStart      = "start"
+	auditConnect    = "connect"
+	auditDisconnect = "disconnect"
+
+	// auditTail is how much of the end of an existing audit log is read to
+	// continue its chain.
+	auditTail = 64 * 1024
+)
+
+var auditErrorsTotal = newCounter("audit_write_errors_total",
+	"Audit log entries that could not be written.")
+
+// AuditConfig appends which client was connected to which backend, and
+// when it disconnected, to path for forensics after an incident. Every
+// entry holds the SHA-256 of the previous one and of itself, so an entry
+// edited, inserted or removed breaks the chain, which
+// `kube-apiserver-lb audit-verify` checks. Unlike record, entries are
+// written before the connection is forwarded and never dropped, and the
+// file is never rotated by the lb. TCP listeners only.
+type AuditConfig struct {
+	Path string `yaml:"path"`
+}
+
+func (c *AuditConfig) validate() error {
+	if c.Path == "" {
+		return errors.New("audit requires path")
+	}
+	return nil
+}
+
+// auditEntry is one line of the audit log. Hash covers the line without
+// it, prefixed by Prev.
+type auditEntry struct {
+	Seq      uint64 `json:"seq"`
+	Time     string `json:"time"`
+	Event    string `json:"event"`
+	Conn     uint64 `json:"conn,omitempty"`
+	Listener string `json:"listener,omitempty"`
+	Client   string `json:"client,omitempty"`
+	Backend  string `json:"backend,omitempty"`
+	Prev     string `json:"prev"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+func (e auditEntry) digest() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(e.Prev), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditLog writes the entries synchronously, one at a time, continuing the
+// chain of the file it appends to. Its methods do nothing on a nil
+// auditLog.
+type auditLog struct {
+	path string
+
+	mu     sync.Mutex
+	file   *os.File
+	seq    uint64
+	prev   string
+	lastID uint64
+}
+
+func newAuditLog(config AuditConfig) (*auditLog, error) {
+	file, err := os.OpenFile(config.Path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	last, err := lastAuditEntry(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("continuing the chain of %s: %s", config.Path, err)
+	}
+	a := &auditLog{path: config.Path, file: file}
+	if last != nil {
+		a.seq, a.prev = last.Seq, last.Hash
+	}
+	a.write(auditEntry{Event: auditStart})
+	return a, nil
+}
+
+// lastAuditEntry reads the last entry of file, nil when it is empty.
+func lastAuditEntry(file *os.File) (*auditEntry, error) {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return nil, err
+	}
+	offset := info.Size() - auditTail
+	if offset < 0 {
+		offset = 0
+	}
+	data := make([]byte, info.Size()-offset)
+	_, err = file.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	var entry auditEntry
+	err = json.Unmarshal(lines[len(lines)-1], &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (a *auditLog) write(entry auditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry.Seq = a.seq + 1
+	entry.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	entry.Prev = a.prev
+	hash, err := entry.digest()
+	if err == nil {
+		entry.Hash = hash
+		var data []byte
+		data, err = json.Marshal(entry)
+		if err == nil {
+			_, err = a.file.Write(append(data, '\n'))
+		}
+	}
+	if err != nil {
+		auditErrorsTotal.inc()
+		log.Printf("Error writing the audit log %s: %s", a.path, err)
+		return
+	}
+	a.seq, a.prev = entry.Seq, entry.Hash
+}
+
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.file.Close()
+}
+
+// auditedConn is the connect entry of a connection, for its disconnect
+// entry to refer to.
+type auditedConn struct {
+	audit *auditLog
+	entry auditEntry
+}
+
+func (a *auditLog) connected(listener string, client net.Addr, backend string) *auditedConn {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	a.lastID++
+	id := a.lastID
+	a.mu.Unlock()
+	entry := auditEntry{Conn: id, Listener: listener, Client: client.String(), Backend: backend}
+	connect := entry
+	connect.Event = auditConnect
+	a.write(connect)
+	return &auditedConn{audit: a, entry: entry}
+}
+
+func (c *auditedConn) disconnected() {
+	if c == nil {
+		return
+	}
+	entry := c.entry
+	entry.Event = auditDisconnect
+	c.audit.write(entry)
+}
+
+// RunAuditVerify checks the hash chain of the audit logs given as
+// arguments, oldest first when the log was rotated, and reports the first
+// entry that doesn't follow from the previous one.
+func RunAuditVerify(args []string) {
+	flags := flag.NewFlagSet("audit-verify", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kube-apiserver-lb audit-verify audit.jsonl.1 audit.jsonl\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	var prev *auditEntry
+	entries := 0
+	for _, path := range flags.Args() {
+		err := verifyAuditFile(path, &prev, &entries)
+		if err != nil {
+			fmt.Printf("%s: %s\n", path, err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("%d entries, chain intact\n", entries)
+}
+
+func verifyAuditFile(path string, prev **auditEntry, entries *int) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var entry auditEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		hash, err := entry.digest()
+		if err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		if hash != entry.Hash {
+			return fmt.Errorf("line %d: entry %d was modified, its hash doesn't match", line, entry.Seq)
+		}
+		if *prev != nil && (entry.Prev != (*prev).Hash || entry.Seq != (*prev).Seq+1) {
+			return fmt.Errorf("line %d: entry %d doesn't follow entry %d, entries were removed or inserted", line, entry.Seq, (*prev).Seq)
+		}
+		*prev = &entry
+		*entries++
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,87 @@
+package lb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// AWSCredentials are those of the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN environment variables unless access_key_id is set.
+type AWSCredentials struct {
+	AccessKeyID         string `yaml:"access_key_id"`
+	SecretAccessKeyFile string `yaml:"secret_access_key_file"`
+}
+
+func (c *AWSCredentials) validate() error {
+	if (c.AccessKeyID == "") != (c.SecretAccessKeyFile == "") {
+		return errors.New("access_key_id and secret_access_key_file must be set together")
+	}
+	if c.AccessKeyID == "" && (os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "") {
+		return errors.New("requires access_key_id or the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables")
+	}
+	return nil
+}
+
+func (c *AWSCredentials) credentials() (string, string, string, error) {
+	if c.AccessKeyID == "" {
+		return os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"), nil
+	}
+	secret, err := ioutil.ReadFile(c.SecretAccessKeyFile)
+	if err != nil {
+		return "", "", "", err
+	}
+	return c.AccessKeyID, strings.TrimSpace(string(secret)), "", nil
+}
+
+// sign adds the AWS Signature Version 4 headers to req.
+func (c *AWSCredentials) sign(req *http.Request, body []byte, region string, service string, now time.Time) error {
+	keyID, secret, token, err := c.credentials()
+	if err != nil {
+		return err
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	signedHeaders := "host;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-date:%s\n", req.URL.Host, amzDate)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+		signedHeaders += ";x-amz-security-token"
+		canonicalHeaders += fmt.Sprintf("x-amz-security-token:%s\n", token)
+	}
+
+	payload := sha256.Sum256(body)
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s", amzDate, scope, hex.EncodeToString(canonicalHash[:]))
+
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		keyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
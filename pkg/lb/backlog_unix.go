@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package lb
+
+import "syscall"
+
+// setBacklog calls listen(2) on an already listening socket, which only
+// updates the size of its accept queue.
+func setBacklog(fd uintptr, backlog int) error {
+	return syscall.Listen(int(fd), backlog)
+}
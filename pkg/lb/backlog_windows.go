@@ -0,0 +1,7 @@
+package lb
+
+import "errors"
+
+func setBacklog(fd uintptr, backlog int) error {
+	return errors.New("listen_backlog is not supported on windows")
+}
@@ -0,0 +1,71 @@
+package lb
+
+import "sync/atomic"
+
+// Balancer chooses the backend of a connection or request among candidates,
+// the healthy backends left after the topology and version preferences,
+// which is never empty. outstanding returns the requests in flight to a
+// backend, only counted in L7 mode. Pick is called with the state of the
+// listener locked, so it must not block. The balancers of this package are
+// also safe to call concurrently without it, from several acceptors.
+// candidates is shared with the state, so Pick must neither modify nor keep
+// it.
+type Balancer interface {
+	Pick(candidates []string, outstanding func(server string) int64) string
+}
+
+// NewRoundRobin returns the default Balancer, which picks the candidates in
+// turn.
+func NewRoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	counter uint64
+}
+
+func (b *roundRobin) Pick(candidates []string, outstanding func(server string) int64) string {
+	return candidates[(atomic.AddUint64(&b.counter, 1)-1)%uint64(len(candidates))]
+}
+
+// NewLeastOutstanding returns the Balancer of balance: least_outstanding,
+// which picks the candidate with the fewest requests in flight. The scan
+// starts at the round robin position so ties are spread evenly.
+func NewLeastOutstanding() Balancer {
+	return &leastOutstanding{}
+}
+
+type leastOutstanding struct {
+	counter uint64
+}
+
+func (b *leastOutstanding) Pick(candidates []string, outstanding func(server string) int64) string {
+	start := atomic.AddUint64(&b.counter, 1) - 1
+	var picked string
+	least := int64(-1)
+	for i := range candidates {
+		server := candidates[(start+uint64(i))%uint64(len(candidates))]
+		count := outstanding(server)
+		if least == -1 || count < least {
+			picked, least = server, count
+		}
+	}
+	return picked
+}
+
+// balancer is the Balancer of the listener: the one of the embedding
+// program when it set Options.Balancer, or the one of balance otherwise,
+// consulting the plugin first when it balances.
+func (lb *apiServerLb) balancer(balance string) Balancer {
+	if lb.newBalancer != nil {
+		return lb.newBalancer(lb.name)
+	}
+	balancer := NewRoundRobin()
+	if balance == balanceLeastOutstanding {
+		balancer = NewLeastOutstanding()
+	}
+	if lb.plugin != nil && lb.plugin.config.Balance {
+		return &pluginBalancer{plugin: lb.plugin, listener: lb.name, fallback: balancer}
+	}
+	return balancer
+}
@@ -0,0 +1,30 @@
+package lb
+
+import "testing"
+
+// BenchmarkPick measures how long each balancer takes to pick one of three
+// backends, alone and from GOMAXPROCS goroutines, like acceptors under a
+// high accept rate.
+func BenchmarkPick(b *testing.B) {
+	candidates := []string{"10.0.0.1:6443", "10.0.0.2:6443", "10.0.0.3:6443"}
+	outstanding := func(string) int64 { return 0 }
+	for _, balancer := range []struct {
+		name string
+		new  func() Balancer
+	}{{balanceRoundRobin, NewRoundRobin}, {balanceLeastOutstanding, NewLeastOutstanding}} {
+		b.Run(balancer.name+"/sequential", func(b *testing.B) {
+			picker := balancer.new()
+			for i := 0; i < b.N; i++ {
+				picker.Pick(candidates, outstanding)
+			}
+		})
+		b.Run(balancer.name+"/parallel", func(b *testing.B) {
+			picker := balancer.new()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					picker.Pick(candidates, outstanding)
+				}
+			})
+		})
+	}
+}
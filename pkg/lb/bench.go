@@ -0,0 +1,208 @@
+package lb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchResult is what a bench worker measured.
+type benchResult struct {
+	latencies []time.Duration
+	errors    map[string]int
+}
+
+// RunBench loads an lb, or anything listening on -target, from -connections
+// workers for -duration and prints the throughput, the latency percentiles
+// and the errors. Without -path every operation is a TCP connect, with it a
+// GET of path over HTTPS, each worker keeping its connection open unless
+// -new-connections is set.
+func RunBench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := flags.String("target", "", "address of the lb, like 127.0.0.1:6443")
+	connections := flags.Int("connections", 10, "concurrent connections")
+	duration := flags.Duration("duration", 10*time.Second, "how long to run")
+	path := flags.String("path", "", "GET this path over HTTPS, like /healthz, instead of only connecting")
+	newConnections := flags.Bool("new-connections", false, "open a new connection for every request")
+	timeout := flags.Duration("timeout", 5*time.Second, "timeout of each operation")
+	certFile := flags.String("cert", "", "client certificate for the requests")
+	keyFile := flags.String("key", "", "key of the client certificate")
+	caFile := flags.String("ca", "", "CA to verify the lb with, not verified by default")
+	flags.Parse(args)
+
+	if *target == "" {
+		log.Fatalf("bench requires -target")
+	}
+	if *connections <= 0 || *duration <= 0 {
+		log.Fatalf("bench requires positive -connections and -duration")
+	}
+	var tlsConfig *tls.Config
+	if *path != "" {
+		var err error
+		tlsConfig, err = benchTLSConfig(*certFile, *keyFile, *caFile)
+		if err != nil {
+			log.Fatalf("error loading tls configuration : %s", err)
+		}
+	}
+
+	fmt.Printf("Running %s against %s with %d connections\n", *duration, *target, *connections)
+	deadline := time.Now().Add(*duration)
+	results := make([]benchResult, *connections)
+	var workers sync.WaitGroup
+	for i := range results {
+		workers.Add(1)
+		go func(result *benchResult) {
+			defer workers.Done()
+			result.errors = make(map[string]int)
+			op := benchConnect(*target, *timeout)
+			if *path != "" {
+				op = benchRequest(*target, *path, tlsConfig, *newConnections, *timeout)
+			}
+			for time.Now().Before(deadline) {
+				start := time.Now()
+				err := op()
+				if err != nil {
+					result.errors[benchErrorKind(err)]++
+					continue
+				}
+				result.latencies = append(result.latencies, time.Since(start))
+			}
+		}(&results[i])
+	}
+	workers.Wait()
+	printBench(os.Stdout, results, *duration)
+}
+
+func benchTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: true}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", caFile)
+		}
+		config.InsecureSkipVerify = false
+	}
+	return config, nil
+}
+
+func benchConnect(target string, timeout time.Duration) func() error {
+	return func() error {
+		conn, err := net.DialTimeout("tcp", target, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+func benchRequest(target string, path string, config *tls.Config, newConnections bool, timeout time.Duration) func() error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   config,
+			DisableKeepAlives: newConnections,
+			MaxIdleConns:      1,
+		},
+		Timeout: timeout,
+	}
+	url := fmt.Sprintf("https://%s%s", target, path)
+	return func() error {
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("HTTP status code : %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// benchErrorKind groups errors that only differ by addresses and ports.
+func benchErrorKind(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		if opErr.Timeout() {
+			return opErr.Op + " timeout"
+		}
+		return fmt.Sprintf("%s: %s", opErr.Op, opErr.Err)
+	}
+	if strings.HasPrefix(err.Error(), "HTTP status code") {
+		return err.Error()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "connection closed"
+	}
+	return err.Error()
+}
+
+func printBench(w io.Writer, results []benchResult, duration time.Duration) {
+	var latencies []time.Duration
+	errs := make(map[string]int)
+	failed := 0
+	for _, result := range results {
+		latencies = append(latencies, result.latencies...)
+		for kind, count := range result.errors {
+			errs[kind] += count
+			failed += count
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	fmt.Fprintf(w, "Succeeded: %d, failed: %d\n", len(latencies), failed)
+	fmt.Fprintf(w, "Throughput: %.1f/s\n", float64(len(latencies))/duration.Seconds())
+	if len(latencies) > 0 {
+		fmt.Fprintf(w, "Latency: p50 %s, p90 %s, p99 %s, max %s\n",
+			percentile(latencies, 0.50), percentile(latencies, 0.90), percentile(latencies, 0.99), latencies[len(latencies)-1])
+	}
+	kinds := make([]string, 0, len(errs))
+	for kind := range errs {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "Error: %d x %s\n", errs[kind], kind)
+	}
+}
+
+// percentile of sorted, which must not be empty.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i].Round(time.Microsecond)
+}
@@ -0,0 +1,446 @@
+package lb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	bgpPort            = 179
+	bgpVersion         = 4
+	bgpHeaderLen       = 19
+	bgpMaxMessageLen   = 4096
+	defaultBGPHoldTime = 90
+	bgpConnectRetry    = 5 * time.Second
+	bgpCheckPeriod     = time.Second
+	bgpASTrans         = 23456
+
+	bgpMsgOpen         = 1
+	bgpMsgUpdate       = 2
+	bgpMsgNotification = 3
+	bgpMsgKeepalive    = 4
+
+	bgpCapMultiprotocol = 1
+	bgpCapFourOctetAS   = 65
+
+	bgpAttrOrigin     = 1
+	bgpAttrASPath     = 2
+	bgpAttrNextHop    = 3
+	bgpAttrLocalPref  = 5
+	bgpAttrAS4Path    = 17
+	bgpAttrTransitive = 0x40
+	bgpAttrOptional   = 0x80
+	bgpOriginIGP      = 0
+	bgpASSequence     = 2
+	bgpLocalPref      = 100
+
+	bgpErrCease            = 6
+	bgpCeaseAdminShutdown  = 2
+	bgpErrHoldTimerExpired = 4
+)
+
+var (
+	bgpEstablishedGauge = newGauge("bgp_session_established",
+		"1 while the BGP session with the neighbor is established.", "neighbor")
+	bgpAnnouncedGauge = newGauge("bgp_vip_announced",
+		"1 while the virtual IP is announced to the BGP neighbors.")
+)
+
+// BGPConfig announces vip as a /32 to the neighbors while every listener is
+// bound and has a healthy backend, and withdraws it otherwise, so routers
+// spread the traffic to the endpoint over the healthy lb hosts with ECMP.
+// The address itself has to be assigned to the loopback of every lb host.
+type BGPConfig struct {
+	LocalAS   uint32        `yaml:"local_as"`
+	RouterID  string        `yaml:"router_id"`
+	VIP       string        `yaml:"vip"`
+	NextHop   string        `yaml:"next_hop"`
+	HoldTime  int           `yaml:"hold_time"`
+	Neighbors []BGPNeighbor `yaml:"neighbors"`
+}
+
+type BGPNeighbor struct {
+	Address string `yaml:"address"`
+	AS      uint32 `yaml:"as"`
+	Port    int    `yaml:"port"`
+}
+
+func (c *BGPConfig) validate() error {
+	if c.LocalAS == 0 {
+		return errors.New("bgp local_as is required")
+	}
+	if ip := net.ParseIP(c.RouterID); ip == nil || ip.To4() == nil {
+		return errors.New("bgp router_id must be an IPv4 address")
+	}
+	if ip := net.ParseIP(c.VIP); ip == nil || ip.To4() == nil {
+		return errors.New("bgp vip must be an IPv4 address")
+	}
+	if c.NextHop != "" {
+		if ip := net.ParseIP(c.NextHop); ip == nil || ip.To4() == nil {
+			return errors.New("bgp next_hop must be an IPv4 address")
+		}
+	}
+	if c.HoldTime == 0 {
+		c.HoldTime = defaultBGPHoldTime
+	}
+	if c.HoldTime < 3 || c.HoldTime > 0xffff {
+		return errors.New("bgp hold_time must be between 3 and 65535")
+	}
+	if len(c.Neighbors) == 0 {
+		return errors.New("bgp requires neighbors")
+	}
+	for i := range c.Neighbors {
+		neighbor := &c.Neighbors[i]
+		if net.ParseIP(neighbor.Address) == nil {
+			return fmt.Errorf("bgp neighbor %q is not an IP address", neighbor.Address)
+		}
+		if neighbor.AS == 0 {
+			return fmt.Errorf("bgp neighbor %s requires as", neighbor.Address)
+		}
+		if neighbor.Port == 0 {
+			neighbor.Port = bgpPort
+		}
+	}
+	return nil
+}
+
+// startBGP keeps a session with every neighbor until shutdown. The returned
+// channel is closed once the virtual IP was withdrawn from all of them.
+func startBGP(config BGPConfig, listeners int, shutdown <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	var sessions sync.WaitGroup
+	for _, neighbor := range config.Neighbors {
+		sessions.Add(1)
+		go func(neighbor BGPNeighbor) {
+			defer sessions.Done()
+			peer := &bgpPeer{config: config, neighbor: neighbor, listeners: listeners}
+			peer.run(shutdown)
+		}(neighbor)
+	}
+	go func() {
+		sessions.Wait()
+		close(done)
+	}()
+	return done
+}
+
+type bgpPeer struct {
+	config    BGPConfig
+	neighbor  BGPNeighbor
+	listeners int
+}
+
+func (p *bgpPeer) addr() string {
+	return net.JoinHostPort(p.neighbor.Address, strconv.Itoa(p.neighbor.Port))
+}
+
+// run reconnects to the neighbor until shutdown, which closes the session
+// with a Cease after withdrawing the virtual IP.
+func (p *bgpPeer) run(shutdown <-chan struct{}) {
+	for {
+		err := p.session(shutdown)
+		bgpEstablishedGauge.set(0, p.neighbor.Address)
+		select {
+		case <-shutdown:
+			return
+		default:
+		}
+		log.Printf("Error in BGP session with %s: %s", p.neighbor.Address, err)
+		select {
+		case <-shutdown:
+			return
+		case <-time.After(bgpConnectRetry):
+		}
+	}
+}
+
+func (p *bgpPeer) session(shutdown <-chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", p.addr(), bgpConnectRetry)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Duration(p.config.HoldTime) * time.Second))
+	err = writeBGP(conn, bgpMsgOpen, p.open())
+	if err != nil {
+		return err
+	}
+	msgType, body, err := readBGP(conn)
+	if err != nil {
+		return err
+	}
+	if msgType != bgpMsgOpen {
+		return unexpectedBGP(msgType, body)
+	}
+	holdTime, fourOctetAS, err := p.parseOpen(body)
+	if err != nil {
+		return err
+	}
+	err = writeBGP(conn, bgpMsgKeepalive, nil)
+	if err != nil {
+		return err
+	}
+	msgType, body, err = readBGP(conn)
+	if err != nil {
+		return err
+	}
+	if msgType != bgpMsgKeepalive {
+		return unexpectedBGP(msgType, body)
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("BGP session with %s established, hold time %s", p.neighbor.Address, holdTime)
+	bgpEstablishedGauge.set(1, p.neighbor.Address)
+
+	nextHop := net.ParseIP(p.config.NextHop).To4()
+	if nextHop == nil {
+		nextHop = conn.LocalAddr().(*net.TCPAddr).IP.To4()
+	}
+	if nextHop == nil {
+		return fmt.Errorf("no IPv4 next hop to announce to %s, set next_hop", p.neighbor.Address)
+	}
+
+	// From now on receive writes too, a NOTIFICATION when the hold timer
+	// expires.
+	out := &bgpWriter{conn: conn}
+	received := make(chan error, 1)
+	go func() {
+		received <- p.receive(conn, out, holdTime)
+	}()
+	var keepalive <-chan time.Time
+	if holdTime > 0 {
+		ticker := time.NewTicker(holdTime / 3)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	check := time.NewTicker(bgpCheckPeriod)
+	defer check.Stop()
+
+	announced := false
+	for {
+		healthy := backendsHealthy(p.listeners)
+		if healthy != announced {
+			err = writeBGP(out, bgpMsgUpdate, p.update(healthy, nextHop, fourOctetAS))
+			if err != nil {
+				return err
+			}
+			announced = healthy
+			if healthy {
+				bgpAnnouncedGauge.set(1)
+				log.Printf("Announced %s/32 to BGP neighbor %s", p.config.VIP, p.neighbor.Address)
+			} else {
+				bgpAnnouncedGauge.set(0)
+				log.Printf("Withdrew %s/32 from BGP neighbor %s", p.config.VIP, p.neighbor.Address)
+			}
+		}
+
+		select {
+		case <-shutdown:
+			if announced {
+				writeBGP(out, bgpMsgUpdate, p.update(false, nextHop, fourOctetAS))
+				bgpAnnouncedGauge.set(0)
+			}
+			writeBGP(out, bgpMsgNotification, []byte{bgpErrCease, bgpCeaseAdminShutdown})
+			log.Printf("BGP session with %s closed", p.neighbor.Address)
+			return nil
+		case err = <-received:
+			return err
+		case <-keepalive:
+			err = writeBGP(out, bgpMsgKeepalive, nil)
+			if err != nil {
+				return err
+			}
+		case <-check.C:
+		}
+	}
+}
+
+// bgpWriter serializes the messages written by the session loop and by
+// receive, so that they don't interleave on the connection.
+type bgpWriter struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (w *bgpWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn.Write(b)
+}
+
+// receive reads messages until the session ends. Routes from the neighbor
+// are ignored, the lb only announces.
+func (p *bgpPeer) receive(conn net.Conn, out io.Writer, holdTime time.Duration) error {
+	for {
+		if holdTime > 0 {
+			conn.SetReadDeadline(time.Now().Add(holdTime))
+		}
+		msgType, body, err := readBGP(conn)
+		if err != nil {
+			if errors.Is(err, errBGPTimeout) {
+				writeBGP(out, bgpMsgNotification, []byte{bgpErrHoldTimerExpired, 0})
+			}
+			return err
+		}
+		switch msgType {
+		case bgpMsgKeepalive, bgpMsgUpdate:
+		default:
+			return unexpectedBGP(msgType, body)
+		}
+	}
+}
+
+// open advertises IPv4 unicast and 4-octet AS numbers, the latter carrying
+// local_as when it doesn't fit the 2-octet field.
+func (p *bgpPeer) open() []byte {
+	myAS := p.config.LocalAS
+	if myAS > 0xffff {
+		myAS = bgpASTrans
+	}
+	caps := []byte{bgpCapMultiprotocol, 4, 0, 1, 0, 1, bgpCapFourOctetAS, 4}
+	caps = appendUint32(caps, p.config.LocalAS)
+
+	b := []byte{bgpVersion}
+	b = appendUint16(b, uint16(myAS))
+	b = appendUint16(b, uint16(p.config.HoldTime))
+	b = append(b, net.ParseIP(p.config.RouterID).To4()...)
+	// A single capabilities optional parameter.
+	b = append(b, byte(2+len(caps)), 2, byte(len(caps)))
+	return append(b, caps...)
+}
+
+// parseOpen checks the OPEN of the neighbor and returns the negotiated hold
+// time and whether it speaks 4-octet AS numbers.
+func (p *bgpPeer) parseOpen(b []byte) (time.Duration, bool, error) {
+	if len(b) < 10 {
+		return 0, false, errors.New("short BGP OPEN")
+	}
+	if b[0] != bgpVersion {
+		return 0, false, fmt.Errorf("unsupported BGP version %d", b[0])
+	}
+	peerAS := uint32(binary.BigEndian.Uint16(b[1:3]))
+	holdTime := int(binary.BigEndian.Uint16(b[3:5]))
+	params := b[10:]
+	if len(params) > int(b[9]) {
+		params = params[:b[9]]
+	}
+	fourOctetAS := false
+	for len(params) >= 2 {
+		paramType, paramLen := params[0], int(params[1])
+		if len(params) < 2+paramLen {
+			break
+		}
+		caps := params[2 : 2+paramLen]
+		params = params[2+paramLen:]
+		if paramType != 2 {
+			continue
+		}
+		for len(caps) >= 2 {
+			code, capLen := caps[0], int(caps[1])
+			if len(caps) < 2+capLen {
+				break
+			}
+			if code == bgpCapFourOctetAS && capLen == 4 {
+				fourOctetAS = true
+				peerAS = binary.BigEndian.Uint32(caps[2:6])
+			}
+			caps = caps[2+capLen:]
+		}
+	}
+	if peerAS != p.neighbor.AS {
+		return 0, false, fmt.Errorf("neighbor %s is AS %d, not %d", p.neighbor.Address, peerAS, p.neighbor.AS)
+	}
+	if holdTime > p.config.HoldTime {
+		holdTime = p.config.HoldTime
+	}
+	return time.Duration(holdTime) * time.Second, fourOctetAS, nil
+}
+
+// update announces or withdraws the virtual IP. Over iBGP the AS path is
+// empty and a LOCAL_PREF is required. A neighbor without 4-octet AS numbers
+// gets AS_TRANS in the AS path when local_as doesn't fit in 2 octets, and
+// local_as itself in an AS4_PATH, as of RFC 6793.
+func (p *bgpPeer) update(announce bool, nextHop net.IP, fourOctetAS bool) []byte {
+	prefix := append([]byte{32}, net.ParseIP(p.config.VIP).To4()...)
+	if !announce {
+		b := appendUint16(nil, uint16(len(prefix)))
+		b = append(b, prefix...)
+		return appendUint16(b, 0)
+	}
+
+	var asPath, as4Path []byte
+	if p.neighbor.AS != p.config.LocalAS {
+		asPath = []byte{bgpASSequence, 1}
+		if fourOctetAS {
+			asPath = appendUint32(asPath, p.config.LocalAS)
+		} else if p.config.LocalAS > 0xffff {
+			asPath = appendUint16(asPath, bgpASTrans)
+			as4Path = appendUint32([]byte{bgpASSequence, 1}, p.config.LocalAS)
+		} else {
+			asPath = appendUint16(asPath, uint16(p.config.LocalAS))
+		}
+	}
+	attrs := []byte{bgpAttrTransitive, bgpAttrOrigin, 1, bgpOriginIGP}
+	attrs = append(attrs, bgpAttrTransitive, bgpAttrASPath, byte(len(asPath)))
+	attrs = append(attrs, asPath...)
+	attrs = append(attrs, bgpAttrTransitive, bgpAttrNextHop, 4)
+	attrs = append(attrs, nextHop...)
+	if p.neighbor.AS == p.config.LocalAS {
+		attrs = append(attrs, bgpAttrTransitive, bgpAttrLocalPref, 4)
+		attrs = appendUint32(attrs, bgpLocalPref)
+	}
+	if as4Path != nil {
+		attrs = append(attrs, bgpAttrOptional|bgpAttrTransitive, bgpAttrAS4Path, byte(len(as4Path)))
+		attrs = append(attrs, as4Path...)
+	}
+
+	b := appendUint16(nil, 0)
+	b = appendUint16(b, uint16(len(attrs)))
+	b = append(b, attrs...)
+	return append(b, prefix...)
+}
+
+var errBGPTimeout = errors.New("BGP hold timer expired")
+
+func writeBGP(w io.Writer, msgType byte, body []byte) error {
+	b := make([]byte, 16, bgpHeaderLen+len(body))
+	for i := range b {
+		b[i] = 0xff
+	}
+	b = appendUint16(b, uint16(bgpHeaderLen+len(body)))
+	b = append(b, msgType)
+	_, err := w.Write(append(b, body...))
+	return err
+}
+
+func readBGP(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, bgpHeaderLen)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return 0, nil, errBGPTimeout
+		}
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[16:18]))
+	if length < bgpHeaderLen || length > bgpMaxMessageLen {
+		return 0, nil, fmt.Errorf("bad BGP message length %d", length)
+	}
+	body := make([]byte, length-bgpHeaderLen)
+	_, err = io.ReadFull(r, body)
+	return header[18], body, err
+}
+
+func unexpectedBGP(msgType byte, body []byte) error {
+	if msgType == bgpMsgNotification && len(body) >= 2 {
+		return fmt.Errorf("BGP notification from neighbor, code %d subcode %d", body[0], body[1])
+	}
+	return fmt.Errorf("unexpected BGP message type %d", msgType)
+}
@@ -0,0 +1,11 @@
+package lb
+
+import "syscall"
+
+const bindToDeviceSupported = true
+
+// bindToDevice restricts the socket fd to the network interface device,
+// which needs CAP_NET_RAW before Linux 5.7.
+func bindToDevice(fd uintptr, device string) error {
+	return syscall.BindToDevice(int(fd), device)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package lb
+
+import "errors"
+
+// bindToDeviceSupported is false outside linux, which has no
+// SO_BINDTODEVICE.
+const bindToDeviceSupported = false
+
+func bindToDevice(fd uintptr, device string) error {
+	return errors.New("backend_interface is only supported on linux")
+}
@@ -0,0 +1,234 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const (
+	chaosDial  = "dial"
+	chaosProbe = "probe"
+	chaosReset = "reset"
+
+	defaultChaosMaxResetDelay = 30
+	delayedChunks             = 64
+	delayedChunkSize          = 32 * 1024
+)
+
+var chaosInjectedTotal = newCounter("chaos_injected_total",
+	"Failures injected by the chaos mode, by kind.", "fault")
+
+// ChaosConfig injects failures at random to rehearse failover: dials to the
+// backends and health probes fail at their rate, and the share reset_rate
+// of forwarded connections is reset after up to max_reset_delay seconds.
+// backends restricts it to some of the backends, and latency slows down the
+// forwarded connections. It is only honored when the lb runs with -chaos, so
+// a configuration copied from staging can't break production.
+type ChaosConfig struct {
+	DialFailureRate  float64         `yaml:"dial_failure_rate"`
+	ProbeFailureRate float64         `yaml:"probe_failure_rate"`
+	ResetRate        float64         `yaml:"reset_rate"`
+	MaxResetDelay    int             `yaml:"max_reset_delay"`
+	Backends         []string        `yaml:"backends"`
+	Latency          []LatencyConfig `yaml:"latency"`
+}
+
+func (c *ChaosConfig) validate() error {
+	for name, rate := range map[string]float64{
+		"dial_failure_rate":  c.DialFailureRate,
+		"probe_failure_rate": c.ProbeFailureRate,
+		"reset_rate":         c.ResetRate,
+	} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("chaos %s must be between 0 and 1", name)
+		}
+	}
+	if c.MaxResetDelay < 0 {
+		return errors.New("chaos max_reset_delay must not be negative")
+	}
+	if c.MaxResetDelay == 0 {
+		c.MaxResetDelay = defaultChaosMaxResetDelay
+	}
+	for _, backend := range c.Backends {
+		err := validateServerAddr(backend)
+		if err != nil {
+			return fmt.Errorf("chaos backends: %s", err)
+		}
+	}
+	for i := range c.Latency {
+		err := c.Latency[i].validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inject reports whether a fault with rate should hit server.
+func (c *ChaosConfig) inject(fault string, rate float64, server string) bool {
+	if rate == 0 || rand.Float64() >= rate {
+		return false
+	}
+	if len(c.Backends) > 0 && len(filterServers([]string{server}, c.Backends)) > 0 {
+		return false
+	}
+	chaosInjectedTotal.inc(fault)
+	return true
+}
+
+type chaosDialer struct {
+	Dialer
+	config *ChaosConfig
+}
+
+func (d *chaosDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if d.config.inject(chaosDial, d.config.DialFailureRate, addr) {
+		log.Printf("Chaos: failing the dial to %s", addr)
+		return nil, fmt.Errorf("dial %s %s: failure injected by chaos", network, addr)
+	}
+	return d.Dialer.DialContext(ctx, network, addr)
+}
+
+type chaosChecker struct {
+	HealthChecker
+	config *ChaosConfig
+}
+
+func (c *chaosChecker) Check(server string) error {
+	if c.config.inject(chaosProbe, c.config.ProbeFailureRate, server) {
+		return errors.New("probe failure injected by chaos")
+	}
+	return c.HealthChecker.Check(server)
+}
+
+// maybeReset picks whether the connection from local to server is reset,
+// and if so resets it at a random time unless it finishes first.
+func (c *ChaosConfig) maybeReset(local net.Conn, remote net.Conn, server string, done <-chan struct{}) {
+	if !c.inject(chaosReset, c.ResetRate, server) {
+		return
+	}
+	delay := time.Duration(rand.Int63n(int64(c.MaxResetDelay)*int64(time.Second)) + 1)
+	go func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-done:
+			return
+		}
+		log.Printf("Chaos: resetting connection %s -> %s", local.RemoteAddr(), server)
+		if tcp, ok := local.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+		}
+		local.Close()
+		remote.Close()
+	}()
+}
+
+// LatencyConfig delays the data forwarded to and from backends, all of
+// them by default, by delay_ms plus up to jitter_ms in each direction. Data
+// keeps flowing while it is delayed, like on a long link, so throughput
+// holds up.
+type LatencyConfig struct {
+	DelayMs  int      `yaml:"delay_ms"`
+	JitterMs int      `yaml:"jitter_ms"`
+	Backends []string `yaml:"backends"`
+}
+
+func (c *LatencyConfig) validate() error {
+	if c.DelayMs < 0 || c.JitterMs < 0 {
+		return errors.New("chaos latency delay_ms and jitter_ms must not be negative")
+	}
+	if c.DelayMs == 0 && c.JitterMs == 0 {
+		return errors.New("chaos latency requires delay_ms or jitter_ms")
+	}
+	for _, backend := range c.Backends {
+		err := validateServerAddr(backend)
+		if err != nil {
+			return fmt.Errorf("chaos latency backends: %s", err)
+		}
+	}
+	return nil
+}
+
+// delay returns a latency to add.
+func (c *LatencyConfig) delay() time.Duration {
+	delay := time.Duration(c.DelayMs) * time.Millisecond
+	if c.JitterMs > 0 {
+		delay += time.Duration(rand.Int63n(int64(c.JitterMs) * int64(time.Millisecond)))
+	}
+	return delay
+}
+
+// latencyFor returns the first latency entry matching server, or nil.
+func (c *ChaosConfig) latencyFor(server string) *LatencyConfig {
+	for i := range c.Latency {
+		latency := &c.Latency[i]
+		if len(latency.Backends) == 0 || len(filterServers([]string{server}, latency.Backends)) == 0 {
+			return latency
+		}
+	}
+	return nil
+}
+
+type delayedChunk struct {
+	data []byte
+	due  time.Time
+	err  error
+}
+
+// delayedReader hands out what it reads from the underlying reader once
+// the latency of each chunk passed, in order, reading ahead meanwhile.
+type delayedReader struct {
+	chunks  chan delayedChunk
+	pending []byte
+	err     error
+}
+
+func newDelayedReader(r io.Reader, latency *LatencyConfig, done <-chan struct{}) *delayedReader {
+	d := &delayedReader{chunks: make(chan delayedChunk, delayedChunks)}
+	go func() {
+		var last time.Time
+		for {
+			buf := make([]byte, delayedChunkSize)
+			n, err := r.Read(buf)
+			due := time.Now().Add(latency.delay())
+			if due.Before(last) {
+				due = last
+			}
+			last = due
+			select {
+			case d.chunks <- delayedChunk{data: buf[:n], due: due, err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return d
+}
+
+func (d *delayedReader) Read(p []byte) (int, error) {
+	if len(d.pending) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		chunk := <-d.chunks
+		time.Sleep(time.Until(chunk.due))
+		d.pending, d.err = chunk.data, chunk.err
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	if len(d.pending) == 0 && d.err != nil {
+		return n, d.err
+	}
+	return n, nil
+}
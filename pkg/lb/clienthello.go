@@ -0,0 +1,254 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	recordTypeHandshake      = 22
+	handshakeTypeClientHello = 1
+	maxClientHelloSize       = 1 << 16
+	clientHelloReadTimeout   = 10 * time.Second
+
+	extensionServerName          = 0
+	extensionSupportedGroups     = 10
+	extensionECPointFormats      = 11
+	extensionSignatureAlgorithms = 13
+	extensionALPN                = 16
+	extensionSupportedVersions   = 43
+)
+
+var errNotTLS = errors.New("connection does not start with a TLS handshake")
+
+var (
+	clientHellosTotal = newCounter("client_hellos_total",
+		"TLS ClientHellos seen on passthrough connections.", "tls_version", "alpn")
+	plaintextConnectionsTotal = newCounter("plaintext_connections_total",
+		"Passthrough connections that did not start with a TLS handshake.")
+)
+
+// clientHello holds what the logs and the JA3 and JA4 fingerprints need.
+// The lists keep the order of the client, GREASE values included.
+type clientHello struct {
+	version       uint16
+	legacyVersion uint16
+	serverName    string
+	alpn          []string
+	ciphers       []uint16
+	extensions    []uint16
+	groups        []uint16
+	pointFormats  []uint16
+	sigAlgs       []uint16
+}
+
+func (h *clientHello) String() string {
+	return fmt.Sprintf("sni=%q version=%s alpn=%s ja3=%s ja4=%s", h.serverName, tlsVersionName(h.version), strings.Join(h.alpn, ","), h.ja3(), h.ja4())
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case 0x0300:
+		return "SSLv3"
+	case 0x0301:
+		return "TLS1.0"
+	case 0x0302:
+		return "TLS1.1"
+	case 0x0303:
+		return "TLS1.2"
+	case 0x0304:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// isGREASE reports whether value is one of the reserved RFC 8701 values
+// clients send to keep servers tolerant of unknown parameters.
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+// peekedConn replays the bytes consumed while inspecting the connection
+// before reading from the socket again.
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// readClientHello reads the records holding the ClientHello and returns it
+// along with a connection that yields the same bytes again, so the session
+// can be forwarded untouched.
+func readClientHello(conn net.Conn) (*clientHello, net.Conn, error) {
+	err := conn.SetReadDeadline(time.Now().Add(clientHelloReadTimeout))
+	if err != nil {
+		return nil, conn, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	var raw bytes.Buffer
+	var message []byte
+	reader := io.TeeReader(conn, &raw)
+	replay := func() net.Conn {
+		return &peekedConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(raw.Bytes()), conn)}
+	}
+
+	for {
+		header := make([]byte, 5)
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			return nil, replay(), err
+		}
+		if header[0] != recordTypeHandshake {
+			return nil, replay(), errNotTLS
+		}
+
+		length := int(binary.BigEndian.Uint16(header[3:]))
+		if len(message)+length > maxClientHelloSize {
+			return nil, replay(), errors.New("ClientHello too large")
+		}
+		fragment := make([]byte, length)
+		_, err = io.ReadFull(reader, fragment)
+		if err != nil {
+			return nil, replay(), err
+		}
+		message = append(message, fragment...)
+
+		if len(message) < 4 {
+			continue
+		}
+		if message[0] != handshakeTypeClientHello {
+			return nil, replay(), errors.New("first handshake message is not a ClientHello")
+		}
+		size := int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+		if len(message)-4 >= size {
+			hello, err := parseClientHello(message[4 : 4+size])
+			return hello, replay(), err
+		}
+	}
+}
+
+// helloReader walks the length-prefixed fields of a handshake message.
+type helloReader struct {
+	data []byte
+	err  error
+}
+
+var errShortClientHello = errors.New("truncated ClientHello")
+
+func (r *helloReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = errShortClientHello
+		return nil
+	}
+	value := r.data[:n]
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *helloReader) uint8() int {
+	value := r.bytes(1)
+	if value == nil {
+		return 0
+	}
+	return int(value[0])
+}
+
+func (r *helloReader) uint16() int {
+	value := r.bytes(2)
+	if value == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(value))
+}
+
+// uint16s reads the rest of r as a list of uint16.
+func (r *helloReader) uint16s() []uint16 {
+	var values []uint16
+	for len(r.data) >= 2 && r.err == nil {
+		values = append(values, uint16(r.uint16()))
+	}
+	return values
+}
+
+func (r *helloReader) vector8() *helloReader {
+	return &helloReader{data: r.bytes(r.uint8()), err: r.err}
+}
+
+func (r *helloReader) vector16() *helloReader {
+	return &helloReader{data: r.bytes(r.uint16()), err: r.err}
+}
+
+func parseClientHello(data []byte) (*clientHello, error) {
+	r := &helloReader{data: data}
+	hello := &clientHello{version: uint16(r.uint16())}
+	hello.legacyVersion = hello.version
+	r.bytes(32)
+	r.vector8()
+	hello.ciphers = r.vector16().uint16s()
+	r.vector8()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) == 0 {
+		return hello, nil
+	}
+
+	extensions := r.vector16()
+	for len(extensions.data) > 0 && extensions.err == nil {
+		extType := extensions.uint16()
+		ext := extensions.vector16()
+		hello.extensions = append(hello.extensions, uint16(extType))
+
+		switch extType {
+		case extensionServerName:
+			names := ext.vector16()
+			for len(names.data) > 0 && names.err == nil {
+				nameType := names.uint8()
+				name := names.vector16()
+				if nameType == 0 {
+					hello.serverName = string(name.data)
+				}
+			}
+		case extensionALPN:
+			protocols := ext.vector16()
+			for len(protocols.data) > 0 && protocols.err == nil {
+				hello.alpn = append(hello.alpn, string(protocols.vector8().data))
+			}
+		case extensionSupportedGroups:
+			hello.groups = ext.vector16().uint16s()
+		case extensionECPointFormats:
+			for _, format := range ext.vector8().data {
+				hello.pointFormats = append(hello.pointFormats, uint16(format))
+			}
+		case extensionSignatureAlgorithms:
+			hello.sigAlgs = ext.vector16().uint16s()
+		case extensionSupportedVersions:
+			versions := ext.vector8()
+			for len(versions.data) > 0 && versions.err == nil {
+				version := uint16(versions.uint16())
+				if !isGREASE(version) && version > hello.version {
+					hello.version = version
+				}
+			}
+		}
+	}
+
+	return hello, extensions.err
+}
@@ -0,0 +1,216 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	addressFamilyIPv4 = "ipv4"
+	addressFamilyIPv6 = "ipv6"
+
+	// happyEyeballsDelay is the Connection Attempt Delay of RFC 8305.
+	happyEyeballsDelay = 250 * time.Millisecond
+
+	// maxInterfaceNameLen is IFNAMSIZ, with the terminating NUL.
+	maxInterfaceNameLen = 16
+)
+
+// validateServerAddr checks that a backend is a host and port, catching the
+// common mistake of an IPv6 literal without brackets.
+func validateServerAddr(addr string) error {
+	_, _, err := net.SplitHostPort(addr)
+	if err == nil {
+		return nil
+	}
+	if strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+		return fmt.Errorf("invalid backend %q, IPv6 addresses must be bracketed like [2001:db8::1]:6443", addr)
+	}
+	return fmt.Errorf("invalid backend %q: %s", addr, err)
+}
+
+// Dialer opens the connections to the backends of the TCP listeners and of
+// the tcp health checks.
+type Dialer interface {
+	DialContext(ctx context.Context, network string, addr string) (net.Conn, error)
+}
+
+// NewDialer returns the default Dialer, which races the addresses of
+// backends given by name Happy Eyeballs style, those of family, ipv4 or
+// ipv6, first when it is not empty.
+func NewDialer(family string) Dialer {
+	return &preferringDialer{family: family, dialer: &net.Dialer{}}
+}
+
+type preferringDialer struct {
+	family string
+	dialer *net.Dialer
+}
+
+// newNetDialer is the dialer of the sockets of the backends, with the
+// socket options of config.
+func newNetDialer(config *Configuration) *net.Dialer {
+	dialer := &net.Dialer{}
+	if config.MPTCP {
+		setDialerMPTCP(dialer)
+	}
+	var options []func(fd uintptr) error
+	if config.BackendFwmark != 0 {
+		options = append(options, func(fd uintptr) error {
+			return setFwmark(fd, config.BackendFwmark)
+		})
+	}
+	if config.BackendInterface != "" {
+		options = append(options, func(fd uintptr) error {
+			return bindToDevice(fd, config.BackendInterface)
+		})
+	}
+	if len(options) == 0 {
+		return dialer
+	}
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		var err error
+		controlErr := c.Control(func(fd uintptr) {
+			for _, option := range options {
+				err = option(fd)
+				if err != nil {
+					return
+				}
+			}
+		})
+		if controlErr != nil {
+			return controlErr
+		}
+		return err
+	}
+	return dialer
+}
+
+func (d *preferringDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return dialPreferring(ctx, d.family, addr, func(ctx context.Context, addr string) (net.Conn, error) {
+		return d.dialer.DialContext(ctx, network, addr)
+	})
+}
+
+// dialPreferring dials addr like RFC 8305 when its host is a name: the
+// addresses are interleaved by family, starting with the preferred one or
+// else with the family of the first address the resolver returned, and a
+// new attempt starts every happyEyeballsDelay, or as soon as one fails,
+// until one connects. A broken IPv6 path then costs a client 250ms rather
+// than a connect timeout.
+func dialPreferring(ctx context.Context, prefer string, addr string, dial func(ctx context.Context, addr string) (net.Conn, error)) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dial(ctx, addr)
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no addresses for " + host)
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range interleaveFamilies(ips, prefer) {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return dialHappyEyeballs(ctx, addrs, dial)
+}
+
+// interleaveFamilies alternates the addresses of both families, keeping the
+// order of the resolver within each, starting with prefer.
+func interleaveFamilies(ips []net.IPAddr, prefer string) []net.IPAddr {
+	if prefer == "" {
+		prefer = addressFamilyIPv6
+		if ips[0].IP.To4() != nil {
+			prefer = addressFamilyIPv4
+		}
+	}
+	var first, second []net.IPAddr
+	for _, ip := range ips {
+		if isFamily(ip.IP, prefer) {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	interleaved := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			interleaved = append(interleaved, first[i])
+		}
+		if i < len(second) {
+			interleaved = append(interleaved, second[i])
+		}
+	}
+	return interleaved
+}
+
+// dialHappyEyeballs returns the first connection established to one of
+// addrs, tried in order with staggered starts, and closes those that
+// connect after it. It returns the first error when all fail.
+func dialHappyEyeballs(ctx context.Context, addrs []string, dial func(ctx context.Context, addr string) (net.Conn, error)) (net.Conn, error) {
+	if len(addrs) == 1 {
+		return dial(ctx, addrs[0])
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	next, pending := 0, 0
+	var nextAttempt <-chan time.Time
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, addr)
+			results <- dialResult{conn: conn, server: addr, err: err}
+		}()
+		nextAttempt = nil
+		if next < len(addrs) {
+			nextAttempt = time.After(happyEyeballsDelay)
+		}
+	}
+
+	start()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				cancel()
+				go func(pending int) {
+					for i := 0; i < pending; i++ {
+						if loser := <-results; loser.err == nil {
+							CloseAndLog(loser.conn)
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if next < len(addrs) && ctx.Err() == nil {
+				start()
+			}
+		case <-nextAttempt:
+			start()
+		}
+	}
+	return nil, firstErr
+}
+
+func isFamily(ip net.IP, family string) bool {
+	if family == addressFamilyIPv4 {
+		return ip.To4() != nil
+	}
+	return ip.To4() == nil
+}
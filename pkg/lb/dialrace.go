@@ -0,0 +1,69 @@
+package lb
+
+import (
+	"context"
+	"log"
+	"net"
+)
+
+var dialRaceWinsTotal = newCounter("dial_race_wins_total",
+	"Connections of dial_race established first to the picked backend (primary) or to the alternate one.",
+	"listener", "winner")
+
+type dialResult struct {
+	conn   net.Conn
+	server string
+	err    error
+}
+
+// raceDial dials primary and alternate at once and returns the connection
+// established first with its backend, closing the other one, so a backend
+// whose SYN queue is full doesn't hold the client up. A backend failing
+// before the other connected is marked unhealthy, as after a plain dial.
+// The error of primary is returned when both fail, leaving primary to the
+// caller.
+func (lb *apiServerLb) raceDial(ctx context.Context, primary string, alternate string) (net.Conn, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, 2)
+	for _, server := range []string{primary, alternate} {
+		go func(server string) {
+			conn, err := lb.dialer.DialContext(ctx, "tcp", server)
+			results <- dialResult{conn: conn, server: server, err: err}
+		}(server)
+	}
+
+	var primaryErr error
+	for i := 0; i < 2; i++ {
+		result := <-results
+		if result.err != nil {
+			if result.server == primary {
+				primaryErr = result.err
+			} else {
+				log.Printf("Error racing a dial to %s: %s", alternate, result.err)
+				lb.state.markUnhealthy(alternate)
+			}
+			continue
+		}
+		cancel()
+		if primaryErr != nil {
+			log.Printf("Error racing a dial to %s: %s", primary, primaryErr)
+			lb.state.markUnhealthy(primary)
+		}
+		if i == 0 {
+			// The loser may connect before it sees the cancellation.
+			go func() {
+				if loser := <-results; loser.err == nil {
+					CloseAndLog(loser.conn)
+				}
+			}()
+		}
+		winner := "alternate"
+		if result.server == primary {
+			winner = "primary"
+		}
+		dialRaceWinsTotal.inc(lb.name, winner)
+		return result.conn, result.server, nil
+	}
+	return nil, primary, primaryErr
+}
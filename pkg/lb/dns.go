@@ -0,0 +1,231 @@
+package lb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+const (
+	defaultDNSTTL = 5
+
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeNoError  = 0
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeNotImp   = 4
+	dnsRcodeRefused  = 5
+
+	dnsHeaderLen = 12
+	// dnsMaxUDP is the classic limit of a DNS answer over UDP.
+	dnsMaxUDP = 512
+)
+
+var dnsQueriesTotal = newCounter("dns_queries_total",
+	"DNS queries answered by the responder, by response code.", "rcode")
+
+var dnsRcodeNames = map[int]string{
+	dnsRcodeNoError:  "noerror",
+	dnsRcodeFormErr:  "formerr",
+	dnsRcodeServFail: "servfail",
+	dnsRcodeNotImp:   "notimp",
+	dnsRcodeRefused:  "refused",
+}
+
+// DNSConfig answers A and AAAA queries for name with the addresses of the
+// healthy backends of a listener, for clients that must reach the
+// apiservers directly rather than through the lb.
+type DNSConfig struct {
+	ListenAddr string `yaml:"listen_addr"`
+	Name       string `yaml:"name"`
+	Listener   string `yaml:"listener"`
+	TTL        int    `yaml:"ttl"`
+}
+
+func (c *DNSConfig) validate(config *Configuration) error {
+	if c.ListenAddr == "" || c.Name == "" {
+		return errors.New("dns requires listen_addr and name")
+	}
+	if c.TTL < 0 {
+		return errors.New("dns ttl must not be negative")
+	}
+	if c.TTL == 0 {
+		c.TTL = defaultDNSTTL
+	}
+	c.Name = strings.ToLower(strings.TrimSuffix(c.Name, "."))
+	listener, err := config.defaultListener(c.Listener)
+	if err != nil {
+		return fmt.Errorf("dns %s", err)
+	}
+	c.Listener = listener
+	return nil
+}
+
+// serveDNS answers queries over UDP until the socket fails.
+func serveDNS(config DNSConfig) error {
+	conn, err := net.ListenPacket("udp", config.ListenAddr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, dnsMaxUDP)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				log.Printf("Error reading DNS queries: %s", err)
+				return
+			}
+			resp := answerDNS(config, buf[:n])
+			if resp == nil {
+				continue
+			}
+			_, err = conn.WriteTo(resp, addr)
+			if err != nil {
+				log.Printf("Error answering DNS query of %s: %s", addr, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// answerDNS builds the response to query, or returns nil for packets that
+// are not queries.
+func answerDNS(config DNSConfig, query []byte) []byte {
+	if len(query) < dnsHeaderLen || query[2]&0x80 != 0 {
+		return nil
+	}
+	opcode := (query[2] >> 3) & 0x0f
+	qdcount := binary.BigEndian.Uint16(query[4:6])
+	if opcode != 0 || qdcount != 1 {
+		return dnsResponse(query[:dnsHeaderLen], nil, dnsRcodeNotImp, nil, 0)
+	}
+	name, end, ok := parseDNSName(query, dnsHeaderLen)
+	if !ok || len(query) < end+4 {
+		return dnsResponse(query[:dnsHeaderLen], nil, dnsRcodeFormErr, nil, 0)
+	}
+	question := query[dnsHeaderLen : end+4]
+	qtype := binary.BigEndian.Uint16(query[end : end+2])
+	qclass := binary.BigEndian.Uint16(query[end+2 : end+4])
+
+	if name != config.Name || qclass != dnsClassIN {
+		return dnsResponse(query[:dnsHeaderLen], question, dnsRcodeRefused, nil, 0)
+	}
+	ips, ok := dnsBackendIPs(config.Listener)
+	if !ok {
+		return dnsResponse(query[:dnsHeaderLen], question, dnsRcodeServFail, nil, 0)
+	}
+	var answers []net.IP
+	for _, ip := range ips {
+		if (qtype == dnsTypeA) == (ip.To4() != nil) && (qtype == dnsTypeA || qtype == dnsTypeAAAA) {
+			answers = append(answers, ip)
+		}
+	}
+	return dnsResponse(query[:dnsHeaderLen], question, dnsRcodeNoError, answers, uint32(config.TTL))
+}
+
+// dnsBackendIPs returns the addresses of the healthy backends of listener,
+// or of all of them when none is healthy and the listener fails open. It
+// returns false when there is nothing to answer with.
+func dnsBackendIPs(listener string) ([]net.IP, bool) {
+	boundListeners.Lock()
+	state := boundListeners.states[listener]
+	boundListeners.Unlock()
+	if state == nil {
+		return nil, false
+	}
+	servers := state.healthyServers()
+	if len(servers) == 0 {
+		if state.onNoHealthy != onNoHealthyFailOpen {
+			return nil, false
+		}
+		servers = state.allServers()
+	}
+	var ips []net.IP
+	seen := make(map[string]bool)
+	for _, server := range servers {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil || seen[host] {
+			continue
+		}
+		seen[host] = true
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, len(ips) > 0
+}
+
+// parseDNSName reads the uncompressed name at offset, as queries carry it,
+// returning it lowercased and the offset after it.
+func parseDNSName(msg []byte, offset int) (string, int, bool) {
+	var labels []string
+	for {
+		if offset >= len(msg) {
+			return "", 0, false
+		}
+		length := int(msg[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		if length > 63 || offset+length > len(msg) {
+			return "", 0, false
+		}
+		labels = append(labels, strings.ToLower(string(msg[offset:offset+length])))
+		offset += length
+	}
+	return strings.Join(labels, "."), offset, true
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// dnsResponse answers the query of header and question with rcode and one
+// record per ip, the name pointing back at the question.
+func dnsResponse(header []byte, question []byte, rcode int, ips []net.IP, ttl uint32) []byte {
+	dnsQueriesTotal.inc(dnsRcodeNames[rcode])
+	resp := make([]byte, dnsHeaderLen, dnsMaxUDP)
+	copy(resp, header[:2])
+	// QR and AA set, opcode and RD copied from the query.
+	resp[2] = 0x80 | header[2]&0x79 | 0x04
+	resp[3] = byte(rcode)
+	qdcount := 0
+	if question != nil {
+		qdcount = 1
+		resp = append(resp, question...)
+	}
+	binary.BigEndian.PutUint16(resp[4:6], uint16(qdcount))
+
+	ancount := 0
+	for _, ip := range ips {
+		rtype, data := uint16(dnsTypeAAAA), ip.To16()
+		if ip4 := ip.To4(); ip4 != nil {
+			rtype, data = dnsTypeA, ip4
+		}
+		if len(resp)+12+len(data) > dnsMaxUDP {
+			// Truncated, the client retries over TCP, which is not
+			// served: a handful of apiservers always fit.
+			resp[2] |= 0x02
+			break
+		}
+		resp = append(resp, 0xc0, dnsHeaderLen)
+		resp = appendUint16(resp, rtype)
+		resp = appendUint16(resp, dnsClassIN)
+		resp = append(resp, byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl))
+		resp = appendUint16(resp, uint16(len(data)))
+		resp = append(resp, data...)
+		ancount++
+	}
+	binary.BigEndian.PutUint16(resp[6:8], uint16(ancount))
+	return resp
+}
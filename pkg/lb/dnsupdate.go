@@ -0,0 +1,131 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	dnsProviderRFC2136 = "rfc2136"
+	dnsProviderSkyDNS  = "coredns_etcd"
+	dnsProviderRoute53 = "route53"
+
+	dnsUpdatePeriod  = time.Second
+	dnsUpdateTimeout = 10 * time.Second
+)
+
+var dnsUpdatesTotal = newCounter("dns_record_updates_total",
+	"Updates of the DNS record with the healthy backends, by result.", "result")
+
+// DNSUpdateConfig keeps a DNS record set to the addresses of the healthy
+// backends of a listener, through the provider block it names.
+type DNSUpdateConfig struct {
+	Provider string         `yaml:"provider"`
+	Name     string         `yaml:"name"`
+	Listener string         `yaml:"listener"`
+	TTL      int            `yaml:"ttl"`
+	RFC2136  *RFC2136Config `yaml:"rfc2136"`
+	SkyDNS   *SkyDNSConfig  `yaml:"coredns_etcd"`
+	Route53  *Route53Config `yaml:"route53"`
+}
+
+func (c *DNSUpdateConfig) validate(config *Configuration) error {
+	if c.Name == "" {
+		return errors.New("dns_update name is required")
+	}
+	c.Name = strings.ToLower(strings.TrimSuffix(c.Name, "."))
+	if c.TTL < 0 {
+		return errors.New("dns_update ttl must not be negative")
+	}
+	if c.TTL == 0 {
+		c.TTL = defaultDNSTTL
+	}
+	listener, err := config.defaultListener(c.Listener)
+	if err != nil {
+		return fmt.Errorf("dns_update %s", err)
+	}
+	c.Listener = listener
+
+	switch c.Provider {
+	case dnsProviderRFC2136:
+		if c.RFC2136 == nil {
+			return errors.New("dns_update provider rfc2136 requires the rfc2136 block")
+		}
+		return c.RFC2136.validate()
+	case dnsProviderSkyDNS:
+		if c.SkyDNS == nil {
+			return errors.New("dns_update provider coredns_etcd requires the coredns_etcd block")
+		}
+		return c.SkyDNS.validate()
+	case dnsProviderRoute53:
+		if c.Route53 == nil {
+			return errors.New("dns_update provider route53 requires the route53 block")
+		}
+		return c.Route53.validate()
+	}
+	return fmt.Errorf("unknown dns_update provider %q", c.Provider)
+}
+
+// recordUpdater replaces the A and AAAA records of name with ips.
+type recordUpdater interface {
+	update(name string, ttl int, ips []net.IP) error
+}
+
+func (c *DNSUpdateConfig) updater() recordUpdater {
+	switch c.Provider {
+	case dnsProviderRFC2136:
+		return c.RFC2136
+	case dnsProviderSkyDNS:
+		return c.SkyDNS
+	}
+	return c.Route53
+}
+
+// runDNSUpdates pushes the healthy backends of the listener to the record
+// whenever they change. Failed updates are retried until one succeeds. When
+// no backend can be used the record is left as it is rather than emptied.
+func runDNSUpdates(config DNSUpdateConfig) {
+	updater := config.updater()
+	ticker := time.NewTicker(dnsUpdatePeriod)
+	defer ticker.Stop()
+	var applied string
+	for range ticker.C {
+		ips, ok := dnsBackendIPs(config.Listener)
+		if !ok {
+			continue
+		}
+		sort.Slice(ips, func(i, j int) bool {
+			return ips[i].String() < ips[j].String()
+		})
+		key := fmt.Sprint(ips)
+		if key == applied {
+			continue
+		}
+		err := updater.update(config.Name, config.TTL, ips)
+		if err != nil {
+			dnsUpdatesTotal.inc("error")
+			log.Printf("Error updating DNS record %s to %v: %s", config.Name, ips, err)
+			continue
+		}
+		dnsUpdatesTotal.inc("success")
+		log.Printf("DNS record %s updated to %v", config.Name, ips)
+		applied = key
+	}
+}
+
+// splitFamilies separates IPv4 from IPv6 addresses.
+func splitFamilies(ips []net.IP) (v4 []net.IP, v6 []net.IP) {
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 = append(v4, ip4)
+		} else {
+			v6 = append(v6, ip.To16())
+		}
+	}
+	return v4, v6
+}
@@ -0,0 +1,139 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	elbv2APIVersion = "2015-12-01"
+	elbv2Service    = "elasticloadbalancing"
+
+	elbv2TargetDraining = "draining"
+)
+
+// AWSTargetGroupConfig is an ELBv2 target group of type ip, like the one of
+// an NLB in front of the apiservers.
+type AWSTargetGroupConfig struct {
+	TargetGroupARN string `yaml:"target_group_arn"`
+	Endpoint       string `yaml:"endpoint"`
+	AWSCredentials `yaml:",inline"`
+
+	region string
+}
+
+func (c *AWSTargetGroupConfig) validate() error {
+	// arn:aws:elasticloadbalancing:region:account:targetgroup/name/id
+	parts := strings.SplitN(c.TargetGroupARN, ":", 6)
+	if len(parts) != 6 || parts[2] != elbv2Service || !strings.HasPrefix(parts[5], "targetgroup/") {
+		return errors.New("aws_target_group target_group_arn must be the ARN of a target group")
+	}
+	c.region = parts[3]
+	err := c.AWSCredentials.validate()
+	if err != nil {
+		return fmt.Errorf("aws_target_group %s", err)
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com", elbv2Service, c.region)
+	}
+	_, err = url.Parse(c.Endpoint)
+	return err
+}
+
+type describeTargetHealthResponse struct {
+	Targets []struct {
+		ID    string `xml:"Target>Id"`
+		Port  int    `xml:"Target>Port"`
+		State string `xml:"TargetHealth>State"`
+	} `xml:"DescribeTargetHealthResult>TargetHealthDescriptions>member"`
+}
+
+// registered returns the targets of the group, leaving out those draining
+// after a deregistration.
+func (c *AWSTargetGroupConfig) registered() ([]string, error) {
+	var resp describeTargetHealthResponse
+	err := c.call("DescribeTargetHealth", url.Values{}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	var targets []string
+	for _, target := range resp.Targets {
+		if target.State != elbv2TargetDraining {
+			targets = append(targets, fmt.Sprintf("%s:%d", target.ID, target.Port))
+		}
+	}
+	return targets, nil
+}
+
+func (c *AWSTargetGroupConfig) register(targets []string) error {
+	params, err := targetParams(targets)
+	if err != nil {
+		return err
+	}
+	return c.call("RegisterTargets", params, nil)
+}
+
+func (c *AWSTargetGroupConfig) deregister(targets []string) error {
+	params, err := targetParams(targets)
+	if err != nil {
+		return err
+	}
+	return c.call("DeregisterTargets", params, nil)
+}
+
+func targetParams(targets []string) (url.Values, error) {
+	params := url.Values{}
+	for i, target := range targets {
+		host, port, err := splitTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		prefix := "Targets.member." + strconv.Itoa(i+1)
+		params.Set(prefix+".Id", host)
+		params.Set(prefix+".Port", port)
+	}
+	return params, nil
+}
+
+// call invokes action of the ELBv2 query API and decodes its XML response
+// into out.
+func (c *AWSTargetGroupConfig) call(action string, params url.Values, out interface{}) error {
+	params.Set("Action", action)
+	params.Set("Version", elbv2APIVersion)
+	params.Set("TargetGroupArn", c.TargetGroupARN)
+	body := []byte(params.Encode())
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.Endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	err = c.sign(req, body, c.region, elbv2Service, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: targetSyncTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var awsErr struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		xml.NewDecoder(resp.Body).Decode(&awsErr)
+		return fmt.Errorf("%s: HTTP status code : %d %s %s", action, resp.StatusCode, awsErr.Code, awsErr.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return xml.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,113 @@
+package lb
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// withoutGREASE returns values without the GREASE ones, which clients pick
+// at random and would make every fingerprint unique.
+func withoutGREASE(values []uint16) []uint16 {
+	kept := make([]uint16, 0, len(values))
+	for _, value := range values {
+		if !isGREASE(value) {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
+
+func joinUint16s(values []uint16, format string, sep string) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = fmt.Sprintf(format, value)
+	}
+	return strings.Join(parts, sep)
+}
+
+// ja3 is the MD5 of the legacy version, ciphers, extensions, groups and
+// point formats of the ClientHello, which identifies the TLS library and
+// settings of a client whatever server it talks to.
+func (h *clientHello) ja3() string {
+	full := strings.Join([]string{
+		strconv.Itoa(int(h.legacyVersion)),
+		joinUint16s(withoutGREASE(h.ciphers), "%d", "-"),
+		joinUint16s(withoutGREASE(h.extensions), "%d", "-"),
+		joinUint16s(withoutGREASE(h.groups), "%d", "-"),
+		joinUint16s(h.pointFormats, "%d", "-"),
+	}, ",")
+	sum := md5.Sum([]byte(full))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4 is the JA4 fingerprint of the ClientHello: a readable prefix with the
+// TLS version, SNI, counts and first ALPN, then truncated hashes of the
+// sorted ciphers and of the sorted extensions with the signature
+// algorithms, which unlike JA3 doesn't change when a client shuffles its
+// extensions.
+func (h *clientHello) ja4() string {
+	ciphers := withoutGREASE(h.ciphers)
+	extensions := withoutGREASE(h.extensions)
+
+	version := map[uint16]string{0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3"}[h.version]
+	if version == "" {
+		version = "00"
+	}
+	sni := "i"
+	if h.serverName != "" {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.alpn) > 0 && h.alpn[0] != "" {
+		first := h.alpn[0]
+		if !isAlphanumeric(first[0]) || !isAlphanumeric(first[len(first)-1]) {
+			first = hex.EncodeToString([]byte(first))
+		}
+		alpn = first[:1] + first[len(first)-1:]
+	}
+	prefix := fmt.Sprintf("t%s%s%02d%02d%s", version, sni, min99(len(ciphers)), min99(len(extensions)), alpn)
+
+	sortedCiphers := append([]uint16{}, ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+	var sortedExtensions []uint16
+	for _, ext := range extensions {
+		if ext != extensionServerName && ext != extensionALPN {
+			sortedExtensions = append(sortedExtensions, ext)
+		}
+	}
+	sort.Slice(sortedExtensions, func(i, j int) bool { return sortedExtensions[i] < sortedExtensions[j] })
+	extensionsPart := joinUint16s(sortedExtensions, "%04x", ",")
+	if len(h.sigAlgs) > 0 {
+		extensionsPart += "_" + joinUint16s(withoutGREASE(h.sigAlgs), "%04x", ",")
+	}
+
+	cipherHash := ja4Hash(joinUint16s(sortedCiphers, "%04x", ","), len(sortedCiphers))
+	extensionHash := ja4Hash(extensionsPart, len(sortedExtensions))
+	return prefix + "_" + cipherHash + "_" + extensionHash
+}
+
+// ja4Hash is the first 12 hex digits of the SHA-256 of value, or zeros for
+// an empty list.
+func ja4Hash(value string, n int) string {
+	if n == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,107 @@
+package lb
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// fipsCipherSuites are the TLS 1.2 suites allowed with tls fips. TLS 1.3
+// suites can't be configured, the Go FIPS 140-3 module itself limits them
+// to AES-GCM.
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// fipsCurves leaves out X25519 and the post-quantum hybrids, which are not
+// approved key exchanges.
+var fipsCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+func containsUint16(values []uint16, value uint16) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// fipsPolicy restricts policy to TLS 1.2 and 1.3 and fipsCipherSuites,
+// refusing a min_version or cipher_suites the configuration asked for that
+// are outside of them.
+func fipsPolicy(policy tlsPolicy) (tlsPolicy, error) {
+	switch {
+	case policy.minVersion == 0:
+		policy.minVersion = tls.VersionTLS12
+	case policy.minVersion < tls.VersionTLS12:
+		return policy, errors.New("tls fips requires min_version VersionTLS12 or VersionTLS13")
+	}
+	if policy.maxVersion != 0 && policy.maxVersion < tls.VersionTLS12 {
+		return policy, errors.New("tls fips requires max_version VersionTLS12 or VersionTLS13")
+	}
+	for _, id := range policy.cipherSuites {
+		if !containsUint16(fipsCipherSuites, id) {
+			return policy, fmt.Errorf("cipher suite %s is not allowed with tls fips", tls.CipherSuiteName(id))
+		}
+	}
+	if len(policy.cipherSuites) == 0 {
+		policy.cipherSuites = fipsCipherSuites
+	}
+	policy.fips = true
+	return policy, nil
+}
+
+// checkFIPSKey refuses certificates whose key crypto/tls would refuse in
+// FIPS 140-3 mode, at load time rather than on every handshake.
+func checkFIPSKey(cert *tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("empty certificate")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	switch key := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return fmt.Errorf("certificate %q has a %d bit RSA key, tls fips requires at least 2048", leaf.Subject.CommonName, key.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		switch key.Curve.Params().Name {
+		case "P-256", "P-384", "P-521":
+		default:
+			return fmt.Errorf("certificate %q has an ECDSA key on %s, tls fips requires P-256, P-384 or P-521", leaf.Subject.CommonName, key.Curve.Params().Name)
+		}
+	default:
+		return fmt.Errorf("certificate %q has a %T key, tls fips requires RSA or ECDSA", leaf.Subject.CommonName, leaf.PublicKey)
+	}
+	return nil
+}
+
+// verifyFIPS refuses to start with tls fips unless the Go FIPS 140-3
+// module is enabled, with GODEBUG=fips140=on or a build with GOFIPS140,
+// as the restrictions of the policy alone don't cover the primitives
+// themselves nor the TLS 1.3 suites. It logs what the mode covers.
+func verifyFIPS(config TLSConfig) error {
+	enabled, version := fipsModule()
+	if !enabled {
+		return errors.New("the Go FIPS 140-3 module is not enabled, run with GODEBUG=fips140=on or build with GOFIPS140=latest")
+	}
+	policy, err := config.policy()
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(policy.cipherSuites))
+	for i, id := range policy.cipherSuites {
+		names[i] = tls.CipherSuiteName(id)
+	}
+	log.Printf("FIPS mode: Go FIPS 140-3 module %s enabled, TLS termination, backend connections and health probes limited to TLS 1.2+ with %v and P-256/P-384/P-521; the admin API is plain HTTP and uses no cryptography", version, names)
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build go1.24
+// +build go1.24
+
+package lb
+
+import "crypto/fips140"
+
+func fipsModule() (bool, string) {
+	return fips140.Enabled(), fips140.Version()
+}
@@ -0,0 +1,9 @@
+//go:build !go1.24
+// +build !go1.24
+
+package lb
+
+// fipsModule reports no FIPS 140-3 module before Go 1.24, which added it.
+func fipsModule() (bool, string) {
+	return false, ""
+}
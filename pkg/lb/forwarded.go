@@ -0,0 +1,81 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+// setForwardedHeaders records the client in X-Forwarded-For, X-Real-IP and
+// Forwarded so apiserver audit logs show the real client. Headers sent by a
+// trusted proxy are extended, anything else claimed by the client is dropped.
+// httputil.ReverseProxy appends the client address to X-Forwarded-For itself.
+func (lb *apiServerLb) setForwardedHeaders(req *http.Request) {
+	ip := remoteIP(req.RemoteAddr)
+	trusted := ip != nil && containsIP(lb.trustedProxies, ip)
+
+	if !trusted {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Real-IP")
+		req.Header.Del("Forwarded")
+	}
+	if ip == nil {
+		return
+	}
+
+	if req.Header.Get("X-Real-IP") == "" {
+		req.Header.Set("X-Real-IP", ip.String())
+	}
+
+	forwardedFor := ip.String()
+	if ip.To4() == nil {
+		forwardedFor = fmt.Sprintf("\"[%s]\"", ip)
+	}
+	element := fmt.Sprintf("for=%s;host=%q;proto=https", forwardedFor, req.Host)
+	if prior := req.Header.Get("Forwarded"); prior != "" {
+		element = prior + ", " + element
+	}
+	req.Header.Set("Forwarded", element)
+}
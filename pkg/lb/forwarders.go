@@ -0,0 +1,594 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultShutdownTimeout = 30
+
+	leakCheckPeriod  = time.Minute
+	leakCheckSamples = 5
+	// leakFlatTolerance is how far a period's accepts may stray from the
+	// average and still count as a flat accept rate.
+	leakFlatTolerance = 0.2
+
+	// fdExhaustionPause is how long accepting stops after running out of
+	// file descriptors, giving connections time to close.
+	fdExhaustionPause = 250 * time.Millisecond
+
+	defaultMaxForwardersQueueTimeout = 10
+
+	defaultMaxConnectionAgeJitter = 0.1
+	defaultMaxConnectionAgeGrace  = 30 * time.Second
+	recycleQuietPeriod            = time.Second
+)
+
+var (
+	forwardersActive = newGauge("forwarders_active",
+		"Admitted connections waiting for a backend, dialing it or being forwarded.")
+	connectionsOpen = newGauge("connections_open",
+		"Forwarded connections whose sockets have not been closed yet.")
+	connectionsTotal = newCounter("connections_total",
+		"Connections accepted and forwarded to a kube-apiserver.")
+	fdExhaustedTotal = newCounter("fd_exhausted_total",
+		"Times accept or dial failed with EMFILE or ENFILE.", "source")
+	idleConnectionsClosedTotal = newCounter("idle_connections_closed_total",
+		"Idle connections closed to free file descriptors.")
+	recycledTotal = newCounter("recycled_connections_total",
+		"Connections closed for reaching max_connection_age.")
+	drainedTotal = newCounter("drained_connections_total",
+		"Connections closed because their backend announced its shutdown.", "backend")
+	backendDownClosedTotal = newCounter("backend_down_connections_closed_total",
+		"Connections closed because their backend was marked unhealthy.", "backend")
+	forwardersQueued = newGauge("forwarders_queued",
+		"Accepted connections waiting for max_forwarders to allow them a forwarder.")
+	forwardersRejectedTotal = newCounter("forwarders_rejected_total",
+		"Accepted connections closed because max_forwarders was reached, right away with reject or after max_forwarders_queue_timeout with queue.",
+		"policy")
+)
+
+const (
+	backendDownClose = "close"
+
+	maxForwardersReject = "reject"
+	maxForwardersQueue  = "queue"
+
+	lingerGraceful = "graceful"
+	lingerReset    = "reset"
+)
+
+type ForwarderConfig struct {
+	// MaxConnectionAge recycles connections after that many seconds, give
+	// or take MaxConnectionAgeJitter, so clients reconnect and rebalance
+	// once a backend is back. A connection past its age is closed at its
+	// first quiet moment, or after MaxConnectionAgeGrace seconds.
+	MaxConnectionAge       int     `yaml:"max_connection_age"`
+	MaxConnectionAgeJitter float64 `yaml:"max_connection_age_jitter"`
+	MaxConnectionAgeGrace  int     `yaml:"max_connection_age_grace"`
+	// OnBackendDown set to close drops the connections to a backend once it
+	// has been unhealthy for BackendDownGracePeriod seconds, instead of
+	// leaving clients on a dead session until TCP keepalives give up.
+	OnBackendDown          string `yaml:"on_backend_down"`
+	BackendDownGracePeriod int    `yaml:"backend_down_grace_period"`
+	// CloseIdleOnFDPressure is how many of the most idle connections get
+	// closed each time accept or dial run out of file descriptors.
+	CloseIdleOnFDPressure int `yaml:"close_idle_on_fd_pressure"`
+	// MaxForwarders caps the connections of the process being forwarded,
+	// dialed or waiting for a healthy backend, so a reconnect storm can't
+	// spawn goroutines until the node falls over. Above it OnMaxForwarders reject closes new
+	// connections right away, queue stops accepting, leaving them in the
+	// listen backlog, and closes those that waited
+	// MaxForwardersQueueTimeout seconds.
+	MaxForwarders             int    `yaml:"max_forwarders"`
+	OnMaxForwarders           string `yaml:"on_max_forwarders"`
+	MaxForwardersQueueTimeout int    `yaml:"max_forwarders_queue_timeout"`
+	// ClientLinger and BackendLinger are how the lb closes each side of a
+	// forwarded connection it tears down itself, on an error,
+	// max_connection_age, on_backend_down, file descriptor pressure or
+	// shutdown: graceful, the default, sends a FIN once the unsent data is
+	// out, reset sets SO_LINGER to 0 and sends a RST right away, dropping
+	// the unsent data but freeing the socket without going through
+	// TIME_WAIT, which reclaims ports and memory faster during reconnect
+	// storms. A side already half-closed by the other one ending its
+	// stream got its FIN either way.
+	ClientLinger  string `yaml:"client_linger"`
+	BackendLinger string `yaml:"backend_linger"`
+}
+
+func (c *ForwarderConfig) validate() error {
+	if c.MaxConnectionAge < 0 || c.MaxConnectionAgeGrace < 0 {
+		return errors.New("forwarder max_connection_age and max_connection_age_grace must not be negative")
+	}
+	if c.MaxConnectionAgeJitter < 0 || c.MaxConnectionAgeJitter > 1 {
+		return errors.New("forwarder max_connection_age_jitter must be between 0 and 1")
+	}
+	switch c.OnBackendDown {
+	case "", backendDownClose:
+	default:
+		return fmt.Errorf("unknown forwarder on_backend_down policy %q", c.OnBackendDown)
+	}
+	if c.BackendDownGracePeriod < 0 {
+		return errors.New("forwarder backend_down_grace_period must not be negative")
+	}
+	if c.CloseIdleOnFDPressure < 0 {
+		return errors.New("forwarder close_idle_on_fd_pressure must not be negative")
+	}
+	if c.MaxForwarders < 0 || c.MaxForwardersQueueTimeout < 0 {
+		return errors.New("forwarder max_forwarders and max_forwarders_queue_timeout must not be negative")
+	}
+	switch c.OnMaxForwarders {
+	case "":
+		c.OnMaxForwarders = maxForwardersReject
+	case maxForwardersReject, maxForwardersQueue:
+	default:
+		return fmt.Errorf("unknown forwarder on_max_forwarders policy %q", c.OnMaxForwarders)
+	}
+	if c.MaxForwardersQueueTimeout == 0 {
+		c.MaxForwardersQueueTimeout = defaultMaxForwardersQueueTimeout
+	}
+	for _, linger := range []*string{&c.ClientLinger, &c.BackendLinger} {
+		switch *linger {
+		case "":
+			*linger = lingerGraceful
+		case lingerGraceful, lingerReset:
+		default:
+			return fmt.Errorf("forwarder client_linger and backend_linger must be %s or %s", lingerGraceful, lingerReset)
+		}
+	}
+	return nil
+}
+
+// forwarderTracker accounts for every forwarded connection so shutdown can
+// wait for them to finish and cancel whatever is left after the timeout.
+type forwarderTracker struct {
+	// pauseUntil is when the acceptors may accept again after the process
+	// ran out of file descriptors, in unix nanoseconds. It comes first to be
+	// 64-bit aligned for atomic on 32-bit platforms.
+	pauseUntil int64
+
+	maxAge              time.Duration
+	maxAgeJitter        float64
+	maxAgeGrace         time.Duration
+	closeIdleOnPressure int
+	closeOnBackendDown  bool
+	backendDownGrace    time.Duration
+	maxForwarders       int
+	onMaxForwarders     string
+	queueTimeout        time.Duration
+	resetClients        bool
+	resetBackends       bool
+	ctx                 context.Context
+	cancel              context.CancelFunc
+	wg                  sync.WaitGroup
+
+	mu       sync.Mutex
+	conns    map[*trackedConn]struct{}
+	active   int
+	open     int
+	accepted int
+	queued   int
+	// freed is closed and replaced whenever a forwarder finishes below
+	// max_forwarders.
+	freed chan struct{}
+}
+
+func newForwarderTracker(config ForwarderConfig) *forwarderTracker {
+	maxAgeJitter := config.MaxConnectionAgeJitter
+	if maxAgeJitter == 0 {
+		maxAgeJitter = defaultMaxConnectionAgeJitter
+	}
+	maxAgeGrace := time.Duration(config.MaxConnectionAgeGrace) * time.Second
+	if config.MaxConnectionAgeGrace == 0 {
+		maxAgeGrace = defaultMaxConnectionAgeGrace
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &forwarderTracker{
+		maxAge:              time.Duration(config.MaxConnectionAge) * time.Second,
+		maxAgeJitter:        maxAgeJitter,
+		maxAgeGrace:         maxAgeGrace,
+		closeIdleOnPressure: config.CloseIdleOnFDPressure,
+		closeOnBackendDown:  config.OnBackendDown == backendDownClose,
+		backendDownGrace:    time.Duration(config.BackendDownGracePeriod) * time.Second,
+		maxForwarders:       config.MaxForwarders,
+		onMaxForwarders:     config.OnMaxForwarders,
+		queueTimeout:        time.Duration(config.MaxForwardersQueueTimeout) * time.Second,
+		resetClients:        config.ClientLinger == lingerReset,
+		resetBackends:       config.BackendLinger == lingerReset,
+		ctx:                 ctx,
+		cancel:              cancel,
+		conns:               make(map[*trackedConn]struct{}),
+		freed:               make(chan struct{}),
+	}
+}
+
+// trackedConn is the tracker's handle on one forwarded connection. Its
+// context is done when the connection exceeds max_connection_age, is
+// picked to relieve file descriptor pressure or shutdown gives up waiting.
+type trackedConn struct {
+	listener   string
+	backend    string
+	ctx        context.Context
+	cancel     context.CancelFunc
+	lastActive int64
+	finish     func()
+	done       chan struct{}
+}
+
+// touch records traffic on the connection, read by closeIdle.
+func (c *trackedConn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// activityReader touches conn on every successful read and keeps the error
+// that ended reading, telling it apart from write errors after io.Copy.
+type activityReader struct {
+	io.Reader
+	conn *trackedConn
+	err  error
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.conn.touch()
+	}
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// setLinger applies client_linger to client and backend_linger to backend.
+// Either may be nil, and only TCP connections are changed.
+func (t *forwarderTracker) setLinger(client net.Conn, backend net.Conn) {
+	if tcp, ok := client.(*net.TCPConn); ok && t.resetClients {
+		tcp.SetLinger(0)
+	}
+	if tcp, ok := backend.(*net.TCPConn); ok && t.resetBackends {
+		tcp.SetLinger(0)
+	}
+}
+
+// track registers a new forwarder of listener to backend, which takes over
+// the slot admit reserved, and whose finish func must be called once it is
+// done.
+func (t *forwarderTracker) track(listener string, backend string) *trackedConn {
+	t.wg.Add(1)
+	t.updateOpen(1)
+	connectionsTotal.inc()
+
+	conn := &trackedConn{listener: listener, backend: backend, done: make(chan struct{})}
+	if t.maxAge > 0 {
+		age := float64(t.maxAge) * (1 + t.maxAgeJitter*(2*rand.Float64()-1))
+		conn.ctx, conn.cancel = context.WithTimeout(t.ctx, time.Duration(age))
+	} else {
+		conn.ctx, conn.cancel = context.WithCancel(t.ctx)
+	}
+	conn.touch()
+
+	t.mu.Lock()
+	t.conns[conn] = struct{}{}
+	t.mu.Unlock()
+
+	conn.finish = func() {
+		conn.cancel()
+		close(conn.done)
+		t.mu.Lock()
+		delete(t.conns, conn)
+		t.mu.Unlock()
+		t.updateActive(-1)
+		t.wg.Done()
+	}
+	return conn
+}
+
+// closeIdle closes the n connections that have gone the longest without
+// traffic. Watches sit idle for minutes between events, so these are the
+// cheapest to lose when the process runs out of file descriptors.
+func (t *forwarderTracker) closeIdle(n int) {
+	conns := t.idlest("", "", n)
+	log.Printf("Closing %d idle connections to free file descriptors", len(conns))
+	for _, conn := range conns {
+		conn.cancel()
+	}
+	idleConnectionsClosedTotal.add(float64(len(conns)))
+}
+
+// idlest returns up to n of the connections of listener to backend that
+// have gone the longest without traffic. An empty listener or backend
+// matches any. Listeners may share backends, and only touch their own
+// connections.
+func (t *forwarderTracker) idlest(listener string, backend string, n int) []*trackedConn {
+	t.mu.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for conn := range t.conns {
+		if (listener == "" || conn.listener == listener) && (backend == "" || conn.backend == backend) {
+			conns = append(conns, conn)
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return atomic.LoadInt64(&conns[i].lastActive) < atomic.LoadInt64(&conns[j].lastActive)
+	})
+	if n > len(conns) {
+		n = len(conns)
+	}
+	return conns[:n]
+}
+
+// countByBackend returns how many connections listener forwards to each
+// backend.
+func (t *forwarderTracker) countByBackend(listener string) map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := make(map[string]int)
+	for conn := range t.conns {
+		if conn.listener == listener {
+			counts[conn.backend]++
+		}
+	}
+	return counts
+}
+
+// waitQuiet is called once conn is past its max_connection_age, or its
+// backend is shutting down, and returns when it has carried no traffic for
+// recycleQuietPeriod, so it is less likely to be cut in the middle of a
+// response, or once the grace period is over. It returns false if the
+// forwarder finished by itself meanwhile.
+func (t *forwarderTracker) waitQuiet(conn *trackedConn, finished <-chan struct{}) bool {
+	grace := time.NewTimer(t.maxAgeGrace)
+	defer grace.Stop()
+	ticker := time.NewTicker(recycleQuietPeriod / 4)
+	defer ticker.Stop()
+	for {
+		lastActive := time.Unix(0, atomic.LoadInt64(&conn.lastActive))
+		if time.Since(lastActive) >= recycleQuietPeriod {
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-grace.C:
+			return true
+		case <-t.ctx.Done():
+			return true
+		case <-finished:
+			return false
+		}
+	}
+}
+
+// closeBackend closes every connection forwarded to backend.
+func (t *forwarderTracker) closeBackend(backend string) {
+	t.mu.Lock()
+	var conns []*trackedConn
+	for conn := range t.conns {
+		if conn.backend == backend {
+			conns = append(conns, conn)
+		}
+	}
+	t.mu.Unlock()
+
+	if len(conns) == 0 {
+		return
+	}
+	log.Printf("Closing %d connections to unhealthy backend %s", len(conns), backend)
+	for _, conn := range conns {
+		conn.cancel()
+	}
+	backendDownClosedTotal.add(float64(len(conns)), backend)
+}
+
+// backendDown is called when a backend is marked unhealthy and, with
+// on_backend_down: close, drops its connections unless it recovered within
+// the grace period.
+func (lb *apiServerLb) backendDown(server string) {
+	if !lb.forwarders.closeOnBackendDown {
+		return
+	}
+	state := lb.state
+	time.AfterFunc(lb.forwarders.backendDownGrace, func() {
+		if state.isHealthy(server) {
+			return
+		}
+		lb.forwarders.closeBackend(server)
+	})
+}
+
+// drainBackend closes the connections to a backend that announced its
+// shutdown, each at its first quiet moment, while it still serves them.
+func (lb *apiServerLb) drainBackend(server string) {
+	conns := lb.forwarders.idlest(lb.name, server, math.MaxInt32)
+	if len(conns) == 0 {
+		return
+	}
+	log.Printf("Draining %d connections from backend %s", len(conns), server)
+	for _, conn := range conns {
+		go func(conn *trackedConn) {
+			if lb.forwarders.waitQuiet(conn, conn.done) {
+				conn.cancel()
+				drainedTotal.inc(server)
+			}
+		}(conn)
+	}
+}
+
+// relieveFDPressure is called whenever accept or dial fail because the
+// process or system ran out of file descriptors. It pauses the acceptors of
+// every listener, which would only use up more of them.
+func (t *forwarderTracker) relieveFDPressure(source string, err error) {
+	atomic.StoreInt64(&t.pauseUntil, time.Now().Add(fdExhaustionPause).UnixNano())
+	fdExhaustedTotal.inc(source)
+	log.Printf("Out of file descriptors on %s, pausing for %s: %s", source, fdExhaustionPause, err)
+	if t.closeIdleOnPressure > 0 {
+		t.closeIdle(t.closeIdleOnPressure)
+	}
+}
+
+// acceptPause returns how long the acceptors have left to pause after the
+// process last ran out of file descriptors.
+func (t *forwarderTracker) acceptPause() time.Duration {
+	return time.Until(time.Unix(0, atomic.LoadInt64(&t.pauseUntil)))
+}
+
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+func (t *forwarderTracker) updateActive(delta int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active += delta
+	forwardersActive.set(float64(t.active))
+	if delta < 0 && t.maxForwarders > 0 && t.active < t.maxForwarders {
+		close(t.freed)
+		t.freed = make(chan struct{})
+	}
+}
+
+// admit tells whether a newly accepted connection may be forwarded under
+// max_forwarders, and reserves its slot then. With on_max_forwarders queue
+// it blocks the acceptor until a forwarder finishes, for up to
+// max_forwarders_queue_timeout. The slot is handed over to track once the
+// backend is dialed, and must be given back with release if it never is.
+func (t *forwarderTracker) admit() bool {
+	var deadline *time.Timer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.maxForwarders > 0 && t.active >= t.maxForwarders {
+		if t.onMaxForwarders != maxForwardersQueue {
+			forwardersRejectedTotal.inc(maxForwardersReject)
+			return false
+		}
+		if deadline == nil {
+			deadline = time.NewTimer(t.queueTimeout)
+			defer deadline.Stop()
+		}
+		freed := t.freed
+		t.queued++
+		forwardersQueued.set(float64(t.queued))
+		t.mu.Unlock()
+		timedOut := false
+		select {
+		case <-freed:
+		case <-deadline.C:
+			timedOut = true
+		}
+		t.mu.Lock()
+		t.queued--
+		forwardersQueued.set(float64(t.queued))
+		if timedOut {
+			forwardersRejectedTotal.inc(maxForwardersQueue)
+			return false
+		}
+	}
+	t.active++
+	forwardersActive.set(float64(t.active))
+	return true
+}
+
+// release gives back the slot of an admitted connection that was closed
+// before it could be tracked.
+func (t *forwarderTracker) release() {
+	t.updateActive(-1)
+}
+
+// closed records that a tracked connection's sockets were closed, which may
+// happen before its forwarder returns.
+func (t *forwarderTracker) closed() {
+	t.updateOpen(-1)
+}
+
+func (t *forwarderTracker) updateOpen(delta int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open += delta
+	if delta > 0 {
+		t.accepted += delta
+	}
+	connectionsOpen.set(float64(t.open))
+}
+
+// watchLeaks warns when the number of open connections keeps growing while
+// connections are accepted at a steady rate, which means some of them are
+// never closed.
+func (t *forwarderTracker) watchLeaks() {
+	var opens, accepts []int
+	lastAccepted := 0
+	for range time.Tick(leakCheckPeriod) {
+		t.mu.Lock()
+		open, accepted := t.open, t.accepted
+		t.mu.Unlock()
+
+		opens = append(opens, open)
+		accepts = append(accepts, accepted-lastAccepted)
+		lastAccepted = accepted
+		if len(opens) > leakCheckSamples {
+			opens = opens[1:]
+			accepts = accepts[1:]
+		}
+		if len(opens) == leakCheckSamples && growing(opens) && flat(accepts) {
+			log.Printf("Warning: open connections grew from %d to %d over %s while accepts stayed flat, forwarders may be leaking",
+				opens[0], open, time.Duration(leakCheckSamples-1)*leakCheckPeriod)
+		}
+	}
+}
+
+func growing(samples []int) bool {
+	for i := 1; i < len(samples); i++ {
+		if samples[i] <= samples[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+func flat(samples []int) bool {
+	total := 0
+	for _, sample := range samples {
+		total += sample
+	}
+	mean := float64(total) / float64(len(samples))
+	for _, sample := range samples {
+		if math.Abs(float64(sample)-mean) > mean*leakFlatTolerance {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *forwarderTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+// shutdown waits up to timeout for the forwarders to finish by themselves,
+// then cancels the remaining ones and waits for them to close.
+func (t *forwarderTracker) shutdown(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.cancel()
+		<-done
+	}
+}
@@ -0,0 +1,10 @@
+package lb
+
+import "syscall"
+
+const fwmarkSupported = true
+
+// setFwmark sets the SO_MARK of the socket fd, which needs CAP_NET_ADMIN.
+func setFwmark(fd uintptr, mark uint32) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+}
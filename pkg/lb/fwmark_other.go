@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package lb
+
+import "errors"
+
+// fwmarkSupported is false outside linux, which has no SO_MARK.
+const fwmarkSupported = false
+
+func setFwmark(fd uintptr, mark uint32) error {
+	return errors.New("backend_fwmark is only supported on linux")
+}
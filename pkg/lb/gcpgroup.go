@@ -0,0 +1,201 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGCPComputeEndpoint = "https://compute.googleapis.com/compute/v1"
+	defaultGCPMetadataHost    = "metadata.google.internal"
+)
+
+// GCPInstanceGroupConfig is an unmanaged instance group, like the backend
+// of a GCP internal TCP load balancer, that this lb host joins while it is
+// healthy. The instance name and the access token come from the metadata
+// server unless instance and token_file are set.
+type GCPInstanceGroupConfig struct {
+	Project       string `yaml:"project"`
+	Zone          string `yaml:"zone"`
+	InstanceGroup string `yaml:"instance_group"`
+	Instance      string `yaml:"instance"`
+	TokenFile     string `yaml:"token_file"`
+	Endpoint      string `yaml:"endpoint"`
+}
+
+func (c *GCPInstanceGroupConfig) validate() error {
+	if c.Project == "" || c.Zone == "" || c.InstanceGroup == "" {
+		return errors.New("gcp_instance_group requires project, zone and instance_group")
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = defaultGCPComputeEndpoint
+	}
+	return nil
+}
+
+// metadataHost is the GCE metadata server, GCE_METADATA_HOST as for the
+// Google client libraries.
+func metadataHost() string {
+	if host := os.Getenv("GCE_METADATA_HOST"); host != "" {
+		return host
+	}
+	return defaultGCPMetadataHost
+}
+
+func metadata(path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/computeMetadata/v1/%s", metadataHost(), path), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	client := &http.Client{Timeout: targetSyncTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata %s: HTTP status code : %d", path, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (c *GCPInstanceGroupConfig) instanceName() (string, error) {
+	if c.Instance != "" {
+		return c.Instance, nil
+	}
+	name, err := metadata("instance/name")
+	if err != nil {
+		return "", fmt.Errorf("gcp_instance_group instance: %s", err)
+	}
+	return strings.TrimSpace(string(name)), nil
+}
+
+func (c *GCPInstanceGroupConfig) group() targetGroup {
+	group := &gcpInstanceGroup{config: c, client: &http.Client{Timeout: targetSyncTimeout}}
+	if c.TokenFile != "" {
+		group.client = newTokenFile(c.TokenFile).client(group.client)
+	} else {
+		group.client = bearerClient(&metadataToken{}, group.client)
+	}
+	return group
+}
+
+type gcpInstanceGroup struct {
+	config *GCPInstanceGroupConfig
+	client *http.Client
+}
+
+func (g *gcpInstanceGroup) url(method string) string {
+	return fmt.Sprintf("%s/projects/%s/zones/%s/instanceGroups/%s/%s",
+		strings.TrimSuffix(g.config.Endpoint, "/"), g.config.Project, g.config.Zone, g.config.InstanceGroup, method)
+}
+
+func (g *gcpInstanceGroup) instanceURL(name string) string {
+	return fmt.Sprintf("projects/%s/zones/%s/instances/%s", g.config.Project, g.config.Zone, name)
+}
+
+type gcpInstanceReference struct {
+	Instance string `json:"instance"`
+}
+
+// registered returns the names of the instances of the group. Only the
+// first page is read, 500 instances, far more than run apiservers.
+func (g *gcpInstanceGroup) registered() ([]string, error) {
+	var resp struct {
+		Items []gcpInstanceReference `json:"items"`
+	}
+	err := g.call("listInstances", struct{}{}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, item := range resp.Items {
+		names = append(names, item.Instance[strings.LastIndex(item.Instance, "/")+1:])
+	}
+	return names, nil
+}
+
+func (g *gcpInstanceGroup) register(names []string) error {
+	return g.call("addInstances", g.instances(names), nil)
+}
+
+func (g *gcpInstanceGroup) deregister(names []string) error {
+	return g.call("removeInstances", g.instances(names), nil)
+}
+
+func (g *gcpInstanceGroup) instances(names []string) interface{} {
+	var req struct {
+		Instances []gcpInstanceReference `json:"instances"`
+	}
+	for _, name := range names {
+		req.Instances = append(req.Instances, gcpInstanceReference{Instance: g.instanceURL(name)})
+	}
+	return req
+}
+
+// call POSTs to method of the instance group. The changes it makes are
+// applied asynchronously, the next resync sees whether they were.
+func (g *gcpInstanceGroup) call(method string, in interface{}, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	resp, err := g.client.Post(g.url(method), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var gcpErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&gcpErr)
+		return fmt.Errorf("%s: HTTP status code : %d %s", method, resp.StatusCode, gcpErr.Error.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// metadataToken is the access token of the service account of the instance,
+// fetched from the metadata server again shortly before it expires.
+type metadataToken struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (t *metadataToken) read() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Until(t.expires) > time.Minute {
+		return t.token, nil
+	}
+	data, err := metadata("instance/service-accounts/default/token")
+	if err != nil {
+		return "", err
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.Unmarshal(data, &token)
+	if err != nil {
+		return "", err
+	}
+	t.token = token.AccessToken
+	t.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return t.token, nil
+}
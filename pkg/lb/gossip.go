@@ -0,0 +1,284 @@
+package lb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGossipInterval   = 1
+	defaultGossipStaleAfter = 10
+	maxGossipMessage        = 65507
+)
+
+var (
+	gossipPeersGauge = newGauge("gossip_peers",
+		"Peers whose backend health observations are recent enough to be used.")
+	gossipOverridesTotal = newCounter("gossip_overrides_total",
+		"Health checks that could not reach a backend and used the peers' view instead.", "backend")
+)
+
+// GossipConfig shares the backend health observations of lb instances, one
+// per node, so that an instance whose probes can't reach a backend uses what
+// its peers see. Observations of the instance itself win: peers are only
+// asked when a probe could not connect at all, not when a backend answered
+// that it is unhealthy.
+type GossipConfig struct {
+	BindAddr   string   `yaml:"bind_addr"`
+	Peers      []string `yaml:"peers"`
+	PeersDNS   string   `yaml:"peers_dns"`
+	NodeName   string   `yaml:"node_name"`
+	Interval   int      `yaml:"interval"`
+	StaleAfter int      `yaml:"stale_after"`
+}
+
+func (c *GossipConfig) validate() error {
+	if c.BindAddr == "" {
+		return errors.New("gossip bind_addr is required")
+	}
+	if len(c.Peers) == 0 && c.PeersDNS == "" {
+		return errors.New("gossip requires peers or peers_dns")
+	}
+	peers := c.Peers
+	if c.PeersDNS != "" {
+		peers = append([]string{c.PeersDNS}, peers...)
+	}
+	for _, peer := range peers {
+		_, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			return fmt.Errorf("gossip peer %s: %s", peer, err)
+		}
+	}
+	if c.Interval < 0 || c.StaleAfter < 0 {
+		return errors.New("gossip interval and stale_after must not be negative")
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultGossipInterval
+	}
+	if c.StaleAfter == 0 {
+		c.StaleAfter = defaultGossipStaleAfter
+	}
+	if c.NodeName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("gossip node_name is required: %s", err)
+		}
+		c.NodeName = hostname
+	}
+	return nil
+}
+
+type gossipObservation struct {
+	Healthy bool  `json:"healthy"`
+	AgeMs   int64 `json:"age_ms"`
+}
+
+type gossipMessage struct {
+	Node     string                       `json:"node"`
+	Backends map[string]gossipObservation `json:"backends"`
+}
+
+type observation struct {
+	healthy bool
+	at      time.Time
+}
+
+type gossiper struct {
+	config GossipConfig
+	conn   *net.UDPConn
+
+	mu    sync.Mutex
+	local map[string]observation
+	// peers holds the observations of each peer node by backend.
+	peers map[string]map[string]observation
+}
+
+func newGossiper(config GossipConfig) (*gossiper, error) {
+	addr, err := net.ResolveUDPAddr("udp", config.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &gossiper{
+		config: config,
+		conn:   conn,
+		local:  make(map[string]observation),
+		peers:  make(map[string]map[string]observation),
+	}, nil
+}
+
+func (g *gossiper) run() {
+	go g.receive()
+	ticker := time.NewTicker(time.Duration(g.config.Interval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		g.send()
+	}
+}
+
+// peerAddrs returns the static peers and those peers_dns resolves to.
+func (g *gossiper) peerAddrs() []string {
+	addrs := append([]string(nil), g.config.Peers...)
+	if g.config.PeersDNS != "" {
+		host, port, _ := net.SplitHostPort(g.config.PeersDNS)
+		ips, err := net.LookupHost(host)
+		if err != nil {
+			log.Printf("Error resolving gossip peers %s: %s", host, err)
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+	return addrs
+}
+
+func (g *gossiper) send() {
+	msg := gossipMessage{Node: g.config.NodeName, Backends: make(map[string]gossipObservation)}
+	now := time.Now()
+	g.mu.Lock()
+	for server, obs := range g.local {
+		msg.Backends[server] = gossipObservation{Healthy: obs.healthy, AgeMs: now.Sub(obs.at).Milliseconds()}
+	}
+	g.mu.Unlock()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error encoding gossip: %s", err)
+		return
+	}
+
+	local := g.conn.LocalAddr().(*net.UDPAddr)
+	for _, peer := range g.peerAddrs() {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			log.Printf("Error resolving gossip peer %s: %s", peer, err)
+			continue
+		}
+		if addr.Port == local.Port && isLocalIP(addr.IP) {
+			continue
+		}
+		_, err = g.conn.WriteToUDP(data, addr)
+		if err != nil {
+			log.Printf("Error sending gossip to %s: %s", peer, err)
+		}
+	}
+	gossipPeersGauge.set(float64(g.freshPeers()))
+}
+
+func (g *gossiper) receive() {
+	buf := make([]byte, maxGossipMessage)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !isExpectedCloseError(err) {
+				log.Printf("Error reading gossip: %s", err)
+			}
+			return
+		}
+		var msg gossipMessage
+		err = json.Unmarshal(buf[:n], &msg)
+		if err != nil {
+			log.Printf("Dropping gossip from %s: %s", addr, err)
+			continue
+		}
+		if msg.Node == "" || msg.Node == g.config.NodeName {
+			continue
+		}
+		now := time.Now()
+		view := make(map[string]observation, len(msg.Backends))
+		for server, obs := range msg.Backends {
+			view[server] = observation{healthy: obs.Healthy, at: now.Add(-time.Duration(obs.AgeMs) * time.Millisecond)}
+		}
+		g.mu.Lock()
+		g.peers[msg.Node] = view
+		g.mu.Unlock()
+	}
+}
+
+func (g *gossiper) freshPeers() int {
+	cutoff := time.Now().Add(-time.Duration(g.config.StaleAfter) * time.Second)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fresh := 0
+	for _, view := range g.peers {
+		for _, obs := range view {
+			if obs.at.After(cutoff) {
+				fresh++
+				break
+			}
+		}
+	}
+	return fresh
+}
+
+// merge records the outcome of a local probe of server and returns it,
+// unless the probe could not reach server and most peers with a recent
+// observation see it healthy.
+func (g *gossiper) merge(server string, err error) error {
+	if g == nil {
+		return err
+	}
+	now := time.Now()
+	unreachable := isUnreachable(err)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !unreachable {
+		g.local[server] = observation{healthy: err == nil, at: now}
+		return err
+	}
+	delete(g.local, server)
+
+	cutoff := now.Add(-time.Duration(g.config.StaleAfter) * time.Second)
+	healthy, seen := 0, 0
+	for _, view := range g.peers {
+		obs, ok := view[server]
+		if !ok || obs.at.Before(cutoff) {
+			continue
+		}
+		seen++
+		if obs.healthy {
+			healthy++
+		}
+	}
+	if seen == 0 || healthy*2 <= seen {
+		return err
+	}
+	gossipOverridesTotal.inc(server)
+	log.Printf("Warning: backend %s is unreachable from here but healthy for %d of %d peers: %s", server, healthy, seen, err)
+	return nil
+}
+
+// isUnreachable tells probes that never got an answer from a backend apart
+// from backends answering that they are unhealthy.
+func isUnreachable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var opErr *net.OpError
+	var netErr net.Error
+	return errors.As(err, &opErr) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
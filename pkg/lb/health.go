@@ -0,0 +1,371 @@
+package lb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	serviceKubeAPIServer = "kube-apiserver"
+	serviceEtcd          = "etcd"
+	serviceKonnectivity  = "konnectivity"
+	serviceTCP           = "tcp"
+
+	checkHealthz = "healthz"
+	checkEtcd    = "etcd"
+	checkGRPC    = "grpc"
+	checkTCP     = "tcp"
+	checkHTTP    = "http"
+	checkHTTPS   = "https"
+
+	healthCheckTimeout = 5 * time.Second
+)
+
+// defaultCheckTypes is the health check of each service when
+// health_check.type is not set.
+var defaultCheckTypes = map[string]string{
+	serviceKubeAPIServer: checkHealthz,
+	serviceEtcd:          checkEtcd,
+	serviceKonnectivity:  checkGRPC,
+	serviceTCP:           checkTCP,
+	serviceUDP:           checkTCP,
+}
+
+var bootstrappingGauge = newGauge("bootstrapping",
+	"1 while a listener in bootstrap mode health checks its backends with TCP connects.", "listener")
+
+// plainHealthClient probes http and https checks without a tls block,
+// trusting the system roots.
+var plainHealthClient = &http.Client{Timeout: healthCheckTimeout}
+
+// HealthCheckTLS is the CA and client certificate used to probe backends
+// that don't share the PKI of the tls block, like etcd members, which want
+// the etcd healthcheck-client certificate.
+type HealthCheckTLS struct {
+	CAFile   string `yaml:"ca_file"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	once       sync.Once
+	config     *tls.Config
+	err        error
+	clientOnce sync.Once
+	client     *http.Client
+}
+
+func (c *HealthCheckTLS) validate() error {
+	if c.CAFile == "" {
+		return errors.New("health_check tls requires ca_file")
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("health_check tls cert_file and key_file must be set together")
+	}
+	return nil
+}
+
+// tlsConfig loads the certificates on first use. They are not reloaded, as
+// healthcheck client certificates are long lived. policy is the one of the
+// lb tls, so fips applies to the probes too.
+func (c *HealthCheckTLS) tlsConfig(policy tlsPolicy) (*tls.Config, error) {
+	c.once.Do(func() {
+		config := policy.apply(&tls.Config{RootCAs: x509.NewCertPool()})
+		ca, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			c.err = err
+			return
+		}
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			c.err = fmt.Errorf("no certificates found in %s", c.CAFile)
+			return
+		}
+		if c.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+			if err != nil {
+				c.err = err
+				return
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		c.config = config
+	})
+	return c.config, c.err
+}
+
+// httpClient is the client of the checks with the tls block, dialing with
+// dialer when it is not nil.
+func (c *HealthCheckTLS) httpClient(policy tlsPolicy, dialer *net.Dialer) (*http.Client, error) {
+	config, err := c.tlsConfig(policy)
+	if err != nil {
+		return nil, err
+	}
+	c.clientOnce.Do(func() {
+		transport := &http.Transport{TLSClientConfig: config}
+		if dialer != nil {
+			transport.DialContext = dialer.DialContext
+		}
+		c.client = &http.Client{Transport: transport, Timeout: healthCheckTimeout}
+	})
+	return c.client, nil
+}
+
+func (rules *HealthCheck) validate() error {
+	switch rules.Type {
+	case "", checkHealthz, checkEtcd, checkGRPC, checkTCP, checkHTTP, checkHTTPS:
+	default:
+		return fmt.Errorf("unknown health_check type %q", rules.Type)
+	}
+	if rules.GRPCService != "" && rules.Type != checkGRPC {
+		return errors.New("grpc_service requires the grpc health check")
+	}
+	if rules.Path != "" && rules.Type != checkHTTP && rules.Type != checkHTTPS {
+		return errors.New("path requires the http or https health check")
+	}
+	if rules.Bootstrap && (rules.Type == checkTCP || rules.Type == checkHTTP) {
+		return errors.New("bootstrap requires a health check over TLS")
+	}
+	if rules.TokenFile != "" {
+		if rules.Type == checkTCP {
+			return errors.New("token_file is not supported by the tcp health check")
+		}
+		rules.token = newTokenFile(rules.TokenFile)
+	}
+	if rules.TLS != nil {
+		return rules.TLS.validate()
+	}
+	return nil
+}
+
+// HealthChecker probes a backend, returning an error unless it is healthy.
+// Its results go through the up_threshold and down_threshold of the backend
+// like those of the built in checks.
+type HealthChecker interface {
+	Check(server string) error
+}
+
+// probeChecker is the default HealthChecker, running the health_check of
+// the listener or pool of the backend.
+type probeChecker struct {
+	lb *apiServerLb
+}
+
+func (c *probeChecker) Check(server string) error {
+	return c.lb.probeBootstrapping(server, c.lb.healthCheckFor(server))
+}
+
+// probeBootstrapping runs probe, except that with bootstrap set and until a
+// backend first passes its check, a backend failing it is healthy as long
+// as it accepts connections. While a cluster is bootstrapped the apiservers
+// may not have their serving certificates or authentication ready yet, and
+// the lb would otherwise take them all down.
+func (lb *apiServerLb) probeBootstrapping(server string, rules HealthCheck) error {
+	err := lb.probe(server, rules)
+	if !rules.Bootstrap || atomic.LoadInt32(lb.bootstrapped) == 1 {
+		return err
+	}
+	if err == nil {
+		if atomic.CompareAndSwapInt32(lb.bootstrapped, 0, 1) {
+			bootstrappingGauge.set(0, lb.name)
+			log.Printf("%s %s passed its %s health check, leaving bootstrap mode", lb.service, server, rules.Type)
+		}
+		return nil
+	}
+	bootstrappingGauge.set(1, lb.name)
+	tcpErr := lb.probeTCP(server)
+	if tcpErr != nil {
+		return tcpErr
+	}
+	log.Printf("Warning: %s %s failed its %s health check, healthy while bootstrapping: %s", lb.service, server, rules.Type, err)
+	return nil
+}
+
+// probe runs the health check of rules against server.
+func (lb *apiServerLb) probe(server string, rules HealthCheck) error {
+	switch rules.Type {
+	case checkGRPC:
+		return lb.probeGRPC(server, rules)
+	case checkTCP:
+		return lb.probeTCP(server)
+	}
+
+	client, err := lb.probeClient(rules)
+	if err != nil {
+		return err
+	}
+	switch rules.Type {
+	case checkEtcd:
+		return probeEtcd(client, lb.probeURLs.get("https", server, "/health"))
+	case checkHTTP, checkHTTPS:
+		path := rules.Path
+		if path == "" {
+			path = "/"
+		}
+		return probeHTTP(client, lb.probeURLs.get(rules.Type, server, path))
+	default:
+		return probeHealthz(client, lb.probeURLs.get("https", server, "/healthz"))
+	}
+}
+
+type probeURLKey struct {
+	scheme string
+	server string
+	path   string
+}
+
+// probeURLCache formats the URL of each check of each backend once rather
+// than on every probe.
+type probeURLCache struct {
+	mu   sync.Mutex
+	urls map[probeURLKey]string
+}
+
+func (c *probeURLCache) get(scheme string, server string, path string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := probeURLKey{scheme: scheme, server: server, path: path}
+	url, ok := c.urls[key]
+	if !ok {
+		if c.urls == nil {
+			c.urls = make(map[probeURLKey]string)
+		}
+		url = scheme + "://" + server + path
+		c.urls[key] = url
+	}
+	return url
+}
+
+// probeClient is the client of the http based checks of rules.
+func (lb *apiServerLb) probeClient(rules HealthCheck) (*http.Client, error) {
+	client := lb.httpClient
+	if rules.Type == checkHTTP || rules.Type == checkHTTPS {
+		client = plainHealthClient
+		if lb.tlsStore.plainHealthClient != nil {
+			client = lb.tlsStore.plainHealthClient
+		}
+	}
+	if rules.TLS != nil {
+		var err error
+		client, err = rules.TLS.httpClient(lb.tlsStore.policy, lb.tlsStore.netDialer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rules.token != nil {
+		client = rules.token.client(client)
+	}
+	return client, nil
+}
+
+func probeHealthz(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status code : %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// probeHTTP expects a 2xx or 3xx answer to a GET of url.
+func probeHTTP(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("HTTP status code : %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// probeTCP only checks that server accepts connections.
+func (lb *apiServerLb) probeTCP(server string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	conn, err := lb.dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeEtcd checks the /health endpoint of an etcd member, which answers
+// 200 with health "false" when the member has no leader or alarms are
+// raised.
+func probeEtcd(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var health struct {
+		Health string `json:"health"`
+		Reason string `json:"reason"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&health)
+	if err != nil {
+		return fmt.Errorf("HTTP status code : %d, decoding health: %s", resp.StatusCode, err)
+	}
+	if health.Health != "true" {
+		return fmt.Errorf("etcd reports health %q %s", health.Health, health.Reason)
+	}
+	return nil
+}
+
+// probeGRPC calls the standard gRPC health service of server, asking for
+// grpc_service or the server as a whole.
+func (lb *apiServerLb) probeGRPC(server string, rules HealthCheck) error {
+	config := lb.tlsStore.backendTLSConfig(server)
+	if rules.TLS != nil {
+		var err error
+		config, err = rules.TLS.tlsConfig(lb.tlsStore.policy)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	options := []grpc.DialOption{
+		grpc.WithTransportCredentials(credentials.NewTLS(config)),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return lb.dialer.DialContext(ctx, "tcp", addr)
+		}),
+	}
+	if rules.token != nil {
+		options = append(options, grpc.WithPerRPCCredentials(rules.token))
+	}
+	conn, err := grpc.DialContext(ctx, server, options...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: rules.GRPCService})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("gRPC health status : %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package lb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	heartbeatPrimary = "primary"
+	heartbeatStandby = "standby"
+
+	defaultHeartbeatInterval  = 200
+	defaultHeartbeatDeadAfter = 1000
+	maxHeartbeatMessage       = 512
+)
+
+var heartbeatActiveGauge = newGauge("heartbeat_active",
+	"1 while this instance of the heartbeat pair accepts traffic.")
+
+// HeartbeatConfig makes a pair of lbs active/standby over a dedicated UDP
+// port, without needing the apiservers like leader election does. The
+// primary accepts traffic while it is healthy, or while the standby isn't
+// taking over. The standby takes over, and holds vip when set, once no
+// heartbeat came from the primary for dead_after_ms or the primary reports
+// no healthy backend while the standby has some, and hands back as soon as
+// the primary is healthy again.
+type HeartbeatConfig struct {
+	Role        string     `yaml:"role"`
+	BindAddr    string     `yaml:"bind_addr"`
+	Peer        string     `yaml:"peer"`
+	IntervalMs  int        `yaml:"interval_ms"`
+	DeadAfterMs int        `yaml:"dead_after_ms"`
+	VIP         *VIPConfig `yaml:"vip"`
+}
+
+func (c *HeartbeatConfig) validate() error {
+	if c.Role != heartbeatPrimary && c.Role != heartbeatStandby {
+		return fmt.Errorf("heartbeat role must be %s or %s", heartbeatPrimary, heartbeatStandby)
+	}
+	if c.BindAddr == "" || c.Peer == "" {
+		return errors.New("heartbeat requires bind_addr and peer")
+	}
+	_, _, err := net.SplitHostPort(c.Peer)
+	if err != nil {
+		return fmt.Errorf("heartbeat peer: %s", err)
+	}
+	if c.IntervalMs < 0 || c.DeadAfterMs < 0 {
+		return errors.New("heartbeat interval_ms and dead_after_ms must not be negative")
+	}
+	if c.IntervalMs == 0 {
+		c.IntervalMs = defaultHeartbeatInterval
+	}
+	if c.DeadAfterMs == 0 {
+		c.DeadAfterMs = defaultHeartbeatDeadAfter
+	}
+	if c.DeadAfterMs < 2*c.IntervalMs {
+		return errors.New("heartbeat dead_after_ms must be at least twice interval_ms")
+	}
+	if c.VIP != nil {
+		return c.VIP.validate()
+	}
+	return nil
+}
+
+type heartbeatMessage struct {
+	Role    string `json:"role"`
+	Active  bool   `json:"active"`
+	Healthy bool   `json:"healthy"`
+}
+
+type heartbeat struct {
+	config    HeartbeatConfig
+	listeners int
+	conn      *net.UDPConn
+	peer      *net.UDPAddr
+	vip       *virtualIP
+	active    int32
+
+	mu       sync.Mutex
+	lastSeen time.Time
+	last     heartbeatMessage
+}
+
+func newHeartbeat(config HeartbeatConfig, listeners int) (*heartbeat, error) {
+	addr, err := net.ResolveUDPAddr("udp", config.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := net.ResolveUDPAddr("udp", config.Peer)
+	if err != nil {
+		return nil, err
+	}
+	// Until the peer is heard from, or dead_after_ms passes, it is taken
+	// as a healthy peer standing by, so neither instance flaps at startup.
+	h := &heartbeat{
+		config:    config,
+		listeners: listeners,
+		peer:      peer,
+		lastSeen:  time.Now(),
+		last:      heartbeatMessage{Healthy: true},
+	}
+	if config.VIP != nil {
+		h.vip, err = parseVirtualIP(config.VIP.Interface, config.VIP.Address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	h.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *heartbeat) isActive() bool {
+	return atomic.LoadInt32(&h.active) == 1
+}
+
+// run sends heartbeats and reevaluates the role every interval until
+// shutdown. The returned channel is closed once the vip was released and
+// the peer told to take over.
+func (h *heartbeat) run(shutdown <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	heartbeatActiveGauge.set(0)
+	go h.receive()
+	go func() {
+		defer close(done)
+		defer h.conn.Close()
+		ticker := time.NewTicker(time.Duration(h.config.IntervalMs) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			healthy := backendsHealthy(h.listeners)
+			h.setActive(h.shouldBeActive(healthy))
+			h.send(heartbeatMessage{Role: h.config.Role, Active: h.isActive(), Healthy: healthy})
+			select {
+			case <-shutdown:
+				h.setActive(false)
+				h.send(heartbeatMessage{Role: h.config.Role})
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return done
+}
+
+func (h *heartbeat) shouldBeActive(healthy bool) bool {
+	h.mu.Lock()
+	peer, seen := h.last, time.Since(h.lastSeen) < time.Duration(h.config.DeadAfterMs)*time.Millisecond
+	h.mu.Unlock()
+	if h.config.Role == heartbeatPrimary {
+		return healthy || !seen || !peer.Active
+	}
+	return !seen || (!peer.Healthy && healthy)
+}
+
+func (h *heartbeat) setActive(active bool) {
+	value := int32(0)
+	if active {
+		value = 1
+	}
+	if atomic.SwapInt32(&h.active, value) != value {
+		if active {
+			log.Printf("Heartbeat %s is active, accepting traffic", h.config.Role)
+			if h.vip != nil {
+				h.vip.acquire()
+			}
+		} else {
+			log.Printf("Heartbeat %s is standing by", h.config.Role)
+			if h.vip != nil {
+				h.vip.release()
+			}
+		}
+	}
+	heartbeatActiveGauge.set(boolGauge(active))
+}
+
+func (h *heartbeat) send(msg heartbeatMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error encoding heartbeat: %s", err)
+		return
+	}
+	_, err = h.conn.WriteToUDP(data, h.peer)
+	if err != nil {
+		log.Printf("Error sending heartbeat to %s: %s", h.peer, err)
+	}
+}
+
+// receive records the heartbeats of the peer, ignoring those from other
+// addresses or claiming our own role.
+func (h *heartbeat) receive() {
+	buf := make([]byte, maxHeartbeatMessage)
+	for {
+		n, addr, err := h.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !isExpectedCloseError(err) {
+				log.Printf("Error reading heartbeats: %s", err)
+			}
+			return
+		}
+		if !addr.IP.Equal(h.peer.IP) {
+			continue
+		}
+		var msg heartbeatMessage
+		err = json.Unmarshal(buf[:n], &msg)
+		if err != nil || msg.Role == h.config.Role {
+			log.Printf("Dropping heartbeat from %s", addr)
+			continue
+		}
+		h.mu.Lock()
+		h.last = msg
+		h.lastSeen = time.Now()
+		h.mu.Unlock()
+	}
+}
@@ -0,0 +1,114 @@
+package lb
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"text/template"
+)
+
+var kubeadmClusterConfiguration = template.Must(template.New("cluster").Parse(`apiVersion: kubeadm.k8s.io/{{.APIVersion}}
+kind: ClusterConfiguration
+controlPlaneEndpoint: "{{.Endpoint}}"
+apiServer:
+  certSANs:
+{{- range .SANs}}
+    - "{{.}}"
+{{- end}}
+`))
+
+var kubeadmJoinConfiguration = template.Must(template.New("join").Parse(`apiVersion: kubeadm.k8s.io/{{.APIVersion}}
+kind: JoinConfiguration
+discovery:
+  bootstrapToken:
+    apiServerEndpoint: "{{.Endpoint}}"
+`))
+
+// RunKubeadm prints the kubeadm configuration matching the lb configuration,
+// so that the apiserver certificates carry the addresses clients reach the
+// apiservers through: the ClusterConfiguration controlPlaneEndpoint and
+// certSANs, or with -join the endpoint of a JoinConfiguration.
+func RunKubeadm(args []string) {
+	flags := flag.NewFlagSet("kubeadm", flag.ExitOnError)
+	path := flags.String("config", "./config.yaml", "config file of the lb")
+	endpoint := flags.String("endpoint", "", "address clients use, the vrrp virtual_ip or the kube-apiserver listen_addr by default")
+	join := flags.Bool("join", false, "print a JoinConfiguration instead of a ClusterConfiguration")
+	apiVersion := flags.String("api-version", "v1beta3", "version of the kubeadm configuration API")
+	flags.Parse(args)
+
+	config, err := ReadConfiguration(*path)
+	if err != nil {
+		log.Fatalf("error reading configuration : %s", err)
+	}
+	var vip string
+	if config.VRRP != nil {
+		ip, _, _ := net.ParseCIDR(config.VRRP.VirtualIP)
+		vip = ip.String()
+	}
+	if *endpoint == "" {
+		*endpoint, err = kubeadmEndpoint(config, vip)
+		if err != nil {
+			log.Fatalf("error finding the endpoint, set -endpoint : %s", err)
+		}
+	}
+	host, _, err := net.SplitHostPort(*endpoint)
+	if err != nil {
+		log.Fatalf("error parsing the endpoint : %s", err)
+	}
+
+	sans := []string{host}
+	if vip != "" && vip != host {
+		sans = append(sans, vip)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		// Node-local lbs reach the apiservers through localhost.
+		sans = append(sans, "localhost")
+	}
+
+	values := map[string]interface{}{
+		"APIVersion": *apiVersion,
+		"Endpoint":   *endpoint,
+		"SANs":       sans,
+	}
+	tmpl := kubeadmClusterConfiguration
+	if *join {
+		tmpl = kubeadmJoinConfiguration
+	}
+	err = tmpl.Execute(os.Stdout, values)
+	if err != nil {
+		log.Fatalf("error writing kubeadm configuration : %s", err)
+	}
+}
+
+// kubeadmEndpoint is the address of the kube-apiserver listener, with the
+// vrrp virtual ip if there is one. There must be a single such listener to
+// tell kubeadm about.
+func kubeadmEndpoint(config *Configuration, vip string) (string, error) {
+	var addr string
+	for _, listener := range config.listeners() {
+		if listener.Service != serviceKubeAPIServer {
+			continue
+		}
+		if addr != "" {
+			return "", errors.New("several kube-apiserver listeners")
+		}
+		addr = listener.ListenAddr
+	}
+	if addr == "" {
+		return "", errors.New("no kube-apiserver listener")
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if vip != "" {
+		host = vip
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return "", fmt.Errorf("listen_addr %s is not an address clients can use", addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
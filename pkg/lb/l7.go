@@ -0,0 +1,318 @@
+package lb
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+)
+
+const (
+	modeL4 = "l4"
+	modeL7 = "l7"
+
+	l7IdleConnTimeout = 90 * time.Second
+
+	alpnH2     = "h2"
+	alpnHTTP11 = "http/1.1"
+)
+
+const maxGoawayChance = 0.02
+
+const (
+	balanceRoundRobin       = "round_robin"
+	balanceLeastOutstanding = "least_outstanding"
+)
+
+type L7Config struct {
+	MaxConnectionAge int      `yaml:"max_connection_age"`
+	GoawayChance     float64  `yaml:"goaway_chance"`
+	Balance          string   `yaml:"balance"`
+	TrustedProxies   []string `yaml:"trusted_proxies"`
+
+	Mirror *MirrorConfig `yaml:"mirror"`
+	Retry  *RetryConfig  `yaml:"retry"`
+
+	RateLimit *RateLimitConfig `yaml:"rate_limit"`
+	Routes    []RouteConfig    `yaml:"routes"`
+}
+
+func (c L7Config) validate() error {
+	if c.MaxConnectionAge < 0 {
+		return errors.New("l7 max_connection_age must not be negative")
+	}
+	if c.GoawayChance < 0 || c.GoawayChance > maxGoawayChance {
+		return fmt.Errorf("l7 goaway_chance must be between 0 and %v", maxGoawayChance)
+	}
+	switch c.Balance {
+	case "", balanceRoundRobin, balanceLeastOutstanding:
+	default:
+		return fmt.Errorf("unknown l7 balance %q", c.Balance)
+	}
+	if c.Mirror != nil {
+		err := c.Mirror.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Retry != nil {
+		err := c.Retry.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.RateLimit != nil {
+		err := c.RateLimit.validate()
+		if err != nil {
+			return err
+		}
+	}
+	_, err := parseCIDRs(c.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("l7 trusted_proxies: %s", err)
+	}
+	for _, route := range c.Routes {
+		err := route.validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type l7RemoteKey struct{}
+
+type l7ConnStartKey struct{}
+
+// StartL7 terminates TLS and balances every HTTP request on its own instead of
+// whole connections, so a client multiplexing all its requests over a single
+// keep-alive connection is still spread across the apiservers.
+func (lb *apiServerLb) StartL7() error {
+	var err error
+	lb.trustedProxies, err = parseCIDRs(lb.l7Config.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	lb.state = newLBState(lb.allServers(), lb.healthCheckFor, lb.onNoHealthy, lb.minHealthy)
+	lb.state.balancer = lb.balancer(lb.l7Config.Balance)
+	lb.state.topology = lb.topology
+	lb.state.swapBackends = lb.swapBackends
+	lb.state.swaps = lb.swaps
+	if lb.versionSkew != nil {
+		lb.state.versions = newVersionTracker(lb.versionSkew.Prefer)
+	}
+	if lb.outlierConfig != nil {
+		lb.outliers = newOutlierDetector(lb.outlierConfig, lb.state)
+	}
+	healthResultsChan := make(chan []probeResult, 1)
+	stopChecks := make(chan struct{})
+	defer close(stopChecks)
+	go lb.startHealthChecks(healthResultsChan, stopChecks)
+	go func() {
+		for results := range healthResultsChan {
+			lb.state.applyProbes(results)
+			lb.probeBuffers.put(results)
+		}
+	}()
+
+	listeners, err := lb.listenAcceptors(lb.Local)
+	if err != nil {
+		return err
+	}
+	for _, listener := range listeners {
+		defer listener.Close()
+	}
+	if ok, err := lb.hardened(); !ok {
+		return err
+	}
+	defer listenerBound(lb.name, lb.state)()
+
+	if lb.versionSkew != nil {
+		stopVersions := make(chan struct{})
+		defer close(stopVersions)
+		go lb.watchVersions(lb.state.versions, stopVersions)
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director:      lb.direct,
+		Transport:     lb.newRetryTransport(&outlierTransport{lb: lb, next: lb.l7Transport()}),
+		FlushInterval: -1,
+		ErrorHandler:  lb.proxyError,
+	}
+	server := &http.Server{
+		Handler:   lb.rateLimit(lb.goaway(lb.mirror(lb.selectRemote(proxy)))),
+		TLSConfig: lb.tlsStore.frontendTLSConfig(alpnH2, alpnHTTP11),
+		ErrorLog:  log.New(log.Writer(), "", log.Flags()),
+		ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+			return context.WithValue(ctx, l7ConnStartKey{}, time.Now())
+		},
+	}
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	drained := make(chan struct{})
+	go func() {
+		select {
+		case <-lb.shutdown:
+		case <-stopped:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), lb.shutdownTimeout)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Printf("Error draining L7 requests: %s", err)
+		}
+		close(drained)
+	}()
+
+	serveErrs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			serveErrs <- server.ServeTLS(listener, "", "")
+		}(listener)
+	}
+	err = <-serveErrs
+	if err == http.ErrServerClosed {
+		<-drained
+		return nil
+	}
+	return err
+}
+
+// goaway asks HTTP/2 clients to reconnect once their connection is older than
+// max_connection_age, and at random with goaway_chance like the apiserver's
+// --goaway-chance, so long-lived connections get rebalanced. Setting
+// "Connection: close" on an HTTP/2 response makes net/http send a GOAWAY and
+// close the connection once in-flight streams are done.
+func (lb *apiServerLb) goaway(next http.Handler) http.Handler {
+	maxAge := time.Duration(lb.l7Config.MaxConnectionAge) * time.Second
+	chance := lb.l7Config.GoawayChance
+	if maxAge == 0 && chance == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor == 2 {
+			start := req.Context().Value(l7ConnStartKey{}).(time.Time)
+			if (maxAge > 0 && time.Since(start) > maxAge) || (chance > 0 && rand.Float64() < chance) {
+				w.Header().Set("Connection", "close")
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// l7Transport negotiates HTTP/2 with the apiservers whenever they offer it, so
+// every stream of a multiplexed client connection, gRPC ones included, is
+// balanced and proxied on its own. Upgrade requests (kubectl exec, attach,
+// port-forward over SPDY or WebSocket) only work over HTTP/1.1 and get a
+// separate transport that never negotiates HTTP/2.
+func (lb *apiServerLb) l7Transport() http.RoundTripper {
+	return &upgradeAwareTransport{
+		http2: &http.Transport{
+			DialTLSContext:    lb.tlsStore.backendDialer(alpnH2, alpnHTTP11),
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   l7IdleConnTimeout,
+		},
+		http11: &http.Transport{
+			DialTLSContext:  lb.tlsStore.backendDialer(alpnHTTP11),
+			TLSNextProto:    map[string]func(string, *tls.Conn) http.RoundTripper{},
+			IdleConnTimeout: l7IdleConnTimeout,
+		},
+	}
+}
+
+type upgradeAwareTransport struct {
+	http2  http.RoundTripper
+	http11 http.RoundTripper
+}
+
+// RoundTrip hands upgrade requests to the HTTP/1.1 transport. httputil.ReverseProxy
+// then hijacks the client connection on a 101 response and copies both
+// directions until either side closes.
+func (t *upgradeAwareTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isUpgrade(req) {
+		return t.http11.RoundTrip(req)
+	}
+	return t.http2.RoundTrip(req)
+}
+
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (lb *apiServerLb) pickRemote(key string, servers []string) (string, error) {
+	return lb.state.pick(key, servers)
+}
+
+func (lb *apiServerLb) pickRemoteExcluding(servers []string, excluded []string) (string, error) {
+	candidates := make([]string, 0)
+	for _, server := range servers {
+		if len(filterServers([]string{server}, excluded)) == 0 {
+			candidates = append(candidates, server)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", errors.New("no other remote servers")
+	}
+	return lb.pickRemote("", candidates)
+}
+
+func (lb *apiServerLb) selectRemote(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key, servers := lb.routeBackends(req.URL.Path)
+		remote, err := lb.pickRemote(key, servers)
+		if err == errNoHealthy && lb.queue != nil {
+			remote, err = lb.queue.wait(lb.state, key, servers)
+		}
+		if err != nil {
+			log.Printf("Error selecting server: %s\n", err)
+			http.Error(w, "no apiserver available", http.StatusServiceUnavailable)
+			return
+		}
+
+		release := lb.state.acquire(remote)
+		defer release()
+
+		ctx := context.WithValue(req.Context(), l7RemoteKey{}, remote)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// direct points the request at the backend picked for it.
+func (lb *apiServerLb) direct(req *http.Request) {
+	req.URL.Scheme = "https"
+	req.URL.Host = req.Context().Value(l7RemoteKey{}).(string)
+	lb.setForwardedHeaders(req)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", req.Host)
+}
+
+func (lb *apiServerLb) proxyError(w http.ResponseWriter, req *http.Request, err error) {
+	remote := req.Context().Value(l7RemoteKey{}).(string)
+	log.Printf("Error proxying %s %s to %s: %s", req.Method, req.URL.Path, remote, err)
+
+	if _, ok := err.(*net.OpError); ok {
+		lb.state.markUnhealthy(remote)
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
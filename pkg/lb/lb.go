@@ -0,0 +1,1176 @@
+package lb
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type HealthCheck struct {
+	Period int `yaml:"check_period"`
+	UpThreshold int `yaml:"up_threshold"`
+	DownThreshold int `yaml:"down_threshold"`
+	DrainOnShutdown bool `yaml:"drain_on_shutdown"`
+	Type string `yaml:"type"`
+	TLS *HealthCheckTLS `yaml:"tls"`
+	GRPCService string `yaml:"grpc_service"`
+	Path string `yaml:"path"`
+	Bootstrap bool `yaml:"bootstrap"`
+	TokenFile string `yaml:"token_file"`
+
+	token *tokenFile
+}
+
+type Configuration struct {
+	ListenerConfig `yaml:",inline"`
+	Listeners []ListenerConfig `yaml:"listeners"`
+	Pools []PoolConfig `yaml:"pools"`
+	TLS TLSConfig `yaml:"tls"`
+	AdminAddr string `yaml:"admin_addr"`
+	AdminAuth *AdminAuthConfig `yaml:"admin_auth"`
+	AdminTLS *AdminTLSConfig `yaml:"admin_tls"`
+	StatusPeers []string `yaml:"status_peers"`
+	Forwarder ForwarderConfig `yaml:"forwarder"`
+	ShutdownTimeout int `yaml:"shutdown_timeout"`
+	MaxOpenFiles uint64 `yaml:"max_open_files"`
+	BindRetryTimeout int `yaml:"bind_retry_timeout"`
+	Restart RestartConfig `yaml:"restart"`
+	PreferAddressFamily string `yaml:"prefer_address_family"`
+	MPTCP bool `yaml:"mptcp"`
+	BackendFwmark uint32 `yaml:"backend_fwmark"`
+	BackendInterface string `yaml:"backend_interface"`
+	StaticPod bool `yaml:"static_pod"`
+	LeaderElection *LeaderElectionConfig `yaml:"leader_election"`
+	VRRP *VRRPConfig `yaml:"vrrp"`
+	BGP *BGPConfig `yaml:"bgp"`
+	VIP *VIPConfig `yaml:"vip"`
+	Heartbeat *HeartbeatConfig `yaml:"heartbeat"`
+	Topology *TopologyConfig `yaml:"topology"`
+	Gossip *GossipConfig `yaml:"gossip"`
+	DNS *DNSConfig `yaml:"dns"`
+	DNSUpdate *DNSUpdateConfig `yaml:"dns_update"`
+	TargetSync *TargetSyncConfig `yaml:"target_sync"`
+	Plugin *PluginConfig `yaml:"plugin"`
+	Chaos *ChaosConfig `yaml:"chaos"`
+	Record *RecordConfig `yaml:"record"`
+	Audit *AuditConfig `yaml:"audit"`
+	User string `yaml:"user"`
+	Group string `yaml:"group"`
+	Chroot string `yaml:"chroot"`
+	Seccomp *SeccompConfig `yaml:"seccomp"`
+	SecretFilePermissions string `yaml:"secret_file_permissions"`
+}
+
+func (c *Configuration) validate() error {
+	if c.StaticPod {
+		c.applyStaticPodDefaults()
+	}
+	if len(c.StatusPeers) > 0 && c.AdminAddr == "" {
+		return errors.New("status_peers requires admin_addr")
+	}
+	if c.AdminAuth != nil {
+		if c.AdminAddr == "" {
+			return errors.New("admin_auth requires admin_addr")
+		}
+		err := c.AdminAuth.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.AdminTLS != nil {
+		if c.AdminAddr == "" {
+			return errors.New("admin_tls requires admin_addr")
+		}
+		err := c.AdminTLS.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.AdminAuth != nil && c.AdminTLS == nil && !isLoopbackAddr(c.AdminAddr) {
+		return errors.New("admin_auth requires admin_tls unless admin_addr is a loopback address, the tokens would cross the network in cleartext")
+	}
+	err := c.TLS.validate()
+	if err != nil {
+		return err
+	}
+	err = c.Restart.validate()
+	if err != nil {
+		return err
+	}
+	if c.Chroot != "" {
+		if !filepath.IsAbs(c.Chroot) {
+			return errors.New("chroot must be an absolute path")
+		}
+		if c.Plugin != nil || c.Record != nil {
+			return errors.New("chroot can't be used with plugin or record, which need the filesystem at runtime")
+		}
+	}
+	if c.Seccomp != nil {
+		if c.Plugin != nil {
+			return errors.New("seccomp can't be used with plugin, whose process would inherit the filter")
+		}
+		err = c.Seccomp.validate()
+		if err != nil {
+			return err
+		}
+	}
+	switch c.SecretFilePermissions {
+	case "":
+		c.SecretFilePermissions = secretPermissionsWarn
+	case secretPermissionsEnforce, secretPermissionsWarn, secretPermissionsOff:
+	default:
+		return fmt.Errorf("secret_file_permissions must be %s, %s or %s", secretPermissionsEnforce, secretPermissionsWarn, secretPermissionsOff)
+	}
+	if c.ShutdownTimeout < 0 {
+		return errors.New("shutdown_timeout must not be negative")
+	}
+	if c.BindRetryTimeout < 0 {
+		return errors.New("bind_retry_timeout must not be negative")
+	}
+	switch c.PreferAddressFamily {
+	case "", addressFamilyIPv4, addressFamilyIPv6:
+	default:
+		return fmt.Errorf("prefer_address_family must be %s or %s", addressFamilyIPv4, addressFamilyIPv6)
+	}
+	if c.MPTCP && !mptcpSupported {
+		return errors.New("mptcp requires building with Go 1.21 or later")
+	}
+	if c.BackendFwmark != 0 && !fwmarkSupported {
+		return errors.New("backend_fwmark is only supported on linux")
+	}
+	if c.BackendInterface != "" {
+		if !bindToDeviceSupported {
+			return errors.New("backend_interface is only supported on linux")
+		}
+		if len(c.BackendInterface) >= maxInterfaceNameLen {
+			return fmt.Errorf("backend_interface %q is longer than an interface name can be", c.BackendInterface)
+		}
+	}
+	err = c.Forwarder.validate()
+	if err != nil {
+		return err
+	}
+	if c.LeaderElection != nil {
+		err = c.LeaderElection.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.VRRP != nil {
+		err = c.VRRP.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.BGP != nil {
+		err = c.BGP.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.VIP != nil {
+		if c.VRRP != nil {
+			return errors.New("vip and vrrp can't both manage the virtual ip")
+		}
+		err = c.VIP.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Heartbeat != nil {
+		if c.LeaderElection != nil {
+			return errors.New("heartbeat and leader_election can't both pick the active instance")
+		}
+		if c.Heartbeat.VIP != nil && (c.VRRP != nil || c.VIP != nil) {
+			return errors.New("heartbeat vip can't be managed by vrrp or vip as well")
+		}
+		err = c.Heartbeat.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Topology != nil {
+		err = c.Topology.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Gossip != nil {
+		err = c.Gossip.validate()
+		if err != nil {
+			return err
+		}
+	}
+	err = c.validateListeners()
+	if err != nil {
+		return err
+	}
+	if c.DNS != nil {
+		err = c.DNS.validate(c)
+		if err != nil {
+			return err
+		}
+	}
+	if c.DNSUpdate != nil {
+		err = c.DNSUpdate.validate(c)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Record != nil {
+		err = c.Record.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Audit != nil {
+		err = c.Audit.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Chaos != nil {
+		err = c.Chaos.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Plugin != nil {
+		err = c.Plugin.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.TargetSync != nil {
+		return c.TargetSync.validate(c)
+	}
+	return nil
+}
+
+// ReadConfiguration reads and validates the configuration at path, or from
+// the environment variable NAME when path is env:NAME. Unknown keys are an
+// error, so that a misspelled key fails rather than leaving its option unset.
+func ReadConfiguration(path string) (*Configuration, error) {
+	return readConfiguration(path, true)
+}
+
+// ReadConfigurationLenient is ReadConfiguration logging unknown keys instead
+// of failing, for a configuration written for a newer version of the lb.
+func ReadConfigurationLenient(path string) (*Configuration, error) {
+	return readConfiguration(path, false)
+}
+
+func readConfiguration(path string, strict bool) (*Configuration, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(path, envScheme) {
+		name := strings.TrimPrefix(path, envScheme)
+		data = []byte(os.Getenv(name))
+		if len(data) == 0 {
+			return nil, fmt.Errorf("environment variable %s is empty", name)
+		}
+	} else {
+		data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	config := &Configuration{}
+	err = yaml.UnmarshalStrict(data, &config)
+	if err != nil && !strict {
+		log.Printf("Ignoring unknown configuration keys: %s", err)
+		config = &Configuration{}
+		err = yaml.Unmarshal(data, &config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = 1 * time.Second
+
+	// backendDialTimeout bounds the dial of the backend of a new connection.
+	backendDialTimeout = 10 * time.Second
+)
+
+type apiServerLb struct {
+	Local  string
+	name string
+	service string
+	RemoteServers []string
+	healthCheckRules HealthCheck
+	healthChecks map[string]HealthCheck
+	httpClient *http.Client
+	tlsStore *tlsStore
+	reencrypt bool
+	logClientHello bool
+	l7Config L7Config
+	onNoHealthy string
+	queue *connQueue
+	minHealthy int
+	rebalanceConfig *RebalanceConfig
+	outlierConfig *OutlierConfig
+	outliers *outlierDetector
+	bindRetryTimeout time.Duration
+	socketMode os.FileMode
+	acceptors int
+	listenBacklog int
+	udpConfig UDPConfig
+	standby standbyGate
+	acl *clientACL
+	throttle *connThrottle
+	warmPoolConfig *WarmPoolConfig
+	warmPool *warmPool
+	dialRace bool
+	mptcp bool
+	// sockmap is set on listeners with sockmap, and shared by them.
+	sockmap *sockmap
+	topology *TopologyConfig
+	versionSkew *VersionSkewConfig
+	// swaps keeps the backend swap across restarts of the listener.
+	swaps *listenerSwap
+	// bootstrapped is set once a backend passed its full health check. It
+	// is shared by the concurrent probes and kept across restarts of the
+	// listener, which would otherwise go back to bootstrap mode.
+	bootstrapped *int32
+	// hardening, when set, holds the listener back from accepting until
+	// the lb is hardened.
+	hardening *hardening
+	gossip *gossiper
+	probeURLs probeURLCache
+	// probeBuffers recycles the results of the health check sweeps once
+	// applied.
+	probeBuffers probeBuffers
+
+	forwarders *forwarderTracker
+	shutdown <-chan struct{}
+	shutdownTimeout time.Duration
+	dialer Dialer
+	// netDialer opens the sockets of the backends of UDP listeners.
+	netDialer *net.Dialer
+	healthChecker HealthChecker
+	newBalancer func(listener string) Balancer
+	plugin *plugin
+	chaos *ChaosConfig
+	recorder *eventRecorder
+	audit *auditLog
+
+	state *lbState
+	trustedProxies []*net.IPNet
+}
+
+// startHealthChecks probes the backends, publishing the results on
+// healthResultsChan, until stop is closed. It then closes healthResultsChan.
+func (lb *apiServerLb) startHealthChecks(healthResultsChan chan []probeResult, stop <-chan struct{}) {
+	defer close(healthResultsChan)
+	checker := lb.healthChecker
+	if checker == nil {
+		checker = &probeChecker{lb: lb}
+		if lb.plugin != nil && lb.plugin.config.HealthCheck {
+			checker = &pluginChecker{plugin: lb.plugin, listener: lb.name, probe: checker}
+		}
+	}
+	if lb.chaos != nil {
+		checker = &chaosChecker{HealthChecker: checker, config: lb.chaos}
+	}
+	next := make(map[string]time.Time)
+	for {
+		results := lb.probeBuffers.get()
+		wake := time.Time{}
+		for _, server := range lb.allServers() {
+			rules := lb.healthCheckFor(server)
+			if due := next[server]; time.Now().Before(due) {
+				if wake.IsZero() || due.Before(wake) {
+					wake = due
+				}
+				continue
+			}
+
+			err := lb.gossip.merge(server, checker.Check(server))
+			if err != nil {
+				log.Printf("%s %s is not healthy : %s", lb.service, server, err)
+			}
+			result := probeResult{server: server, err: err}
+			if err == nil && rules.DrainOnShutdown {
+				result.shuttingDown = lb.isShuttingDown(server, rules)
+			}
+			results = append(results, result)
+
+			next[server] = time.Now().Add(rules.period())
+			if wake.IsZero() || next[server].Before(wake) {
+				wake = next[server]
+			}
+		}
+
+		if len(results) > 0 {
+			publishLatest(healthResultsChan, results, lb.probeBuffers)
+		} else {
+			lb.probeBuffers.put(results)
+		}
+		timer := time.NewTimer(time.Until(wake))
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// isShuttingDown reports whether the shutdown readyz check of server fails,
+// which the apiserver does for the whole of its graceful termination while
+// still serving, so new connections can go elsewhere before it stops.
+func (lb *apiServerLb) isShuttingDown(server string, rules HealthCheck) bool {
+	client, err := lb.probeClient(rules)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Get(lb.probeURLs.get("https", server, "/readyz/shutdown"))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == http.StatusInternalServerError
+}
+
+// acceptAsChan backs off on temporary errors like EMFILE, as net/http does,
+// and hands fatal ones to Start so it can rebind instead of spinning.
+// Connections admitted under max_forwarders are released again if Start
+// returned before taking them.
+func (lb *apiServerLb) acceptAsChan(listener net.Listener, acceptChan chan net.Conn, errChan chan error, stop <-chan struct{}) {
+	var backoff time.Duration
+	for {
+		if pause := lb.forwarders.acceptPause(); pause > 0 {
+			time.Sleep(pause)
+		}
+		localConn, err := listener.Accept()
+		if err != nil {
+			if isFDExhausted(err) {
+				lb.forwarders.relieveFDPressure("accept", err)
+				continue
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if backoff == 0 {
+					backoff = minAcceptBackoff
+				} else {
+					backoff *= 2
+				}
+				if backoff > maxAcceptBackoff {
+					backoff = maxAcceptBackoff
+				}
+				log.Printf("Error accepting connections in lb, retrying in %s : %s", backoff, err)
+				time.Sleep(backoff)
+				continue
+			}
+			errChan <- err
+			return
+		}
+		backoff = 0
+		if !lb.forwarders.admit() {
+			CloseAndLog(localConn)
+			continue
+		}
+		select {
+		case acceptChan <- localConn:
+		case <-stop:
+			CloseAndLog(localConn)
+			lb.forwarders.release()
+			return
+		}
+	}
+}
+
+func (lb *apiServerLb) Start() error {
+	lb.state = newLBState(lb.allServers(), lb.healthCheckFor, lb.onNoHealthy, lb.minHealthy)
+	lb.state.balancer = lb.balancer(balanceRoundRobin)
+	lb.state.onUnhealthy = lb.backendDown
+	lb.state.onShutdown = lb.drainBackend
+	lb.state.swapBackends = lb.swapBackends
+	lb.state.swaps = lb.swaps
+	lb.state.topology = lb.topology
+	if lb.versionSkew != nil {
+		lb.state.versions = newVersionTracker(lb.versionSkew.Prefer)
+	}
+	if lb.outlierConfig != nil {
+		lb.outliers = newOutlierDetector(lb.outlierConfig, lb.state)
+	}
+	healthResultsChan := make(chan []probeResult, 1)
+
+	stopChecks := make(chan struct{})
+	defer close(stopChecks)
+	go lb.startHealthChecks(healthResultsChan, stopChecks)
+
+	listeners, err := lb.listenAcceptors(lb.Local)
+	if err != nil {
+		return err
+	}
+	for _, listener := range listeners {
+		defer listener.Close()
+	}
+	if ok, err := lb.hardened(); !ok {
+		return err
+	}
+
+	connChan := make(chan net.Conn)
+	acceptErrChan := make(chan error, len(listeners))
+	stopAccepts := make(chan struct{})
+	defer close(stopAccepts)
+
+	for _, listener := range listeners {
+		go lb.acceptAsChan(listener, connChan, acceptErrChan, stopAccepts)
+	}
+	defer listenerBound(lb.name, lb.state)()
+
+	if lb.versionSkew != nil {
+		stopVersions := make(chan struct{})
+		defer close(stopVersions)
+		go lb.watchVersions(lb.state.versions, stopVersions)
+	}
+
+	lb.warmPool = newWarmPool(lb, lb.warmPoolConfig)
+	if lb.warmPool != nil {
+		stopWarmPool := make(chan struct{})
+		defer close(stopWarmPool)
+		go lb.warmPool.run(stopWarmPool)
+	}
+
+	if lb.rebalanceConfig != nil {
+		stopRebalance := make(chan struct{})
+		defer close(stopRebalance)
+		go lb.rebalance(stopRebalance)
+	}
+
+	for {
+		select {
+		case conn := <- connChan: {
+			rec := lb.recorder.conn(lb.name, conn)
+			remote, err := lb.state.pick(defaultServersKey, lb.remoteServers())
+			if err == errNoHealthy && lb.queue != nil {
+				go func(conn net.Conn) {
+					remote, err := lb.queue.wait(lb.state, defaultServersKey, lb.remoteServers())
+					rec.selected(remote, err)
+					if err != nil {
+						log.Printf("Error selecting server: %s\n", err)
+						CloseAndLog(conn)
+						lb.forwarders.release()
+						return
+					}
+					lb.connect(conn, remote, rec)
+				}(conn)
+				continue
+			}
+			rec.selected(remote, err)
+			if err != nil {
+				log.Printf("Error selecting server: %s\n", err)
+				CloseAndLog(conn)
+				lb.forwarders.release()
+				continue
+			}
+
+			// A slow dial must not hold up the accepts and the health
+			// results. Running out of file descriptors while dialing
+			// pauses the acceptors instead.
+			go lb.connect(conn, remote, rec)
+		}
+		case results := <- healthResultsChan:
+			lb.state.applyProbes(results)
+			lb.probeBuffers.put(results)
+		case err := <- acceptErrChan:
+			return fmt.Errorf("accepting connections: %s", err)
+		case <- lb.shutdown:
+			return nil
+		}
+	}
+}
+
+// connect dials remote, unless the warm_pool has a connection to it, and
+// forwards conn to it. It runs in the goroutine of conn, and releases the
+// slot of conn under max_forwarders when it can't forward it.
+func (lb *apiServerLb) connect(conn net.Conn, remote string, rec *connRecord) {
+	dialStart := time.Now()
+	var err error
+	remoteConn := lb.warmPool.take(remote)
+	if remoteConn == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), backendDialTimeout)
+		defer cancel()
+		alternate := ""
+		if lb.dialRace {
+			alternate = lb.state.alternate(defaultServersKey, lb.remoteServers(), remote)
+		}
+		if alternate != "" {
+			remoteConn, remote, err = lb.raceDial(ctx, remote, alternate)
+		} else {
+			remoteConn, err = lb.dialer.DialContext(ctx, "tcp", remote)
+		}
+	}
+	rec.dialed(remote, time.Since(dialStart), err)
+	if err != nil && isFDExhausted(err) {
+		CloseAndLog(conn)
+		lb.forwarders.release()
+		lb.forwarders.relieveFDPressure("dial", err)
+		return
+	}
+	lb.recordOutcome(remote, err != nil)
+	if err != nil {
+		log.Printf("Error trying to forward: %s\n", err)
+		lb.state.markUnhealthy(remote)
+		CloseAndLog(conn)
+		lb.forwarders.release()
+		return
+	}
+	if lb.mptcp {
+		lb.countMPTCP("client", conn)
+		lb.countMPTCP("backend", remoteConn)
+	}
+
+	rawConn, rawRemoteConn := conn, remoteConn
+	lb.forwarders.setLinger(rawConn, rawRemoteConn)
+	if lb.reencrypt {
+		conn = tls.Server(conn, lb.tlsStore.frontendTLSConfig())
+		// Connections of a warm_pool with tls are past their handshake.
+		if _, ok := remoteConn.(*tls.Conn); !ok {
+			remoteConn = tls.Client(remoteConn, lb.tlsStore.backendTLSConfig(remote))
+		}
+	}
+
+	tracked := lb.forwarders.track(lb.name, remote)
+	if lb.chaos != nil {
+		lb.chaos.maybeReset(rawConn, rawRemoteConn, remote, tracked.done)
+	}
+	audited := lb.audit.connected(lb.name, conn.RemoteAddr(), remote)
+	go func() {
+		defer tracked.finish()
+		defer audited.disconnected()
+		lb.forward(tracked, conn, remoteConn, rec)
+	}()
+}
+
+func CloseAndLog(conn net.Conn) {
+	err := conn.Close()
+	if err != nil && !isExpectedCloseError(err) {
+		log.Printf("Error closing socket: %s", err)
+	}
+}
+
+func (lb *apiServerLb) forward(tracked *trackedConn, localConn net.Conn, remoteConn net.Conn, rec *connRecord) {
+	ctx := tracked.ctx
+	var closeOnce sync.Once
+	closeBoth := func(local, remote net.Conn) func() {
+		return func() {
+			closeOnce.Do(func() {
+				CloseAndLog(local)
+				CloseAndLog(remote)
+				lb.forwarders.closed()
+			})
+		}
+	}(localConn, remoteConn)
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				if !lb.forwarders.waitQuiet(tracked, finished) {
+					return
+				}
+				log.Printf("Recycling connection %s -> %s after max_connection_age", localConn.RemoteAddr(), remoteConn.RemoteAddr())
+				recycledTotal.inc()
+			}
+			closeBoth()
+		case <-finished:
+		}
+	}()
+
+	if tlsConn, ok := localConn.(*tls.Conn); ok {
+		err := handshakeFrontend(tlsConn)
+		if err != nil {
+			log.Printf("Rejected client %s: %s", localConn.RemoteAddr(), err)
+			rec.closed(tracked.backend, 0, 0, err)
+			closeBoth()
+			return
+		}
+	}
+
+	if lb.logClientHello {
+		localConn = lb.inspectClientHello(localConn, remoteConn)
+	}
+	offloaded := lb.offload(localConn, remoteConn)
+	defer offloaded.remove()
+
+	// A direction that reaches EOF only half-closes its writer, so a client
+	// that shuts down its sending side still gets the whole response. Both
+	// sockets are closed once both directions are done or one fails.
+	var copyErr error
+	var copyErrOnce sync.Once
+	var latency *LatencyConfig
+	if lb.chaos != nil {
+		latency = lb.chaos.latencyFor(tracked.backend)
+	}
+	copyConn := func (writer, reader net.Conn) int64 {
+		activity := &activityReader{Reader: reader, conn: tracked}
+		if latency != nil {
+			activity.Reader = newDelayedReader(reader, latency, tracked.done)
+		}
+		n, err := io.Copy(writer, activity)
+		if reader == remoteConn && activity.err != nil && errors.Is(activity.err, syscall.ECONNRESET) {
+			lb.recordOutcome(tracked.backend, true)
+		}
+		if err != nil {
+			if !isExpectedCloseError(err) {
+				log.Printf("io.Copy error: %s", err)
+				copyErrOnce.Do(func() { copyErr = err })
+			}
+			closeBoth()
+			return n
+		}
+		offloaded.drain(reader, writer, n)
+		err = closeWrite(writer)
+		if err != nil {
+			closeBoth()
+		}
+		return n
+	}
+
+	done := make(chan struct{})
+	var out int64
+	go func() {
+		out = copyConn(localConn, remoteConn)
+		close(done)
+	}()
+	in := copyConn(remoteConn, localConn)
+	<-done
+
+	closeBoth()
+	rec.closed(tracked.backend, in, out, copyErr)
+}
+
+// isExpectedCloseError reports whether err is the usual noise of a connection
+// being torn down, either by us closing it from the other direction or by the
+// peer resetting it.
+func isExpectedCloseError(err error) bool {
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("connection does not support half-close")
+}
+
+
+func (lb *apiServerLb) inspectClientHello(localConn net.Conn, remoteConn net.Conn) net.Conn {
+	hello, conn, err := readClientHello(localConn)
+	switch {
+	case err == errNotTLS:
+		plaintextConnectionsTotal.inc()
+		log.Printf("Client %s -> %s is not speaking TLS, check its configuration", localConn.RemoteAddr(), remoteConn.RemoteAddr())
+	case err != nil:
+		log.Printf("Error reading ClientHello from %s: %s", localConn.RemoteAddr(), err)
+	default:
+		clientHellosTotal.inc(tlsVersionName(hello.version), strings.Join(hello.alpn, ","))
+		log.Printf("Client %s -> %s %s", localConn.RemoteAddr(), remoteConn.RemoteAddr(), hello)
+	}
+	return conn
+}
+
+// Options are the settings of Run that are not part of the configuration
+// file.
+type Options struct {
+	// WaitForBackends delays listening until a kube-apiserver is healthy,
+	// or until WaitTimeout when it is not 0.
+	WaitForBackends bool
+	WaitTimeout time.Duration
+	// Dialer, HealthChecker and Balancer replace the default dialing of
+	// the backends, health checks and round robin. Balancer is called for
+	// every listener, each time it starts.
+	Dialer Dialer
+	HealthChecker HealthChecker
+	Balancer func(listener string) Balancer
+	// Chaos allows the chaos block of the configuration to inject
+	// failures.
+	Chaos bool
+}
+
+// Run serves config until shutdown is closed, or a listener gives up after
+// its restarts and Run returns the error, then waits for the forwarded
+// connections to finish for up to shutdown_timeout. The metrics and the
+// admin server are process wide, so only one Run should be serving at a
+// time.
+func Run(config *Configuration, options Options, shutdown <-chan struct{}) error {
+	if config.Chaos != nil && !options.Chaos {
+		return errors.New("the configuration has a chaos block, run with -chaos to inject failures")
+	}
+	if config.TLS.FIPS {
+		err := verifyFIPS(config.TLS)
+		if err != nil {
+			return fmt.Errorf("error starting fips mode : %s", err)
+		}
+	}
+	raiseOpenFileLimit(config.MaxOpenFiles)
+	runAsUser, err := lookupRunAs(config.User, config.Group)
+	if runAsUser != nil && (config.VRRP != nil || config.VIP != nil || (config.Heartbeat != nil && config.Heartbeat.VIP != nil)) {
+		err = errors.New("vrrp and vip need root to move the virtual ip")
+	}
+	if runAsUser != nil && config.BackendFwmark != 0 {
+		err = errors.New("backend_fwmark needs root to mark the sockets of the backends")
+	}
+	if err != nil {
+		return fmt.Errorf("error dropping privileges : %s", err)
+	}
+	owners := []int{os.Geteuid()}
+	if runAsUser != nil {
+		owners = append(owners, runAsUser.uid)
+	}
+	err = checkSecretFiles(config.secretFiles(), config.SecretFilePermissions, owners)
+	if err != nil {
+		return err
+	}
+	if config.Chroot != "" {
+		info, err := os.Stat(config.Chroot)
+		if err == nil && !info.IsDir() {
+			err = errors.New("not a directory")
+		}
+		if err != nil {
+			return fmt.Errorf("error checking chroot %s : %s", config.Chroot, err)
+		}
+	}
+
+	tlsStore, err := newTLSStore(config.TLS)
+	if err != nil {
+		return fmt.Errorf("error loading tls configuration : %s", err)
+	}
+	tlsStore.preferFamily = config.PreferAddressFamily
+	if config.MPTCP {
+		warnMPTCPDisabled()
+	}
+	if config.BackendInterface != "" {
+		_, err := net.InterfaceByName(config.BackendInterface)
+		if err != nil {
+			log.Printf("Warning: backend_interface %s: %s, backends can't be reached until it shows up", config.BackendInterface, err)
+		}
+	}
+	netDialer := newNetDialer(config)
+	tlsStore.useNetDialer(netDialer)
+	go tlsStore.watch()
+
+	if config.AdminAddr != "" {
+		err = startAdminServer(config.AdminAddr, len(config.listeners()), config.StatusPeers, config.AdminAuth, config.AdminTLS, tlsStore.policy)
+		if err != nil {
+			return fmt.Errorf("error starting admin server : %s", err)
+		}
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialTLSContext: tlsStore.backendDialer(),
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	if options.WaitForBackends {
+		waitForBackends(client, config.allKubeApiServers(), options.WaitTimeout)
+	}
+
+	var standby standbyGate
+	if config.LeaderElection != nil {
+		elector := newLeaderElector(*config.LeaderElection, client, config.allKubeApiServers())
+		go elector.run()
+		standby = elector
+	}
+	var hb *heartbeat
+	if config.Heartbeat != nil {
+		hb, err = newHeartbeat(*config.Heartbeat, len(config.listeners()))
+		if err != nil {
+			return fmt.Errorf("error starting heartbeat : %s", err)
+		}
+		standby = hb
+	}
+
+	if config.DNS != nil {
+		err = serveDNS(*config.DNS)
+		if err != nil {
+			return fmt.Errorf("error starting the DNS responder : %s", err)
+		}
+	}
+	if config.DNSUpdate != nil {
+		go runDNSUpdates(*config.DNSUpdate)
+	}
+
+	var plug *plugin
+	if config.Plugin != nil {
+		plug = newPlugin(*config.Plugin)
+		err = plug.start()
+		if err != nil {
+			return fmt.Errorf("error starting plugin : %s", err)
+		}
+	}
+
+	var recorder *eventRecorder
+	if config.Record != nil {
+		recorder, err = newEventRecorder(*config.Record)
+		if err != nil {
+			return fmt.Errorf("error starting the event recorder : %s", err)
+		}
+		defer recorder.close()
+	}
+	var audit *auditLog
+	if config.Audit != nil {
+		audit, err = newAuditLog(*config.Audit)
+		if err != nil {
+			return fmt.Errorf("error starting the audit log : %s", err)
+		}
+		defer audit.close()
+	}
+
+	var gossip *gossiper
+	if config.Gossip != nil {
+		gossip, err = newGossiper(*config.Gossip)
+		if err != nil {
+			return fmt.Errorf("error starting gossip : %s", err)
+		}
+		go gossip.run()
+	}
+
+	shutdownTimeout := time.Duration(config.ShutdownTimeout) * time.Second
+	if shutdownTimeout == 0 {
+		shutdownTimeout = defaultShutdownTimeout * time.Second
+	}
+	bindRetryTimeout := time.Duration(config.BindRetryTimeout) * time.Second
+	if bindRetryTimeout == 0 {
+		bindRetryTimeout = defaultBindRetryTimeout * time.Second
+	}
+	dialer := options.Dialer
+	if dialer == nil {
+		dialer = &preferringDialer{family: config.PreferAddressFamily, dialer: netDialer}
+	}
+	if config.Chaos != nil {
+		log.Printf("Warning: chaos mode is injecting failures")
+		dialer = &chaosDialer{Dialer: dialer, config: config.Chaos}
+	}
+	forwarders := newForwarderTracker(config.Forwarder)
+	go forwarders.watchLeaks()
+
+	// stop is closed on shutdown, or once a listener gives up, which stops
+	// the rest of the lb as well so that Run returns its error.
+	stop := make(chan struct{})
+	failed := make(chan error, 1)
+	var stopOnce sync.Once
+	fail := func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+		stopOnce.Do(func() { close(stop) })
+	}
+	go func() {
+		select {
+		case <-shutdown:
+			stopOnce.Do(func() { close(stop) })
+		case <-stop:
+		}
+	}()
+
+	var vrrpDone <-chan struct{}
+	if config.VRRP != nil {
+		vrrpDone, err = startVRRP(*config.VRRP, len(config.listeners()), stop)
+		if err != nil {
+			return fmt.Errorf("error starting vrrp : %s", err)
+		}
+	}
+	var heartbeatDone <-chan struct{}
+	if hb != nil {
+		heartbeatDone = hb.run(stop)
+	}
+	var vipDone <-chan struct{}
+	if config.VIP != nil {
+		vipDone, err = startVIP(*config.VIP, len(config.listeners()), stop)
+		if err != nil {
+			return fmt.Errorf("error starting vip : %s", err)
+		}
+	}
+	var targetSyncDone <-chan struct{}
+	if config.TargetSync != nil {
+		targetSyncDone, err = runTargetSync(*config.TargetSync, len(config.listeners()), stop)
+		if err != nil {
+			return fmt.Errorf("error starting target sync : %s", err)
+		}
+	}
+	var bgpDone <-chan struct{}
+	if config.BGP != nil {
+		bgpDone = startBGP(*config.BGP, len(config.listeners()), stop)
+	}
+
+	var sockmapOffload *sockmap
+	for _, listener := range config.listeners() {
+		if listener.Sockmap && sockmapOffload == nil {
+			sockmapOffload, err = newSockmap()
+			if err != nil {
+				return fmt.Errorf("error starting sockmap : %s", err)
+			}
+		}
+	}
+
+	var hardening *hardening
+	if runAsUser != nil || config.Chroot != "" || config.Seccomp != nil {
+		hardening = newHardening(config, runAsUser, fail)
+	}
+
+	var listeners sync.WaitGroup
+	for _, listener := range config.listeners() {
+		listeners.Add(1)
+		go func(listener *ListenerConfig) {
+			defer listeners.Done()
+
+			socketMode, _ := parseSocketMode(listener.SocketMode)
+			acl, _ := newClientACL(listener.AllowedCIDRs, listener.DeniedCIDRs)
+			throttle := newConnThrottle(listener.ConnectionRateLimit, listener.Name)
+			var queue *connQueue
+			if listener.OnNoHealthy == onNoHealthyQueue {
+				queue = newConnQueue(listener.Queue)
+			}
+			restarts := newRestartPolicy(config.Restart)
+			swaps := newListenerSwap()
+			bootstrapped := new(int32)
+			var listenerSockmap *sockmap
+			if listener.Sockmap {
+				listenerSockmap = sockmapOffload
+			}
+			for {
+				lb := apiServerLb{
+					Local: listener.ListenAddr,
+					name: listener.Name,
+					service: listener.Service,
+					RemoteServers: listener.KubeApiServers,
+					healthCheckRules: listener.HealthCheck,
+					healthChecks: listener.healthChecks,
+					httpClient: client,
+					tlsStore: tlsStore,
+					reencrypt: config.TLS.reencrypt() && listener.Service == serviceKubeAPIServer,
+					logClientHello: config.TLS.LogClientHello,
+					probeBuffers: newProbeBuffers(),
+					l7Config: listener.L7,
+					onNoHealthy: listener.OnNoHealthy,
+					queue: queue,
+					minHealthy: listener.MinHealthyToServe,
+					rebalanceConfig: listener.Rebalance,
+					outlierConfig: listener.OutlierDetection,
+					warmPoolConfig: listener.WarmPool,
+					dialRace: listener.DialRace,
+					sockmap: listenerSockmap,
+					mptcp: config.MPTCP,
+					bindRetryTimeout: bindRetryTimeout,
+					socketMode: socketMode,
+					acceptors: listener.Acceptors,
+					listenBacklog: listener.ListenBacklog,
+					udpConfig: listener.UDP,
+					standby: standby,
+					acl: acl,
+					throttle: throttle,
+					gossip: gossip,
+					topology: config.Topology,
+					versionSkew: listener.VersionSkew,
+					swaps: swaps,
+					bootstrapped: bootstrapped,
+					hardening: hardening,
+					forwarders: forwarders,
+					shutdown: stop,
+					shutdownTimeout: shutdownTimeout,
+					dialer: dialer,
+					netDialer: netDialer,
+					healthChecker: options.HealthChecker,
+					newBalancer: options.Balancer,
+					plugin: plug,
+					chaos: config.Chaos,
+					recorder: recorder,
+					audit: audit,
+				}
+				started := time.Now()
+				var err error
+				if listener.Service == serviceUDP {
+					err = lb.StartUDP()
+				} else if listener.Mode == modeL7 {
+					err = lb.StartL7()
+				} else {
+					err = lb.Start()
+				}
+				if err == nil {
+					return
+				}
+				select {
+				case <-stop:
+					// Hardening failed, or another listener gave up.
+					return
+				default:
+				}
+				ranFor := time.Since(started)
+				backoff, ok := restarts.next(ranFor)
+				if !ok {
+					fail(fmt.Errorf("giving up on listener %s after %d restarts, last HARD error: %s", listener.Name, config.Restart.MaxRestarts, err))
+					return
+				}
+				log.Printf("Restarting lb because of HARD error: listener=%s mode=%s listen=%s ran_for=%s restart=%d backoff=%s error=%q",
+					listener.Name, listener.Mode, listener.ListenAddr, ranFor.Round(time.Millisecond), restarts.restarts, backoff, err)
+
+				select {
+				case <-time.After(backoff):
+				case <-stop:
+					return
+				}
+			}
+		}(listener)
+	}
+	listeners.Wait()
+	if vrrpDone != nil {
+		<-vrrpDone
+	}
+	if heartbeatDone != nil {
+		<-heartbeatDone
+	}
+	if vipDone != nil {
+		<-vipDone
+	}
+	if bgpDone != nil {
+		<-bgpDone
+	}
+	if targetSyncDone != nil {
+		<-targetSyncDone
+	}
+
+	log.Printf("Waiting up to %s for %d forwarded connections to finish", shutdownTimeout, forwarders.count())
+	forwarders.shutdown(shutdownTimeout)
+	select {
+	case err := <-failed:
+		return err
+	default:
+		return nil
+	}
+}
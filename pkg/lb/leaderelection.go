@@ -0,0 +1,283 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultLeaseName      = "kube-apiserver-lb"
+	defaultLeaseNamespace = "kube-system"
+	defaultLeaseDuration  = 15
+	defaultLeaseRetry     = 2
+
+	leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+var (
+	leaderGauge = newGauge("leader",
+		"1 while this instance holds the leader election lease and accepts traffic.")
+	standbyRejectedTotal = newCounter("standby_rejected_connections_total",
+		"Connections closed because this instance is standing by.")
+)
+
+// LeaderElectionConfig makes a pair of lbs sharing a VIP active/passive: only
+// the holder of a coordination.k8s.io Lease accepts traffic. The lease is
+// read and written on the kube_apiservers directly, authenticating with the
+// client certificate of the tls block or token_file.
+type LeaderElectionConfig struct {
+	LeaseName     string `yaml:"lease_name"`
+	Namespace     string `yaml:"namespace"`
+	Identity      string `yaml:"identity"`
+	LeaseDuration int    `yaml:"lease_duration"`
+	RetryPeriod   int    `yaml:"retry_period"`
+	TokenFile     string `yaml:"token_file"`
+}
+
+func (c *LeaderElectionConfig) validate() error {
+	if c.LeaseDuration < 0 || c.RetryPeriod < 0 {
+		return errors.New("leader_election lease_duration and retry_period must not be negative")
+	}
+	if c.LeaseName == "" {
+		c.LeaseName = defaultLeaseName
+	}
+	if c.Namespace == "" {
+		c.Namespace = defaultLeaseNamespace
+	}
+	if c.LeaseDuration == 0 {
+		c.LeaseDuration = defaultLeaseDuration
+	}
+	if c.RetryPeriod == 0 {
+		c.RetryPeriod = defaultLeaseRetry
+	}
+	if c.RetryPeriod >= c.LeaseDuration {
+		return errors.New("leader_election retry_period must be shorter than lease_duration")
+	}
+	if c.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("leader_election identity is required: %s", err)
+		}
+		c.Identity = hostname
+	}
+	return nil
+}
+
+type lease struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   map[string]string `json:"metadata"`
+	Spec       leaseSpec         `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+var errLeaseConflict = errors.New("lease was updated concurrently")
+
+// leaderElector holds or waits for the lease. When no apiserver can be
+// reached it falls back to keeping its last role: the leader keeps serving,
+// as the standby can't take the lease over either, and the standby waits.
+type leaderElector struct {
+	config  LeaderElectionConfig
+	client  *http.Client
+	servers []string
+	leader  int32
+}
+
+func newLeaderElector(config LeaderElectionConfig, client *http.Client, servers []string) *leaderElector {
+	return &leaderElector{config: config, client: client, servers: servers}
+}
+
+func (e *leaderElector) isActive() bool {
+	return atomic.LoadInt32(&e.leader) == 1
+}
+
+func (e *leaderElector) setLeader(leader bool) {
+	value := int32(0)
+	if leader {
+		value = 1
+	}
+	if atomic.SwapInt32(&e.leader, value) != value {
+		if leader {
+			log.Printf("Acquired lease %s/%s as %s, accepting traffic", e.config.Namespace, e.config.LeaseName, e.config.Identity)
+		} else {
+			log.Printf("Lost lease %s/%s, standing by", e.config.Namespace, e.config.LeaseName)
+		}
+	}
+	leaderGauge.set(boolGauge(leader))
+}
+
+func (e *leaderElector) run() {
+	leaderGauge.set(0)
+	retry := time.Duration(e.config.RetryPeriod) * time.Second
+	for {
+		leader, err := e.tryAcquireOrRenew()
+		if err == nil {
+			e.setLeader(leader)
+		} else if err != errLeaseConflict {
+			log.Printf("Error updating lease %s/%s, keeping the current role : %s", e.config.Namespace, e.config.LeaseName, err)
+		}
+		time.Sleep(retry)
+	}
+}
+
+// tryAcquireOrRenew takes the lease when it is free, expired or already
+// ours, and reports whether we hold it.
+func (e *leaderElector) tryAcquireOrRenew() (bool, error) {
+	now := time.Now()
+	current, resourceVersion, err := e.get()
+	if err != nil {
+		return false, err
+	}
+
+	spec := leaseSpec{
+		HolderIdentity:       e.config.Identity,
+		LeaseDurationSeconds: e.config.LeaseDuration,
+		AcquireTime:          now.UTC().Format(leaseTimeFormat),
+		RenewTime:            now.UTC().Format(leaseTimeFormat),
+	}
+	if current == nil {
+		return true, e.write(http.MethodPost, "", spec)
+	}
+
+	spec.LeaseTransitions = current.Spec.LeaseTransitions
+	if current.Spec.HolderIdentity == e.config.Identity {
+		spec.AcquireTime = current.Spec.AcquireTime
+	} else {
+		renewed, err := time.Parse(leaseTimeFormat, current.Spec.RenewTime)
+		duration := time.Duration(current.Spec.LeaseDurationSeconds) * time.Second
+		if current.Spec.HolderIdentity != "" && err == nil && now.Before(renewed.Add(duration)) {
+			return false, nil
+		}
+		spec.LeaseTransitions++
+	}
+	return true, e.write(http.MethodPut, resourceVersion, spec)
+}
+
+func (e *leaderElector) path() string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", e.config.Namespace)
+}
+
+// get returns the lease, or nil when it doesn't exist yet.
+func (e *leaderElector) get() (*lease, string, error) {
+	resp, err := e.do(http.MethodGet, e.path()+"/"+e.config.LeaseName, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("HTTP status code : %d", resp.StatusCode)
+	}
+	var current lease
+	err = json.NewDecoder(resp.Body).Decode(&current)
+	if err != nil {
+		return nil, "", err
+	}
+	return &current, current.Metadata["resourceVersion"], nil
+}
+
+func (e *leaderElector) write(method string, resourceVersion string, spec leaseSpec) error {
+	metadata := map[string]string{"name": e.config.LeaseName, "namespace": e.config.Namespace}
+	if resourceVersion != "" {
+		metadata["resourceVersion"] = resourceVersion
+	}
+	body, err := json.Marshal(lease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease", Metadata: metadata, Spec: spec})
+	if err != nil {
+		return err
+	}
+
+	path := e.path()
+	if method == http.MethodPut {
+		path += "/" + e.config.LeaseName
+	}
+	resp, err := e.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return nil
+	case http.StatusConflict:
+		return errLeaseConflict
+	}
+	return fmt.Errorf("HTTP status code : %d", resp.StatusCode)
+}
+
+// do sends the request to the first apiserver that answers it.
+func (e *leaderElector) do(method string, path string, body []byte) (*http.Response, error) {
+	var token string
+	if e.config.TokenFile != "" {
+		data, err := ioutil.ReadFile(e.config.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	err := errors.New("no kube_apiservers")
+	for _, server := range e.servers {
+		var req *http.Request
+		req, err = http.NewRequest(method, fmt.Sprintf("https://%s%s", server, path), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		var resp *http.Response
+		resp, err = e.client.Do(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("%s answered HTTP status code : %d", server, resp.StatusCode)
+		}
+	}
+	return nil, err
+}
+
+// standbyGate tells whether this instance of an active/passive pair is the
+// one accepting traffic.
+type standbyGate interface {
+	isActive() bool
+}
+
+// standbyListener closes the connections it accepts while this instance is
+// standing by.
+type standbyListener struct {
+	net.Listener
+	gate standbyGate
+}
+
+func (l *standbyListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || l.gate.isActive() {
+			return conn, err
+		}
+		standbyRejectedTotal.inc()
+		CloseAndLog(conn)
+	}
+}
@@ -0,0 +1,186 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	unixScheme    = "unix://"
+	somaxconnPath = "/proc/sys/net/core/somaxconn"
+
+	defaultBindRetryTimeout = 30
+	minBindBackoff          = 100 * time.Millisecond
+	maxBindBackoff          = 2 * time.Second
+)
+
+// listenAcceptors opens one socket per acceptor on addr. With more than one
+// acceptor the sockets share the port through SO_REUSEPORT and the kernel
+// spreads incoming connections over them. With leader election or a
+// heartbeat, connections are only accepted while this instance is the
+// active one, and only from the clients allowed_cidrs, denied_cidrs and
+// connection_rate_limit let through.
+func (lb *apiServerLb) listenAcceptors(addr string) ([]net.Listener, error) {
+	n := lb.acceptors
+	if n < 1 {
+		n = 1
+	}
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		listener, err := lb.listen(addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		if lb.throttle != nil {
+			listener = &throttleListener{Listener: listener, throttle: lb.throttle}
+		}
+		if lb.acl != nil {
+			listener = &aclListener{Listener: listener, acl: lb.acl, name: lb.name}
+		}
+		if lb.standby != nil {
+			listener = &standbyListener{Listener: listener, gate: lb.standby}
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listen binds addr, either a unix:// socket path or a TCP address. TCP
+// binds are retried with backoff for up to bindRetryTimeout while the address
+// is still in use, e.g. by a previous instance that is slowly shutting down.
+// SO_REUSEADDR lets it bind over connections in TIME_WAIT.
+func (lb *apiServerLb) listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, unixScheme) {
+		return lb.listenUnix(strings.TrimPrefix(addr, unixScheme))
+	}
+
+	config := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			controlErr := c.Control(func(fd uintptr) {
+				err = setReuseAddr(fd)
+				if err == nil && lb.acceptors > 1 {
+					err = setReusePort(fd)
+				}
+			})
+			if controlErr != nil {
+				return controlErr
+			}
+			return err
+		},
+	}
+	if lb.mptcp {
+		setListenMPTCP(&config)
+	}
+
+	deadline := time.Now().Add(lb.bindRetryTimeout)
+	backoff := minBindBackoff
+	for {
+		listener, err := config.Listen(context.Background(), "tcp", addr)
+		if err == nil {
+			return lb.applyBacklog(listener)
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) || time.Now().Add(backoff).After(deadline) {
+			return listener, err
+		}
+		log.Printf("Error listening on %s, retrying in %s : %s", addr, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBindBackoff {
+			backoff = maxBindBackoff
+		}
+	}
+}
+
+// applyBacklog resizes the accept queue of listener to listen_backlog by
+// calling listen(2) again on its socket, as net.Listen always uses the system
+// default. The listener is closed if that fails.
+func (lb *apiServerLb) applyBacklog(listener net.Listener) (net.Listener, error) {
+	if lb.listenBacklog == 0 {
+		return listener, nil
+	}
+	somaxconn, err := readSomaxconn()
+	if err == nil && lb.listenBacklog > somaxconn {
+		log.Printf("Warning: listen_backlog %d is capped by net.core.somaxconn %d", lb.listenBacklog, somaxconn)
+	}
+
+	rawConn, err := listener.(syscall.Conn).SyscallConn()
+	if err == nil {
+		controlErr := rawConn.Control(func(fd uintptr) {
+			err = setBacklog(fd, lb.listenBacklog)
+		})
+		if controlErr != nil {
+			err = controlErr
+		}
+	}
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("setting listen backlog: %s", err)
+	}
+	return listener, nil
+}
+
+func readSomaxconn() (int, error) {
+	data, err := ioutil.ReadFile(somaxconnPath)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// listenUnix listens on a unix socket at path, replacing a socket left over
+// by an instance that did not shut down cleanly, and applies socket_mode.
+func (lb *apiServerLb) listenUnix(path string) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, dialErr := net.Dial("unix", path)
+		if dialErr == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	listener, err = lb.applyBacklog(listener)
+	if err != nil {
+		return nil, err
+	}
+	if lb.socketMode != 0 {
+		err = os.Chmod(path, lb.socketMode)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 0777 {
+		return 0, fmt.Errorf("socket_mode %q is not an octal permission like 0660", mode)
+	}
+	return os.FileMode(value), nil
+}
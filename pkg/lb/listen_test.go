@@ -0,0 +1,73 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkAccept compares the rate connections are accepted at with a
+// single acceptor and with several sharing the port through SO_REUSEPORT,
+// which pays off with as many CPUs, see -cpu.
+func BenchmarkAccept(b *testing.B) {
+	for _, acceptors := range []int{1, 4} {
+		b.Run(fmt.Sprintf("acceptors=%d", acceptors), func(b *testing.B) {
+			benchmarkAccept(b, acceptors)
+		})
+	}
+}
+
+func benchmarkAccept(b *testing.B, acceptors int) {
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	addr := probe.Addr().String()
+	probe.Close()
+
+	lb := &apiServerLb{acceptors: acceptors}
+	listeners, err := lb.listenAcceptors(addr)
+	if err != nil {
+		b.Skipf("listening with %d acceptors: %s", acceptors, err)
+	}
+	var accepted int64
+	for _, listener := range listeners {
+		defer listener.Close()
+		go func(listener net.Listener) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+				atomic.AddInt64(&accepted, 1)
+			}
+		}(listener)
+	}
+
+	var dialed int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			atomic.AddInt64(&dialed, 1)
+			// A reset leaves no TIME_WAIT behind to run out of ports.
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	})
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt64(&accepted) < atomic.LoadInt64(&dialed) {
+		if time.Now().After(deadline) {
+			b.Fatalf("accepted %d of %d connections", atomic.LoadInt64(&accepted), atomic.LoadInt64(&dialed))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+}
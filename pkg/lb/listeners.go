@@ -0,0 +1,311 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ListenerConfig is one frontend: an address, the apiservers behind it and
+// how traffic is balanced over them. The top level of the configuration is
+// itself a listener, used when no listeners are configured. Listeners of
+// other services name their servers backends, which is the same as
+// kube_apiservers.
+type ListenerConfig struct {
+	Name                string                     `yaml:"name"`
+	Service             string                     `yaml:"service"`
+	ListenAddr          string                     `yaml:"listen_addr"`
+	SocketMode          string                     `yaml:"socket_mode"`
+	Acceptors           int                        `yaml:"acceptors"`
+	ListenBacklog       int                        `yaml:"listen_backlog"`
+	KubeApiServers      []string                   `yaml:"kube_apiservers"`
+	Backends            []string                   `yaml:"backends"`
+	Pool                string                     `yaml:"pool"`
+	HealthCheck         HealthCheck                `yaml:"health_check"`
+	Mode                string                     `yaml:"mode"`
+	L7                  L7Config                   `yaml:"l7"`
+	OnNoHealthy         string                     `yaml:"on_no_healthy"`
+	Queue               QueueConfig                `yaml:"queue"`
+	MinHealthyToServe   int                        `yaml:"min_healthy_to_serve"`
+	Rebalance           *RebalanceConfig           `yaml:"rebalance"`
+	OutlierDetection    *OutlierConfig             `yaml:"outlier_detection"`
+	UDP                 UDPConfig                  `yaml:"udp"`
+	VersionSkew         *VersionSkewConfig         `yaml:"version_skew"`
+	AllowedCIDRs        []string                   `yaml:"allowed_cidrs"`
+	DeniedCIDRs         []string                   `yaml:"denied_cidrs"`
+	ConnectionRateLimit *ConnectionRateLimitConfig `yaml:"connection_rate_limit"`
+	WarmPool            *WarmPoolConfig            `yaml:"warm_pool"`
+	DialRace            bool                       `yaml:"dial_race"`
+	Sockmap             bool                       `yaml:"sockmap"`
+
+	// healthChecks holds the health checks of servers coming from pools.
+	healthChecks map[string]HealthCheck
+}
+
+func (c *ListenerConfig) validate(tlsConfig *TLSConfig) error {
+	if c.ListenAddr == "" {
+		return errors.New("listen_addr is required")
+	}
+	if len(c.KubeApiServers) == 0 {
+		return errors.New("kube_apiservers, backends or pool is required")
+	}
+	for _, server := range c.KubeApiServers {
+		err := validateServerAddr(server)
+		if err != nil {
+			return err
+		}
+	}
+	if c.SocketMode != "" && !strings.HasPrefix(c.ListenAddr, unixScheme) {
+		return errors.New("socket_mode requires a unix:// listen_addr")
+	}
+	if c.Acceptors < 0 {
+		return errors.New("acceptors can't be negative")
+	}
+	if c.ListenBacklog < 0 {
+		return errors.New("listen_backlog can't be negative")
+	}
+	if c.Acceptors > 1 && strings.HasPrefix(c.ListenAddr, unixScheme) {
+		return errors.New("acceptors above 1 require a TCP listen_addr")
+	}
+	_, err := parseSocketMode(c.SocketMode)
+	if err != nil {
+		return err
+	}
+	switch c.Service {
+	case "":
+		c.Service = serviceKubeAPIServer
+	case serviceKubeAPIServer, serviceEtcd, serviceKonnectivity, serviceTCP:
+	case serviceUDP:
+		err = c.validateUDP()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown service %q", c.Service)
+	}
+	err = c.HealthCheck.validate()
+	if err != nil {
+		return err
+	}
+	if c.HealthCheck.Type == "" {
+		c.HealthCheck.Type = defaultCheckTypes[c.Service]
+	}
+	if c.HealthCheck.DrainOnShutdown && c.HealthCheck.Type != checkHealthz {
+		return errors.New("drain_on_shutdown requires the healthz health check")
+	}
+	switch c.Mode {
+	case "":
+		c.Mode = modeL4
+	case modeL4:
+	case modeL7:
+		if c.Service != serviceKubeAPIServer {
+			return fmt.Errorf("mode l7 is not supported for service %s", c.Service)
+		}
+		if !tlsConfig.reencrypt() {
+			return errors.New("mode l7 requires tls mode reencrypt")
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", c.Mode)
+	}
+	switch c.OnNoHealthy {
+	case "", onNoHealthyFailOpen, onNoHealthyReject, onNoHealthyQueue:
+	default:
+		return fmt.Errorf("unknown on_no_healthy policy %q", c.OnNoHealthy)
+	}
+	if c.MinHealthyToServe < 0 || c.MinHealthyToServe > len(c.KubeApiServers) {
+		return fmt.Errorf("min_healthy_to_serve must be between 0 and the %d kube_apiservers", len(c.KubeApiServers))
+	}
+	if c.Rebalance != nil {
+		err = c.Rebalance.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.OutlierDetection != nil {
+		err = c.OutlierDetection.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.VersionSkew != nil {
+		if c.Service != serviceKubeAPIServer {
+			return fmt.Errorf("version_skew is not supported for service %s", c.Service)
+		}
+		err = c.VersionSkew.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if len(c.AllowedCIDRs) > 0 || len(c.DeniedCIDRs) > 0 {
+		if strings.HasPrefix(c.ListenAddr, unixScheme) {
+			return errors.New("allowed_cidrs and denied_cidrs require a TCP listen_addr")
+		}
+		_, err = newClientACL(c.AllowedCIDRs, c.DeniedCIDRs)
+		if err != nil {
+			return err
+		}
+	}
+	if c.ConnectionRateLimit != nil {
+		if strings.HasPrefix(c.ListenAddr, unixScheme) {
+			return errors.New("connection_rate_limit requires a TCP listen_addr")
+		}
+		err = c.ConnectionRateLimit.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.DialRace && c.Mode == modeL7 {
+		return errors.New("dial_race is not supported in mode l7")
+	}
+	if c.Sockmap {
+		if c.Mode == modeL7 {
+			return errors.New("sockmap is not supported in mode l7")
+		}
+		if strings.HasPrefix(c.ListenAddr, unixScheme) {
+			return errors.New("sockmap requires a TCP listen_addr")
+		}
+		if (tlsConfig.reencrypt() && c.Service == serviceKubeAPIServer) || tlsConfig.LogClientHello {
+			return errors.New("sockmap requires tls passthrough without log_client_hello, the lb must not read the bytes")
+		}
+	}
+	if c.WarmPool != nil {
+		if c.Mode == modeL7 {
+			return errors.New("warm_pool is not supported in mode l7, which keeps its own connections")
+		}
+		if c.WarmPool.TLS && (!tlsConfig.reencrypt() || c.Service != serviceKubeAPIServer) {
+			return errors.New("warm_pool tls requires tls mode reencrypt and service kube-apiserver")
+		}
+		err = c.WarmPool.validate()
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Queue.validate()
+	if err != nil {
+		return err
+	}
+	return c.L7.validate()
+}
+
+// validateUDP rejects the options that only make sense for stream sockets.
+func (c *ListenerConfig) validateUDP() error {
+	if strings.HasPrefix(c.ListenAddr, unixScheme) {
+		return errors.New("service udp requires a UDP listen_addr")
+	}
+	if c.Mode == modeL7 {
+		return errors.New("mode l7 is not supported for service udp")
+	}
+	if c.Acceptors > 1 || c.ListenBacklog > 0 {
+		return errors.New("acceptors and listen_backlog are not supported for service udp")
+	}
+	if c.OnNoHealthy == onNoHealthyQueue || c.Rebalance != nil || c.OutlierDetection != nil {
+		return errors.New("queue, rebalance and outlier_detection are not supported for service udp")
+	}
+	if len(c.AllowedCIDRs) > 0 || len(c.DeniedCIDRs) > 0 || c.ConnectionRateLimit != nil {
+		return errors.New("allowed_cidrs, denied_cidrs and connection_rate_limit are not supported for service udp")
+	}
+	if c.WarmPool != nil || c.DialRace || c.Sockmap {
+		return errors.New("warm_pool, dial_race and sockmap are not supported for service udp")
+	}
+	return c.UDP.validate()
+}
+
+// defaultListener checks that the listener name exists, and returns the
+// only listener when name is empty.
+func (c *Configuration) defaultListener(name string) (string, error) {
+	listeners := c.listeners()
+	if name == "" {
+		if len(listeners) > 1 {
+			return "", errors.New("listener is required with several listeners")
+		}
+		return listeners[0].Name, nil
+	}
+	for _, listener := range listeners {
+		if listener.Name == name {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("listener %q does not exist", name)
+}
+
+// listeners returns the configured listeners, or the top level one.
+func (c *Configuration) listeners() []*ListenerConfig {
+	if len(c.Listeners) == 0 {
+		return []*ListenerConfig{&c.ListenerConfig}
+	}
+	listeners := make([]*ListenerConfig, len(c.Listeners))
+	for i := range c.Listeners {
+		listeners[i] = &c.Listeners[i]
+	}
+	return listeners
+}
+
+func (c *Configuration) validateListeners() error {
+	if len(c.Listeners) > 0 && (c.ListenAddr != "" || len(c.KubeApiServers) > 0 || len(c.Backends) > 0 || c.Pool != "") {
+		return errors.New("listen_addr, kube_apiservers, backends and pool can't be set together with listeners")
+	}
+	for _, listener := range c.listeners() {
+		if len(listener.Backends) > 0 {
+			if len(listener.KubeApiServers) > 0 {
+				return errors.New("kube_apiservers and backends are mutually exclusive")
+			}
+			listener.KubeApiServers = listener.Backends
+		}
+	}
+	err := c.resolvePools()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for i, listener := range c.listeners() {
+		if listener.Name == "" {
+			listener.Name = listener.ListenAddr
+		}
+		if seen[listener.Name] {
+			return fmt.Errorf("duplicate listener %q", listener.Name)
+		}
+		seen[listener.Name] = true
+
+		err := listener.validate(&c.TLS)
+		if err == nil && listener.Sockmap {
+			err = c.validateSockmap()
+		}
+		if err != nil {
+			if len(c.Listeners) == 0 {
+				return err
+			}
+			return fmt.Errorf("listener %d (%s): %s", i, listener.Name, err)
+		}
+	}
+	return nil
+}
+
+// validateSockmap rejects the options that need the bytes of the forwarded
+// connections to go through the lb.
+func (c *Configuration) validateSockmap() error {
+	if c.Chaos != nil {
+		return errors.New("sockmap can't be used with chaos, which delays and resets the bytes in the lb")
+	}
+	if c.MPTCP {
+		return errors.New("sockmap can't be used with mptcp, the kernel doesn't redirect MPTCP sockets")
+	}
+	return nil
+}
+
+// allKubeApiServers returns the apiservers of every kube-apiserver listener.
+func (c *Configuration) allKubeApiServers() []string {
+	var servers []string
+	seen := make(map[string]bool)
+	for _, listener := range c.listeners() {
+		if listener.Service != serviceKubeAPIServer {
+			continue
+		}
+		for _, server := range listener.KubeApiServers {
+			if !seen[server] {
+				seen[server] = true
+				servers = append(servers, server)
+			}
+		}
+	}
+	return servers
+}
@@ -0,0 +1,40 @@
+package lb
+
+import (
+	"log"
+	"math"
+	"os"
+	"runtime"
+)
+
+// SetMaxProcs sets GOMAXPROCS to override when it is positive. Otherwise,
+// unless the GOMAXPROCS environment variable is set, it lowers GOMAXPROCS
+// to the CPU quota of the cgroup of the process, rounded up, as the
+// runtime sizes it from the CPUs of the node: a static pod limited to 2
+// CPUs on a 64 CPU node would run 64 threads and get throttled for most of
+// every CFS period under load.
+func SetMaxProcs(override int) {
+	if override > 0 {
+		runtime.GOMAXPROCS(override)
+		log.Printf("GOMAXPROCS set to %d by -gomaxprocs", override)
+		return
+	}
+	if os.Getenv("GOMAXPROCS") != "" {
+		return
+	}
+	quota, source, ok := cgroupCPUQuota()
+	if !ok {
+		return
+	}
+	procs := int(math.Ceil(quota))
+	// Like the runtime since Go 1.25, keep a second P for the GC
+	// workers unless there is a single CPU.
+	if procs < 2 {
+		procs = 2
+	}
+	if procs >= runtime.NumCPU() {
+		return
+	}
+	runtime.GOMAXPROCS(procs)
+	log.Printf("GOMAXPROCS set to %d from the CPU quota of %.2f of %s", procs, quota, source)
+}
@@ -0,0 +1,165 @@
+package lb
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupCPUQuota returns the CPUs the cgroup of the process, or one of its
+// parents, may use per period, with the cgroup file it comes from. Both
+// cgroup v2 cpu.max and the cgroup v1 cpu controller are read.
+func cgroupCPUQuota() (float64, string, bool) {
+	groups, err := readProcCgroups()
+	if err != nil {
+		return 0, "", false
+	}
+	mounts, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return 0, "", false
+	}
+	defer mounts.Close()
+
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		// 33 32 0:29 / /sys/fs/cgroup/cpu rw,relatime - cgroup cgroup rw,cpu
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator < 5 || len(fields) < separator+4 {
+			continue
+		}
+		root, mountPoint := fields[3], fields[4]
+		fsType, superOptions := fields[separator+1], fields[separator+3]
+		switch {
+		case fsType == "cgroup2" && groups[""] != "":
+			dir, ok := cgroupDir(mountPoint, root, groups[""])
+			if ok {
+				if quota, source, ok := walkCgroupQuota(dir, mountPoint, readCPUMax); ok {
+					return quota, source, true
+				}
+			}
+		case fsType == "cgroup" && hasOption(superOptions, "cpu"):
+			for controllers, path := range groups {
+				if !hasOption(controllers, "cpu") {
+					continue
+				}
+				dir, ok := cgroupDir(mountPoint, root, path)
+				if ok {
+					if quota, source, ok := walkCgroupQuota(dir, mountPoint, readCFSQuota); ok {
+						return quota, source, true
+					}
+				}
+			}
+		}
+	}
+	return 0, "", false
+}
+
+// readProcCgroups maps the controllers of each hierarchy the process is in,
+// "" for cgroup v2, to its cgroup path.
+func readProcCgroups() (map[string]string, error) {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// 1:cpu,cpuacct:/kubepods/pod1234 or 0::/kubepods/pod1234
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) == 3 {
+			groups[parts[1]] = parts[2]
+		}
+	}
+	return groups, nil
+}
+
+// cgroupDir is where path is visible under a cgroup mount of root, which
+// in a cgroup namespace is the cgroup of the container itself.
+func cgroupDir(mountPoint string, root string, path string) (string, bool) {
+	if root != "/" {
+		if path != root && !strings.HasPrefix(path, root+"/") {
+			return "", false
+		}
+		path = strings.TrimPrefix(path, root)
+	}
+	return filepath.Join(mountPoint, path), true
+}
+
+// walkCgroupQuota returns the smallest quota of dir and its parents up to
+// mountPoint, since a limit on a parent, like the pod of a container,
+// applies too.
+func walkCgroupQuota(dir string, mountPoint string, read func(dir string) (float64, string, bool)) (float64, string, bool) {
+	var least float64
+	var source string
+	for {
+		quota, file, ok := read(dir)
+		if ok && (source == "" || quota < least) {
+			least, source = quota, file
+		}
+		if dir == mountPoint || len(dir) <= len(mountPoint) {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return least, source, source != ""
+}
+
+// readCPUMax reads the cgroup v2 cpu.max of dir, like "200000 100000", or
+// "max 100000" without a limit.
+func readCPUMax(dir string) (float64, string, bool) {
+	file := filepath.Join(dir, "cpu.max")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, "", false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0, "", false
+	}
+	return cpuQuota(fields[0], fields[1], file)
+}
+
+// readCFSQuota reads the cgroup v1 cpu.cfs_quota_us of dir, -1 without a
+// limit, and its cpu.cfs_period_us.
+func readCFSQuota(dir string) (float64, string, bool) {
+	file := filepath.Join(dir, "cpu.cfs_quota_us")
+	quota, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, "", false
+	}
+	period, err := ioutil.ReadFile(filepath.Join(dir, "cpu.cfs_period_us"))
+	if err != nil {
+		return 0, "", false
+	}
+	return cpuQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)), file)
+}
+
+func cpuQuota(quota string, period string, file string) (float64, string, bool) {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return 0, "", false
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0, "", false
+	}
+	return float64(q) / float64(p), file, true
+}
+
+func hasOption(options string, option string) bool {
+	for _, o := range strings.Split(options, ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
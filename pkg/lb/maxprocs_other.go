@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package lb
+
+func cgroupCPUQuota() (float64, string, bool) {
+	return 0, "", false
+}
@@ -0,0 +1,110 @@
+package lb
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const metricsNamespace = "kube_apiserver_lb"
+
+// metric is a counter or gauge with an optional set of labels, exposed in
+// the Prometheus text format by the admin server.
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+var registry = &metricsRegistry{}
+
+func (r *metricsRegistry) register(kind, name, help string, labels []string) *metric {
+	m := &metric{
+		name:   metricsNamespace + "_" + name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return registry.register("counter", name, help, labels)
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+	return registry.register("gauge", name, help, labels)
+}
+
+func (m *metric) key(labelValues []string) string {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	pairs := make([]string, len(m.labels))
+	for i, label := range m.labels {
+		pairs[i] = fmt.Sprintf("%s=%q", label, labelValues[i])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *metric) add(value float64, labelValues ...string) {
+	key := m.key(labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] += value
+}
+
+func (m *metric) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metric) set(value float64, labelValues ...string) {
+	key := m.key(labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = value
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "" {
+			fmt.Fprintf(w, "%s %v\n", m.name, m.values[key])
+		} else {
+			fmt.Fprintf(w, "%s{%s} %v\n", m.name, key, m.values[key])
+		}
+	}
+}
+
+func (r *metricsRegistry) write(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		m.write(w)
+	}
+}
@@ -0,0 +1,160 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxMirrorsInFlight = 100
+	mirrorTimeout      = 30 * time.Second
+)
+
+var (
+	mirrorRequestsTotal = newCounter("mirror_requests_total",
+		"Requests mirrored to the shadow backend by result.", "result")
+	mirrorPrimarySecondsTotal = newCounter("mirror_primary_seconds_total",
+		"Time spent by the primary backends on mirrored requests.")
+	mirrorShadowSecondsTotal = newCounter("mirror_shadow_seconds_total",
+		"Time spent by the shadow backend on mirrored requests.")
+)
+
+type MirrorConfig struct {
+	Backend    string  `yaml:"backend"`
+	Percentage float64 `yaml:"percentage"`
+}
+
+func (c *MirrorConfig) validate() error {
+	if c.Backend == "" {
+		return errors.New("l7 mirror requires backend")
+	}
+	if c.Percentage <= 0 || c.Percentage > 100 {
+		return errors.New("l7 mirror percentage must be in (0, 100]")
+	}
+	return validateServerAddr(c.Backend)
+}
+
+type mirrorResult struct {
+	status   int
+	duration time.Duration
+	err      error
+}
+
+// statusRecorder remembers the status code sent to the client. Unwrap lets
+// httputil.ReverseProxy keep flushing through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func isMirrorable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if isUpgrade(req) || req.URL.Query().Get("watch") == "true" || req.URL.Query().Get("watch") == "1" {
+		return false
+	}
+	return !strings.Contains(req.URL.Path, "/watch/")
+}
+
+// mirror sends a share of the read-only requests to a shadow backend as well,
+// discards its responses and records how its status and latency compare with
+// the primary's. Watches and upgrades are never mirrored.
+func (lb *apiServerLb) mirror(next http.Handler) http.Handler {
+	config := lb.l7Config.Mirror
+	if config == nil {
+		return next
+	}
+	transport := lb.l7Transport()
+	var inFlight int64
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !isMirrorable(req) || rand.Float64()*100 >= config.Percentage {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if atomic.AddInt64(&inFlight, 1) > maxMirrorsInFlight {
+			atomic.AddInt64(&inFlight, -1)
+			mirrorRequestsTotal.inc("skipped")
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		shadowResult := make(chan mirrorResult, 1)
+		shadowReq := req.Clone(context.Background())
+		go func() {
+			defer atomic.AddInt64(&inFlight, -1)
+			shadowResult <- sendMirror(transport, shadowReq, config.Backend)
+		}()
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+		primary := mirrorResult{status: recorder.status, duration: time.Since(start)}
+
+		go recordMirror(req, primary, shadowResult)
+	})
+}
+
+func sendMirror(transport http.RoundTripper, req *http.Request, backend string) mirrorResult {
+	ctx, cancel := context.WithTimeout(req.Context(), mirrorTimeout)
+	defer cancel()
+
+	req = req.WithContext(ctx)
+	req.URL.Scheme = "https"
+	req.URL.Host = backend
+	req.RequestURI = ""
+
+	start := time.Now()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return mirrorResult{err: err}
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+
+	return mirrorResult{status: resp.StatusCode, duration: time.Since(start), err: err}
+}
+
+func recordMirror(req *http.Request, primary mirrorResult, shadowResult chan mirrorResult) {
+	shadow := <-shadowResult
+	if shadow.err != nil {
+		mirrorRequestsTotal.inc("error")
+		log.Printf("Error mirroring %s %s: %s", req.Method, req.URL.Path, shadow.err)
+		return
+	}
+
+	mirrorPrimarySecondsTotal.add(primary.duration.Seconds())
+	mirrorShadowSecondsTotal.add(shadow.duration.Seconds())
+
+	if shadow.status != primary.status {
+		mirrorRequestsTotal.inc("status_mismatch")
+		log.Printf("Mirror of %s %s returned %d, primary returned %d (latency %s vs %s)",
+			req.Method, req.URL.Path, shadow.status, primary.status, shadow.duration, primary.duration)
+		return
+	}
+	mirrorRequestsTotal.inc("match")
+}
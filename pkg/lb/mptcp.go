@@ -0,0 +1,40 @@
+package lb
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+)
+
+const mptcpEnabledPath = "/proc/sys/net/mptcp/enabled"
+
+var mptcpConnectionsTotal = newCounter("mptcp_connections_total",
+	"Forwarded connections with mptcp, by side, client or backend, and by whether the peer spoke MPTCP (mptcp) or fell back to TCP (tcp).",
+	"listener", "side", "protocol")
+
+// warnMPTCPDisabled warns when the kernel won't create MPTCP sockets, in
+// which case the lb silently uses TCP.
+func warnMPTCPDisabled() {
+	enabled, err := ioutil.ReadFile(mptcpEnabledPath)
+	if err != nil {
+		log.Printf("Warning: mptcp is set but the kernel doesn't support MPTCP, using TCP: %s", err)
+		return
+	}
+	if strings.TrimSpace(string(enabled)) != "1" {
+		log.Printf("Warning: mptcp is set but net.mptcp.enabled is %s, using TCP", strings.TrimSpace(string(enabled)))
+	}
+}
+
+// countMPTCP records whether the peer of conn, on side, negotiated MPTCP.
+func (lb *apiServerLb) countMPTCP(side string, conn net.Conn) {
+	mptcp, ok := isMultipathTCP(conn)
+	if !ok {
+		return
+	}
+	protocol := "tcp"
+	if mptcp {
+		protocol = "mptcp"
+	}
+	mptcpConnectionsTotal.inc(lb.name, side, protocol)
+}
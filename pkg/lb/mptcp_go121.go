@@ -0,0 +1,33 @@
+//go:build go1.21
+// +build go1.21
+
+package lb
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+const mptcpSupported = true
+
+func setDialerMPTCP(dialer *net.Dialer) {
+	dialer.SetMultipathTCP(true)
+}
+
+func setListenMPTCP(config *net.ListenConfig) {
+	config.SetMultipathTCP(true)
+}
+
+// isMultipathTCP tells whether conn uses MPTCP, with ok false when conn is
+// not a TCP connection.
+func isMultipathTCP(conn net.Conn) (mptcp bool, ok bool) {
+	if tlsConn, isTLS := conn.(*tls.Conn); isTLS {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return false, false
+	}
+	mptcp, err := tcpConn.MultipathTCP()
+	return mptcp && err == nil, err == nil
+}
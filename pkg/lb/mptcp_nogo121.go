@@ -0,0 +1,17 @@
+//go:build !go1.21
+// +build !go1.21
+
+package lb
+
+import "net"
+
+// mptcpSupported is false before Go 1.21, which added MPTCP sockets.
+const mptcpSupported = false
+
+func setDialerMPTCP(dialer *net.Dialer) {}
+
+func setListenMPTCP(config *net.ListenConfig) {}
+
+func isMultipathTCP(conn net.Conn) (bool, bool) {
+	return false, false
+}
@@ -0,0 +1,92 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// addAddress assigns addr to iface, like `ip addr add`.
+func addAddress(iface *net.Interface, addr *net.IPNet) error {
+	return addressRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, iface, addr)
+}
+
+// delAddress removes addr from iface, like `ip addr del`.
+func delAddress(iface *net.Interface, addr *net.IPNet) error {
+	return addressRequest(syscall.RTM_DELADDR, 0, iface, addr)
+}
+
+// addressRequest sends an rtnetlink address request and waits for its
+// acknowledgement.
+func addressRequest(msgType uint16, flags uint16, iface *net.Interface, addr *net.IPNet) error {
+	family := syscall.AF_INET
+	ip := addr.IP.To4()
+	if ip == nil {
+		family = syscall.AF_INET6
+		ip = addr.IP.To16()
+	}
+	prefixLen, _ := addr.Mask.Size()
+
+	ifAddr := syscall.IfAddrmsg{
+		Family:    uint8(family),
+		Prefixlen: uint8(prefixLen),
+		Index:     uint32(iface.Index),
+	}
+	payload := (*[syscall.SizeofIfAddrmsg]byte)(unsafe.Pointer(&ifAddr))[:]
+	payload = appendRtAttr(payload, syscall.IFA_LOCAL, ip)
+	payload = appendRtAttr(payload, syscall.IFA_ADDRESS, ip)
+
+	header := syscall.NlMsghdr{
+		Len:   uint32(syscall.SizeofNlMsghdr + len(payload)),
+		Type:  msgType,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags,
+		Seq:   1,
+	}
+	msg := append((*[syscall.SizeofNlMsghdr]byte)(unsafe.Pointer(&header))[:], payload...)
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	err = syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	n, _, err := syscall.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return err
+	}
+	replies, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if reply.Header.Type != syscall.NLMSG_ERROR {
+			continue
+		}
+		if len(reply.Data) < 4 {
+			return errors.New("short netlink error message")
+		}
+		errno := -*(*int32)(unsafe.Pointer(&reply.Data[0]))
+		if errno != 0 {
+			return fmt.Errorf("%s on %s: %w", addr, iface.Name, syscall.Errno(errno))
+		}
+		return nil
+	}
+	return errors.New("no netlink acknowledgement")
+}
+
+func appendRtAttr(b []byte, attrType uint16, value []byte) []byte {
+	attr := syscall.RtAttr{Len: uint16(syscall.SizeofRtAttr + len(value)), Type: attrType}
+	b = append(b, (*[syscall.SizeofRtAttr]byte)(unsafe.Pointer(&attr))[:]...)
+	b = append(b, value...)
+	for len(b)%syscall.NLMSG_ALIGNTO != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package lb
+
+import (
+	"errors"
+	"net"
+)
+
+var errVIPUnsupported = errors.New("managing virtual IPs is only supported on linux")
+
+func addAddress(iface *net.Interface, addr *net.IPNet) error {
+	return errVIPUnsupported
+}
+
+func delAddress(iface *net.Interface, addr *net.IPNet) error {
+	return errVIPUnsupported
+}
@@ -0,0 +1,157 @@
+package lb
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOutlierWindow             = 30
+	defaultOutlierMinRequests        = 20
+	defaultOutlierErrorRate          = 0.5
+	defaultOutlierEjectionTime       = 30
+	defaultOutlierMaxEjectionPercent = 50
+)
+
+var outlierEjectionsTotal = newCounter("outlier_ejections_total",
+	"Backends ejected for their data path error rate.", "backend")
+
+// OutlierConfig ejects a backend for ejection_time seconds once at least
+// error_rate of its connections, or requests in L7 mode, failed within the
+// last window seconds. Half broken apiservers, e.g. one whose etcd
+// connection is wedged, keep answering /healthz while failing real traffic.
+type OutlierConfig struct {
+	Window             int     `yaml:"window"`
+	MinRequests        int     `yaml:"min_requests"`
+	ErrorRate          float64 `yaml:"error_rate"`
+	EjectionTime       int     `yaml:"ejection_time"`
+	MaxEjectionPercent int     `yaml:"max_ejection_percent"`
+}
+
+func (c *OutlierConfig) validate() error {
+	if c.Window < 0 || c.MinRequests < 0 || c.EjectionTime < 0 {
+		return errors.New("outlier_detection window, min_requests and ejection_time must not be negative")
+	}
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return errors.New("outlier_detection error_rate must be between 0 and 1")
+	}
+	if c.MaxEjectionPercent < 0 || c.MaxEjectionPercent > 100 {
+		return errors.New("outlier_detection max_ejection_percent must be between 0 and 100")
+	}
+	return nil
+}
+
+// outcomeBucket counts the outcomes seen during one second.
+type outcomeBucket struct {
+	second int64
+	total  int
+	failed int
+}
+
+type outlierDetector struct {
+	state              *lbState
+	window             int
+	minRequests        int
+	errorRate          float64
+	ejectionTime       time.Duration
+	maxEjectionPercent int
+
+	mu      sync.Mutex
+	buckets map[string][]outcomeBucket
+}
+
+func newOutlierDetector(config *OutlierConfig, state *lbState) *outlierDetector {
+	d := &outlierDetector{
+		state:              state,
+		window:             config.Window,
+		minRequests:        config.MinRequests,
+		errorRate:          config.ErrorRate,
+		ejectionTime:       time.Duration(config.EjectionTime) * time.Second,
+		maxEjectionPercent: config.MaxEjectionPercent,
+		buckets:            make(map[string][]outcomeBucket),
+	}
+	if d.window == 0 {
+		d.window = defaultOutlierWindow
+	}
+	if d.minRequests == 0 {
+		d.minRequests = defaultOutlierMinRequests
+	}
+	if d.errorRate == 0 {
+		d.errorRate = defaultOutlierErrorRate
+	}
+	if d.ejectionTime == 0 {
+		d.ejectionTime = defaultOutlierEjectionTime * time.Second
+	}
+	if d.maxEjectionPercent == 0 {
+		d.maxEjectionPercent = defaultOutlierMaxEjectionPercent
+	}
+	return d
+}
+
+// record counts one outcome for server and ejects it when the failures in
+// the window cross the error rate.
+func (d *outlierDetector) record(server string, failed bool) {
+	now := time.Now().Unix()
+
+	d.mu.Lock()
+	buckets := d.buckets[server]
+	if buckets == nil {
+		buckets = make([]outcomeBucket, d.window)
+		d.buckets[server] = buckets
+	}
+	bucket := &buckets[now%int64(d.window)]
+	if bucket.second != now {
+		*bucket = outcomeBucket{second: now}
+	}
+	bucket.total++
+	if failed {
+		bucket.failed++
+	}
+
+	total, failures := 0, 0
+	for _, b := range buckets {
+		if now-b.second < int64(d.window) {
+			total += b.total
+			failures += b.failed
+		}
+	}
+	eject := failed && total >= d.minRequests && float64(failures) >= float64(total)*d.errorRate
+	if eject {
+		delete(d.buckets, server)
+	}
+	d.mu.Unlock()
+
+	if !eject {
+		return
+	}
+	if !d.state.eject(server, d.ejectionTime, d.maxEjectionPercent) {
+		log.Printf("Backend %s failed %d of %d connections but max_ejection_percent is reached", server, failures, total)
+		return
+	}
+	outlierEjectionsTotal.inc(server)
+	log.Printf("Backend %s ejected for %s after failing %d of %d connections", server, d.ejectionTime, failures, total)
+}
+
+func (lb *apiServerLb) recordOutcome(server string, failed bool) {
+	if lb.outliers != nil {
+		lb.outliers.record(server, failed)
+	}
+}
+
+// outlierTransport records the outcome of every round trip, failing only on
+// transport errors since apiserver errors are answers too.
+type outlierTransport struct {
+	lb   *apiServerLb
+	next http.RoundTripper
+}
+
+func (t *outlierTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if req.Context().Err() == nil {
+		t.lb.recordOutcome(req.URL.Host, err != nil)
+	}
+	return resp, err
+}
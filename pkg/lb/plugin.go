@@ -0,0 +1,255 @@
+package lb
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPluginTimeout = 100
+	pluginRestartDelay   = time.Second
+	maxPluginResponse    = 64 * 1024
+
+	pluginOpPick   = "pick"
+	pluginOpHealth = "health"
+)
+
+var pluginCallsTotal = newCounter("plugin_calls_total",
+	"Calls to the external plugin, by operation and result.", "op", "result")
+
+// PluginConfig runs command once and consults it, with one JSON object per
+// line on its stdin and stdout, for the backend of every connection or
+// request with balance, and for the health of every backend after each
+// probe with health_check. When it fails, times out or answers nonsense the
+// lb carries on as if it was not configured, and restarts it.
+//
+// The requests are
+//
+//	{"op": "pick", "listener": "main", "candidates": ["10.0.0.101:6443"], "outstanding": {"10.0.0.101:6443": 3}}
+//	{"op": "health", "listener": "main", "server": "10.0.0.101:6443", "error": "HTTP status code : 500"}
+//
+// answered by {"backend": "10.0.0.101:6443"} and {"healthy": true, "reason": "..."}.
+// Picks are made with the state of the listener locked, so timeout_ms
+// should be kept low.
+type PluginConfig struct {
+	Command     []string `yaml:"command"`
+	Balance     bool     `yaml:"balance"`
+	HealthCheck bool     `yaml:"health_check"`
+	TimeoutMs   int      `yaml:"timeout_ms"`
+}
+
+func (c *PluginConfig) validate() error {
+	if len(c.Command) == 0 {
+		return errors.New("plugin requires command")
+	}
+	if !c.Balance && !c.HealthCheck {
+		return errors.New("plugin requires balance or health_check")
+	}
+	if c.TimeoutMs < 0 {
+		return errors.New("plugin timeout_ms must not be negative")
+	}
+	if c.TimeoutMs == 0 {
+		c.TimeoutMs = defaultPluginTimeout
+	}
+	return nil
+}
+
+type pluginRequest struct {
+	Op          string           `json:"op"`
+	Listener    string           `json:"listener"`
+	Candidates  []string         `json:"candidates,omitempty"`
+	Outstanding map[string]int64 `json:"outstanding,omitempty"`
+	Server      string           `json:"server,omitempty"`
+	Error       string           `json:"error,omitempty"`
+}
+
+type pluginPick struct {
+	Backend string `json:"backend"`
+}
+
+type pluginHealth struct {
+	Healthy bool   `json:"healthy"`
+	Reason  string `json:"reason"`
+}
+
+// plugin is the running plugin process. Calls are serialized, one request
+// in flight at a time.
+type plugin struct {
+	config PluginConfig
+
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	lines     chan []byte
+	stopped   chan struct{}
+	restartAt time.Time
+}
+
+func newPlugin(config PluginConfig) *plugin {
+	return &plugin{config: config}
+}
+
+func (p *plugin) start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.startLocked()
+}
+
+func (p *plugin) startLocked() error {
+	cmd := exec.Command(p.config.Command[0], p.config.Command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	lines := make(chan []byte)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 4096), maxPluginResponse)
+		for scanner.Scan() {
+			line := append([]byte(nil), scanner.Bytes()...)
+			select {
+			case lines <- line:
+			case <-stopped:
+			}
+		}
+		err := cmd.Wait()
+		if err != nil {
+			log.Printf("Plugin %s exited: %s", p.config.Command[0], err)
+		}
+	}()
+	p.cmd, p.stdin, p.lines, p.stopped = cmd, stdin, lines, stopped
+	log.Printf("Started plugin %s, pid %d", p.config.Command[0], cmd.Process.Pid)
+	return nil
+}
+
+// stopLocked kills the process after an error, which could leave a late
+// answer behind, and holds off restarting it for pluginRestartDelay.
+func (p *plugin) stopLocked() {
+	p.cmd.Process.Kill()
+	p.stdin.Close()
+	close(p.stopped)
+	p.cmd = nil
+	p.restartAt = time.Now().Add(pluginRestartDelay)
+}
+
+func (p *plugin) call(req pluginRequest, resp interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd == nil {
+		if time.Now().Before(p.restartAt) {
+			return errors.New("plugin is restarting")
+		}
+		err := p.startLocked()
+		if err != nil {
+			p.restartAt = time.Now().Add(pluginRestartDelay)
+			return err
+		}
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err = p.stdin.Write(append(data, '\n'))
+	if err != nil {
+		p.stopLocked()
+		return err
+	}
+	timer := time.NewTimer(time.Duration(p.config.TimeoutMs) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case line, ok := <-p.lines:
+		if !ok {
+			p.stopLocked()
+			return errors.New("plugin exited")
+		}
+		err = json.Unmarshal(line, resp)
+		if err != nil {
+			p.stopLocked()
+			return fmt.Errorf("plugin answered %q: %s", line, err)
+		}
+		return nil
+	case <-timer.C:
+		p.stopLocked()
+		return fmt.Errorf("plugin did not answer within %dms", p.config.TimeoutMs)
+	}
+}
+
+// pluginBalancer asks the plugin for the backend, and falls back to the
+// balancer of the listener when it can't tell.
+type pluginBalancer struct {
+	plugin   *plugin
+	listener string
+	fallback Balancer
+}
+
+func (b *pluginBalancer) Pick(candidates []string, outstanding func(server string) int64) string {
+	req := pluginRequest{Op: pluginOpPick, Listener: b.listener, Candidates: candidates, Outstanding: make(map[string]int64, len(candidates))}
+	for _, server := range candidates {
+		req.Outstanding[server] = outstanding(server)
+	}
+	var resp pluginPick
+	err := b.plugin.call(req, &resp)
+	if err == nil {
+		for _, server := range candidates {
+			if server == resp.Backend {
+				pluginCallsTotal.inc(pluginOpPick, "success")
+				return server
+			}
+		}
+		err = fmt.Errorf("backend %q is not a candidate", resp.Backend)
+	}
+	pluginCallsTotal.inc(pluginOpPick, "error")
+	log.Printf("Error consulting the plugin for a %s backend: %s", b.listener, err)
+	return b.fallback.Pick(candidates, outstanding)
+}
+
+// pluginChecker lets the plugin overrule the result of the health check,
+// which stands when the plugin can't tell.
+type pluginChecker struct {
+	plugin   *plugin
+	listener string
+	probe    HealthChecker
+}
+
+func (c *pluginChecker) Check(server string) error {
+	probeErr := c.probe.Check(server)
+	req := pluginRequest{Op: pluginOpHealth, Listener: c.listener, Server: server}
+	if probeErr != nil {
+		req.Error = probeErr.Error()
+	}
+	var resp pluginHealth
+	err := c.plugin.call(req, &resp)
+	if err != nil {
+		pluginCallsTotal.inc(pluginOpHealth, "error")
+		log.Printf("Error consulting the plugin for the health of %s: %s", server, err)
+		return probeErr
+	}
+	pluginCallsTotal.inc(pluginOpHealth, "success")
+	if resp.Healthy {
+		return nil
+	}
+	if resp.Reason == "" {
+		resp.Reason = "unhealthy according to the plugin"
+	}
+	return errors.New(resp.Reason)
+}
@@ -0,0 +1,111 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PoolConfig is a named set of backends that listeners and L7 routes refer
+// to with pool. A pool's health_check overrides the listener's for its
+// servers.
+type PoolConfig struct {
+	Name        string       `yaml:"name"`
+	Servers     []string     `yaml:"servers"`
+	HealthCheck *HealthCheck `yaml:"health_check"`
+}
+
+func (c *PoolConfig) validate() error {
+	if c.Name == "" {
+		return errors.New("pool name is required")
+	}
+	if len(c.Servers) == 0 {
+		return fmt.Errorf("pool %s requires servers", c.Name)
+	}
+	if c.HealthCheck != nil {
+		return c.HealthCheck.validate()
+	}
+	return nil
+}
+
+// resolvePools replaces the pool references of listeners and routes with
+// the servers of those pools, and records the pools' health checks.
+func (c *Configuration) resolvePools() error {
+	pools := make(map[string]*PoolConfig)
+	for i := range c.Pools {
+		pool := &c.Pools[i]
+		err := pool.validate()
+		if err != nil {
+			return err
+		}
+		if pools[pool.Name] != nil {
+			return fmt.Errorf("duplicate pool %q", pool.Name)
+		}
+		pools[pool.Name] = pool
+	}
+
+	for _, listener := range c.listeners() {
+		listener.healthChecks = make(map[string]HealthCheck)
+		use := func(name string) ([]string, error) {
+			pool := pools[name]
+			if pool == nil {
+				return nil, fmt.Errorf("unknown pool %q", name)
+			}
+			if pool.HealthCheck != nil {
+				for _, server := range pool.Servers {
+					listener.healthChecks[server] = *pool.HealthCheck
+				}
+			}
+			return pool.Servers, nil
+		}
+
+		if listener.Pool != "" {
+			if len(listener.KubeApiServers) > 0 {
+				return errors.New("kube_apiservers and pool are mutually exclusive")
+			}
+			servers, err := use(listener.Pool)
+			if err != nil {
+				return err
+			}
+			listener.KubeApiServers = servers
+		}
+		for i := range listener.L7.Routes {
+			route := &listener.L7.Routes[i]
+			if route.Pool == "" {
+				continue
+			}
+			if len(route.Backends) > 0 {
+				return errors.New("l7 route backends and pool are mutually exclusive")
+			}
+			servers, err := use(route.Pool)
+			if err != nil {
+				return err
+			}
+			route.Backends = servers
+		}
+	}
+	return nil
+}
+
+// healthCheckFor returns the health check settings of server, those of its
+// pool if it has any. A pool check without type, tls or token_file inherits
+// them from the listener.
+func (lb *apiServerLb) healthCheckFor(server string) HealthCheck {
+	if rules, ok := lb.healthChecks[server]; ok {
+		if rules.Type == "" {
+			rules.Type = lb.healthCheckRules.Type
+		}
+		if rules.TLS == nil {
+			rules.TLS = lb.healthCheckRules.TLS
+		}
+		if rules.token == nil {
+			rules.token = lb.healthCheckRules.token
+		}
+		return rules
+	}
+	return lb.healthCheckRules
+}
+
+func (rules HealthCheck) period() time.Duration {
+	return time.Duration(rules.Period) * time.Second
+}
@@ -0,0 +1,117 @@
+package lb
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// runAs is the uid and gid the lb runs as once its listeners are
+// bound, so it can bind privileged ports as root without proxying every
+// byte of the API as root.
+type runAs struct {
+	uid int
+	gid int
+}
+
+// hardening chroots into chroot, switches to runAs, when not nil, and
+// applies the seccomp filter, once all the listeners are bound and before
+// any of them accepts. When that fails, fail is called with the error, so
+// that Run stops and returns it rather than serve unhardened. Listeners
+// restarted afterwards can't bind privileged ports again, and files read
+// later, like reloaded certificates and token files, must be readable by
+// the new user and be found inside chroot, e.g. bind mounted there.
+type hardening struct {
+	config    *Configuration
+	runAs     *runAs
+	listeners int
+	fail      func(error)
+
+	mu      sync.Mutex
+	bound   map[string]bool
+	started bool
+	done    chan struct{}
+	err     error
+}
+
+func newHardening(config *Configuration, c *runAs, fail func(error)) *hardening {
+	return &hardening{
+		config:    config,
+		runAs:     c,
+		listeners: len(config.listeners()),
+		fail:      fail,
+		bound:     make(map[string]bool),
+		done:      make(chan struct{}),
+	}
+}
+
+// wait is called by listener once it is bound, and returns once the lb is
+// hardened, with the error if that failed, or stop is closed. The last
+// listener to be bound hardens the lb in its own goroutine.
+func (h *hardening) wait(listener string, stop <-chan struct{}) error {
+	h.mu.Lock()
+	h.bound[listener] = true
+	last := len(h.bound) == h.listeners && !h.started
+	if last {
+		h.started = true
+	}
+	h.mu.Unlock()
+
+	if last {
+		h.err = h.harden()
+		if h.err != nil {
+			h.fail(h.err)
+		}
+		close(h.done)
+	}
+	select {
+	case <-h.done:
+		return h.err
+	case <-stop:
+		return nil
+	}
+}
+
+func (h *hardening) harden() error {
+	if h.config.Chroot != "" {
+		err := enterChroot(h.config.Chroot)
+		if err != nil {
+			return fmt.Errorf("error entering chroot %s : %s", h.config.Chroot, err)
+		}
+		log.Printf("Entered chroot %s", h.config.Chroot)
+	}
+	if h.runAs != nil {
+		err := h.runAs.drop()
+		if err != nil {
+			return fmt.Errorf("error dropping privileges : %s", err)
+		}
+		log.Printf("Dropped privileges to uid %d gid %d", h.runAs.uid, h.runAs.gid)
+	}
+	if h.config.Seccomp != nil {
+		err := applySeccomp(*h.config.Seccomp)
+		if err != nil {
+			return fmt.Errorf("error applying the seccomp filter : %s", err)
+		}
+		log.Printf("Applied the seccomp filter, other syscalls get %s", h.config.Seccomp.Action)
+	}
+	return nil
+}
+
+// hardened waits, once the listener is bound, for the lb to be hardened
+// before it accepts anything. It returns false when the listener must stop
+// instead, along with the error when hardening failed.
+func (lb *apiServerLb) hardened() (bool, error) {
+	if lb.hardening == nil {
+		return true, nil
+	}
+	err := lb.hardening.wait(lb.name, lb.shutdown)
+	if err != nil {
+		return false, err
+	}
+	select {
+	case <-lb.shutdown:
+		return false, nil
+	default:
+		return true, nil
+	}
+}
@@ -0,0 +1,73 @@
+//go:build !windows
+// +build !windows
+
+package lb
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// lookupRunAs resolves user and group, names or numeric ids, to the
+// ids to switch to. The group defaults to the primary group of the
+// user. It returns nil when neither is set.
+func lookupRunAs(userName string, groupName string) (*runAs, error) {
+	if userName == "" && groupName == "" {
+		return nil, nil
+	}
+	c := &runAs{uid: syscall.Getuid(), gid: syscall.Getgid()}
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if _, unknown := err.(user.UnknownUserError); unknown {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %s", userName, err)
+		}
+		c.uid, _ = strconv.Atoi(u.Uid)
+		c.gid, _ = strconv.Atoi(u.Gid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if _, unknown := err.(user.UnknownGroupError); unknown {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %s", groupName, err)
+		}
+		c.gid, _ = strconv.Atoi(g.Gid)
+	}
+	return c, nil
+}
+
+// drop switches every thread of the process to the uid and gid, clearing
+// the supplementary groups, and checks root can't be regained.
+func (c *runAs) drop() error {
+	err := syscall.Setgroups([]int{c.gid})
+	if err != nil {
+		return fmt.Errorf("setgroups: %s", err)
+	}
+	err = syscall.Setgid(c.gid)
+	if err != nil {
+		return fmt.Errorf("setgid %d: %s", c.gid, err)
+	}
+	err = syscall.Setuid(c.uid)
+	if err != nil {
+		return fmt.Errorf("setuid %d: %s", c.uid, err)
+	}
+	if c.uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("setuid %d left the process able to regain root", c.uid)
+	}
+	return nil
+}
+
+// enterChroot makes dir the root of the process, for all its threads.
+func enterChroot(dir string) error {
+	err := syscall.Chroot(dir)
+	if err != nil {
+		return err
+	}
+	return syscall.Chdir("/")
+}
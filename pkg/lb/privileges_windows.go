@@ -0,0 +1,18 @@
+package lb
+
+import "errors"
+
+func lookupRunAs(userName string, groupName string) (*runAs, error) {
+	if userName == "" && groupName == "" {
+		return nil, nil
+	}
+	return nil, errors.New("user and group are not supported on windows")
+}
+
+func (c *runAs) drop() error {
+	return nil
+}
+
+func enterChroot(dir string) error {
+	return errors.New("chroot is not supported on windows")
+}
@@ -0,0 +1,87 @@
+package lb
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	defaultQueueSize    = 1024
+	defaultQueueTimeout = 10
+)
+
+var errQueueFull = errors.New("no remote servers are healthy and the queue is full")
+
+var (
+	queuedTotal = newCounter("queued_total",
+		"Connections and requests queued while no backend was healthy, by outcome.", "result")
+	queuedGauge = newGauge("queued",
+		"Connections and requests waiting for a healthy backend.")
+)
+
+// QueueConfig bounds how many connections, or requests in L7 mode, are held
+// and for how long while waiting for a backend with on_no_healthy: queue.
+type QueueConfig struct {
+	Size    int `yaml:"size"`
+	Timeout int `yaml:"timeout"`
+}
+
+func (c *QueueConfig) validate() error {
+	if c.Size < 0 {
+		return errors.New("queue size must not be negative")
+	}
+	if c.Timeout < 0 {
+		return errors.New("queue timeout must not be negative")
+	}
+	return nil
+}
+
+// connQueue holds connections until a backend recovers, so a short control
+// plane restart looks like a slow connect rather than a refused one.
+type connQueue struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newConnQueue(config QueueConfig) *connQueue {
+	size := config.Size
+	if size == 0 {
+		size = defaultQueueSize
+	}
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = defaultQueueTimeout
+	}
+	return &connQueue{
+		slots:   make(chan struct{}, size),
+		timeout: time.Duration(timeout) * time.Second,
+	}
+}
+
+// wait takes a slot in the queue until one of servers is healthy and picks
+// it, or gives up after the timeout.
+func (q *connQueue) wait(state *lbState, key string, servers []string) (string, error) {
+	select {
+	case q.slots <- struct{}{}:
+	default:
+		queuedTotal.inc("full")
+		return "", errQueueFull
+	}
+	queuedGauge.add(1)
+	defer func() {
+		<-q.slots
+		queuedGauge.add(-1)
+	}()
+
+	if !state.waitHealthy(key, servers, q.timeout) {
+		queuedTotal.inc("timeout")
+		return "", errNoHealthy
+	}
+	remote, err := state.pick(key, servers)
+	if err != nil {
+		queuedTotal.inc("no_backend")
+		return "", err
+	}
+	queuedTotal.inc("forwarded")
+	return remote, nil
+}
@@ -0,0 +1,138 @@
+package lb
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitKeyIP = "ip"
+	rateLimitKeyCN = "cn"
+
+	rateLimitCleanupPeriod = time.Minute
+)
+
+var rateLimitedTotal = newCounter("rate_limited_requests_total",
+	"Requests rejected with 429 by the per-client rate limit in L7 mode.", "key")
+
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+	Key               string  `yaml:"key"`
+}
+
+func (c *RateLimitConfig) validate() error {
+	if c.RequestsPerSecond <= 0 {
+		return errors.New("l7 rate_limit requests_per_second must be positive")
+	}
+	if c.Burst < 0 {
+		return errors.New("l7 rate_limit burst must not be negative")
+	}
+	switch c.Key {
+	case "", rateLimitKeyIP, rateLimitKeyCN:
+	default:
+		return errors.New("l7 rate_limit key must be ip or cn")
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps one token bucket per client. Buckets that have refilled
+// completely carry no state and are dropped periodically.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst == 0 {
+		burst = int(math.Ceil(rate))
+	}
+	limiter := &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+	go limiter.cleanup()
+	return limiter
+}
+
+// allow takes a token for key, or returns how long until one is available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+func (l *rateLimiter) cleanup() {
+	for {
+		time.Sleep(rateLimitCleanupPeriod)
+
+		l.mu.Lock()
+		for key, bucket := range l.buckets {
+			if time.Since(bucket.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+func rateLimitKey(req *http.Request, key string) string {
+	if key == rateLimitKeyCN && req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return "cn:" + req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	ip := remoteIP(req.RemoteAddr)
+	if ip == nil {
+		return "ip:" + req.RemoteAddr
+	}
+	return "ip:" + ip.String()
+}
+
+// rateLimit answers 429 locally once a client exceeds its request rate, so a
+// runaway controller is throttled before it reaches the apiservers. Clients
+// without a certificate are keyed by IP even when keying by CN.
+func (lb *apiServerLb) rateLimit(next http.Handler) http.Handler {
+	config := lb.l7Config.RateLimit
+	if config == nil {
+		return next
+	}
+	limiter := newRateLimiter(config.RequestsPerSecond, config.Burst)
+	keyKind := config.Key
+	if keyKind == "" {
+		keyKind = rateLimitKeyIP
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := rateLimitKey(req, keyKind)
+		allowed, retryAfter := limiter.allow(key)
+		if !allowed {
+			rateLimitedTotal.inc(keyKind)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
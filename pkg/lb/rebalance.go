@@ -0,0 +1,113 @@
+package lb
+
+import (
+	"errors"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	defaultRebalancePeriod    = 30
+	defaultRebalanceThreshold = 1.5
+	defaultRebalanceMaxCloses = 10
+)
+
+var (
+	connectionSkew = newGauge("connection_skew",
+		"Connections on the busiest healthy backend relative to an even share.", "listener")
+	backendConnections = newGauge("backend_connections",
+		"Forwarded connections per backend.", "listener", "backend")
+	rebalancedTotal = newCounter("rebalanced_connections_total",
+		"Connections closed by the rebalancer, by the backend they were on.", "backend")
+)
+
+// RebalanceConfig enables closing connections on backends holding more than
+// threshold times their even share, e.g. the survivor of a failover that
+// kept every reconnecting client. At most max_closes connections are closed
+// per period so clients come back gradually.
+type RebalanceConfig struct {
+	Period    int     `yaml:"period"`
+	Threshold float64 `yaml:"threshold"`
+	MaxCloses int     `yaml:"max_closes"`
+}
+
+func (c *RebalanceConfig) validate() error {
+	if c.Period < 0 || c.MaxCloses < 0 {
+		return errors.New("rebalance period and max_closes must not be negative")
+	}
+	if c.Threshold != 0 && c.Threshold <= 1 {
+		return errors.New("rebalance threshold must be above 1")
+	}
+	return nil
+}
+
+func (lb *apiServerLb) rebalance(stop <-chan struct{}) {
+	config := lb.rebalanceConfig
+	period := config.Period
+	if period == 0 {
+		period = defaultRebalancePeriod
+	}
+	threshold := config.Threshold
+	if threshold == 0 {
+		threshold = defaultRebalanceThreshold
+	}
+	maxCloses := config.MaxCloses
+	if maxCloses == 0 {
+		maxCloses = defaultRebalanceMaxCloses
+	}
+
+	ticker := time.NewTicker(time.Duration(period) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		healthy := lb.state.preferredOf(defaultServersKey, lb.remoteServers())
+		counts := lb.forwarders.countByBackend(lb.name)
+		total := 0
+		for _, server := range lb.remoteServers() {
+			backendConnections.set(float64(counts[server]), lb.name, server)
+		}
+		for _, server := range healthy {
+			total += counts[server]
+		}
+		if len(healthy) < 2 || total == 0 {
+			connectionSkew.set(1, lb.name)
+			continue
+		}
+
+		fair := float64(total) / float64(len(healthy))
+		busiest := 0
+		for _, server := range healthy {
+			if counts[server] > busiest {
+				busiest = counts[server]
+			}
+		}
+		connectionSkew.set(float64(busiest)/fair, lb.name)
+
+		budget := maxCloses
+		for _, server := range healthy {
+			if budget == 0 {
+				break
+			}
+			if float64(counts[server]) <= fair*threshold {
+				continue
+			}
+			excess := counts[server] - int(math.Ceil(fair))
+			if excess > budget {
+				excess = budget
+			}
+			conns := lb.forwarders.idlest(lb.name, server, excess)
+			log.Printf("Rebalancing %d of %d connections away from backend %s", len(conns), counts[server], server)
+			for _, conn := range conns {
+				conn.cancel()
+			}
+			rebalancedTotal.add(float64(len(conns)), server)
+			budget -= len(conns)
+		}
+	}
+}
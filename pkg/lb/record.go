@@ -0,0 +1,251 @@
+package lb
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	eventStart  = "start"
+	eventAccept = "accept"
+	eventSelect = "select"
+	eventDial   = "dial"
+	eventClose  = "close"
+
+	defaultRecordMaxSize = 100
+	recordBuffer         = 4096
+	recordFlushPeriod    = time.Second
+)
+
+var recordDroppedTotal = newCounter("record_events_dropped_total",
+	"Connection events not recorded because the writer fell behind.")
+
+// RecordConfig appends an event to path, one JSON object per line, as the
+// connections of the TCP listeners are accepted, get a backend selected and
+// dialed, and close, for `kube-apiserver-lb replay` to rebuild the timeline
+// of an incident. A start event marks every run of the lb, connection ids
+// begin again after it. The file is moved to path.1 once it grows over max_size
+// MB.
+type RecordConfig struct {
+	Path    string `yaml:"path"`
+	MaxSize int    `yaml:"max_size"`
+}
+
+func (c *RecordConfig) validate() error {
+	if c.Path == "" {
+		return errors.New("record requires path")
+	}
+	if c.MaxSize < 0 {
+		return errors.New("record max_size must not be negative")
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = defaultRecordMaxSize
+	}
+	return nil
+}
+
+// connEvent is a recorded event. Durations are the dial time, or at close
+// the lifetime of the connection, in and out the bytes from and to the
+// client.
+type connEvent struct {
+	Time     int64  `json:"t"`
+	Event    string `json:"ev"`
+	Conn     uint64 `json:"c"`
+	Listener string `json:"l,omitempty"`
+	Client   string `json:"cl,omitempty"`
+	Backend  string `json:"b,omitempty"`
+	Micros   int64  `json:"us,omitempty"`
+	In       int64  `json:"in,omitempty"`
+	Out      int64  `json:"out,omitempty"`
+	Error    string `json:"err,omitempty"`
+}
+
+// eventRecorder writes the events from a buffer, dropping them rather than
+// slowing connections down when the disk can't keep up.
+type eventRecorder struct {
+	config RecordConfig
+	events chan connEvent
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+	lastID uint64
+
+	file *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+func newEventRecorder(config RecordConfig) (*eventRecorder, error) {
+	r := &eventRecorder{
+		config: config,
+		events: make(chan connEvent, recordBuffer),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	r.record(connEvent{Event: eventStart})
+	go r.run()
+	return r, nil
+}
+
+func (r *eventRecorder) open() error {
+	file, err := os.OpenFile(r.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.w, r.size = file, bufio.NewWriter(file), info.Size()
+	return nil
+}
+
+func (r *eventRecorder) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(recordFlushPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-r.events:
+			r.write(event)
+		case <-ticker.C:
+			r.flush()
+		case <-r.stop:
+			for {
+				select {
+				case event := <-r.events:
+					r.write(event)
+				default:
+					r.flush()
+					if r.file != nil {
+						r.file.Close()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *eventRecorder) write(event connEvent) {
+	if r.file == nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	n, err := r.w.Write(append(data, '\n'))
+	r.size += int64(n)
+	if err != nil {
+		log.Printf("Error recording connection events to %s: %s", r.config.Path, err)
+	}
+	if r.size >= int64(r.config.MaxSize)*1024*1024 {
+		r.rotate()
+	}
+}
+
+func (r *eventRecorder) flush() {
+	if r.file == nil {
+		return
+	}
+	err := r.w.Flush()
+	if err != nil {
+		log.Printf("Error recording connection events to %s: %s", r.config.Path, err)
+	}
+}
+
+func (r *eventRecorder) rotate() {
+	r.flush()
+	r.file.Close()
+	r.file = nil
+	err := os.Rename(r.config.Path, r.config.Path+".1")
+	if err != nil {
+		log.Printf("Error rotating %s: %s", r.config.Path, err)
+	}
+	err = r.open()
+	if err != nil {
+		log.Printf("Error recording connection events to %s: %s", r.config.Path, err)
+	}
+}
+
+func (r *eventRecorder) record(event connEvent) {
+	event.Time = time.Now().UnixNano()
+	select {
+	case r.events <- event:
+	default:
+		recordDroppedTotal.inc()
+	}
+}
+
+// close writes out the buffered events, the ones recorded after are lost.
+func (r *eventRecorder) close() {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() {
+		close(r.stop)
+		<-r.done
+	})
+}
+
+// connRecord records the events of one connection. Its methods do nothing
+// on a nil connRecord, which is what conn returns without record.
+type connRecord struct {
+	recorder *eventRecorder
+	id       uint64
+	listener string
+	accepted time.Time
+}
+
+func (r *eventRecorder) conn(listener string, conn net.Conn) *connRecord {
+	if r == nil {
+		return nil
+	}
+	c := &connRecord{recorder: r, id: atomic.AddUint64(&r.lastID, 1), listener: listener, accepted: time.Now()}
+	r.record(connEvent{Event: eventAccept, Conn: c.id, Listener: listener, Client: conn.RemoteAddr().String()})
+	return c
+}
+
+func (c *connRecord) event(event string, backend string, duration time.Duration, err error) connEvent {
+	e := connEvent{Event: event, Conn: c.id, Listener: c.listener, Backend: backend, Micros: duration.Microseconds()}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+func (c *connRecord) selected(backend string, err error) {
+	if c == nil {
+		return
+	}
+	c.recorder.record(c.event(eventSelect, backend, 0, err))
+}
+
+func (c *connRecord) dialed(backend string, took time.Duration, err error) {
+	if c == nil {
+		return
+	}
+	c.recorder.record(c.event(eventDial, backend, took, err))
+}
+
+func (c *connRecord) closed(backend string, in int64, out int64, err error) {
+	if c == nil {
+		return
+	}
+	e := c.event(eventClose, backend, time.Since(c.accepted), err)
+	e.In, e.Out = in, out
+	c.recorder.record(e)
+}
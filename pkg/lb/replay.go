@@ -0,0 +1,265 @@
+package lb
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const replayTimeFormat = "2006-01-02T15:04:05.000"
+
+// replayedConn is a connection rebuilt from its events.
+type replayedConn struct {
+	run      int
+	id       uint64
+	listener string
+	client   string
+	accepted time.Time
+	backend  string
+	dial     time.Duration
+	lifetime time.Duration
+	in       int64
+	out      int64
+	closed   bool
+	errors   []string
+}
+
+func (c *replayedConn) failed() bool {
+	return len(c.errors) > 0
+}
+
+type replayedStart struct {
+	run  int
+	time time.Time
+}
+
+// RunReplay reads the events recorded with record from the files given as
+// arguments, oldest first, and prints a timeline of the connections and a
+// summary by backend and error.
+func RunReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	since := flags.String("since", "", "only connections accepted from this RFC3339 time")
+	until := flags.String("until", "", "only connections accepted before this RFC3339 time")
+	backend := flags.String("backend", "", "only connections to this backend")
+	failed := flags.Bool("errors", false, "only connections that failed")
+	summary := flags.Bool("summary", false, "only print the summary")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kube-apiserver-lb replay [flags] events.jsonl.1 events.jsonl\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	var from, to time.Time
+	var err error
+	if *since != "" {
+		from, err = time.Parse(time.RFC3339, *since)
+		if err != nil {
+			log.Fatalf("error parsing -since : %s", err)
+		}
+	}
+	if *until != "" {
+		to, err = time.Parse(time.RFC3339, *until)
+		if err != nil {
+			log.Fatalf("error parsing -until : %s", err)
+		}
+	}
+
+	var conns []*replayedConn
+	var starts []replayedStart
+	run := 0
+	byID := make(map[uint64]*replayedConn)
+	for _, path := range flags.Args() {
+		err := readEvents(path, func(event connEvent) {
+			if event.Event == eventStart {
+				run++
+				byID = make(map[uint64]*replayedConn)
+				starts = append(starts, replayedStart{run: run, time: time.Unix(0, event.Time)})
+				return
+			}
+			conn := byID[event.Conn]
+			if conn == nil {
+				conn = &replayedConn{run: run, id: event.Conn, listener: event.Listener, accepted: time.Unix(0, event.Time)}
+				byID[event.Conn] = conn
+				conns = append(conns, conn)
+			}
+			replayEvent(conn, event)
+		})
+		if err != nil {
+			log.Fatalf("error reading %s : %s", path, err)
+		}
+	}
+
+	var selected []*replayedConn
+	for _, conn := range conns {
+		if (!from.IsZero() && conn.accepted.Before(from)) || (!to.IsZero() && !conn.accepted.Before(to)) {
+			continue
+		}
+		if (*backend != "" && conn.backend != *backend) || (*failed && !conn.failed()) {
+			continue
+		}
+		selected = append(selected, conn)
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].accepted.Before(selected[j].accepted)
+	})
+	if !*summary {
+		printTimeline(os.Stdout, selected, starts)
+	}
+	printReplaySummary(os.Stdout, selected)
+}
+
+func readEvents(path string, handle func(connEvent)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var event connEvent
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			// The last line of a file the lb was killed while writing.
+			log.Printf("Skipping line %d of %s: %s", line, path, err)
+			continue
+		}
+		handle(event)
+	}
+	return scanner.Err()
+}
+
+func replayEvent(conn *replayedConn, event connEvent) {
+	if event.Error != "" {
+		conn.errors = append(conn.errors, fmt.Sprintf("%s: %s", event.Event, event.Error))
+	}
+	switch event.Event {
+	case eventAccept:
+		conn.client = event.Client
+		conn.accepted = time.Unix(0, event.Time)
+	case eventSelect:
+		conn.backend = event.Backend
+	case eventDial:
+		conn.backend = event.Backend
+		conn.dial = time.Duration(event.Micros) * time.Microsecond
+	case eventClose:
+		conn.closed = true
+		conn.lifetime = time.Duration(event.Micros) * time.Microsecond
+		conn.in, conn.out = event.In, event.Out
+	}
+}
+
+func printTimeline(w io.Writer, conns []*replayedConn, starts []replayedStart) {
+	next := 0
+	for _, conn := range conns {
+		for next < len(starts) && !starts[next].time.After(conn.accepted) {
+			fmt.Fprintf(w, "%s --- lb started, run %d\n", starts[next].time.Format(replayTimeFormat), starts[next].run)
+			next++
+		}
+		backend := conn.backend
+		if backend == "" {
+			backend = "-"
+		}
+		line := fmt.Sprintf("%s %s #%d %s -> %s", conn.accepted.Format(replayTimeFormat), conn.listener, conn.id, conn.client, backend)
+		if conn.dial > 0 {
+			line += fmt.Sprintf(" dial %s", conn.dial)
+		}
+		if conn.closed {
+			line += fmt.Sprintf(" lived %s in %s out %s", conn.lifetime.Round(time.Millisecond), formatBytes(conn.in), formatBytes(conn.out))
+		} else if !conn.failed() {
+			line += " not closed"
+		}
+		if conn.failed() {
+			line += " error " + strings.Join(conn.errors, "; ")
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+type backendSummary struct {
+	conns   int
+	failed  int
+	dialSum time.Duration
+	dials   int
+	in      int64
+	out     int64
+}
+
+func printReplaySummary(w io.Writer, conns []*replayedConn) {
+	backends := make(map[string]*backendSummary)
+	errs := make(map[string]int)
+	failed := 0
+	for _, conn := range conns {
+		summary := backends[conn.backend]
+		if summary == nil {
+			summary = &backendSummary{}
+			backends[conn.backend] = summary
+		}
+		summary.conns++
+		if conn.dial > 0 {
+			summary.dialSum += conn.dial
+			summary.dials++
+		}
+		summary.in += conn.in
+		summary.out += conn.out
+		if conn.failed() {
+			summary.failed++
+			failed++
+			for _, err := range conn.errors {
+				errs[err]++
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d connections, %d failed\n", len(conns), failed)
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		summary := backends[name]
+		if name == "" {
+			name = "no backend"
+		}
+		var dial time.Duration
+		if summary.dials > 0 {
+			dial = summary.dialSum / time.Duration(summary.dials)
+		}
+		fmt.Fprintf(w, "  %s: %d connections, %d failed, mean dial %s, in %s out %s\n",
+			name, summary.conns, summary.failed, dial, formatBytes(summary.in), formatBytes(summary.out))
+	}
+	kinds := make([]string, 0, len(errs))
+	for kind := range errs {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		return errs[kinds[i]] > errs[kinds[j]] || (errs[kinds[i]] == errs[kinds[j]] && kinds[i] < kinds[j])
+	})
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "  %d x %s\n", errs[kind], kind)
+	}
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
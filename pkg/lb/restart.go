@@ -0,0 +1,85 @@
+package lb
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	defaultRestartBackoffMs    = 1000
+	defaultRestartMaxBackoffMs = 30000
+)
+
+var restartsTotal = newCounter("restarts_total",
+	"Times the lb was restarted after a hard error.")
+
+// RestartConfig controls how the lb is restarted after a hard error. The
+// backoff doubles on every restart up to max_backoff_ms and starts over once
+// the lb ran for longer than that. With max_restarts set, the process exits
+// after that many consecutive restarts so its supervisor notices.
+type RestartConfig struct {
+	BackoffMs    int `yaml:"backoff_ms"`
+	MaxBackoffMs int `yaml:"max_backoff_ms"`
+	MaxRestarts  int `yaml:"max_restarts"`
+}
+
+func (c *RestartConfig) validate() error {
+	if c.BackoffMs < 0 || c.MaxBackoffMs < 0 || c.MaxRestarts < 0 {
+		return errors.New("restart backoff_ms, max_backoff_ms and max_restarts must not be negative")
+	}
+	if c.BackoffMs > 0 && c.MaxBackoffMs > 0 && c.BackoffMs > c.MaxBackoffMs {
+		return errors.New("restart backoff_ms must not exceed max_backoff_ms")
+	}
+	return nil
+}
+
+type restartPolicy struct {
+	initial     time.Duration
+	max         time.Duration
+	maxRestarts int
+
+	restarts int
+	backoff  time.Duration
+}
+
+func newRestartPolicy(config RestartConfig) *restartPolicy {
+	p := &restartPolicy{
+		initial:     time.Duration(config.BackoffMs) * time.Millisecond,
+		max:         time.Duration(config.MaxBackoffMs) * time.Millisecond,
+		maxRestarts: config.MaxRestarts,
+	}
+	if p.initial == 0 {
+		p.initial = defaultRestartBackoffMs * time.Millisecond
+	}
+	if p.max == 0 {
+		p.max = defaultRestartMaxBackoffMs * time.Millisecond
+	}
+	if p.max < p.initial {
+		p.max = p.initial
+	}
+	return p
+}
+
+// next returns how long to wait before restarting an lb that failed after
+// running for ranFor, and false once max_restarts is exhausted.
+func (p *restartPolicy) next(ranFor time.Duration) (time.Duration, bool) {
+	if ranFor >= p.max {
+		p.restarts = 0
+		p.backoff = 0
+	}
+	p.restarts++
+	if p.maxRestarts > 0 && p.restarts > p.maxRestarts {
+		return 0, false
+	}
+	restartsTotal.inc()
+
+	if p.backoff == 0 {
+		p.backoff = p.initial
+	} else {
+		p.backoff *= 2
+	}
+	if p.backoff > p.max {
+		p.backoff = p.max
+	}
+	return p.backoff, true
+}
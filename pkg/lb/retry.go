@@ -0,0 +1,204 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	retryBudgetWindow     = 10 * time.Second
+	minRetriesPerWindow   = 3
+	defaultRetryAttempts  = 2
+	defaultRetryBackoffMs = 50
+)
+
+var retriesTotal = newCounter("retries_total",
+	"Requests retried against another backend in L7 mode by outcome.", "result")
+
+type RetryConfig struct {
+	Methods       []string `yaml:"methods"`
+	Attempts      int      `yaml:"attempts"`
+	BackoffMs     int      `yaml:"backoff_ms"`
+	BudgetPercent float64  `yaml:"budget_percent"`
+}
+
+func (c *RetryConfig) validate() error {
+	if c.Attempts < 0 || c.BackoffMs < 0 {
+		return errors.New("l7 retry attempts and backoff_ms must not be negative")
+	}
+	if c.BudgetPercent < 0 || c.BudgetPercent > 100 {
+		return errors.New("l7 retry budget_percent must be between 0 and 100")
+	}
+	return nil
+}
+
+// retryBudget caps retries to a share of the requests seen in the current
+// window so retries cannot multiply the load on apiservers that are already
+// failing.
+type retryBudget struct {
+	percent float64
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+func (b *retryBudget) roll() {
+	if time.Since(b.windowStart) > retryBudgetWindow {
+		b.windowStart = time.Now()
+		b.requests, b.retries = 0, 0
+	}
+}
+
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	b.requests++
+}
+
+func (b *retryBudget) allowRetry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+
+	if b.percent > 0 {
+		allowed := int(float64(b.requests) * b.percent / 100)
+		if allowed < minRetriesPerWindow {
+			allowed = minRetriesPerWindow
+		}
+		if b.retries >= allowed {
+			return false
+		}
+	}
+	b.retries++
+	return true
+}
+
+// retryTransport retries idempotent requests against a different backend
+// when the connection fails or the backend answers 502 or 503.
+type retryTransport struct {
+	lb       *apiServerLb
+	next     http.RoundTripper
+	methods  map[string]bool
+	attempts int
+	backoff  time.Duration
+	budget   *retryBudget
+}
+
+func (lb *apiServerLb) newRetryTransport(next http.RoundTripper) http.RoundTripper {
+	config := lb.l7Config.Retry
+	if config == nil {
+		return next
+	}
+
+	t := &retryTransport{
+		lb:       lb,
+		next:     next,
+		methods:  make(map[string]bool),
+		attempts: config.Attempts,
+		backoff:  time.Duration(config.BackoffMs) * time.Millisecond,
+		budget:   &retryBudget{percent: config.BudgetPercent},
+	}
+	if t.attempts == 0 {
+		t.attempts = defaultRetryAttempts
+	}
+	if t.backoff == 0 {
+		t.backoff = defaultRetryBackoffMs * time.Millisecond
+	}
+	methods := config.Methods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead}
+	}
+	for _, method := range methods {
+		t.methods[strings.ToUpper(method)] = true
+	}
+	return t
+}
+
+func (t *retryTransport) retryable(req *http.Request) bool {
+	if !t.methods[req.Method] || isUpgrade(req) {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.budget.request()
+	resp, err := t.next.RoundTrip(req)
+	if !t.retryable(req) {
+		return resp, err
+	}
+
+	tried := []string{req.URL.Host}
+	for attempt := 0; attempt < t.attempts && shouldRetry(resp, err); attempt++ {
+		if req.Context().Err() != nil || !t.budget.allowRetry() {
+			retriesTotal.inc("budget_exhausted")
+			break
+		}
+
+		_, servers := t.lb.routeBackends(req.URL.Path)
+		remote, pickErr := t.lb.pickRemoteExcluding(servers, tried)
+		if pickErr != nil {
+			retriesTotal.inc("no_backend")
+			break
+		}
+
+		select {
+		case <-time.After(t.backoff << uint(attempt)):
+		case <-req.Context().Done():
+			return resp, err
+		}
+
+		retryReq, cloneErr := cloneForRetry(req, remote)
+		if cloneErr != nil {
+			break
+		}
+		log.Printf("Retrying %s %s on %s after %s", req.Method, req.URL.Path, remote, describeFailure(resp, err))
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		tried = append(tried, remote)
+		resp, err = t.next.RoundTrip(retryReq)
+		if shouldRetry(resp, err) {
+			retriesTotal.inc("failed")
+		} else {
+			retriesTotal.inc("succeeded")
+		}
+	}
+	return resp, err
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+func describeFailure(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("HTTP status code : %d", resp.StatusCode)
+}
+
+func cloneForRetry(req *http.Request, remote string) (*http.Request, error) {
+	retryReq := req.Clone(req.Context())
+	retryReq.URL.Host = remote
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retryReq.Body = body
+	}
+	return retryReq, nil
+}
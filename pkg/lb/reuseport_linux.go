@@ -0,0 +1,11 @@
+package lb
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, which the syscall package does not export on
+// linux.
+const soReusePort = 0xf
+
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package lb
+
+import "errors"
+
+// setReusePort fails outside linux, where SO_REUSEPORT either doesn't exist
+// or doesn't balance connections between the sockets.
+func setReusePort(fd uintptr) error {
+	return errors.New("acceptors above 1 are only supported on linux")
+}
@@ -0,0 +1,213 @@
+package lb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	dnsOpcodeUpdate = 5
+	dnsTypeSOA      = 6
+	dnsTypeTSIG     = 250
+	dnsClassANY     = 255
+	tsigFudge       = 300
+
+	tsigHMACSHA256 = "hmac-sha256"
+	tsigHMACSHA512 = "hmac-sha512"
+)
+
+var tsigHashes = map[string]func() hash.Hash{
+	tsigHMACSHA256: sha256.New,
+	tsigHMACSHA512: sha512.New,
+}
+
+// RFC2136Config sends DNS UPDATE messages to server, the primary of zone,
+// signed with a TSIG key when key_name is set.
+type RFC2136Config struct {
+	Server        string `yaml:"server"`
+	Zone          string `yaml:"zone"`
+	KeyName       string `yaml:"key_name"`
+	KeyAlgorithm  string `yaml:"key_algorithm"`
+	KeySecretFile string `yaml:"key_secret_file"`
+}
+
+func (c *RFC2136Config) validate() error {
+	if c.Server == "" || c.Zone == "" {
+		return errors.New("rfc2136 requires server and zone")
+	}
+	_, _, err := net.SplitHostPort(c.Server)
+	if err != nil {
+		return fmt.Errorf("rfc2136 server: %s", err)
+	}
+	if c.KeyName != "" {
+		if c.KeySecretFile == "" {
+			return errors.New("rfc2136 key_name requires key_secret_file")
+		}
+		if c.KeyAlgorithm == "" {
+			c.KeyAlgorithm = tsigHMACSHA256
+		}
+		if tsigHashes[c.KeyAlgorithm] == nil {
+			return fmt.Errorf("rfc2136 key_algorithm must be %s or %s", tsigHMACSHA256, tsigHMACSHA512)
+		}
+	}
+	return nil
+}
+
+// update deletes the A and AAAA records of name and adds one per ip in a
+// single UPDATE, which the server applies atomically. It goes over TCP as
+// large backend sets don't fit a UDP message.
+func (c *RFC2136Config) update(name string, ttl int, ips []net.IP) error {
+	msg := make([]byte, dnsHeaderLen)
+	id := uint16(rand.Intn(1 << 16))
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	msg[2] = dnsOpcodeUpdate << 3
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+
+	msg = append(msg, encodeDNSName(c.Zone)...)
+	msg = appendUint16(msg, dnsTypeSOA)
+	msg = appendUint16(msg, dnsClassIN)
+
+	owner := encodeDNSName(name)
+	updates := 0
+	for _, rtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		// Delete the RRset: class ANY, ttl 0 and no data.
+		msg = append(msg, owner...)
+		msg = appendUint16(msg, rtype)
+		msg = appendUint16(msg, dnsClassANY)
+		msg = append(msg, 0, 0, 0, 0, 0, 0)
+		updates++
+	}
+	for _, ip := range ips {
+		rtype, data := uint16(dnsTypeAAAA), ip.To16()
+		if ip4 := ip.To4(); ip4 != nil {
+			rtype, data = dnsTypeA, ip4
+		}
+		msg = append(msg, owner...)
+		msg = appendUint16(msg, rtype)
+		msg = appendUint16(msg, dnsClassIN)
+		msg = appendUint32(msg, uint32(ttl))
+		msg = appendUint16(msg, uint16(len(data)))
+		msg = append(msg, data...)
+		updates++
+	}
+	binary.BigEndian.PutUint16(msg[8:10], uint16(updates))
+
+	if c.KeyName != "" {
+		var err error
+		msg, err = c.sign(msg, id)
+		if err != nil {
+			return err
+		}
+	}
+	resp, err := exchangeDNSTCP(c.Server, msg)
+	if err != nil {
+		return err
+	}
+	if len(resp) < dnsHeaderLen || binary.BigEndian.Uint16(resp[0:2]) != id {
+		return errors.New("malformed DNS UPDATE response")
+	}
+	if rcode := resp[3] & 0x0f; rcode != dnsRcodeNoError {
+		return fmt.Errorf("DNS UPDATE refused with rcode %d", rcode)
+	}
+	return nil
+}
+
+// sign appends the TSIG record of RFC 8945 to msg.
+func (c *RFC2136Config) sign(msg []byte, id uint16) ([]byte, error) {
+	secret, err := ioutil.ReadFile(c.KeySecretFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(secret)))
+	if err != nil {
+		return nil, fmt.Errorf("key_secret_file is not base64: %s", err)
+	}
+
+	keyName := encodeDNSName(c.KeyName)
+	algorithm := encodeDNSName(c.KeyAlgorithm)
+	now := uint64(time.Now().Unix())
+	signedAt := []byte{byte(now >> 40), byte(now >> 32), byte(now >> 24), byte(now >> 16), byte(now >> 8), byte(now)}
+
+	mac := hmac.New(tsigHashes[c.KeyAlgorithm], key)
+	mac.Write(msg)
+	variables := append([]byte{}, keyName...)
+	variables = appendUint16(variables, dnsClassANY)
+	variables = appendUint32(variables, 0)
+	variables = append(variables, algorithm...)
+	variables = append(variables, signedAt...)
+	variables = appendUint16(variables, tsigFudge)
+	// No error and no other data.
+	variables = append(variables, 0, 0, 0, 0)
+	mac.Write(variables)
+	sum := mac.Sum(nil)
+
+	rdata := append([]byte{}, algorithm...)
+	rdata = append(rdata, signedAt...)
+	rdata = appendUint16(rdata, tsigFudge)
+	rdata = appendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = appendUint16(rdata, id)
+	rdata = append(rdata, 0, 0, 0, 0)
+
+	msg = append(msg, keyName...)
+	msg = appendUint16(msg, dnsTypeTSIG)
+	msg = appendUint16(msg, dnsClassANY)
+	msg = appendUint32(msg, 0)
+	msg = appendUint16(msg, uint16(len(rdata)))
+	msg = append(msg, rdata...)
+	binary.BigEndian.PutUint16(msg[10:12], binary.BigEndian.Uint16(msg[10:12])+1)
+	return msg, nil
+}
+
+func exchangeDNSTCP(server string, msg []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", server, dnsUpdateTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsUpdateTimeout))
+	_, err = conn.Write(appendUint16(nil, uint16(len(msg))))
+	if err == nil {
+		_, err = conn.Write(msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	_, err = io.ReadFull(conn, length[:])
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(conn, resp)
+	return resp, err
+}
+
+// encodeDNSName returns name in wire format, lowercased as TSIG wants it.
+func encodeDNSName(name string) []byte {
+	var encoded []byte
+	for _, label := range strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".") {
+		if label == "" {
+			continue
+		}
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+	return append(encoded, 0)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
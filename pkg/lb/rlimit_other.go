@@ -0,0 +1,6 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package lb
+
+func raiseOpenFileLimit(want uint64) {}
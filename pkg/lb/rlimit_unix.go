@@ -0,0 +1,42 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package lb
+
+import (
+	"log"
+	"syscall"
+)
+
+// raiseOpenFileLimit raises the soft RLIMIT_NOFILE to want, or to the hard
+// limit when want is 0, since every forwarded connection holds two file
+// descriptors and the usual default of 1024 runs out under watch heavy load.
+func raiseOpenFileLimit(want uint64) {
+	var limit syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit)
+	if err != nil {
+		log.Printf("Error reading open file limit: %s", err)
+		return
+	}
+
+	target := limit
+	if want == 0 {
+		target.Cur = limit.Max
+	} else {
+		target.Cur = want
+		if want > limit.Max {
+			target.Max = want
+		}
+	}
+	if target.Cur <= limit.Cur && target.Max == limit.Max {
+		log.Printf("Open file limit is %d (hard %d)", limit.Cur, limit.Max)
+		return
+	}
+
+	err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &target)
+	if err != nil {
+		log.Printf("Error raising open file limit from %d to %d, keeping it: %s", limit.Cur, target.Cur, err)
+		return
+	}
+	log.Printf("Raised open file limit from %d to %d (hard %d)", limit.Cur, target.Cur, target.Max)
+}
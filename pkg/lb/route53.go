@@ -0,0 +1,122 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRoute53Endpoint = "https://route53.amazonaws.com"
+	route53Region          = "us-east-1"
+	route53Service         = "route53"
+	route53XMLNS           = "https://route53.amazonaws.com/doc/2013-04-01/"
+)
+
+// Route53Config upserts the records in a Route53 hosted zone.
+type Route53Config struct {
+	HostedZoneID   string `yaml:"hosted_zone_id"`
+	Endpoint       string `yaml:"endpoint"`
+	AWSCredentials `yaml:",inline"`
+}
+
+func (c *Route53Config) validate() error {
+	if c.HostedZoneID == "" {
+		return errors.New("route53 requires hosted_zone_id")
+	}
+	c.HostedZoneID = strings.TrimPrefix(c.HostedZoneID, "/hostedzone/")
+	err := c.AWSCredentials.validate()
+	if err != nil {
+		return fmt.Errorf("route53 %s", err)
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = defaultRoute53Endpoint
+	}
+	_, err = url.Parse(c.Endpoint)
+	return err
+}
+
+type changeResourceRecordSetsRequest struct {
+	XMLName     xml.Name      `xml:"ChangeResourceRecordSetsRequest"`
+	XMLNS       string        `xml:"xmlns,attr"`
+	ChangeBatch route53Change `xml:"ChangeBatch"`
+}
+
+type route53Change struct {
+	Comment string          `xml:"Comment"`
+	Changes []route53Upsert `xml:"Changes>Change"`
+}
+
+type route53Upsert struct {
+	Action    string           `xml:"Action"`
+	RecordSet route53RecordSet `xml:"ResourceRecordSet"`
+}
+
+type route53RecordSet struct {
+	Name   string   `xml:"Name"`
+	Type   string   `xml:"Type"`
+	TTL    int      `xml:"TTL"`
+	Values []string `xml:"ResourceRecords>ResourceRecord>Value"`
+}
+
+// update upserts the A and AAAA record sets of name. A family without
+// addresses is left as it is: deleting a Route53 record set needs its
+// current values, which the lb does not track.
+func (c *Route53Config) update(name string, ttl int, ips []net.IP) error {
+	req := changeResourceRecordSetsRequest{
+		XMLNS:       route53XMLNS,
+		ChangeBatch: route53Change{Comment: "healthy apiservers"},
+	}
+	v4, v6 := splitFamilies(ips)
+	for _, family := range []struct {
+		rtype string
+		ips   []net.IP
+	}{{"A", v4}, {"AAAA", v6}} {
+		if len(family.ips) == 0 {
+			continue
+		}
+		set := route53RecordSet{Name: name + ".", Type: family.rtype, TTL: ttl}
+		for _, ip := range family.ips {
+			set.Values = append(set.Values, ip.String())
+		}
+		req.ChangeBatch.Changes = append(req.ChangeBatch.Changes, route53Upsert{Action: "UPSERT", RecordSet: set})
+	}
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+
+	httpReq, err := http.NewRequest(http.MethodPost,
+		fmt.Sprintf("%s/2013-04-01/hostedzone/%s/rrset/", strings.TrimSuffix(c.Endpoint, "/"), c.HostedZoneID),
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "text/xml")
+	err = c.sign(httpReq, body, route53Region, route53Service, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: dnsUpdateTimeout}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var awsErr struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		xml.NewDecoder(resp.Body).Decode(&awsErr)
+		return fmt.Errorf("HTTP status code : %d %s %s", resp.StatusCode, awsErr.Code, awsErr.Message)
+	}
+	return nil
+}
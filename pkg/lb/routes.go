@@ -0,0 +1,89 @@
+package lb
+
+import (
+	"errors"
+	"strings"
+)
+
+type RouteConfig struct {
+	PathPrefix string   `yaml:"path_prefix"`
+	Backends   []string `yaml:"backends"`
+	Pool       string   `yaml:"pool"`
+}
+
+func (c RouteConfig) validate() error {
+	if !strings.HasPrefix(c.PathPrefix, "/") {
+		return errors.New("l7 route path_prefix must start with /")
+	}
+	if len(c.Backends) == 0 {
+		return errors.New("l7 route requires backends or pool")
+	}
+	for _, backend := range c.Backends {
+		err := validateServerAddr(backend)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c RouteConfig) matches(path string) bool {
+	if !strings.HasPrefix(path, c.PathPrefix) {
+		return false
+	}
+	return len(path) == len(c.PathPrefix) || strings.HasSuffix(c.PathPrefix, "/") || path[len(c.PathPrefix)] == '/'
+}
+
+// routeBackends returns the backends of the route with the longest matching
+// path prefix, or the default kube_apiservers when no route matches, along
+// with the key healthyLocked caches them under.
+func (lb *apiServerLb) routeBackends(path string) (string, []string) {
+	var matched *RouteConfig
+	for i, route := range lb.l7Config.Routes {
+		if route.matches(path) && (matched == nil || len(route.PathPrefix) > len(matched.PathPrefix)) {
+			matched = &lb.l7Config.Routes[i]
+		}
+	}
+	if matched == nil {
+		return defaultServersKey, lb.remoteServers()
+	}
+	return routeKey(matched.PathPrefix), matched.Backends
+}
+
+// routeKey is the key healthyLocked caches the backends of the route with
+// prefix under, which can't clash with the others as prefixes start with /.
+func routeKey(prefix string) string {
+	return "route " + prefix
+}
+
+// allServers are the backends that get health checked: the default ones plus
+// those only reachable through a route.
+func (lb *apiServerLb) allServers() []string {
+	servers := append([]string{}, lb.remoteServers()...)
+	seen := make(map[string]bool)
+	for _, server := range servers {
+		seen[server] = true
+	}
+	for _, route := range lb.l7Config.Routes {
+		for _, backend := range route.Backends {
+			if !seen[backend] {
+				seen[backend] = true
+				servers = append(servers, backend)
+			}
+		}
+	}
+	return servers
+}
+
+func filterServers(servers []string, allowed []string) []string {
+	filtered := make([]string, 0)
+	for _, server := range servers {
+		for _, a := range allowed {
+			if server == a {
+				filtered = append(filtered, server)
+				break
+			}
+		}
+	}
+	return filtered
+}
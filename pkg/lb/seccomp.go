@@ -0,0 +1,30 @@
+package lb
+
+import "fmt"
+
+const (
+	seccompErrno = "errno"
+	seccompKill  = "kill"
+	seccompLog   = "log"
+)
+
+// SeccompConfig restricts the lb, once its listeners are bound, to the
+// syscalls a proxy needs: sockets, epoll, reading and writing file
+// descriptors and what the Go runtime uses. action is what any other
+// syscall gets: errno fails it with EPERM, kill ends the process, and log
+// only logs it to the audit log, to try the filter out first. Linux amd64
+// and arm64 only.
+type SeccompConfig struct {
+	Action string `yaml:"action"`
+}
+
+func (c *SeccompConfig) validate() error {
+	switch c.Action {
+	case "":
+		c.Action = seccompErrno
+	case seccompErrno, seccompKill, seccompLog:
+	default:
+		return fmt.Errorf("seccomp action must be %s, %s or %s", seccompErrno, seccompKill, seccompLog)
+	}
+	return nil
+}
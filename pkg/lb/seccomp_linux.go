@@ -0,0 +1,194 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package lb
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetNoNewPrivs = 38
+
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSync = 1
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+
+	// Offsets in struct seccomp_data.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+// seccompSyscalls are allowed on every architecture, on top of
+// archSyscalls.
+var seccompSyscalls = []uintptr{
+	// Go runtime: memory, threads, signals, timers and scheduling.
+	syscall.SYS_MMAP,
+	syscall.SYS_MUNMAP,
+	syscall.SYS_MPROTECT,
+	syscall.SYS_MREMAP,
+	syscall.SYS_MADVISE,
+	syscall.SYS_MINCORE,
+	syscall.SYS_BRK,
+	syscall.SYS_CLONE,
+	sysClone3,
+	syscall.SYS_EXIT,
+	syscall.SYS_EXIT_GROUP,
+	syscall.SYS_FUTEX,
+	syscall.SYS_SET_ROBUST_LIST,
+	syscall.SYS_GET_ROBUST_LIST,
+	syscall.SYS_SET_TID_ADDRESS,
+	sysRseq,
+	sysMembarrier,
+	syscall.SYS_RT_SIGACTION,
+	syscall.SYS_RT_SIGPROCMASK,
+	syscall.SYS_RT_SIGRETURN,
+	syscall.SYS_SIGALTSTACK,
+	syscall.SYS_RESTART_SYSCALL,
+	syscall.SYS_GETPID,
+	syscall.SYS_GETPPID,
+	syscall.SYS_GETTID,
+	syscall.SYS_TKILL,
+	syscall.SYS_TGKILL,
+	syscall.SYS_KILL,
+	syscall.SYS_SCHED_YIELD,
+	syscall.SYS_SCHED_GETAFFINITY,
+	syscall.SYS_NANOSLEEP,
+	syscall.SYS_CLOCK_GETTIME,
+	syscall.SYS_CLOCK_GETRES,
+	syscall.SYS_CLOCK_NANOSLEEP,
+	syscall.SYS_GETTIMEOFDAY,
+	syscall.SYS_SETITIMER,
+	syscall.SYS_TIMER_CREATE,
+	syscall.SYS_TIMER_SETTIME,
+	syscall.SYS_TIMER_GETTIME,
+	syscall.SYS_TIMER_DELETE,
+	sysGetrandom,
+	syscall.SYS_UNAME,
+	syscall.SYS_SYSINFO,
+	syscall.SYS_GETRLIMIT,
+	syscall.SYS_PRLIMIT64,
+	syscall.SYS_GETRUSAGE,
+	syscall.SYS_GETUID,
+	syscall.SYS_GETEUID,
+	syscall.SYS_GETGID,
+	syscall.SYS_GETEGID,
+
+	// Polling.
+	syscall.SYS_EPOLL_CREATE1,
+	syscall.SYS_EPOLL_CTL,
+	syscall.SYS_EPOLL_PWAIT,
+	sysEpollPwait2,
+	syscall.SYS_PPOLL,
+	syscall.SYS_PSELECT6,
+	syscall.SYS_EVENTFD2,
+	syscall.SYS_PIPE2,
+
+	// File descriptors, and the files read at runtime: certificates,
+	// tokens and the event record.
+	syscall.SYS_READ,
+	syscall.SYS_WRITE,
+	syscall.SYS_READV,
+	syscall.SYS_WRITEV,
+	syscall.SYS_PREAD64,
+	syscall.SYS_PWRITE64,
+	syscall.SYS_CLOSE,
+	syscall.SYS_DUP,
+	syscall.SYS_DUP3,
+	syscall.SYS_FCNTL,
+	syscall.SYS_IOCTL,
+	syscall.SYS_LSEEK,
+	syscall.SYS_FSTAT,
+	sysStatx,
+	syscall.SYS_OPENAT,
+	syscall.SYS_READLINKAT,
+	syscall.SYS_GETDENTS64,
+	syscall.SYS_GETCWD,
+	syscall.SYS_FSYNC,
+	syscall.SYS_FDATASYNC,
+	syscall.SYS_FTRUNCATE,
+	syscall.SYS_RENAMEAT,
+	syscall.SYS_UNLINKAT,
+	syscall.SYS_FCHMODAT,
+	syscall.SYS_FCHMOD,
+
+	// Sockets, for the listeners, backends, probes, netlink, VRRP and
+	// the admin API.
+	syscall.SYS_SOCKET,
+	syscall.SYS_SOCKETPAIR,
+	syscall.SYS_CONNECT,
+	syscall.SYS_ACCEPT,
+	syscall.SYS_ACCEPT4,
+	syscall.SYS_BIND,
+	syscall.SYS_LISTEN,
+	syscall.SYS_SHUTDOWN,
+	syscall.SYS_GETSOCKNAME,
+	syscall.SYS_GETPEERNAME,
+	syscall.SYS_SETSOCKOPT,
+	syscall.SYS_GETSOCKOPT,
+	syscall.SYS_SENDTO,
+	syscall.SYS_RECVFROM,
+	syscall.SYS_SENDMSG,
+	syscall.SYS_RECVMSG,
+
+	// sockmap, which adds every forwarded connection to its BPF map.
+	sysBPF,
+}
+
+// seccompFilter is a BPF program returning action for any syscall missing
+// from the allowlist, and killing the process for a foreign architecture
+// whose syscall numbers mean something else.
+func seccompFilter(action uint32) []syscall.SockFilter {
+	allowed := append(append([]uintptr{}, seccompSyscalls...), archSyscalls...)
+	filter := []syscall.SockFilter{
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: seccompDataArch},
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 1, K: auditArch},
+		{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetKillProcess},
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: seccompDataNr},
+	}
+	for _, nr := range allowed {
+		filter = append(filter,
+			syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jf: 1, K: uint32(nr)},
+			syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetAllow})
+	}
+	return append(filter, syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: action})
+}
+
+// applySeccomp installs the filter on every thread of the process. It
+// can't be removed, and is inherited by the processes the lb starts.
+func applySeccomp(config SeccompConfig) error {
+	action := uint32(seccompRetErrno | uint32(syscall.EPERM))
+	switch config.Action {
+	case seccompKill:
+		action = seccompRetKillProcess
+	case seccompLog:
+		action = seccompRetLog
+	}
+	filter := seccompFilter(action)
+	program := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// no_new_privs and the filter are set on this thread, TSYNC copies
+	// both to the others.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0)
+	if errno != 0 {
+		return errno
+	}
+	thread, _, errno := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTSync, uintptr(unsafe.Pointer(&program)))
+	if errno != 0 {
+		return errno
+	}
+	if thread != 0 {
+		return fmt.Errorf("thread %d could not take the filter", thread)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package lb
+
+import "syscall"
+
+// Syscall numbers missing from the syscall package.
+const (
+	auditArch = 0xc000003e // AUDIT_ARCH_X86_64
+
+	sysSeccomp     = 317
+	sysGetrandom   = 318
+	sysMembarrier  = 324
+	sysStatx       = 332
+	sysRseq        = 334
+	sysClone3      = 435
+	sysEpollPwait2 = 441
+	sysBPF         = 321
+)
+
+// archSyscalls are the legacy syscalls amd64 still has and Go uses.
+var archSyscalls = []uintptr{
+	syscall.SYS_ARCH_PRCTL,
+	syscall.SYS_EPOLL_CREATE,
+	syscall.SYS_EPOLL_WAIT,
+	syscall.SYS_POLL,
+	syscall.SYS_SELECT,
+	syscall.SYS_PIPE,
+	syscall.SYS_DUP2,
+	syscall.SYS_OPEN,
+	syscall.SYS_STAT,
+	syscall.SYS_LSTAT,
+	syscall.SYS_NEWFSTATAT,
+	syscall.SYS_READLINK,
+	syscall.SYS_GETDENTS,
+	syscall.SYS_RENAME,
+	syscall.SYS_UNLINK,
+	syscall.SYS_CHMOD,
+	syscall.SYS_TIME,
+}
@@ -0,0 +1,22 @@
+package lb
+
+import "syscall"
+
+// Syscall numbers missing from the syscall package.
+const (
+	auditArch = 0xc00000b7 // AUDIT_ARCH_AARCH64
+
+	sysSeccomp     = syscall.SYS_SECCOMP
+	sysGetrandom   = syscall.SYS_GETRANDOM
+	sysMembarrier  = 283
+	sysStatx       = 291
+	sysRseq        = 293
+	sysClone3      = 435
+	sysEpollPwait2 = 441
+	sysBPF         = syscall.SYS_BPF
+)
+
+// archSyscalls are the arm64 names of syscalls amd64 has under another.
+var archSyscalls = []uintptr{
+	syscall.SYS_FSTATAT,
+}
@@ -0,0 +1,126 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package lb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lumasepa/kube-apiserver-lb/pkg/mockserver"
+)
+
+// seccompChildEnv makes TestSeccompForwards run the lb itself, in the
+// process it starts, as the filter can't be removed once applied.
+const seccompChildEnv = "LB_TEST_SECCOMP_CHILD"
+
+// The lb must keep forwarding under the filter with action kill, which
+// ends the process on the first syscall missing from the allowlist, with
+// sockmap too when the kernel lets the test create its maps.
+func TestSeccompForwards(t *testing.T) {
+	if config := os.Getenv(seccompChildEnv); config != "" {
+		forwardUnderSeccomp(t, config)
+		return
+	}
+	configs := map[string]string{"plain": "sockmap: false"}
+	if s, err := newSockmap(); err == nil {
+		s.close()
+		configs["sockmap"] = "sockmap: true"
+	} else {
+		t.Logf("not trying sockmap: %s", err)
+	}
+	for name, config := range configs {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSeccompForwards$", "-test.v")
+		cmd.Env = append(os.Environ(), seccompChildEnv+"="+config)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("lb under the seccomp filter failed, %s: %s\n%s", name, err, out)
+		}
+		if !strings.Contains(string(out), "Applied the seccomp filter") {
+			t.Fatalf("the seccomp filter was not applied, %s:\n%s", name, out)
+		}
+	}
+}
+
+// forwardUnderSeccomp runs the lb with config, some more yaml, added to
+// its configuration.
+func forwardUnderSeccomp(t *testing.T, config string) {
+	dir := t.TempDir()
+	pki, err := mockserver.NewPKI(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiserver, err := mockserver.NewAPIServer(pki, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apiserver.Close()
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.Addr().String()
+	probe.Close()
+
+	path := filepath.Join(dir, "config.yaml")
+	data := fmt.Sprintf(`kube_apiservers: [%s]
+listen_addr: %s
+shutdown_timeout: 1
+health_check: {check_period: 1}
+tls:
+  ca_file: %s
+seccomp: {action: kill}
+%s
+`, apiserver.Addr, addr, pki.CAFile, config)
+	err = ioutil.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lbConfig, err := ReadConfiguration(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(lbConfig, Options{}, shutdown)
+	}()
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: pki.ClientTLSConfig(), DisableKeepAlives: true},
+		Timeout:   time.Second,
+	}
+	var name string
+	deadline := time.Now().Add(5 * time.Second)
+	for name == "" && time.Now().Before(deadline) {
+		resp, err := client.Get("https://" + addr + "/api")
+		if err != nil {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		resp.Body.Close()
+		name = resp.Header.Get(mockserver.BackendHeader)
+	}
+	if name != "a" {
+		t.Errorf("no request was forwarded to a under the seccomp filter")
+	}
+
+	close(shutdown)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("lb stopped with: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("lb did not stop")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package lb
+
+import "errors"
+
+func applySeccomp(config SeccompConfig) error {
+	return errors.New("seccomp is only supported on linux amd64 and arm64")
+}
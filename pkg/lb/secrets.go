@@ -0,0 +1,120 @@
+package lb
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+)
+
+const (
+	secretPermissionsEnforce = "enforce"
+	secretPermissionsWarn    = "warn"
+	secretPermissionsOff     = "off"
+)
+
+// secretFiles lists the private keys, tokens and secrets the configuration
+// reads.
+func (c *Configuration) secretFiles() []string {
+	var files []string
+	add := func(paths ...string) {
+		for _, path := range paths {
+			if path != "" {
+				files = append(files, path)
+			}
+		}
+	}
+	add(c.TLS.KeyFile, c.TLS.ClientKeyFile)
+	if c.TLS.Vault != nil {
+		add(c.TLS.Vault.TokenFile)
+	}
+	healthChecks := []*HealthCheck{}
+	for _, listener := range c.listeners() {
+		healthChecks = append(healthChecks, &listener.HealthCheck)
+	}
+	for i := range c.Pools {
+		if c.Pools[i].HealthCheck != nil {
+			healthChecks = append(healthChecks, c.Pools[i].HealthCheck)
+		}
+	}
+	for _, check := range healthChecks {
+		add(check.TokenFile)
+		if check.TLS != nil {
+			add(check.TLS.KeyFile)
+		}
+	}
+	if c.AdminTLS != nil {
+		add(c.AdminTLS.KeyFile)
+	}
+	if c.AdminAuth != nil {
+		add(c.AdminAuth.ReadTokenFiles...)
+		add(c.AdminAuth.AdminTokenFiles...)
+		add(c.AdminAuth.PeerTokenFile)
+	}
+	if c.LeaderElection != nil {
+		add(c.LeaderElection.TokenFile)
+	}
+	if c.DNSUpdate != nil {
+		if c.DNSUpdate.RFC2136 != nil {
+			add(c.DNSUpdate.RFC2136.KeySecretFile)
+		}
+		if c.DNSUpdate.Route53 != nil {
+			add(c.DNSUpdate.Route53.SecretAccessKeyFile)
+		}
+	}
+	if c.TargetSync != nil {
+		if c.TargetSync.AWS != nil {
+			add(c.TargetSync.AWS.SecretAccessKeyFile)
+		}
+		if c.TargetSync.GCP != nil {
+			add(c.TargetSync.GCP.TokenFile)
+		}
+	}
+	return files
+}
+
+// checkSecretFiles refuses secret files that others than their owner can
+// read or write, like sshd does for private keys, and files owned by
+// someone else than root or the users in owners, who could swap them. With
+// secret_file_permissions warn the problems are only logged. Permissions
+// mean nothing on windows, where nothing is checked.
+func checkSecretFiles(files []string, enforcement string, owners []int) error {
+	if enforcement == secretPermissionsOff || runtime.GOOS == "windows" {
+		return nil
+	}
+	var problems []string
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			// Missing files are reported by whatever reads them.
+			continue
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			problems = append(problems, fmt.Sprintf("%s has permissions %04o, accessible to group or others", path, info.Mode().Perm()))
+		}
+		owner, ok := fileOwner(info)
+		if ok && owner != 0 && !containsInt(owners, owner) {
+			problems = append(problems, fmt.Sprintf("%s is owned by uid %d, not root or the lb user", path, owner))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	if enforcement == secretPermissionsEnforce {
+		return fmt.Errorf("unsafe secret files: %s", strings.Join(problems, "; "))
+	}
+	for _, problem := range problems {
+		log.Printf("Warning: %s, set secret_file_permissions: enforce to refuse it", problem)
+	}
+	return nil
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
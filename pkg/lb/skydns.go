@@ -0,0 +1,124 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const defaultSkyDNSPrefix = "/skydns"
+
+// SkyDNSConfig writes the records to the etcd backend of the CoreDNS etcd
+// plugin, through the JSON gateway of etcd v3.
+type SkyDNSConfig struct {
+	Endpoints []string        `yaml:"endpoints"`
+	Prefix    string          `yaml:"prefix"`
+	TLS       *HealthCheckTLS `yaml:"tls"`
+}
+
+func (c *SkyDNSConfig) validate() error {
+	if len(c.Endpoints) == 0 {
+		return errors.New("coredns_etcd requires endpoints")
+	}
+	if c.Prefix == "" {
+		c.Prefix = defaultSkyDNSPrefix
+	}
+	c.Prefix = "/" + strings.Trim(c.Prefix, "/")
+	if c.TLS != nil {
+		return c.TLS.validate()
+	}
+	return nil
+}
+
+// skyDNSRecord is the value CoreDNS reads from etcd.
+type skyDNSRecord struct {
+	Host string `json:"host"`
+	TTL  int    `json:"ttl"`
+}
+
+type etcdTxn struct {
+	Success []etcdOp `json:"success"`
+}
+
+type etcdOp struct {
+	RequestPut         *etcdKeyValue `json:"request_put,omitempty"`
+	RequestDeleteRange *etcdKeyRange `json:"request_delete_range,omitempty"`
+}
+
+// Keys and values are bytes, which the gateway wants base64 encoded as
+// encoding/json does.
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdKeyRange struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end"`
+}
+
+// path is the etcd directory of name, its labels reversed under the prefix
+// as SkyDNS lays them out.
+func (c *SkyDNSConfig) path(name string) string {
+	labels := strings.Split(name, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return c.Prefix + "/" + strings.Join(labels, "/") + "/"
+}
+
+// update replaces every record under the directory of name with one per ip,
+// in a single transaction so CoreDNS never sees a partial set.
+func (c *SkyDNSConfig) update(name string, ttl int, ips []net.IP) error {
+	dir := c.path(name)
+	end := []byte(dir)
+	end[len(end)-1]++
+	txn := etcdTxn{Success: []etcdOp{{RequestDeleteRange: &etcdKeyRange{Key: []byte(dir), RangeEnd: end}}}}
+	for i, ip := range ips {
+		value, err := json.Marshal(skyDNSRecord{Host: ip.String(), TTL: ttl})
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%sx%d", dir, i+1)
+		txn.Success = append(txn.Success, etcdOp{RequestPut: &etcdKeyValue{Key: []byte(key), Value: value}})
+	}
+	body, err := json.Marshal(txn)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: dnsUpdateTimeout}
+	if c.TLS != nil {
+		client, err = c.TLS.httpClient(tlsPolicy{}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	for _, endpoint := range c.Endpoints {
+		err = postEtcdTxn(client, endpoint, body)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func postEtcdTxn(client *http.Client, endpoint string, body []byte) error {
+	resp, err := client.Post(strings.TrimSuffix(endpoint, "/")+"/v3/kv/txn", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var status struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		return fmt.Errorf("etcd %s: HTTP status code : %d %s", endpoint, resp.StatusCode, status.Message)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package lb
+
+import (
+	"log"
+	"net"
+)
+
+var sockmapConnectionsTotal = newCounter("sockmap_connections_total",
+	"Forwarded connections of sockmap listeners whose bytes the kernel forwards (offloaded), or the lb as it couldn't offload them (fallback).",
+	"listener", "result")
+
+// offload hands the bytes between local and remote to the kernel on a
+// listener with sockmap. The lb then only sees their EOF, and its copy loop
+// tears the connection down as usual, draining the pair before each
+// half-close. It returns nil otherwise, or when the connection can't be
+// offloaded, which leaves it to the copy loop.
+func (lb *apiServerLb) offload(local net.Conn, remote net.Conn) *sockmapPair {
+	if lb.sockmap == nil {
+		return nil
+	}
+	pair, err := lb.sockmap.offload(local, remote)
+	if err != nil {
+		sockmapConnectionsTotal.inc(lb.name, "fallback")
+		log.Printf("Error offloading %s -> %s to the sockmap, forwarding it in userspace: %s", local.RemoteAddr(), remote.RemoteAddr(), err)
+		return nil
+	}
+	sockmapConnectionsTotal.inc(lb.name, "offloaded")
+	return pair
+}
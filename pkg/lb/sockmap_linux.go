@@ -0,0 +1,410 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package lb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	bpfCmdMapCreate     = 0
+	bpfCmdMapLookupElem = 1
+	bpfCmdMapUpdateElem = 2
+	bpfCmdMapDeleteElem = 3
+	bpfCmdProgLoad      = 5
+	bpfCmdProgAttach    = 8
+
+	bpfMapTypeHash     = 1
+	bpfMapTypeSockhash = 18
+	bpfProgTypeSKSKB   = 14
+	bpfSKSKBVerdict    = 38
+
+	// Helpers called by the verdict program.
+	bpfFuncMapLookupElem    = 1
+	bpfFuncGetSocketCookie  = 46
+	bpfFuncSKRedirectHash   = 72
+	skPass                  = 1
+	bpfPseudoMapFD          = 1
+	soCookie                = 0x39
+	sockmapMaxEntries       = 65536
+	sockmapVerifierLogBytes = 64 * 1024
+
+	// tcpInfoBytesAcked is the offset of tcpi_bytes_acked in struct
+	// tcp_info, past the fields of syscall.TCPInfo.
+	tcpInfoBytesAcked = 120
+	tcpInfoSize       = 136
+	sioCOutQ          = syscall.TIOCOUTQ
+
+	sockmapDrainPoll = 10 * time.Millisecond
+)
+
+// eBPF opcodes, on top of the classic ones of the syscall package.
+const (
+	ebpfALU64 = 0x07
+	ebpfDW    = 0x18
+	ebpfMov   = 0xb0
+	ebpfCall  = 0x80
+	ebpfExit  = 0x90
+	// ebpfAtomic with imm BPF_ADD is a lock add.
+	ebpfAtomic = 0xc0
+)
+
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+func insn(code uint8, dst uint8, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code: code, regs: dst | src<<4, off: off, imm: imm}
+}
+
+// sockmap holds the maps and the verdict program: socks has the sockets of
+// the offloaded connections, by socket cookie, and peers the peerValue of
+// each one.
+type sockmap struct {
+	peers int
+	socks int
+	prog  int
+}
+
+// newSockmap loads the verdict program, which redirects every skb received
+// by a socket of socks to the egress of its peer, or leaves it to the
+// socket when it has no peer. It needs CAP_NET_ADMIN, so it runs before
+// the lb drops its privileges, and kernel 5.13 or later.
+func newSockmap() (*sockmap, error) {
+	peers, err := bpfMapCreate(bpfMapTypeHash, 8, uint32(unsafe.Sizeof(peerValue{})))
+	if err != nil {
+		return nil, fmt.Errorf("creating the peers map: %s", err)
+	}
+	socks, err := bpfMapCreate(bpfMapTypeSockhash, 8, 4)
+	if err != nil {
+		syscall.Close(peers)
+		return nil, fmt.Errorf("creating the sockhash: %s", err)
+	}
+	s := &sockmap{peers: peers, socks: socks}
+	s.prog, err = bpfVerdictLoad(peers, socks)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	attach := struct {
+		targetFD    uint32
+		attachBPFFD uint32
+		attachType  uint32
+		attachFlags uint32
+	}{targetFD: uint32(socks), attachBPFFD: uint32(s.prog), attachType: bpfSKSKBVerdict}
+	_, err = bpf(bpfCmdProgAttach, unsafe.Pointer(&attach), unsafe.Sizeof(attach))
+	if err != nil {
+		s.close()
+		return nil, fmt.Errorf("attaching the verdict program: %s", err)
+	}
+	return s, nil
+}
+
+// peerValue is the value of peers: the cookie of the socket the bytes go
+// to, and how many were redirected to it.
+type peerValue struct {
+	cookie     uint64
+	redirected uint64
+}
+
+func (s *sockmap) close() {
+	for _, fd := range []int{s.prog, s.socks, s.peers} {
+		if fd > 0 {
+			syscall.Close(fd)
+		}
+	}
+}
+
+// bpf calls the bpf syscall. The pointers in attr are unsafe.Pointer fields,
+// 64 bits wide on the architectures supported, so that the runtime keeps
+// track of them.
+func bpf(cmd uintptr, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := syscall.Syscall(sysBPF, cmd, uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+func bpfMapCreate(mapType uint32, keySize uint32, valueSize uint32) (int, error) {
+	attr := struct {
+		mapType    uint32
+		keySize    uint32
+		valueSize  uint32
+		maxEntries uint32
+	}{mapType: mapType, keySize: keySize, valueSize: valueSize, maxEntries: sockmapMaxEntries}
+	return bpf(bpfCmdMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func bpfMapUpdate(mapFD int, key uint64, value unsafe.Pointer) error {
+	attr := struct {
+		mapFD uint32
+		_     uint32
+		key   unsafe.Pointer
+		value unsafe.Pointer
+		flags uint64
+	}{mapFD: uint32(mapFD), key: unsafe.Pointer(&key), value: value}
+	_, err := bpf(bpfCmdMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func bpfMapLookup(mapFD int, key uint64, value unsafe.Pointer) error {
+	attr := struct {
+		mapFD uint32
+		_     uint32
+		key   unsafe.Pointer
+		value unsafe.Pointer
+	}{mapFD: uint32(mapFD), key: unsafe.Pointer(&key), value: value}
+	_, err := bpf(bpfCmdMapLookupElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func bpfMapDelete(mapFD int, key uint64) {
+	attr := struct {
+		mapFD uint32
+		_     uint32
+		key   unsafe.Pointer
+	}{mapFD: uint32(mapFD), key: unsafe.Pointer(&key)}
+	bpf(bpfCmdMapDeleteElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// bpfVerdictLoad loads the SK_SKB verdict program below. Empty skbs, like
+// the one of a FIN, are left to the socket so that the lb sees the EOF, as
+// the kernel takes sending nothing to the peer for a broken pipe.
+//
+//	if (!skb->len) return SK_PASS
+//	cookie = bpf_get_socket_cookie(skb)
+//	peer = bpf_map_lookup_elem(&peers, &cookie)
+//	if (!peer) return SK_PASS
+//	__sync_fetch_and_add(&peer->redirected, skb->len)
+//	return bpf_sk_redirect_hash(skb, &socks, &peer->cookie, 0)
+func bpfVerdictLoad(peers int, socks int) (int, error) {
+	const (
+		r0, r1, r2, r3, r4, r6, r10 = 0, 1, 2, 3, 4, 6, 10
+		stx                         = syscall.BPF_STX | syscall.BPF_MEM | ebpfDW
+		ldx                         = syscall.BPF_LDX | syscall.BPF_MEM | ebpfDW
+		ldxW                        = syscall.BPF_LDX | syscall.BPF_MEM | syscall.BPF_W
+		xadd                        = syscall.BPF_STX | ebpfAtomic | ebpfDW
+		ldImm64                     = syscall.BPF_LD | syscall.BPF_IMM | ebpfDW
+		movReg                      = ebpfALU64 | ebpfMov | syscall.BPF_X
+		movImm                      = ebpfALU64 | ebpfMov | syscall.BPF_K
+		addImm                      = ebpfALU64 | syscall.BPF_ADD | syscall.BPF_K
+		jeqImm                      = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+		call                        = syscall.BPF_JMP | ebpfCall
+		exit                        = syscall.BPF_JMP | ebpfExit
+	)
+	program := []bpfInsn{
+		insn(ldxW, r2, r1, 0, 0),
+		insn(jeqImm, r2, 0, 21, 0),
+		insn(movReg, r6, r1, 0, 0),
+		insn(call, 0, 0, 0, bpfFuncGetSocketCookie),
+		insn(stx, r10, r0, -8, 0),
+		insn(movReg, r2, r10, 0, 0),
+		insn(addImm, r2, 0, 0, -8),
+		insn(ldImm64, r1, bpfPseudoMapFD, 0, int32(peers)), insn(0, 0, 0, 0, 0),
+		insn(call, 0, 0, 0, bpfFuncMapLookupElem),
+		insn(jeqImm, r0, 0, 12, 0),
+		insn(ldxW, r1, r6, 0, 0),
+		insn(xadd, r0, r1, 8, syscall.BPF_ADD),
+		insn(ldx, r0, r0, 0, 0),
+		insn(stx, r10, r0, -16, 0),
+		insn(movReg, r1, r6, 0, 0),
+		insn(ldImm64, r2, bpfPseudoMapFD, 0, int32(socks)), insn(0, 0, 0, 0, 0),
+		insn(movReg, r3, r10, 0, 0),
+		insn(addImm, r3, 0, 0, -16),
+		insn(movImm, r4, 0, 0, 0),
+		insn(call, 0, 0, 0, bpfFuncSKRedirectHash),
+		insn(exit, 0, 0, 0, 0),
+		insn(movImm, r0, 0, 0, skPass),
+		insn(exit, 0, 0, 0, 0),
+	}
+	license := []byte("GPL\x00")
+	verifierLog := make([]byte, sockmapVerifierLogBytes)
+	attr := struct {
+		progType uint32
+		insnCnt  uint32
+		insns    unsafe.Pointer
+		license  unsafe.Pointer
+		logLevel uint32
+		logSize  uint32
+		logBuf   unsafe.Pointer
+	}{
+		progType: bpfProgTypeSKSKB,
+		insnCnt:  uint32(len(program)),
+		insns:    unsafe.Pointer(&program[0]),
+		license:  unsafe.Pointer(&license[0]),
+		logLevel: 1,
+		logSize:  uint32(len(verifierLog)),
+		logBuf:   unsafe.Pointer(&verifierLog[0]),
+	}
+	fd, err := bpf(bpfCmdProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("loading the verdict program: %s %s", err, cString(verifierLog))
+	}
+	return fd, nil
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// socketCookie is the SO_COOKIE of fd, the key of the maps.
+func socketCookie(fd uintptr) (uint64, error) {
+	var cookie uint64
+	size := uint32(unsafe.Sizeof(cookie))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_SOCKET, soCookie,
+		uintptr(unsafe.Pointer(&cookie)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return cookie, nil
+}
+
+// socketControl runs f on the file descriptor of conn.
+func socketControl(conn net.Conn, f func(fd uintptr)) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("%T is not a socket", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return raw.Control(f)
+}
+
+// insert adds conn to socks, returning its cookie.
+func (s *sockmap) insert(conn net.Conn) (uint64, error) {
+	var cookie uint64
+	var insertErr error
+	err := socketControl(conn, func(fd uintptr) {
+		cookie, insertErr = socketCookie(fd)
+		if insertErr != nil {
+			return
+		}
+		value := uint32(fd)
+		insertErr = bpfMapUpdate(s.socks, cookie, unsafe.Pointer(&value))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return cookie, insertErr
+}
+
+// sockmapPair is an offloaded connection. Its methods do nothing on a nil
+// sockmapPair.
+type sockmapPair struct {
+	s            *sockmap
+	local        net.Conn
+	localCookie  uint64
+	remoteCookie uint64
+}
+
+// offload has the kernel forward the bytes between local and remote from
+// now on. The sockets only see what the verdict program leaves them, which
+// is their EOF, and bytes that arrive while the pair is only half set up.
+// Sockets leave socks on their own when closed.
+func (s *sockmap) offload(local net.Conn, remote net.Conn) (*sockmapPair, error) {
+	localCookie, err := s.insert(local)
+	if err != nil {
+		return nil, err
+	}
+	remoteCookie, err := s.insert(remote)
+	if err != nil {
+		bpfMapDelete(s.socks, localCookie)
+		return nil, err
+	}
+	pair := &sockmapPair{s: s, local: local, localCookie: localCookie, remoteCookie: remoteCookie}
+	err = bpfMapUpdate(s.peers, localCookie, unsafe.Pointer(&peerValue{cookie: remoteCookie}))
+	if err == nil {
+		err = bpfMapUpdate(s.peers, remoteCookie, unsafe.Pointer(&peerValue{cookie: localCookie}))
+	}
+	if err != nil {
+		pair.remove()
+		bpfMapDelete(s.socks, localCookie)
+		bpfMapDelete(s.socks, remoteCookie)
+		if errors.Is(err, syscall.E2BIG) {
+			return nil, errors.New("sockmap is full")
+		}
+		return nil, err
+	}
+	return pair, nil
+}
+
+// remove forgets the pair once both sockets are closed.
+func (p *sockmapPair) remove() {
+	if p == nil {
+		return
+	}
+	bpfMapDelete(p.s.peers, p.localCookie)
+	bpfMapDelete(p.s.peers, p.remoteCookie)
+}
+
+// drain waits, after reader reached EOF, for writer to have taken every
+// byte redirected from reader and the copied ones the lb forwarded itself.
+// The kernel queues the redirected bytes until writer has room for them,
+// and would drop those left when writer is half-closed. It returns early
+// once the sockets are closed.
+func (p *sockmapPair) drain(reader net.Conn, writer net.Conn, copied int64) {
+	if p == nil {
+		return
+	}
+	cookie := p.remoteCookie
+	if reader == p.local {
+		cookie = p.localCookie
+	}
+	var value peerValue
+	if bpfMapLookup(p.s.peers, cookie, unsafe.Pointer(&value)) != nil {
+		return
+	}
+	want := value.redirected + uint64(copied)
+	for {
+		written, err := bytesWritten(writer)
+		if err != nil || written >= want {
+			return
+		}
+		time.Sleep(sockmapDrainPoll)
+	}
+}
+
+// bytesWritten is how many bytes were written to the TCP socket of conn:
+// those acknowledged by the peer and those still in its send queue.
+func bytesWritten(conn net.Conn) (uint64, error) {
+	var info [tcpInfoSize]byte
+	var outq int32
+	var errno syscall.Errno
+	err := socketControl(conn, func(fd uintptr) {
+		size := uint32(len(info))
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info[0])), uintptr(unsafe.Pointer(&size)), 0)
+		if errno == 0 && size < tcpInfoSize {
+			errno = syscall.ENOPROTOOPT
+		}
+		if errno == 0 {
+			_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, sioCOutQ, uintptr(unsafe.Pointer(&outq)))
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return binary.LittleEndian.Uint64(info[tcpInfoBytesAcked:]) + uint64(outq), nil
+}
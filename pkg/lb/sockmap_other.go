@@ -0,0 +1,25 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package lb
+
+import (
+	"errors"
+	"net"
+)
+
+type sockmap struct{}
+
+type sockmapPair struct{}
+
+func newSockmap() (*sockmap, error) {
+	return nil, errors.New("sockmap is only supported on linux amd64 and arm64")
+}
+
+func (s *sockmap) offload(local net.Conn, remote net.Conn) (*sockmapPair, error) {
+	return nil, errors.New("sockmap is not supported")
+}
+
+func (p *sockmapPair) remove() {}
+
+func (p *sockmapPair) drain(reader net.Conn, writer net.Conn, copied int64) {}
@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package lb
+
+import "syscall"
+
+func setReuseAddr(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
@@ -0,0 +1,7 @@
+package lb
+
+// setReuseAddr is a no-op on Windows, where SO_REUSEADDR lets another
+// process steal a port that is actively listened on.
+func setReuseAddr(fd uintptr) error {
+	return nil
+}
@@ -0,0 +1,68 @@
+package lb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+const spiffeInitialFetchTimeout = 30 * time.Second
+
+type SPIFFEConfig struct {
+	SocketPath string `yaml:"socket_path"`
+}
+
+// spiffeSource keeps the X509-SVID and trust bundle of the LB up to date by
+// streaming them from the Workload API, so rotated SVIDs are used as soon as
+// the agent issues them.
+type spiffeSource struct {
+	source *workloadapi.X509Source
+}
+
+func newSPIFFESource(config SPIFFEConfig) (*spiffeSource, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), spiffeInitialFetchTimeout)
+	defer cancel()
+
+	source, err := workloadapi.NewX509Source(ctx,
+		workloadapi.WithClientOptions(workloadapi.WithAddr(config.SocketPath)))
+	if err != nil {
+		return nil, err
+	}
+	return &spiffeSource{source: source}, nil
+}
+
+func (s *spiffeSource) certificate() (*tls.Certificate, error) {
+	svid, err := s.source.GetX509SVID()
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		PrivateKey: svid.PrivateKey,
+		Leaf:       svid.Certificates[0],
+	}
+	for _, c := range svid.Certificates {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
+}
+
+func (s *spiffeSource) rootCAs() (*x509.CertPool, error) {
+	svid, err := s.source.GetX509SVID()
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := s.source.GetX509BundleForTrustDomain(svid.ID.TrustDomain())
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	for _, cert := range bundle.X509Authorities() {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
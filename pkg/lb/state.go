@@ -0,0 +1,490 @@
+package lb
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	onNoHealthyFailOpen = "fail_open"
+	onNoHealthyReject   = "reject"
+	onNoHealthyQueue    = "queue"
+
+	// The keys healthyLocked caches the default backends and all of them
+	// under, routes use routeKey.
+	defaultServersKey = "default"
+	allServersKey     = "all"
+)
+
+var (
+	errNoHealthy       = errors.New("no remote servers are healthy")
+	errBelowMinHealthy = errors.New("fewer remote servers than min_healthy_to_serve are healthy")
+)
+
+var (
+	noHealthyTotal = newCounter("no_healthy_backends_total",
+		"Backend selections that found no healthy backend, by the on_no_healthy policy applied.", "policy")
+	servingGauge = newGauge("serving",
+		"1 when enough backends are healthy to serve according to min_healthy_to_serve.")
+)
+
+type probeResult struct {
+	server string
+	err    error
+	// shuttingDown is set when the apiserver's shutdown readyz check fails,
+	// i.e. it is in graceful termination.
+	shuttingDown bool
+}
+
+// publishLatest hands results to the consumer of ch, a channel with a buffer
+// of one, without ever blocking the prober: a snapshot the consumer has not
+// picked up yet is replaced by the fresher one, and goes back to free.
+func publishLatest(ch chan []probeResult, results []probeResult, free probeBuffers) {
+	for {
+		select {
+		case ch <- results:
+			return
+		default:
+		}
+		select {
+		case stale := <-ch:
+			free.put(stale)
+		default:
+		}
+	}
+}
+
+// probeBuffers is a free list of the result slices of the health check
+// sweeps, which the consumer puts back once it applied them. Its methods
+// allocate and drop slices on a nil probeBuffers.
+type probeBuffers chan []probeResult
+
+func newProbeBuffers() probeBuffers {
+	// One being filled, one waiting in the results channel and one being
+	// applied.
+	return make(probeBuffers, 3)
+}
+
+func (b probeBuffers) get() []probeResult {
+	select {
+	case results := <-b:
+		return results[:0]
+	default:
+		return make([]probeResult, 0)
+	}
+}
+
+func (b probeBuffers) put(results []probeResult) {
+	select {
+	case b <- results:
+	default:
+	}
+}
+
+type backendState struct {
+	healthy bool
+	// ejectedUntil keeps an outlier out of rotation regardless of its
+	// health checks.
+	ejectedUntil  time.Time
+	successes     int
+	failures      int
+	outstanding   int64
+	upThreshold   int
+	downThreshold int
+}
+
+// lbState is shared by the accept loop, the health checks and, in L7 mode,
+// every request goroutine. All of it is guarded by mu except the outstanding
+// counters, which are updated atomically on the request path.
+type lbState struct {
+	onNoHealthy string
+	minHealthy  int
+
+	mu       sync.Mutex
+	servers  []string
+	backends map[string]*backendState
+	balancer Balancer
+	serving  bool
+	// recovered is closed and replaced whenever a backend becomes healthy
+	// or the min_healthy_to_serve gate opens.
+	recovered chan struct{}
+	// onUnhealthy, when set, is run in its own goroutine every time a
+	// backend goes from healthy to unhealthy.
+	onUnhealthy func(server string)
+	// onShutdown, when set, is run in its own goroutine when a backend
+	// reports that it is shutting down.
+	onShutdown func(server string)
+	// topology, when set, narrows the picks to the closest healthy backends.
+	topology *TopologyConfig
+	// versions, when set, narrows the picks to the newest or oldest
+	// apiservers during an upgrade.
+	versions *versionTracker
+	// swaps is the backend swap of the listener, shown in the status.
+	swaps *listenerSwap
+	// swapBackends, when set, is run by the admin API to replace the
+	// default backends.
+	swapBackends func(servers []string, grace time.Duration)
+	// healthy caches healthyLocked by the key of the server list until
+	// generation, bumped whenever a backend changes health or a swap
+	// replaces the servers, moves on.
+	healthy    map[string]*healthyCache
+	generation uint64
+}
+
+// healthyCache is the healthy ones of a server list at a generation of the
+// state, valid until the first ejection among them expires.
+type healthyCache struct {
+	healthy    []string
+	generation uint64
+	until      time.Time
+}
+
+// newLBState starts with every backend healthy so traffic flows before the
+// first health check completes.
+//
+// With min_healthy_to_serve the optimistic start is not trusted: nothing is
+// served until that many backends passed a health check, and the gate closes
+// again only once every backend is down, so the first apiserver back from a
+// full outage is not dog-piled by every client at once.
+func newLBState(servers []string, rules func(server string) HealthCheck, onNoHealthy string, minHealthy int) *lbState {
+	s := &lbState{
+		onNoHealthy: onNoHealthy,
+		minHealthy:  minHealthy,
+		balancer:    NewRoundRobin(),
+		serving:     minHealthy == 0,
+		servers:     servers,
+		backends:    make(map[string]*backendState),
+		recovered:   make(chan struct{}),
+		healthy:     make(map[string]*healthyCache),
+	}
+	if s.onNoHealthy == "" {
+		s.onNoHealthy = onNoHealthyFailOpen
+	}
+	for _, server := range servers {
+		backend := &backendState{
+			healthy:       true,
+			upThreshold:   rules(server).UpThreshold,
+			downThreshold: rules(server).DownThreshold,
+		}
+		if backend.upThreshold < 1 {
+			backend.upThreshold = 1
+		}
+		if backend.downThreshold < 1 {
+			backend.downThreshold = 1
+		}
+		s.backends[server] = backend
+	}
+	servingGauge.set(boolGauge(s.serving))
+	return s
+}
+
+// applyProbes counts consecutive probe results per backend and flips its
+// health once up_threshold successes or down_threshold failures are reached.
+func (s *lbState) applyProbes(results []probeResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, result := range results {
+		backend, ok := s.backends[result.server]
+		if !ok {
+			continue
+		}
+		if result.shuttingDown {
+			backend.successes = 0
+			if backend.healthy {
+				backend.healthy = false
+				s.generation++
+				log.Printf("Backend %s is shutting down, draining it", result.server)
+				s.notifyUnhealthyLocked(result.server)
+				if s.onShutdown != nil {
+					go s.onShutdown(result.server)
+				}
+			}
+			continue
+		}
+		if result.err == nil {
+			backend.successes++
+			backend.failures = 0
+			if !backend.healthy && backend.successes >= backend.upThreshold {
+				backend.healthy = true
+				s.generation++
+				log.Printf("Backend %s is healthy again", result.server)
+				close(s.recovered)
+				s.recovered = make(chan struct{})
+			}
+		} else {
+			backend.failures++
+			backend.successes = 0
+			if backend.healthy && backend.failures >= backend.downThreshold {
+				backend.healthy = false
+				s.generation++
+				log.Printf("Backend %s marked as unhealthy", result.server)
+				s.notifyUnhealthyLocked(result.server)
+			}
+		}
+	}
+	s.updateServingLocked(true)
+}
+
+// updateServingLocked opens or closes the min_healthy_to_serve gate. Only
+// probes may open it, since backends start out healthy without being checked.
+func (s *lbState) updateServingLocked(probed bool) {
+	if s.minHealthy == 0 {
+		return
+	}
+	healthy := len(s.healthyLocked(allServersKey, s.servers))
+	switch {
+	case !s.serving && probed && healthy >= s.minHealthy:
+		s.serving = true
+		log.Printf("%d kube-apiservers are healthy, serving traffic", healthy)
+		// Backends start out healthy, so the gate opening may be the
+		// only recovery the queued connections get to see.
+		close(s.recovered)
+		s.recovered = make(chan struct{})
+	case s.serving && healthy == 0:
+		s.serving = false
+		log.Printf("No kube-apiserver is healthy, waiting for %d before serving again", s.minHealthy)
+	}
+	servingGauge.set(boolGauge(s.serving))
+}
+
+func boolGauge(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// markUnhealthy takes a backend out of rotation right away, e.g. after a
+// failed dial, until the health checks bring it back.
+func (s *lbState) markUnhealthy(server string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backend, ok := s.backends[server]
+	if !ok {
+		return
+	}
+	if backend.healthy {
+		s.notifyUnhealthyLocked(server)
+		s.generation++
+	}
+	backend.healthy = false
+	backend.successes = 0
+	s.updateServingLocked(false)
+}
+
+func (s *lbState) notifyUnhealthyLocked(server string) {
+	if s.onUnhealthy != nil {
+		go s.onUnhealthy(server)
+	}
+}
+
+func (s *lbState) isHealthy(server string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	backend, ok := s.backends[server]
+	return ok && backend.healthy && !time.Now().Before(backend.ejectedUntil)
+}
+
+// eject takes server out of rotation for duration unless that would leave
+// more than maxPercent of the backends ejected.
+func (s *lbState) eject(server string, duration time.Duration, maxPercent int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backend, ok := s.backends[server]
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	ejected := 0
+	for _, other := range s.backends {
+		if now.Before(other.ejectedUntil) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > maxPercent*len(s.backends) {
+		return false
+	}
+	if backend.healthy && !now.Before(backend.ejectedUntil) {
+		s.notifyUnhealthyLocked(server)
+	}
+	backend.ejectedUntil = now.Add(duration)
+	s.generation++
+	s.updateServingLocked(false)
+	return true
+}
+
+func (s *lbState) healthyServers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.healthyLocked(allServersKey, s.servers)...)
+}
+
+func (s *lbState) healthyOf(key string, servers []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.healthyLocked(key, servers)...)
+}
+
+// preferredOf returns the healthy servers that picks are spread over, the
+// closest ones with a topology and the preferred version during upgrades.
+func (s *lbState) preferredOf(key string, servers []string) []string {
+	return s.preferredAmong(s.healthyOf(key, servers))
+}
+
+// preferredAmong narrows candidates by topology and then by version,
+// ignoring the version preference when it would leave nothing.
+func (s *lbState) preferredAmong(candidates []string) []string {
+	candidates = s.topology.prefer(candidates)
+	if preferred := s.versions.preferred(candidates); len(preferred) > 0 {
+		return preferred
+	}
+	return candidates
+}
+
+// healthyLocked returns the healthy ones of servers, the list known as key,
+// computed again only when a backend changed health, a swap replaced the
+// servers or an ejection expired since the last call with the same key,
+// which is most of the picks. Lists built for a single pick, like those of
+// retries, have no key and are never cached. The result is shared, so
+// callers must not modify it.
+func (s *lbState) healthyLocked(key string, servers []string) []string {
+	if len(servers) == 0 {
+		return nil
+	}
+	now := time.Now()
+	cached := s.healthy[key]
+	if key != "" && cached != nil && cached.generation == s.generation &&
+		(cached.until.IsZero() || now.Before(cached.until)) {
+		return cached.healthy
+	}
+	if cached == nil {
+		cached = &healthyCache{}
+		if key != "" {
+			s.healthy[key] = cached
+		}
+	}
+	cached.healthy = cached.healthy[:0]
+	cached.until = time.Time{}
+	for _, server := range servers {
+		backend, ok := s.backends[server]
+		if !ok || !backend.healthy {
+			continue
+		}
+		if now.Before(backend.ejectedUntil) {
+			if cached.until.IsZero() || backend.ejectedUntil.Before(cached.until) {
+				cached.until = backend.ejectedUntil
+			}
+			continue
+		}
+		cached.healthy = append(cached.healthy, server)
+	}
+	cached.generation = s.generation
+	return cached.healthy[:len(cached.healthy):len(cached.healthy)]
+}
+
+// pick chooses among the healthy ones of servers, the list known as key to
+// healthyLocked, with the balancer. When none is healthy it falls back to
+// all of them with the fail_open policy and returns errNoHealthy otherwise.
+func (s *lbState) pick(key string, servers []string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(servers) == 0 {
+		return "", errors.New("no remote servers")
+	}
+	if !s.serving {
+		if s.onNoHealthy == onNoHealthyQueue {
+			return "", errNoHealthy
+		}
+		return "", errBelowMinHealthy
+	}
+	candidates := s.healthyLocked(key, servers)
+	if len(candidates) == 0 {
+		noHealthyTotal.inc(s.onNoHealthy)
+		if s.onNoHealthy != onNoHealthyFailOpen {
+			return "", errNoHealthy
+		}
+		log.Printf("Error selecting healthy server: no remote servers are Healthy\n")
+		candidates = servers
+	}
+	candidates = s.preferredAmong(candidates)
+
+	picked := s.balancer.Pick(candidates, s.outstandingLocked)
+	if s.topology != nil {
+		topologyPicksTotal.inc(s.topology.locality(picked))
+	}
+
+	return picked, nil
+}
+
+// alternate returns the healthy one of servers that follows picked among
+// the candidates of pick, for dial_race, or "" when there is no other. The
+// balancer isn't consulted again, with round robin it is the next pick
+// anyway.
+func (s *lbState) alternate(key string, servers []string, picked string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	candidates := s.preferredAmong(s.healthyLocked(key, servers))
+	for i, server := range candidates {
+		if server == picked {
+			if len(candidates) == 1 {
+				return ""
+			}
+			return candidates[(i+1)%len(candidates)]
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates[0]
+	}
+	return ""
+}
+
+// waitHealthy blocks until one of servers is healthy, returning false if that
+// does not happen within timeout.
+func (s *lbState) waitHealthy(key string, servers []string, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		s.mu.Lock()
+		healthy := s.serving && len(s.healthyLocked(key, servers)) > 0
+		recovered := s.recovered
+		s.mu.Unlock()
+		if healthy {
+			return true
+		}
+
+		select {
+		case <-recovered:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+func (s *lbState) outstandingLocked(server string) int64 {
+	backend, ok := s.backends[server]
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt64(&backend.outstanding)
+}
+
+// acquire counts a request in flight to server and returns the func that
+// releases it.
+func (s *lbState) acquire(server string) func() {
+	s.mu.Lock()
+	backend, ok := s.backends[server]
+	s.mu.Unlock()
+
+	if !ok {
+		return func() {}
+	}
+	atomic.AddInt64(&backend.outstanding, 1)
+	return func() { atomic.AddInt64(&backend.outstanding, -1) }
+}
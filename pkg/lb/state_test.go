@@ -0,0 +1,133 @@
+package lb
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func noRules(string) HealthCheck {
+	return HealthCheck{}
+}
+
+// A connection queued before min_healthy_to_serve is reached must be woken
+// up by the gate opening, as the backends start out healthy and no probe
+// ever sees one of them recover.
+func TestQueuedConnectionServedWhenGateOpens(t *testing.T) {
+	servers := []string{"10.0.0.1:6443", "10.0.0.2:6443"}
+	state := newLBState(servers, noRules, onNoHealthyQueue, 2)
+	queue := newConnQueue(QueueConfig{Timeout: 3})
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		state.applyProbes([]probeResult{{server: servers[0]}, {server: servers[1]}})
+	}()
+
+	start := time.Now()
+	remote, err := queue.wait(state, defaultServersKey, servers)
+	if err != nil {
+		t.Fatalf("queued connection not served: %s", err)
+	}
+	if remote != servers[0] && remote != servers[1] {
+		t.Fatalf("picked unknown backend %q", remote)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("queued connection waited %s for the gate to open", elapsed)
+	}
+}
+
+// The accept loop, the health checks, failed dials and the queue all share
+// the state, which go test -race checks here.
+func TestStateConcurrentAccess(t *testing.T) {
+	servers := []string{"10.0.0.1:6443", "10.0.0.2:6443", "10.0.0.3:6443"}
+	state := newLBState(servers, noRules, onNoHealthyQueue, 1)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				f(i)
+			}
+		}()
+	}
+
+	run(func(i int) {
+		results := make([]probeResult, len(servers))
+		for j, server := range servers {
+			results[j] = probeResult{server: server}
+			if (i+j)%3 == 0 {
+				results[j].err = errors.New("probe failed")
+			}
+		}
+		state.applyProbes(results)
+	})
+	run(func(i int) {
+		state.markUnhealthy(servers[i%len(servers)])
+	})
+	for p := 0; p < 4; p++ {
+		run(func(i int) {
+			remote, err := state.pick(defaultServersKey, servers)
+			if err == nil {
+				state.acquire(remote)()
+			}
+		})
+	}
+	run(func(i int) {
+		state.waitHealthy(defaultServersKey, servers, time.Millisecond)
+	})
+
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	state.applyProbes([]probeResult{{server: servers[0]}, {server: servers[1]}, {server: servers[2]}})
+	if !state.waitHealthy(defaultServersKey, servers, time.Second) {
+		t.Fatal("no backend healthy after every probe passed")
+	}
+	for _, server := range servers {
+		if outstanding := state.outstandingLocked(server); outstanding != 0 {
+			t.Errorf("%s has %d requests outstanding after all were released", server, outstanding)
+		}
+	}
+}
+
+// The healthy ones of the default backends are cached, which must not outlive
+// a swap replacing them, nor be handed to the lists retries build.
+func TestHealthyCacheFollowsSwaps(t *testing.T) {
+	servers := []string{"10.0.0.1:6443", "10.0.0.2:6443"}
+	state := newLBState(servers, noRules, onNoHealthyReject, 0)
+	if _, err := state.pick(defaultServersKey, servers); err != nil {
+		t.Fatal(err)
+	}
+
+	swapped := []string{"10.0.0.3:6443"}
+	state.addBackends(swapped, noRules)
+	state.setServers(append(append([]string{}, servers...), swapped...))
+	for i := 0; i < 2; i++ {
+		remote, err := state.pick(defaultServersKey, swapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remote != swapped[0] {
+			t.Fatalf("picked %s after the swap to %v", remote, swapped)
+		}
+	}
+
+	// Retries reuse the array of their candidates for another list.
+	candidates := servers[:1]
+	if remote, _ := state.pick("", candidates); remote != servers[0] {
+		t.Fatalf("picked %s among %v", remote, candidates)
+	}
+	candidates[0] = swapped[0]
+	if remote, _ := state.pick("", candidates); remote != swapped[0] {
+		t.Fatalf("picked %s among %v", remote, candidates)
+	}
+}
@@ -0,0 +1,237 @@
+package lb
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultStaticPodListenAddr = "127.0.0.1:6443"
+	defaultStaticPodAdminAddr  = "127.0.0.1:9443"
+	staticPodConfigDir         = "/etc/kubernetes/kube-apiserver-lb"
+	defaultManifestOpenFiles   = 1048576
+
+	manifestFormatPod     = "pod"
+	manifestFormatSystemd = "systemd"
+
+	// envScheme makes -config read the configuration from an environment
+	// variable, which is how manifests embed it.
+	envScheme    = "env:"
+	configEnvVar = "KUBE_APISERVER_LB_CONFIG"
+)
+
+// applyStaticPodDefaults prepares the configuration for running as a static
+// pod on every node: the lb listens on localhost:6443, serves its own
+// /healthz and /readyz on the admin address for the kubelet probes, and
+// queues connections while no apiserver is up yet during node bootstrap
+// instead of refusing them.
+func (c *Configuration) applyStaticPodDefaults() {
+	if len(c.Listeners) == 0 && c.ListenAddr == "" {
+		c.ListenAddr = defaultStaticPodListenAddr
+	}
+	if c.AdminAddr == "" {
+		c.AdminAddr = defaultStaticPodAdminAddr
+	}
+	for _, listener := range c.listeners() {
+		if listener.OnNoHealthy == "" {
+			listener.OnNoHealthy = onNoHealthyQueue
+		}
+	}
+}
+
+var staticPodManifest = template.Must(template.New("manifest").Parse(`apiVersion: v1
+kind: Pod
+metadata:
+  name: kube-apiserver-lb
+  namespace: kube-system
+  labels:
+    component: kube-apiserver-lb
+    tier: node
+spec:
+  hostNetwork: true
+  priorityClassName: system-node-critical
+  containers:
+    - name: kube-apiserver-lb
+      image: {{.Image}}
+{{- if .Config}}
+      args: ["-config", "{{.ConfigEnv}}"]
+      env:
+        - name: {{.ConfigVar}}
+          value: |
+{{.Config}}
+{{- else}}
+      args: ["-config", "{{.ConfigDir}}/config.yaml"]
+{{- end}}
+      resources:
+        requests: {cpu: {{.CPURequest}}, memory: {{.MemoryRequest}}}
+        limits: {memory: {{.MemoryLimit}}}
+      livenessProbe:
+        httpGet: {host: 127.0.0.1, port: {{.AdminPort}}, path: /healthz{{if .AdminHTTPS}}, scheme: HTTPS{{end}}}
+        initialDelaySeconds: 10
+        failureThreshold: 8
+      readinessProbe:
+        httpGet: {host: 127.0.0.1, port: {{.AdminPort}}, path: /readyz{{if .AdminHTTPS}}, scheme: HTTPS{{end}}}
+        periodSeconds: 1
+      volumeMounts:
+        - name: config
+          mountPath: {{.ConfigDir}}
+          readOnly: true
+        - name: pki
+          mountPath: /etc/kubernetes/pki
+          readOnly: true
+  volumes:
+    - name: config
+      hostPath:
+        path: {{.ConfigDir}}
+        type: DirectoryOrCreate
+    - name: pki
+      hostPath:
+        path: /etc/kubernetes/pki
+        type: DirectoryOrCreate
+`))
+
+var systemdUnit = template.Must(template.New("unit").Parse(`[Unit]
+Description=kube-apiserver-lb
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+{{- if .Config}}
+Environment="{{.ConfigVar}}={{.Config}}"
+ExecStart={{.Binary}} -config {{.ConfigEnv}}
+{{- else}}
+ExecStart={{.Binary}} -config {{.ConfigDir}}/config.yaml
+{{- end}}
+Restart=always
+RestartSec=1
+LimitNOFILE={{.OpenFiles}}
+MemoryMax={{.MemoryMax}}
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// RunManifest prints a static pod manifest, or a systemd unit, running the
+// lb. With -config the configuration is validated and embedded in the
+// manifest, otherwise it is read from config.yaml in the config directory,
+// which should set static_pod: true.
+func RunManifest(args []string) {
+	flags := flag.NewFlagSet("manifest", flag.ExitOnError)
+	image := flags.String("image", "", "container image of the lb, required for the pod format")
+	path := flags.String("config", "", "config file to embed in the manifest")
+	format := flags.String("format", manifestFormatPod, "pod, or systemd for a unit running the binary")
+	binary := flags.String("binary", "/usr/local/bin/kube-apiserver-lb", "path of the lb binary in the systemd unit")
+	cpuRequest := flags.String("cpu-request", "50m", "cpu request of the pod")
+	memoryRequest := flags.String("memory-request", "64Mi", "memory request of the pod")
+	memoryLimit := flags.String("memory-limit", "256Mi", "memory limit of the pod or unit")
+	flags.Parse(args)
+
+	values := map[string]string{
+		"Image":         *image,
+		"Binary":        *binary,
+		"ConfigDir":     staticPodConfigDir,
+		"ConfigEnv":     envScheme + configEnvVar,
+		"ConfigVar":     configEnvVar,
+		"CPURequest":    *cpuRequest,
+		"MemoryRequest": *memoryRequest,
+		"MemoryLimit":   *memoryLimit,
+		"MemoryMax":     strings.TrimSuffix(*memoryLimit, "i"),
+		"OpenFiles":     strconv.Itoa(defaultManifestOpenFiles),
+	}
+	adminAddr := defaultStaticPodAdminAddr
+	if *path != "" {
+		config, err := ReadConfiguration(*path)
+		if err != nil {
+			log.Fatalf("error reading configuration : %s", err)
+		}
+		if config.AdminAddr == "" {
+			log.Fatalf("the configuration needs admin_addr or static_pod: true for the probes")
+		}
+		adminAddr = config.AdminAddr
+		if config.AdminTLS != nil {
+			values["AdminHTTPS"] = "true"
+		}
+		if config.MaxOpenFiles > 0 {
+			values["OpenFiles"] = strconv.FormatUint(config.MaxOpenFiles, 10)
+		}
+		data, err := ioutil.ReadFile(*path)
+		if err != nil {
+			log.Fatalf("error reading configuration : %s", err)
+		}
+		values["Config"], err = embedConfig(*format, data)
+		if err != nil {
+			log.Fatalf("error embedding configuration : %s", err)
+		}
+	}
+	_, values["AdminPort"], _ = net.SplitHostPort(adminAddr)
+
+	var err error
+	switch *format {
+	case manifestFormatPod:
+		if *image == "" {
+			log.Fatalf("manifest requires -image")
+		}
+		err = staticPodManifest.Execute(os.Stdout, values)
+	case manifestFormatSystemd:
+		err = systemdUnit.Execute(os.Stdout, values)
+	default:
+		log.Fatalf("unknown manifest format %q", *format)
+	}
+	if err != nil {
+		log.Fatalf("error writing manifest : %s", err)
+	}
+}
+
+// embedConfig formats the configuration for the environment variable of
+// the manifest: as a block scalar indented into the pod, or as a single line
+// of JSON, which is also YAML, quoted for systemd.
+func embedConfig(format string, data []byte) (string, error) {
+	if format != manifestFormatSystemd {
+		lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+		for i, line := range lines {
+			if line != "" {
+				lines[i] = "            " + line
+			}
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+
+	var config interface{}
+	err := yaml.Unmarshal(data, &config)
+	if err != nil {
+		return "", err
+	}
+	line, err := json.Marshal(jsonCompatible(config))
+	if err != nil {
+		return "", err
+	}
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%").Replace(string(line)), nil
+}
+
+// jsonCompatible turns the maps decoded from YAML, keyed by interface{},
+// into maps encoding/json accepts.
+func jsonCompatible(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			converted[fmt.Sprint(k)] = jsonCompatible(v)
+		}
+		return converted
+	case []interface{}:
+		for i, v := range value {
+			value[i] = jsonCompatible(v)
+		}
+	}
+	return value
+}
@@ -0,0 +1,164 @@
+package lb
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const statusPeerTimeout = 2 * time.Second
+
+const (
+	backendStatusHealthy   = "healthy"
+	backendStatusUnhealthy = "unhealthy"
+	backendStatusEjected   = "ejected"
+)
+
+// nodeStatus is what an instance serves on /status: how it sees each
+// backend of each of its listeners.
+type nodeStatus struct {
+	Node      string                    `json:"node"`
+	Listeners map[string]listenerStatus `json:"listeners"`
+}
+
+type listenerStatus struct {
+	Serving  bool                     `json:"serving"`
+	Backends map[string]backendStatus `json:"backends"`
+	// Draining are the backends a swap replaced that still have
+	// connections.
+	Draining map[string]drainProgress `json:"draining,omitempty"`
+}
+
+type backendStatus struct {
+	Status      string `json:"status"`
+	Outstanding int64  `json:"outstanding"`
+}
+
+// clusterStatus is the /status/peers view: the status of every instance,
+// and for each backend what each instance thinks of it, which shows
+// asymmetric partitions at a glance.
+type clusterStatus struct {
+	Nodes    map[string]nodeStatus        `json:"nodes"`
+	Errors   map[string]string            `json:"errors,omitempty"`
+	Backends map[string]map[string]string `json:"backends"`
+}
+
+func (s *lbState) status() listenerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	status := listenerStatus{Serving: s.serving, Backends: make(map[string]backendStatus)}
+	for _, server := range s.servers {
+		backend, ok := s.backends[server]
+		if !ok {
+			continue
+		}
+		state := backendStatusUnhealthy
+		if now.Before(backend.ejectedUntil) {
+			state = backendStatusEjected
+		} else if backend.healthy {
+			state = backendStatusHealthy
+		}
+		status.Backends[server] = backendStatus{Status: state, Outstanding: s.outstandingLocked(server)}
+	}
+	status.Draining = s.swaps.drainProgress()
+	return status
+}
+
+func localStatus() nodeStatus {
+	node, _ := os.Hostname()
+	status := nodeStatus{Node: node, Listeners: make(map[string]listenerStatus)}
+	boundListeners.Lock()
+	states := make(map[string]*lbState, len(boundListeners.states))
+	for name, state := range boundListeners.states {
+		states[name] = state
+	}
+	boundListeners.Unlock()
+	for name, state := range states {
+		status.Listeners[name] = state.status()
+	}
+	return status
+}
+
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(localStatus())
+}
+
+// peerStatusHandler serves the status of this instance and of the peers,
+// the admin addresses of the other instances, fetched at request time,
+// with the token of peerTokenFile when set, and over HTTPS with tlsConfig
+// when not nil.
+func peerStatusHandler(peers []string, peerTokenFile string, tlsConfig *tls.Config) http.HandlerFunc {
+	client := &http.Client{Timeout: statusPeerTimeout}
+	scheme := "http"
+	if tlsConfig != nil {
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+		scheme = "https"
+	}
+	if peerTokenFile != "" {
+		client = newTokenFile(peerTokenFile).client(client)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		local := localStatus()
+		cluster := clusterStatus{
+			Nodes:    map[string]nodeStatus{local.Node: local},
+			Errors:   make(map[string]string),
+			Backends: make(map[string]map[string]string),
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, peer := range peers {
+			wg.Add(1)
+			go func(peer string) {
+				defer wg.Done()
+				status, err := fetchPeerStatus(client, scheme, peer)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					cluster.Errors[peer] = err.Error()
+					return
+				}
+				node := status.Node
+				if _, dup := cluster.Nodes[node]; dup || node == "" {
+					node = peer
+				}
+				cluster.Nodes[node] = status
+			}(peer)
+		}
+		wg.Wait()
+
+		for node, status := range cluster.Nodes {
+			for _, listener := range status.Listeners {
+				for server, backend := range listener.Backends {
+					if cluster.Backends[server] == nil {
+						cluster.Backends[server] = make(map[string]string)
+					}
+					cluster.Backends[server][node] = backend.Status
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cluster)
+	}
+}
+
+func fetchPeerStatus(client *http.Client, scheme string, peer string) (nodeStatus, error) {
+	var status nodeStatus
+	resp, err := client.Get(fmt.Sprintf("%s://%s/status", scheme, peer))
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("HTTP status code : %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
@@ -0,0 +1,270 @@
+package lb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultSwapGracePeriod = 300
+
+// swapMu serializes swaps, which read the backends they replace.
+var swapMu sync.Mutex
+
+var (
+	backendSwapsTotal = newCounter("backend_swaps_total",
+		"Replacements of the whole backend set of a listener.", "listener")
+	swapDrainedTotal = newCounter("swap_drained_connections_total",
+		"Connections to a replaced backend still open when the swap grace period ended.", "backend")
+)
+
+// drainProgress is how far a backend replaced by a swap is from having no
+// connections left.
+type drainProgress struct {
+	Connections int       `json:"connections"`
+	Deadline    time.Time `json:"deadline"`
+}
+
+// swapRequest is the body of a POST to /backends.
+type swapRequest struct {
+	Listener    string   `json:"listener"`
+	Backends    []string `json:"backends"`
+	GracePeriod int      `json:"grace_period"`
+}
+
+// listenerSwap is the backend swap of a listener. It outlives the lbState
+// rebuilt on every restart of the listener, which would otherwise go back
+// to the configured backends. servers and drainProgress return nil on a nil
+// listenerSwap.
+type listenerSwap struct {
+	mu sync.Mutex
+	// swapped, once set, replaces the configured default backends, and
+	// draining tracks the connections left to the backends it replaced.
+	swapped  []string
+	draining map[string]drainProgress
+}
+
+func newListenerSwap() *listenerSwap {
+	return &listenerSwap{draining: make(map[string]drainProgress)}
+}
+
+// servers returns the backends that replaced the configured ones, nil
+// before any swap.
+func (s *listenerSwap) servers() []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.swapped
+}
+
+func (s *listenerSwap) set(servers []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.swapped = servers
+}
+
+func (s *listenerSwap) setDrainProgress(server string, progress *drainProgress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if progress == nil {
+		delete(s.draining, server)
+		return
+	}
+	s.draining[server] = *progress
+}
+
+// drainProgress returns a copy of the progress of the backends draining, nil
+// when there are none.
+func (s *listenerSwap) drainProgress() map[string]drainProgress {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.draining) == 0 {
+		return nil
+	}
+	draining := make(map[string]drainProgress, len(s.draining))
+	for server, progress := range s.draining {
+		draining[server] = progress
+	}
+	return draining
+}
+
+// addBackends starts tracking the servers swapped in. Those not known yet
+// start out healthy, as at startup, so new connections move over right away.
+func (s *lbState) addBackends(servers []string, rules func(server string) HealthCheck) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, server := range servers {
+		if _, ok := s.backends[server]; ok {
+			continue
+		}
+		backend := &backendState{
+			healthy:       true,
+			upThreshold:   rules(server).UpThreshold,
+			downThreshold: rules(server).DownThreshold,
+		}
+		if backend.upThreshold < 1 {
+			backend.upThreshold = 1
+		}
+		if backend.downThreshold < 1 {
+			backend.downThreshold = 1
+		}
+		s.backends[server] = backend
+	}
+	s.generation++
+}
+
+// setServers replaces the backends that are checked, after a swap replaced
+// the default ones, dropping the healthy lists cached before.
+func (s *lbState) setServers(servers []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servers = servers
+	s.generation++
+}
+
+func (s *lbState) allServers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.servers
+}
+
+// remoteServers returns the default backends, the configured ones until a
+// swap replaces them.
+func (lb *apiServerLb) remoteServers() []string {
+	if servers := lb.swaps.servers(); servers != nil {
+		return servers
+	}
+	return lb.RemoteServers
+}
+
+// swapBackends replaces the default backends at once: new connections only
+// go to servers from now on, while those open to the previous backends are
+// left to finish until grace is over and closed then.
+func (lb *apiServerLb) swapBackends(servers []string, grace time.Duration) {
+	previous := lb.remoteServers()
+	lb.state.addBackends(servers, lb.healthCheckFor)
+	lb.swaps.set(servers)
+	all := lb.allServers()
+	lb.state.setServers(all)
+	backendSwapsTotal.inc(lb.name)
+	log.Printf("Listener %s backends swapped from %v to %v, draining for %s", lb.name, previous, servers, grace)
+
+	kept := make(map[string]bool)
+	for _, server := range all {
+		kept[server] = true
+	}
+	deadline := time.Now().Add(grace)
+	for _, server := range previous {
+		if !kept[server] {
+			go lb.drainSwapped(server, deadline)
+		}
+	}
+}
+
+// drainSwapped reports the connections left to server, a backend replaced by
+// a swap, until there are none or deadline passes and it closes them.
+func (lb *apiServerLb) drainSwapped(server string, deadline time.Time) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if lb.isServer(server) {
+			// Swapped back in before it was drained.
+			lb.swaps.setDrainProgress(server, nil)
+			return
+		}
+		conns := lb.forwarders.idlest(lb.name, server, math.MaxInt32)
+		if len(conns) == 0 {
+			lb.swaps.setDrainProgress(server, nil)
+			log.Printf("Backend %s replaced by a swap has no connections left", server)
+			return
+		}
+		if !time.Now().Before(deadline) {
+			log.Printf("Closing %d connections to backend %s replaced by a swap", len(conns), server)
+			for _, conn := range conns {
+				conn.cancel()
+			}
+			swapDrainedTotal.add(float64(len(conns)), server)
+			lb.swaps.setDrainProgress(server, nil)
+			return
+		}
+		lb.swaps.setDrainProgress(server, &drainProgress{Connections: len(conns), Deadline: deadline})
+		<-ticker.C
+	}
+}
+
+// isServer tells whether server is one of the backends of the listener,
+// asking the swap rather than the lbState, which a restart replaces.
+func (lb *apiServerLb) isServer(server string) bool {
+	for _, known := range lb.allServers() {
+		if known == server {
+			return true
+		}
+	}
+	return false
+}
+
+// serveSwap replaces the backends of a listener, the only one when the
+// request names none.
+func serveSwap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "backend swaps are POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req swapRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err == nil {
+		err = req.validate()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	boundListeners.Lock()
+	state := boundListeners.states[req.Listener]
+	if req.Listener == "" && len(boundListeners.states) == 1 {
+		for _, only := range boundListeners.states {
+			state = only
+		}
+	}
+	boundListeners.Unlock()
+	if state == nil || state.swapBackends == nil {
+		http.Error(w, fmt.Sprintf("no bound listener %q", req.Listener), http.StatusNotFound)
+		return
+	}
+	grace := req.GracePeriod
+	if grace == 0 {
+		grace = defaultSwapGracePeriod
+	}
+	swapMu.Lock()
+	state.swapBackends(req.Backends, time.Duration(grace)*time.Second)
+	swapMu.Unlock()
+	fmt.Fprintln(w, "ok")
+}
+
+func (req *swapRequest) validate() error {
+	if len(req.Backends) == 0 {
+		return errors.New("backends is required")
+	}
+	if req.GracePeriod < 0 {
+		return errors.New("grace_period must not be negative")
+	}
+	for _, server := range req.Backends {
+		err := validateServerAddr(server)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
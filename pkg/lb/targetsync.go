@@ -0,0 +1,252 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	targetProviderAWS = "aws_target_group"
+	targetProviderGCP = "gcp_instance_group"
+
+	targetsBackends = "backends"
+	targetsSelf     = "self"
+
+	targetSyncPeriod    = time.Second
+	targetSyncTimeout   = 10 * time.Second
+	defaultTargetResync = 60
+)
+
+var targetSyncsTotal = newCounter("target_syncs_total",
+	"Syncs of the cloud target group with the healthy targets, by result.", "result")
+
+// TargetSyncConfig keeps the membership of a cloud load balancer target
+// group matching what this instance sees: either the healthy backends of
+// listener, or this lb host while every listener has a healthy backend.
+// Changes are pushed when they happen, and the whole membership is
+// reconciled every resync seconds in case it was changed by someone else.
+type TargetSyncConfig struct {
+	Provider    string                  `yaml:"provider"`
+	Targets     string                  `yaml:"targets"`
+	Listener    string                  `yaml:"listener"`
+	SelfAddress string                  `yaml:"self_address"`
+	Resync      int                     `yaml:"resync"`
+	AWS         *AWSTargetGroupConfig   `yaml:"aws_target_group"`
+	GCP         *GCPInstanceGroupConfig `yaml:"gcp_instance_group"`
+}
+
+func (c *TargetSyncConfig) validate(config *Configuration) error {
+	if c.Targets == "" {
+		c.Targets = targetsBackends
+	}
+	switch c.Targets {
+	case targetsBackends:
+		listener, err := config.defaultListener(c.Listener)
+		if err != nil {
+			return fmt.Errorf("target_sync %s", err)
+		}
+		c.Listener = listener
+	case targetsSelf:
+	default:
+		return fmt.Errorf("target_sync targets must be %s or %s", targetsBackends, targetsSelf)
+	}
+	if c.Resync < 0 {
+		return errors.New("target_sync resync must not be negative")
+	}
+	if c.Resync == 0 {
+		c.Resync = defaultTargetResync
+	}
+
+	switch c.Provider {
+	case targetProviderAWS:
+		if c.AWS == nil {
+			return errors.New("target_sync provider aws_target_group requires the aws_target_group block")
+		}
+		if c.Targets == targetsSelf {
+			if c.SelfAddress == "" {
+				return errors.New("target_sync targets self requires self_address")
+			}
+			err := validateServerAddr(c.SelfAddress)
+			if err != nil {
+				return fmt.Errorf("target_sync self_address: %s", err)
+			}
+		}
+		return c.AWS.validate()
+	case targetProviderGCP:
+		if c.GCP == nil {
+			return errors.New("target_sync provider gcp_instance_group requires the gcp_instance_group block")
+		}
+		if c.Targets != targetsSelf {
+			return errors.New("target_sync gcp_instance_group members are instances, it requires targets self")
+		}
+		return c.GCP.validate()
+	}
+	return fmt.Errorf("unknown target_sync provider %q", c.Provider)
+}
+
+// targetGroup is the membership of a cloud target group. Targets are
+// ip:port for AWS target groups and instance names for GCP instance groups.
+type targetGroup interface {
+	registered() ([]string, error)
+	register(targets []string) error
+	deregister(targets []string) error
+}
+
+func (c *TargetSyncConfig) group() targetGroup {
+	if c.Provider == targetProviderGCP {
+		return c.GCP.group()
+	}
+	return c.AWS
+}
+
+// self is what registers this lb host.
+func (c *TargetSyncConfig) self() (string, error) {
+	if c.Provider == targetProviderGCP {
+		return c.GCP.instanceName()
+	}
+	return c.SelfAddress, nil
+}
+
+// runTargetSync pushes the targets to the group until shutdown. With
+// targets self this host is deregistered before returning, so the cloud
+// load balancer stops sending to it while the listeners drain.
+func runTargetSync(config TargetSyncConfig, listeners int, shutdown <-chan struct{}) (<-chan struct{}, error) {
+	group := config.group()
+	var self string
+	if config.Targets == targetsSelf {
+		var err error
+		self, err = config.self()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(targetSyncPeriod)
+		defer ticker.Stop()
+		resync := time.Duration(config.Resync) * time.Second
+		var applied []string
+		var appliedAt time.Time
+		synced := false
+		for {
+			select {
+			case <-shutdown:
+				if self != "" && (!synced || len(applied) > 0) {
+					err := group.deregister([]string{self})
+					if err != nil {
+						log.Printf("Error deregistering %s from the target group: %s", self, err)
+					}
+				}
+				return
+			case <-ticker.C:
+			}
+
+			var desired []string
+			if self != "" {
+				if backendsHealthy(listeners) {
+					desired = []string{self}
+				}
+			} else {
+				var ok bool
+				desired, ok = healthyBackends(config.Listener)
+				if !ok {
+					// Like DNS updates, leave the group alone rather
+					// than emptying it.
+					continue
+				}
+			}
+			sort.Strings(desired)
+			if synced && equalStrings(desired, applied) && time.Since(appliedAt) < resync {
+				continue
+			}
+			err := syncTargets(group, desired)
+			if err != nil {
+				targetSyncsTotal.inc("error")
+				log.Printf("Error syncing the target group to %v: %s", desired, err)
+				continue
+			}
+			targetSyncsTotal.inc("success")
+			if !synced || !equalStrings(desired, applied) {
+				log.Printf("Target group synced to %v", desired)
+			}
+			applied, appliedAt, synced = desired, time.Now(), true
+		}
+	}()
+	return done, nil
+}
+
+// syncTargets registers the desired targets missing from group and
+// deregisters those it has that are not desired.
+func syncTargets(group targetGroup, desired []string) error {
+	current, err := group.registered()
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool, len(current))
+	for _, target := range current {
+		have[target] = true
+	}
+	want := make(map[string]bool, len(desired))
+	var add, remove []string
+	for _, target := range desired {
+		want[target] = true
+		if !have[target] {
+			add = append(add, target)
+		}
+	}
+	for _, target := range current {
+		if !want[target] {
+			remove = append(remove, target)
+		}
+	}
+	if len(add) > 0 {
+		err = group.register(add)
+		if err != nil {
+			return err
+		}
+	}
+	if len(remove) > 0 {
+		return group.deregister(remove)
+	}
+	return nil
+}
+
+// healthyBackends returns the healthy backends of listener, and false while
+// it is not bound or none is healthy.
+func healthyBackends(listener string) ([]string, bool) {
+	boundListeners.Lock()
+	state := boundListeners.states[listener]
+	boundListeners.Unlock()
+	if state == nil {
+		return nil, false
+	}
+	healthy := state.healthyServers()
+	return healthy, len(healthy) > 0
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// splitTarget splits an ip:port target.
+func splitTarget(target string) (string, string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", "", fmt.Errorf("target %s: %s", target, err)
+	}
+	return host, port, nil
+}
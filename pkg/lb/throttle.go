@@ -0,0 +1,159 @@
+package lb
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultThrottleBanAfter    = 20
+	defaultThrottleBanDuration = 300
+)
+
+var (
+	connectionsThrottledTotal = newCounter("throttled_connections_total",
+		"New connections closed by connection_rate_limit, because the source went over its rate or is banned.",
+		"listener", "reason")
+	throttleBansTotal = newCounter("throttle_bans_total",
+		"Sources banned by connection_rate_limit for going over their rate repeatedly.", "listener")
+)
+
+// ConnectionRateLimitConfig limits the new connections of each source IP
+// with a token bucket of connections_per_second and burst, on top of any
+// concurrency limit. A source going over it ban_after times within
+// ban_duration seconds has all its connections closed for ban_duration
+// seconds, so a compromised pod can't hammer the apiservers through the lb.
+type ConnectionRateLimitConfig struct {
+	ConnectionsPerSecond float64 `yaml:"connections_per_second"`
+	Burst                int     `yaml:"burst"`
+	BanAfter             int     `yaml:"ban_after"`
+	BanDuration          int     `yaml:"ban_duration"`
+}
+
+func (c *ConnectionRateLimitConfig) validate() error {
+	if c.ConnectionsPerSecond <= 0 {
+		return errors.New("connection_rate_limit connections_per_second must be positive")
+	}
+	if c.Burst < 0 || c.BanAfter < 0 || c.BanDuration < 0 {
+		return errors.New("connection_rate_limit burst, ban_after and ban_duration must not be negative")
+	}
+	if c.BanAfter == 0 {
+		c.BanAfter = defaultThrottleBanAfter
+	}
+	if c.BanDuration == 0 {
+		c.BanDuration = defaultThrottleBanDuration
+	}
+	return nil
+}
+
+type throttleStrikes struct {
+	count int
+	first time.Time
+}
+
+// connThrottle applies a ConnectionRateLimitConfig across the acceptors and
+// restarts of a listener.
+type connThrottle struct {
+	config      ConnectionRateLimitConfig
+	listener    string
+	limiter     *rateLimiter
+	banDuration time.Duration
+
+	mu        sync.Mutex
+	strikes   map[string]*throttleStrikes
+	banned    map[string]time.Time
+	lastPrune time.Time
+}
+
+func newConnThrottle(config *ConnectionRateLimitConfig, listener string) *connThrottle {
+	if config == nil {
+		return nil
+	}
+	return &connThrottle{
+		config:      *config,
+		listener:    listener,
+		limiter:     newRateLimiter(config.ConnectionsPerSecond, config.Burst),
+		banDuration: time.Duration(config.BanDuration) * time.Second,
+		strikes:     make(map[string]*throttleStrikes),
+		banned:      make(map[string]time.Time),
+		lastPrune:   time.Now(),
+	}
+}
+
+// admit tells whether source may open a new connection, and the reason
+// when it may not.
+func (t *connThrottle) admit(source string) (bool, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.Sub(t.lastPrune) >= rateLimitCleanupPeriod {
+		t.prune(now)
+	}
+	if until, ok := t.banned[source]; ok {
+		if now.Before(until) {
+			return false, "banned"
+		}
+		delete(t.banned, source)
+	}
+	allowed, _ := t.limiter.allow(source)
+	if allowed {
+		return true, ""
+	}
+
+	strikes := t.strikes[source]
+	if strikes == nil || now.Sub(strikes.first) >= t.banDuration {
+		strikes = &throttleStrikes{first: now}
+		t.strikes[source] = strikes
+	}
+	strikes.count++
+	if strikes.count >= t.config.BanAfter {
+		delete(t.strikes, source)
+		t.banned[source] = now.Add(t.banDuration)
+		throttleBansTotal.inc(t.listener)
+		log.Printf("Banning %s from %s for %s after going over connection_rate_limit %d times", source, t.listener, t.banDuration, strikes.count)
+	}
+	return false, "rate"
+}
+
+func (t *connThrottle) prune(now time.Time) {
+	t.lastPrune = now
+	for source, strikes := range t.strikes {
+		if now.Sub(strikes.first) >= t.banDuration {
+			delete(t.strikes, source)
+		}
+	}
+	for source, until := range t.banned {
+		if !now.Before(until) {
+			delete(t.banned, source)
+		}
+	}
+}
+
+// throttleListener closes the new connections connThrottle doesn't admit,
+// before they take a backend.
+type throttleListener struct {
+	net.Listener
+	throttle *connThrottle
+}
+
+func (l *throttleListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return conn, nil
+		}
+		admitted, reason := l.throttle.admit(addr.IP.String())
+		if admitted {
+			return conn, nil
+		}
+		connectionsThrottledTotal.inc(l.throttle.listener, reason)
+		CloseAndLog(conn)
+	}
+}
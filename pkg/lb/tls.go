@@ -0,0 +1,629 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	tlsModePassthrough = "passthrough"
+	tlsModeReencrypt   = "reencrypt"
+
+	defaultTLSReloadPeriod = 60
+
+	frontendHandshakeTimeout = 10 * time.Second
+)
+
+type TLSConfig struct {
+	Mode           string `yaml:"mode"`
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientCertFile string `yaml:"client_cert_file"`
+	ClientKeyFile  string `yaml:"client_key_file"`
+	CAFile         string `yaml:"ca_file"`
+	ServerName     string `yaml:"server_name"`
+	ReloadPeriod   int    `yaml:"reload_period"`
+
+	ClientCAFile       string   `yaml:"client_ca_file"`
+	AllowedClientNames []string `yaml:"allowed_client_names"`
+
+	LogClientHello bool `yaml:"log_client_hello"`
+
+	MinVersion   string   `yaml:"min_version"`
+	MaxVersion   string   `yaml:"max_version"`
+	CipherSuites []string `yaml:"cipher_suites"`
+	FIPS         bool     `yaml:"fips"`
+
+	SecretDir       string `yaml:"secret_dir"`
+	ClientSecretDir string `yaml:"client_secret_dir"`
+
+	SPIFFE *SPIFFEConfig `yaml:"spiffe"`
+	Vault  *VaultConfig  `yaml:"vault"`
+}
+
+func (c TLSConfig) validate() error {
+	if c.SecretDir != "" && c.CertFile != "" {
+		return errors.New("secret_dir and cert_file are mutually exclusive")
+	}
+	if c.ClientSecretDir != "" && c.ClientCertFile != "" {
+		return errors.New("client_secret_dir and client_cert_file are mutually exclusive")
+	}
+	c = c.withSecretDirs()
+
+	switch c.Mode {
+	case "", tlsModePassthrough:
+	case tlsModeReencrypt:
+		if (c.CertFile == "" || c.KeyFile == "") && (c.Vault == nil || c.Vault.Serving == nil) {
+			return errors.New("tls mode reencrypt requires cert_file and key_file or a vault serving certificate")
+		}
+	default:
+		return fmt.Errorf("unknown tls mode %q", c.Mode)
+	}
+	if (c.ClientCertFile == "") != (c.ClientKeyFile == "") {
+		return errors.New("client_cert_file and client_key_file must be set together")
+	}
+	if len(c.AllowedClientNames) > 0 && c.ClientCAFile == "" {
+		return errors.New("allowed_client_names requires client_ca_file")
+	}
+	if c.LogClientHello && c.reencrypt() {
+		return errors.New("log_client_hello is only supported in passthrough mode")
+	}
+	if c.ClientCAFile != "" && !c.reencrypt() {
+		return errors.New("client_ca_file requires tls mode reencrypt")
+	}
+	clientCert := c.ClientCertFile != "" || c.SPIFFE != nil || (c.Vault != nil && c.Vault.Client != nil)
+	if clientCert && c.reencrypt() && c.ClientCAFile == "" {
+		// The apiservers authenticate the client certificate of the lb ahead
+		// of the bearer token of the client, anyone reaching the listener
+		// would get its identity.
+		return errors.New("a client certificate in tls mode reencrypt requires client_ca_file, clients act as its identity")
+	}
+	if c.reencrypt() && c.CAFile == "" && c.SPIFFE == nil {
+		return errors.New("tls mode reencrypt requires ca_file or spiffe to verify the apiservers")
+	}
+	if c.SPIFFE != nil {
+		if c.SPIFFE.SocketPath == "" {
+			return errors.New("tls spiffe requires socket_path")
+		}
+		if c.ClientCertFile != "" {
+			return errors.New("client_cert_file and spiffe are mutually exclusive")
+		}
+	}
+	if c.Vault != nil {
+		err := c.Vault.validate()
+		if err != nil {
+			return err
+		}
+		if c.Vault.Serving != nil && c.CertFile != "" {
+			return errors.New("cert_file and a vault serving certificate are mutually exclusive")
+		}
+		if c.Vault.Client != nil && (c.ClientCertFile != "" || c.SPIFFE != nil) {
+			return errors.New("a vault client certificate excludes client_cert_file and spiffe")
+		}
+	}
+	if c.ReloadPeriod < 0 {
+		return errors.New("tls reload_period must not be negative")
+	}
+	if c.FIPS && c.LogClientHello {
+		return errors.New("log_client_hello hashes the JA3 fingerprint with MD5, which tls fips excludes")
+	}
+	_, err := c.policy()
+	return err
+}
+
+var tlsVersions = map[string]uint16{
+	"VersionTLS10": tls.VersionTLS10,
+	"VersionTLS11": tls.VersionTLS11,
+	"VersionTLS12": tls.VersionTLS12,
+	"VersionTLS13": tls.VersionTLS13,
+}
+
+// tlsPolicy holds the protocol versions and cipher suites allowed on both the
+// frontend and backend sides. Names follow the kube-apiserver --tls-min-version
+// and --tls-cipher-suites flags. With fips the policy is narrowed by
+// fipsPolicy and also restricts the key exchange curves.
+type tlsPolicy struct {
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+	fips         bool
+}
+
+func (c TLSConfig) policy() (tlsPolicy, error) {
+	policy := tlsPolicy{}
+
+	for _, v := range []struct {
+		name    string
+		version *uint16
+	}{{c.MinVersion, &policy.minVersion}, {c.MaxVersion, &policy.maxVersion}} {
+		if v.name == "" {
+			continue
+		}
+		version, ok := tlsVersions[v.name]
+		if !ok {
+			return policy, fmt.Errorf("unknown tls version %q", v.name)
+		}
+		*v.version = version
+	}
+	if policy.maxVersion != 0 && policy.minVersion > policy.maxVersion {
+		return policy, errors.New("tls min_version is greater than max_version")
+	}
+
+	for _, name := range c.CipherSuites {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return policy, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		policy.cipherSuites = append(policy.cipherSuites, id)
+	}
+
+	if c.FIPS {
+		return fipsPolicy(policy)
+	}
+	return policy, nil
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// apply restricts config to the policy. TLS 1.3 suites are not configurable
+// in crypto/tls, so cipher_suites only affects TLS 1.2 and below.
+func (p tlsPolicy) apply(config *tls.Config) *tls.Config {
+	config.MinVersion = p.minVersion
+	config.MaxVersion = p.maxVersion
+	config.CipherSuites = p.cipherSuites
+	if p.fips {
+		config.CurvePreferences = fipsCurves
+	}
+	return config
+}
+
+func (c TLSConfig) reencrypt() bool {
+	return c.Mode == tlsModeReencrypt
+}
+
+// withSecretDirs fills in the file paths of mounted kubernetes.io/tls secrets.
+// Secret volumes are updated by swapping the ..data symlink, so it is resolved
+// once here and every file is read from the same generation of the secret.
+func (c TLSConfig) withSecretDirs() TLSConfig {
+	if c.SecretDir != "" {
+		dir := resolveSecretDir(c.SecretDir)
+		c.CertFile = filepath.Join(dir, "tls.crt")
+		c.KeyFile = filepath.Join(dir, "tls.key")
+	}
+	if c.ClientSecretDir != "" {
+		dir := resolveSecretDir(c.ClientSecretDir)
+		c.ClientCertFile = filepath.Join(dir, "tls.crt")
+		c.ClientKeyFile = filepath.Join(dir, "tls.key")
+		if _, err := os.Stat(filepath.Join(dir, "ca.crt")); c.CAFile == "" && err == nil {
+			c.CAFile = filepath.Join(dir, "ca.crt")
+		}
+	}
+	return c
+}
+
+func resolveSecretDir(dir string) string {
+	resolved, err := filepath.EvalSymlinks(filepath.Join(dir, "..data"))
+	if err != nil {
+		return dir
+	}
+	return resolved
+}
+
+func (c TLSConfig) files() []string {
+	files := make([]string, 0)
+	for _, file := range []string{c.CertFile, c.KeyFile, c.ClientCertFile, c.ClientKeyFile, c.CAFile, c.ClientCAFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// tlsStore holds the certificates and CA bundle currently in use. The tls.Config
+// values it hands out look them up on every handshake, so a reload applies to
+// new connections without touching the established ones.
+type tlsStore struct {
+	config TLSConfig
+	policy tlsPolicy
+	spiffe *spiffeSource
+	// preferFamily orders the addresses of backends given by name.
+	preferFamily string
+	// netDialer dials the connections under TLS to the backends, and those
+	// of the health checks with a tls block.
+	netDialer *net.Dialer
+	// plainHealthClient replaces the one of the same name with fips or
+	// with backend socket options, so http and https checks without a tls
+	// block follow them too.
+	plainHealthClient *http.Client
+
+	mu         sync.RWMutex
+	serving    *tls.Certificate
+	client     *tls.Certificate
+	rootCAs    *x509.CertPool
+	clientCAs  *x509.CertPool
+	fileDigest []byte
+}
+
+func newTLSStore(config TLSConfig) (*tlsStore, error) {
+	policy, err := config.policy()
+	if err != nil {
+		return nil, err
+	}
+	store := &tlsStore{config: config, policy: policy}
+	if policy.fips {
+		store.plainHealthClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: policy.apply(&tls.Config{})},
+			Timeout:   healthCheckTimeout,
+		}
+	}
+	err = store.reload()
+	if err != nil {
+		return nil, err
+	}
+	if config.SPIFFE != nil {
+		store.spiffe, err = newSPIFFESource(*config.SPIFFE)
+		if err != nil {
+			return nil, fmt.Errorf("fetching SVID from the workload API: %s", err)
+		}
+	}
+	if config.Vault != nil {
+		err = store.startVault(*config.Vault)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+func (s *tlsStore) reload() error {
+	config := s.config.withSecretDirs()
+	digest, err := digestFiles(config.files())
+	if err != nil {
+		return err
+	}
+
+	var serving, client *tls.Certificate
+	var rootCAs, clientCAs *x509.CertPool
+
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading serving certificate: %s", err)
+		}
+		serving = &cert
+	}
+	if config.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return fmt.Errorf("loading client certificate: %s", err)
+		}
+		client = &cert
+	}
+	if s.policy.fips {
+		for _, cert := range []*tls.Certificate{serving, client} {
+			if cert == nil {
+				continue
+			}
+			err = checkFIPSKey(cert)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if config.CAFile != "" {
+		rootCAs, err = loadCertPool(config.CAFile)
+		if err != nil {
+			return err
+		}
+	}
+	if config.ClientCAFile != "" {
+		clientCAs, err = loadCertPool(config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if config.CertFile != "" {
+		s.serving = serving
+	}
+	if config.ClientCertFile != "" {
+		s.client = client
+	}
+	s.rootCAs = rootCAs
+	s.clientCAs = clientCAs
+	s.fileDigest = digest
+
+	return nil
+}
+
+func (s *tlsStore) startVault(config VaultConfig) error {
+	issuer, err := newVaultIssuer(config)
+	if err != nil {
+		return err
+	}
+	if config.Serving != nil {
+		err = issuer.start(config.Serving, func(cert *tls.Certificate) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.serving = cert
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if config.Client != nil {
+		err = issuer.start(config.Client, func(cert *tls.Certificate) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.client = cert
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *tlsStore) changed() (bool, error) {
+	digest, err := digestFiles(s.config.withSecretDirs().files())
+	if err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !bytes.Equal(digest, s.fileDigest), nil
+}
+
+func (s *tlsStore) watch() {
+	period := s.config.ReloadPeriod
+	if period == 0 {
+		period = defaultTLSReloadPeriod
+	}
+
+	for {
+		time.Sleep(time.Duration(period) * time.Second)
+
+		changed, err := s.changed()
+		if err != nil {
+			log.Printf("Error checking tls files for changes: %s", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		err = s.reload()
+		if err != nil {
+			log.Printf("Error reloading tls files, keeping the previous ones: %s", err)
+			continue
+		}
+		log.Printf("Reloaded tls certificates and CA bundle")
+	}
+}
+
+func (s *tlsStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.serving == nil {
+		return nil, errors.New("no serving certificate loaded")
+	}
+	return s.serving, nil
+}
+
+func (s *tlsStore) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if s.spiffe != nil {
+		return s.spiffe.certificate()
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.client == nil {
+		return &tls.Certificate{}, nil
+	}
+	return s.client, nil
+}
+
+// verifyBackend replaces the standard verification so that a rotated CA
+// bundle is picked up. The SPIFFE trust bundle is used when no ca_file is
+// configured, and without either backends are not verified, which only
+// happens to the health checks, as reencrypt requires one of them.
+func (s *tlsStore) verifyBackend(state tls.ConnectionState, serverName string) error {
+	s.mu.RLock()
+	rootCAs := s.rootCAs
+	s.mu.RUnlock()
+
+	if rootCAs == nil && s.spiffe != nil {
+		var err error
+		rootCAs, err = s.spiffe.rootCAs()
+		if err != nil {
+			return err
+		}
+	}
+
+	if rootCAs == nil {
+		return nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("backend presented no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         rootCAs,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// backendTLSConfig is used for health checks in every mode and for the
+// connections to the apiservers when re-encrypting. The expected server name
+// is the backend host unless it was overridden in the configuration.
+func (s *tlsStore) backendTLSConfig(remote string) *tls.Config {
+	serverName := s.config.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(remote)
+		if err != nil {
+			host = remote
+		}
+		serverName = host
+	}
+
+	return s.policy.apply(&tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return s.verifyBackend(state, serverName)
+		},
+		GetClientCertificate: s.getClientCertificate,
+	})
+}
+
+// backendDialer dials TLS connections to the backends offering nextProtos
+// through ALPN.
+func (s *tlsStore) backendDialer(nextProtos ...string) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		config := s.backendTLSConfig(addr)
+		config.NextProtos = nextProtos
+		dialer := &tls.Dialer{NetDialer: s.netDialer, Config: config}
+		return dialPreferring(ctx, s.preferFamily, addr, func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		})
+	}
+}
+
+// useNetDialer has the connections to the backends, and to those of the
+// health checks, dialed by dialer.
+func (s *tlsStore) useNetDialer(dialer *net.Dialer) {
+	s.netDialer = dialer
+	if dialer.Control == nil {
+		return
+	}
+	transport := &http.Transport{DialContext: dialer.DialContext}
+	if s.plainHealthClient != nil {
+		transport.TLSClientConfig = s.plainHealthClient.Transport.(*http.Transport).TLSClientConfig
+	}
+	s.plainHealthClient = &http.Client{Transport: transport, Timeout: healthCheckTimeout}
+}
+
+func (s *tlsStore) frontendTLSConfig(nextProtos ...string) *tls.Config {
+	if s.config.ClientCAFile == "" {
+		return s.policy.apply(&tls.Config{GetCertificate: s.getCertificate, NextProtos: nextProtos})
+	}
+	return &tls.Config{
+		NextProtos: nextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.clientVerifyingConfig(nextProtos), nil
+		},
+	}
+}
+
+// clientVerifyingConfig builds the frontend config on every handshake so that
+// a rotated client CA bundle is used for verification.
+func (s *tlsStore) clientVerifyingConfig(nextProtos []string) *tls.Config {
+	s.mu.RLock()
+	clientCAs := s.clientCAs
+	s.mu.RUnlock()
+
+	return s.policy.apply(&tls.Config{
+		GetCertificate:   s.getCertificate,
+		NextProtos:       nextProtos,
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		ClientCAs:        clientCAs,
+		VerifyConnection: s.verifyClientName,
+	})
+}
+
+func (s *tlsStore) verifyClientName(state tls.ConnectionState) error {
+	if len(s.config.AllowedClientNames) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	for _, name := range certificateNames(cert) {
+		for _, allowed := range s.config.AllowedClientNames {
+			if name == allowed {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("client certificate %q is not in allowed_client_names", cert.Subject.CommonName)
+}
+
+func certificateNames(cert *x509.Certificate) []string {
+	names := make([]string, 0)
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+func digestFiles(paths []string) ([]byte, error) {
+	hash := sha256.New()
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		hash.Write(data)
+	}
+	return hash.Sum(nil), nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// handshakeFrontend completes the client handshake before anything is sent to
+// the backend, so clients failing verification never reach an apiserver.
+func handshakeFrontend(conn *tls.Conn) error {
+	err := conn.SetDeadline(time.Now().Add(frontendHandshakeTimeout))
+	if err != nil {
+		return err
+	}
+	err = conn.Handshake()
+	if err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
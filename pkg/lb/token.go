@@ -0,0 +1,94 @@
+package lb
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// tokenFile is a bearer token read from a file and read again whenever the
+// file is replaced or modified. The kubelet rotates projected service
+// account tokens by swapping the ..data symlink to a directory holding the
+// new one.
+type tokenFile struct {
+	path string
+
+	mu    sync.Mutex
+	token string
+	info  os.FileInfo
+}
+
+func newTokenFile(path string) *tokenFile {
+	return &tokenFile{path: path}
+}
+
+func (t *tokenFile) read() (string, error) {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return "", err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.info != nil && os.SameFile(info, t.info) && info.ModTime().Equal(t.info.ModTime()) {
+		return t.token, nil
+	}
+	data, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return "", err
+	}
+	t.token = strings.TrimSpace(string(data))
+	t.info = info
+	return t.token, nil
+}
+
+// client returns client sending the token with every request.
+func (t *tokenFile) client(client *http.Client) *http.Client {
+	return bearerClient(t, client)
+}
+
+// tokenSource returns the current bearer token.
+type tokenSource interface {
+	read() (string, error)
+}
+
+func bearerClient(token tokenSource, client *http.Client) *http.Client {
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &http.Client{
+		Transport: &bearerTransport{token: token, next: next},
+		Timeout:   client.Timeout,
+	}
+}
+
+// GetRequestMetadata lets the token authenticate gRPC calls.
+func (t *tokenFile) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := t.read()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+func (t *tokenFile) RequireTransportSecurity() bool {
+	return true
+}
+
+type bearerTransport struct {
+	token tokenSource
+	next  http.RoundTripper
+}
+
+func (b *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := b.token.read()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return b.next.RoundTrip(req)
+}
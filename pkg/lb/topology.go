@@ -0,0 +1,72 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	localityZone   = "zone"
+	localityRegion = "region"
+	localityRemote = "remote"
+)
+
+var topologyPicksTotal = newCounter("topology_picks_total",
+	"Backend selections by locality of the backend picked relative to the lb.", "locality")
+
+// Locality is where an lb or a backend runs.
+type Locality struct {
+	Zone   string `yaml:"zone"`
+	Region string `yaml:"region"`
+}
+
+// TopologyConfig places the lb and its backends so that same-zone backends
+// are preferred, then same-region ones, and other backends are only used
+// when no closer one is healthy.
+type TopologyConfig struct {
+	Locality `yaml:",inline"`
+	Backends map[string]Locality `yaml:"backends"`
+}
+
+func (c *TopologyConfig) validate() error {
+	if c.Zone == "" && c.Region == "" {
+		return errors.New("topology requires the zone or region of the lb")
+	}
+	for server := range c.Backends {
+		err := validateServerAddr(server)
+		if err != nil {
+			return fmt.Errorf("topology backends: %s", err)
+		}
+	}
+	return nil
+}
+
+func (c *TopologyConfig) locality(server string) string {
+	backend := c.Backends[server]
+	switch {
+	case c.Zone != "" && backend.Zone == c.Zone:
+		return localityZone
+	case c.Region != "" && backend.Region == c.Region:
+		return localityRegion
+	}
+	return localityRemote
+}
+
+// prefer returns the closest of servers.
+func (c *TopologyConfig) prefer(servers []string) []string {
+	if c == nil {
+		return servers
+	}
+	for _, locality := range []string{localityZone, localityRegion} {
+		var closest []string
+		for _, server := range servers {
+			if c.locality(server) == locality {
+				closest = append(closest, server)
+			}
+		}
+		if len(closest) > 0 {
+			return closest
+		}
+	}
+	return servers
+}
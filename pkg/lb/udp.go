@@ -0,0 +1,243 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	serviceUDP = "udp"
+
+	defaultUDPSessionTimeout = 60
+	maxUDPPacketSize         = 65535
+)
+
+var (
+	udpSessionsActive = newGauge("udp_sessions_active",
+		"UDP client sessions currently mapped to a backend.")
+	udpSessionsTotal = newCounter("udp_sessions_total",
+		"UDP client sessions opened.")
+)
+
+// UDPConfig tunes the listeners of the udp service.
+type UDPConfig struct {
+	SessionTimeout int `yaml:"session_timeout"`
+}
+
+func (c UDPConfig) validate() error {
+	if c.SessionTimeout < 0 {
+		return errors.New("udp session_timeout must not be negative")
+	}
+	return nil
+}
+
+func (c UDPConfig) sessionTimeout() time.Duration {
+	if c.SessionTimeout == 0 {
+		return defaultUDPSessionTimeout * time.Second
+	}
+	return time.Duration(c.SessionTimeout) * time.Second
+}
+
+// udpSession maps a client address to the backend it was balanced to,
+// through a socket connected to that backend that carries the replies back.
+type udpSession struct {
+	client     net.Addr
+	server     string
+	backend    *net.UDPConn
+	lastActive time.Time
+}
+
+// udpSessions is the session table of a udp listener, keyed by client
+// address. Sessions idle for longer than timeout are expired by sweep.
+type udpSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	timeout  time.Duration
+}
+
+func (s *udpSessions) get(client net.Addr) *udpSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session := s.sessions[client.String()]
+	if session != nil {
+		session.lastActive = time.Now()
+	}
+	return session
+}
+
+func (s *udpSessions) add(session *udpSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session.lastActive = time.Now()
+	s.sessions[session.client.String()] = session
+	udpSessionsTotal.inc()
+	udpSessionsActive.set(float64(len(s.sessions)))
+}
+
+func (s *udpSessions) remove(session *udpSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[session.client.String()] == session {
+		delete(s.sessions, session.client.String())
+		session.backend.Close()
+	}
+	udpSessionsActive.set(float64(len(s.sessions)))
+}
+
+func (s *udpSessions) sweep(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		for key, session := range s.sessions {
+			if time.Since(session.lastActive) > s.timeout {
+				delete(s.sessions, key)
+				session.backend.Close()
+			}
+		}
+		udpSessionsActive.set(float64(len(s.sessions)))
+		s.mu.Unlock()
+	}
+}
+
+func (s *udpSessions) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, session := range s.sessions {
+		delete(s.sessions, key)
+		session.backend.Close()
+	}
+	udpSessionsActive.set(0)
+}
+
+// StartUDP forwards datagrams. Every client address is pinned to a backend
+// until it goes idle for session_timeout or the backend turns unhealthy.
+func (lb *apiServerLb) StartUDP() error {
+	lb.state = newLBState(lb.allServers(), lb.healthCheckFor, lb.onNoHealthy, lb.minHealthy)
+	lb.state.balancer = lb.balancer(balanceRoundRobin)
+	lb.state.topology = lb.topology
+	lb.state.swapBackends = lb.swapBackends
+	lb.state.swaps = lb.swaps
+	healthResultsChan := make(chan []probeResult, 1)
+	stopChecks := make(chan struct{})
+	defer close(stopChecks)
+	go lb.startHealthChecks(healthResultsChan, stopChecks)
+	go func() {
+		for results := range healthResultsChan {
+			lb.state.applyProbes(results)
+			lb.probeBuffers.put(results)
+		}
+	}()
+
+	conn, err := net.ListenPacket("udp", lb.Local)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if ok, err := lb.hardened(); !ok {
+		return err
+	}
+	defer listenerBound(lb.name, lb.state)()
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-lb.shutdown:
+			conn.Close()
+		case <-stopped:
+		}
+	}()
+
+	sessions := &udpSessions{sessions: make(map[string]*udpSession), timeout: lb.udpConfig.sessionTimeout()}
+	defer sessions.closeAll()
+	go sessions.sweep(stopped)
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-lb.shutdown:
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return fmt.Errorf("reading datagrams: %s", err)
+		}
+		if lb.standby != nil && !lb.standby.isActive() {
+			standbyRejectedTotal.inc()
+			continue
+		}
+
+		session := sessions.get(client)
+		if session != nil && !lb.state.isHealthy(session.server) {
+			sessions.remove(session)
+			session = nil
+		}
+		if session == nil {
+			session, err = lb.openUDPSession(conn, client, sessions)
+			if err != nil {
+				log.Printf("Error opening udp session for %s: %s", client, err)
+				continue
+			}
+		}
+
+		_, err = session.backend.Write(buf[:n])
+		if err != nil {
+			log.Printf("Error forwarding datagram from %s to %s: %s", client, session.server, err)
+		}
+	}
+}
+
+func (lb *apiServerLb) openUDPSession(conn net.PacketConn, client net.Addr, sessions *udpSessions) (*udpSession, error) {
+	server, err := lb.state.pick(defaultServersKey, lb.remoteServers())
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	dialed, err := lb.netDialer.Dial("udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	backend := dialed.(*net.UDPConn)
+
+	session := &udpSession{client: client, server: server, backend: backend}
+	sessions.add(session)
+	go func() {
+		defer sessions.remove(session)
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, err := backend.Read(buf)
+			if err != nil {
+				if !isExpectedCloseError(err) {
+					log.Printf("Error reading datagrams from %s: %s", server, err)
+				}
+				return
+			}
+			if sessions.get(client) != session {
+				return
+			}
+			_, err = conn.WriteTo(buf[:n], client)
+			if err != nil {
+				log.Printf("Error sending datagram to %s: %s", client, err)
+				return
+			}
+		}
+	}()
+	return session, nil
+}
@@ -0,0 +1,169 @@
+package lb
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultVaultMount   = "pki"
+	vaultRetryPeriod    = 30 * time.Second
+	vaultRequestTimeout = 10 * time.Second
+)
+
+type VaultCertificate struct {
+	Role       string   `yaml:"role"`
+	CommonName string   `yaml:"common_name"`
+	AltNames   []string `yaml:"alt_names"`
+	IPSans     []string `yaml:"ip_sans"`
+	TTL        string   `yaml:"ttl"`
+}
+
+type VaultConfig struct {
+	Address   string            `yaml:"address"`
+	TokenFile string            `yaml:"token_file"`
+	Mount     string            `yaml:"mount"`
+	CAFile    string            `yaml:"ca_file"`
+	Serving   *VaultCertificate `yaml:"serving"`
+	Client    *VaultCertificate `yaml:"client"`
+}
+
+func (c VaultConfig) validate() error {
+	if c.Address == "" || c.TokenFile == "" {
+		return errors.New("tls vault requires address and token_file")
+	}
+	for _, cert := range []*VaultCertificate{c.Serving, c.Client} {
+		if cert != nil && (cert.Role == "" || cert.CommonName == "") {
+			return errors.New("vault certificates require role and common_name")
+		}
+	}
+	return nil
+}
+
+type vaultIssueResponse struct {
+	Data struct {
+		Certificate string   `json:"certificate"`
+		PrivateKey  string   `json:"private_key"`
+		CAChain     []string `json:"ca_chain"`
+		Expiration  int64    `json:"expiration"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// vaultIssuer requests certificates from the PKI secrets engine and renews
+// them once two thirds of their lifetime has passed, so no long-lived key
+// material has to be distributed to the nodes.
+type vaultIssuer struct {
+	config VaultConfig
+	client *http.Client
+}
+
+func newVaultIssuer(config VaultConfig) (*vaultIssuer, error) {
+	transport := &http.Transport{}
+	if config.CAFile != "" {
+		pool, err := loadCertPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if config.Mount == "" {
+		config.Mount = defaultVaultMount
+	}
+
+	return &vaultIssuer{
+		config: config,
+		client: &http.Client{Transport: transport, Timeout: vaultRequestTimeout},
+	}, nil
+}
+
+func (v *vaultIssuer) issue(request *VaultCertificate) (*tls.Certificate, time.Time, error) {
+	token, err := ioutil.ReadFile(v.config.TokenFile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"common_name": request.CommonName,
+		"alt_names":   strings.Join(request.AltNames, ","),
+		"ip_sans":     strings.Join(request.IPSans, ","),
+		"ttl":         request.TTL,
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/issue/%s", strings.TrimRight(v.config.Address, "/"), v.config.Mount, request.Role)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req.Header.Set("X-Vault-Token", strings.TrimSpace(string(token)))
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	issued := &vaultIssueResponse{}
+	err = json.NewDecoder(resp.Body).Decode(issued)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("decoding vault response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("vault returned HTTP status code %d: %s", resp.StatusCode, strings.Join(issued.Errors, ", "))
+	}
+
+	chain := issued.Data.Certificate
+	for _, ca := range issued.Data.CAChain {
+		chain += "\n" + ca
+	}
+	cert, err := tls.X509KeyPair([]byte(chain), []byte(issued.Data.PrivateKey))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return &cert, time.Unix(issued.Data.Expiration, 0), nil
+}
+
+// renew keeps issuing the certificate and hands every new one to update. The
+// first certificate has already been issued by the caller.
+func (v *vaultIssuer) renew(request *VaultCertificate, issuedAt, expiration time.Time, update func(*tls.Certificate)) {
+	for {
+		wait := expiration.Sub(issuedAt) * 2 / 3
+		time.Sleep(time.Until(issuedAt.Add(wait)))
+
+		for {
+			cert, newExpiration, err := v.issue(request)
+			if err == nil {
+				update(cert)
+				issuedAt, expiration = time.Now(), newExpiration
+				log.Printf("Renewed vault certificate for %s, expires at %s", request.CommonName, expiration)
+				break
+			}
+			log.Printf("Error renewing vault certificate for %s: %s", request.CommonName, err)
+			time.Sleep(vaultRetryPeriod)
+		}
+	}
+}
+
+func (v *vaultIssuer) start(request *VaultCertificate, update func(*tls.Certificate)) error {
+	issuedAt := time.Now()
+	cert, expiration, err := v.issue(request)
+	if err != nil {
+		return fmt.Errorf("issuing vault certificate for %s: %s", request.CommonName, err)
+	}
+	update(cert)
+
+	go v.renew(request, issuedAt, expiration, update)
+	return nil
+}
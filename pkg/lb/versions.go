@@ -0,0 +1,207 @@
+package lb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	defaultVersionPeriod       = 60
+	defaultVersionMaxMinorSkew = 1
+
+	preferNewest = "newest"
+	preferOldest = "oldest"
+)
+
+var (
+	backendVersionInfo = newGauge("backend_version_info",
+		"1 for the version each backend reports on /version.", "backend", "git_version")
+	versionSkewMinor = newGauge("version_skew_minor",
+		"Minor versions between the newest and the oldest backend of a listener.", "listener")
+	versionSkewExceeded = newGauge("version_skew_exceeded",
+		"1 when the backends of a listener are further apart than max_minor_skew.", "listener")
+)
+
+var gitVersionPattern = regexp.MustCompile(`^v(\d+)\.(\d+)\.`)
+
+// VersionSkewConfig polls /version on the apiservers to warn about versions
+// further apart than max_minor_skew, and optionally to prefer the newest or
+// oldest ones while a control plane upgrade is rolling.
+type VersionSkewConfig struct {
+	Period       int    `yaml:"period"`
+	MaxMinorSkew int    `yaml:"max_minor_skew"`
+	Prefer       string `yaml:"prefer"`
+}
+
+func (c *VersionSkewConfig) validate() error {
+	if c.Period < 0 || c.MaxMinorSkew < 0 {
+		return errors.New("version_skew period and max_minor_skew must not be negative")
+	}
+	switch c.Prefer {
+	case "", preferNewest, preferOldest:
+	default:
+		return fmt.Errorf("version_skew prefer must be %s or %s", preferNewest, preferOldest)
+	}
+	return nil
+}
+
+type apiVersion struct {
+	gitVersion string
+	major      int
+	minor      int
+}
+
+func (v apiVersion) less(other apiVersion) bool {
+	if v.major != other.major {
+		return v.major < other.major
+	}
+	return v.minor < other.minor
+}
+
+func parseAPIVersion(gitVersion string) (apiVersion, error) {
+	match := gitVersionPattern.FindStringSubmatch(gitVersion)
+	if match == nil {
+		return apiVersion{}, fmt.Errorf("unexpected gitVersion %q", gitVersion)
+	}
+	v := apiVersion{gitVersion: gitVersion}
+	fmt.Sscan(match[1], &v.major)
+	fmt.Sscan(match[2], &v.minor)
+	return v, nil
+}
+
+// versionTracker holds the last version seen on each backend.
+type versionTracker struct {
+	prefer string
+
+	mu       sync.Mutex
+	versions map[string]apiVersion
+}
+
+func newVersionTracker(prefer string) *versionTracker {
+	return &versionTracker{prefer: prefer, versions: make(map[string]apiVersion)}
+}
+
+// preferred narrows servers to those on the newest or oldest version, if the
+// tracker is set to prefer one. Backends of unknown version are kept out
+// unless no version is known at all.
+func (t *versionTracker) preferred(servers []string) []string {
+	if t == nil || t.prefer == "" {
+		return servers
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var best *apiVersion
+	for _, server := range servers {
+		v, ok := t.versions[server]
+		if !ok {
+			continue
+		}
+		if best == nil || (t.prefer == preferNewest && best.less(v)) || (t.prefer == preferOldest && v.less(*best)) {
+			best = &v
+		}
+	}
+	if best == nil {
+		return servers
+	}
+	var preferred []string
+	for _, server := range servers {
+		v, ok := t.versions[server]
+		if ok && v.major == best.major && v.minor == best.minor {
+			preferred = append(preferred, server)
+		}
+	}
+	return preferred
+}
+
+func fetchVersion(client *http.Client, server string) (apiVersion, error) {
+	resp, err := client.Get(fmt.Sprintf("https://%s/version", server))
+	if err != nil {
+		return apiVersion{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return apiVersion{}, fmt.Errorf("HTTP status code : %d", resp.StatusCode)
+	}
+	var info struct {
+		GitVersion string `json:"gitVersion"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	if err != nil {
+		return apiVersion{}, err
+	}
+	return parseAPIVersion(info.GitVersion)
+}
+
+// watchVersions polls the version of every backend until stop is closed.
+func (lb *apiServerLb) watchVersions(tracker *versionTracker, stop <-chan struct{}) {
+	config := lb.versionSkew
+	period := config.Period
+	if period == 0 {
+		period = defaultVersionPeriod
+	}
+	maxSkew := config.MaxMinorSkew
+	if maxSkew == 0 {
+		maxSkew = defaultVersionMaxMinorSkew
+	}
+
+	ticker := time.NewTicker(time.Duration(period) * time.Second)
+	defer ticker.Stop()
+	warned := false
+	for {
+		for _, server := range lb.remoteServers() {
+			v, err := fetchVersion(lb.httpClient, server)
+			if err != nil {
+				log.Printf("Error getting the version of %s: %s", server, err)
+				continue
+			}
+			tracker.mu.Lock()
+			previous, ok := tracker.versions[server]
+			tracker.versions[server] = v
+			tracker.mu.Unlock()
+			if ok && previous.gitVersion != v.gitVersion {
+				backendVersionInfo.set(0, server, previous.gitVersion)
+				log.Printf("Backend %s was upgraded from %s to %s", server, previous.gitVersion, v.gitVersion)
+			}
+			backendVersionInfo.set(1, server, v.gitVersion)
+		}
+
+		skew := tracker.minorSkew()
+		versionSkewMinor.set(float64(skew), lb.name)
+		exceeded := skew > maxSkew
+		versionSkewExceeded.set(boolGauge(exceeded), lb.name)
+		if exceeded && !warned {
+			log.Printf("Warning: backends of listener %s are %d minor versions apart, more than the supported %d", lb.name, skew, maxSkew)
+		}
+		warned = exceeded
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// minorSkew is the number of minor versions between the newest and oldest
+// backend, assuming they share the major version.
+func (t *versionTracker) minorSkew() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	oldest, newest := -1, -1
+	for _, v := range t.versions {
+		if oldest == -1 || v.minor < oldest {
+			oldest = v.minor
+		}
+		if v.minor > newest {
+			newest = v.minor
+		}
+	}
+	return newest - oldest
+}
@@ -0,0 +1,157 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	vipAnnouncements        = 3
+	vipAnnouncementInterval = 200 * time.Millisecond
+	vipCheckPeriod          = time.Second
+	vipProbeTimeout         = 500 * time.Millisecond
+)
+
+var (
+	vipHeldGauge = newGauge("vip_held",
+		"1 while this instance has the virtual IP assigned.")
+	vipAnnouncementsTotal = newCounter("vip_announcements_total",
+		"Gratuitous ARPs or unsolicited neighbor advertisements sent for the virtual IP.")
+)
+
+// virtualIP is an address moved between lb hosts by the HA modes.
+type virtualIP struct {
+	iface *net.Interface
+	addr  *net.IPNet
+	held  bool
+}
+
+// parseVirtualIP parses an address with its prefix length, like
+// 10.0.0.100/24, and checks that iface exists.
+func parseVirtualIP(ifaceName string, address string) (*virtualIP, error) {
+	ip, network, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, fmt.Errorf("virtual ip must be an address with a prefix length: %s", err)
+	}
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %s", ifaceName, err)
+	}
+	return &virtualIP{iface: iface, addr: &net.IPNet{IP: ip, Mask: network.Mask}}, nil
+}
+
+func (v *virtualIP) acquire() {
+	if v.held {
+		return
+	}
+	err := addAddress(v.iface, v.addr)
+	if err != nil && !errors.Is(err, syscall.EEXIST) {
+		log.Printf("Error adding virtual ip %s: %s", v.addr, err)
+		return
+	}
+	v.held = true
+	vipHeldGauge.set(1)
+	log.Printf("Acquired virtual ip %s on %s", v.addr, v.iface.Name)
+	go v.announce()
+}
+
+// announce repeats the announcement a few times, in case the first is lost
+// while the link is busy with the failover.
+func (v *virtualIP) announce() {
+	for i := 0; i < vipAnnouncements; i++ {
+		if i > 0 {
+			time.Sleep(vipAnnouncementInterval)
+		}
+		err := announceAddress(v.iface, v.addr.IP)
+		if err != nil {
+			log.Printf("Error announcing virtual ip %s: %s", v.addr, err)
+			return
+		}
+		vipAnnouncementsTotal.inc()
+	}
+}
+
+func (v *virtualIP) release() {
+	if !v.held {
+		return
+	}
+	err := delAddress(v.iface, v.addr)
+	if err != nil && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		log.Printf("Error removing virtual ip %s: %s", v.addr, err)
+		return
+	}
+	v.held = false
+	vipHeldGauge.set(0)
+	log.Printf("Released virtual ip %s from %s", v.addr, v.iface.Name)
+}
+
+// VIPConfig makes the lb hold address on interface while every listener is
+// bound and has a healthy backend, for two node failover without VRRP. An
+// instance only takes the address when no other host on the link answers
+// for it, so the first healthy one keeps it until it becomes unhealthy.
+type VIPConfig struct {
+	Interface string `yaml:"interface"`
+	Address   string `yaml:"address"`
+}
+
+func (c *VIPConfig) validate() error {
+	if c.Interface == "" {
+		return errors.New("vip interface is required")
+	}
+	_, _, err := net.ParseCIDR(c.Address)
+	if err != nil {
+		return errors.New("vip address must be an address with a prefix length, like 10.0.0.100/24")
+	}
+	return nil
+}
+
+// startVIP adds and removes the address following the health of this
+// instance until shutdown. The returned channel is closed once the address
+// was released.
+func startVIP(config VIPConfig, listeners int, shutdown <-chan struct{}) (<-chan struct{}, error) {
+	vip, err := parseVirtualIP(config.Interface, config.Address)
+	if err != nil {
+		return nil, err
+	}
+	// Fail at startup rather than on every check when probing isn't
+	// possible, on other platforms or without CAP_NET_RAW.
+	_, err = addressInUse(vip.iface, vip.addr.IP, 0)
+	if err != nil {
+		return nil, err
+	}
+	vipHeldGauge.set(0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(vipCheckPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-shutdown:
+				vip.release()
+				return
+			case <-ticker.C:
+			}
+			if !backendsHealthy(listeners) {
+				vip.release()
+				continue
+			}
+			if vip.held {
+				continue
+			}
+			inUse, err := addressInUse(vip.iface, vip.addr.IP, vipProbeTimeout)
+			if err != nil {
+				log.Printf("Error probing for virtual ip %s: %s", vip.addr, err)
+				continue
+			}
+			if !inUse {
+				vip.acquire()
+			}
+		}
+	}()
+	return done, nil
+}
@@ -0,0 +1,139 @@
+package lb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	vrrpProtocol       = 112
+	vrrpVersionAdvert  = 0x31
+	vrrpTTL            = 255
+	vrrpHeaderSize     = 8
+	defaultVRRPAdvert  = 1000
+	defaultVRRPPrio    = 100
+	vrrpOwnerPriority  = 255
+	vrrpMaxAdvertCenti = 0x0fff
+)
+
+var vrrpGroup = net.IPv4(224, 0, 0, 18)
+
+// VRRPConfig makes lb hosts share virtual_ip with VRRPv3 (RFC 5798). The
+// priority is advertised while every listener is bound and has a healthy
+// backend, unhealthy_priority otherwise, so a peer with healthy backends
+// preempts the master whose backends are down.
+type VRRPConfig struct {
+	Interface         string   `yaml:"interface"`
+	VirtualRouterID   int      `yaml:"virtual_router_id"`
+	Priority          int      `yaml:"priority"`
+	UnhealthyPriority int      `yaml:"unhealthy_priority"`
+	AdvertIntervalMs  int      `yaml:"advert_interval_ms"`
+	VirtualIP         string   `yaml:"virtual_ip"`
+	Peers             []string `yaml:"peers"`
+	NoPreempt         bool     `yaml:"nopreempt"`
+}
+
+func (c *VRRPConfig) validate() error {
+	if c.Interface == "" {
+		return errors.New("vrrp interface is required")
+	}
+	if c.VirtualRouterID < 1 || c.VirtualRouterID > 255 {
+		return errors.New("vrrp virtual_router_id must be between 1 and 255")
+	}
+	if c.Priority == 0 {
+		c.Priority = defaultVRRPPrio
+	}
+	if c.Priority < 1 || c.Priority >= vrrpOwnerPriority {
+		return errors.New("vrrp priority must be between 1 and 254")
+	}
+	if c.UnhealthyPriority == 0 {
+		c.UnhealthyPriority = 1
+	}
+	if c.UnhealthyPriority < 1 || c.UnhealthyPriority > c.Priority {
+		return errors.New("vrrp unhealthy_priority must be between 1 and priority")
+	}
+	if c.AdvertIntervalMs == 0 {
+		c.AdvertIntervalMs = defaultVRRPAdvert
+	}
+	if c.AdvertIntervalMs < 10 || c.AdvertIntervalMs/10 > vrrpMaxAdvertCenti || c.AdvertIntervalMs%10 != 0 {
+		return errors.New("vrrp advert_interval_ms must be a multiple of 10 between 10 and 40950")
+	}
+	ip, _, err := net.ParseCIDR(c.VirtualIP)
+	if err != nil || ip.To4() == nil {
+		return errors.New("vrrp virtual_ip must be an IPv4 address with a prefix length, like 10.0.0.100/24")
+	}
+	for _, peer := range c.Peers {
+		if ip := net.ParseIP(peer); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("vrrp peer %q is not an IPv4 address", peer)
+		}
+	}
+	return nil
+}
+
+// vrrpAdvert is a VRRPv3 advertisement. interval is in centiseconds.
+type vrrpAdvert struct {
+	routerID uint8
+	priority uint8
+	interval uint16
+	addrs    []net.IP
+}
+
+func (a vrrpAdvert) marshal(src net.IP, dst net.IP) []byte {
+	b := make([]byte, vrrpHeaderSize, vrrpHeaderSize+4*len(a.addrs))
+	b[0] = vrrpVersionAdvert
+	b[1] = a.routerID
+	b[2] = a.priority
+	b[3] = uint8(len(a.addrs))
+	binary.BigEndian.PutUint16(b[4:], a.interval&vrrpMaxAdvertCenti)
+	for _, addr := range a.addrs {
+		b = append(b, addr.To4()...)
+	}
+	binary.BigEndian.PutUint16(b[6:], vrrpChecksum(src, dst, b))
+	return b
+}
+
+func parseVRRPAdvert(b []byte, src net.IP, dst net.IP) (vrrpAdvert, error) {
+	if len(b) < vrrpHeaderSize {
+		return vrrpAdvert{}, errors.New("short VRRP packet")
+	}
+	if b[0] != vrrpVersionAdvert {
+		return vrrpAdvert{}, fmt.Errorf("not a VRRPv3 advertisement: 0x%02x", b[0])
+	}
+	if vrrpChecksum(src, dst, b) != 0 {
+		return vrrpAdvert{}, errors.New("bad VRRP checksum")
+	}
+	a := vrrpAdvert{routerID: b[1], priority: b[2], interval: binary.BigEndian.Uint16(b[4:]) & vrrpMaxAdvertCenti}
+	count := int(b[3])
+	if len(b) < vrrpHeaderSize+4*count {
+		return vrrpAdvert{}, errors.New("short VRRP address list")
+	}
+	for i := 0; i < count; i++ {
+		offset := vrrpHeaderSize + 4*i
+		a.addrs = append(a.addrs, net.IP(b[offset:offset+4]))
+	}
+	return a, nil
+}
+
+// vrrpChecksum is the internet checksum of b with the IPv4 pseudo-header
+// VRRPv3 includes. Over a packet holding its checksum it is 0.
+func vrrpChecksum(src net.IP, dst net.IP, b []byte) uint16 {
+	var sum uint32
+	add := func(data []byte) {
+		for i := 0; i+1 < len(data); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(data[i:]))
+		}
+		if len(data)%2 == 1 {
+			sum += uint32(data[len(data)-1]) << 8
+		}
+	}
+	add(src.To4())
+	add(dst.To4())
+	sum += vrrpProtocol + uint32(len(b))
+	add(b)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,274 @@
+package lb
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	vrrpStateBackup = "backup"
+	vrrpStateMaster = "master"
+)
+
+var vrrpMasterGauge = newGauge("vrrp_master",
+	"1 while this instance is the VRRP master.")
+
+type receivedAdvert struct {
+	src    net.IP
+	advert vrrpAdvert
+}
+
+type vrrpSpeaker struct {
+	config    VRRPConfig
+	listeners int
+	vip       *virtualIP
+	primary   net.IP
+	senders   []*net.IPConn
+	dsts      []net.IP
+	recv      *net.IPConn
+	interval  time.Duration
+}
+
+// startVRRP runs the VRRP state machine until shutdown. The returned channel
+// is closed once the virtual IP was released and the backups were told to
+// take over.
+func startVRRP(config VRRPConfig, listeners int, shutdown <-chan struct{}) (<-chan struct{}, error) {
+	vip, err := parseVirtualIP(config.Interface, config.VirtualIP)
+	if err != nil {
+		return nil, err
+	}
+	primary, err := primaryIPv4(vip)
+	if err != nil {
+		return nil, err
+	}
+	s := &vrrpSpeaker{
+		config:    config,
+		listeners: listeners,
+		vip:       vip,
+		primary:   primary,
+		interval:  time.Duration(config.AdvertIntervalMs) * time.Millisecond,
+	}
+
+	s.dsts = []net.IP{vrrpGroup}
+	if len(config.Peers) > 0 {
+		s.dsts = nil
+		for _, peer := range config.Peers {
+			s.dsts = append(s.dsts, net.ParseIP(peer))
+		}
+	}
+	for _, dst := range s.dsts {
+		conn, err := net.DialIP(fmt.Sprintf("ip4:%d", vrrpProtocol), &net.IPAddr{IP: primary}, &net.IPAddr{IP: dst})
+		if err != nil {
+			return nil, err
+		}
+		err = setSockopts(conn, func(fd int) error {
+			err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TTL, vrrpTTL)
+			if err == nil {
+				err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, vrrpTTL)
+			}
+			if err == nil {
+				err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 0)
+			}
+			if err == nil {
+				err = syscall.SetsockoptIPMreqn(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, &syscall.IPMreqn{Ifindex: int32(vip.iface.Index)})
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		s.senders = append(s.senders, conn)
+	}
+
+	s.recv, err = net.ListenIP(fmt.Sprintf("ip4:%d", vrrpProtocol), &net.IPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	err = setSockopts(s.recv, func(fd int) error {
+		if len(config.Peers) > 0 {
+			return nil
+		}
+		mreq := &syscall.IPMreqn{Ifindex: int32(vip.iface.Index)}
+		copy(mreq.Multiaddr[:], vrrpGroup.To4())
+		return syscall.SetsockoptIPMreqn(fd, syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	adverts := make(chan receivedAdvert, 16)
+	go s.receive(adverts)
+	done := make(chan struct{})
+	go s.run(adverts, shutdown, done)
+	return done, nil
+}
+
+func setSockopts(conn *net.IPConn, set func(fd int) error) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	controlErr := rawConn.Control(func(fd uintptr) {
+		err = set(int(fd))
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+// primaryIPv4 is the address of the interface the advertisements come from.
+func primaryIPv4(vip *virtualIP) (net.IP, error) {
+	addrs, err := vip.iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.To4() != nil && !ipNet.IP.Equal(vip.addr.IP) {
+			return ipNet.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no IPv4 address besides the virtual ip", vip.iface.Name)
+}
+
+// receive hands the valid advertisements of our virtual router to adverts.
+// Raw IPv4 sockets return the packets with their IP header, which holds the
+// TTL to check and the destination the checksum covers.
+func (s *vrrpSpeaker) receive(adverts chan<- receivedAdvert) {
+	buf := make([]byte, 1500)
+	for {
+		n, _, _, addr, err := s.recv.ReadMsgIP(buf, nil)
+		if err != nil {
+			if !isExpectedCloseError(err) {
+				log.Printf("Error reading VRRP advertisements: %s", err)
+			}
+			return
+		}
+		packet := buf[:n]
+		if len(packet) < 20 || packet[0]>>4 != 4 {
+			continue
+		}
+		headerLen := int(packet[0]&0x0f) * 4
+		if addr.IP.Equal(s.primary) || len(packet) < headerLen || packet[8] != vrrpTTL {
+			continue
+		}
+		dst := net.IP(packet[16:20])
+		advert, err := parseVRRPAdvert(packet[headerLen:], addr.IP, dst)
+		if err != nil {
+			log.Printf("Dropping VRRP packet from %s: %s", addr.IP, err)
+			continue
+		}
+		if int(advert.routerID) != s.config.VirtualRouterID {
+			continue
+		}
+		adverts <- receivedAdvert{src: addr.IP, advert: advert}
+	}
+}
+
+func (s *vrrpSpeaker) priority() uint8 {
+	if backendsHealthy(s.listeners) {
+		return uint8(s.config.Priority)
+	}
+	return uint8(s.config.UnhealthyPriority)
+}
+
+// skew is the Skew_Time of RFC 5798, letting higher priority backups take
+// over first.
+func (s *vrrpSpeaker) skew(interval time.Duration) time.Duration {
+	return time.Duration(256-int(s.priority())) * interval / 256
+}
+
+func (s *vrrpSpeaker) masterDown(interval time.Duration) time.Duration {
+	return 3*interval + s.skew(interval)
+}
+
+func (s *vrrpSpeaker) advertise(priority uint8) {
+	advert := vrrpAdvert{
+		routerID: uint8(s.config.VirtualRouterID),
+		priority: priority,
+		interval: uint16(s.interval / (10 * time.Millisecond)),
+		addrs:    []net.IP{s.vip.addr.IP},
+	}
+	for i, conn := range s.senders {
+		_, err := conn.Write(advert.marshal(s.primary, s.dsts[i]))
+		if err != nil {
+			log.Printf("Error sending VRRP advertisement to %s: %s", s.dsts[i], err)
+		}
+	}
+}
+
+func (s *vrrpSpeaker) run(adverts <-chan receivedAdvert, shutdown <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	defer s.recv.Close()
+
+	state := vrrpStateBackup
+	vrrpMasterGauge.set(0)
+	timer := time.NewTimer(s.masterDown(s.interval))
+	reset := func(d time.Duration) {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d)
+	}
+	for {
+		select {
+		case <-shutdown:
+			if state == vrrpStateMaster {
+				s.advertise(0)
+				s.vip.release()
+			}
+			return
+
+		case received := <-adverts:
+			advert := received.advert
+			switch state {
+			case vrrpStateBackup:
+				masterInterval := time.Duration(advert.interval) * 10 * time.Millisecond
+				if advert.priority == 0 {
+					reset(s.skew(masterInterval))
+				} else if s.config.NoPreempt || advert.priority >= s.priority() {
+					reset(s.masterDown(masterInterval))
+				}
+			case vrrpStateMaster:
+				priority := s.priority()
+				if advert.priority == 0 {
+					s.advertise(priority)
+					reset(s.interval)
+				} else if advert.priority > priority || (advert.priority == priority && ipGreater(received.src, s.primary)) {
+					log.Printf("VRRP router %d is backup, %s advertises priority %d over our %d", s.config.VirtualRouterID, received.src, advert.priority, priority)
+					state = vrrpStateBackup
+					vrrpMasterGauge.set(0)
+					s.vip.release()
+					reset(s.masterDown(time.Duration(advert.interval) * 10 * time.Millisecond))
+				}
+			}
+
+		case <-timer.C:
+			if state == vrrpStateBackup {
+				log.Printf("VRRP router %d is master with priority %d", s.config.VirtualRouterID, s.priority())
+				state = vrrpStateMaster
+				vrrpMasterGauge.set(1)
+				s.vip.acquire()
+			}
+			s.advertise(s.priority())
+			timer.Reset(s.interval)
+		}
+	}
+}
+
+func ipGreater(a net.IP, b net.IP) bool {
+	a, b = a.To4(), b.To4()
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package lb
+
+func startVRRP(config VRRPConfig, listeners int, shutdown <-chan struct{}) (<-chan struct{}, error) {
+	return nil, errVIPUnsupported
+}
@@ -0,0 +1,36 @@
+package lb
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const waitForBackendsInterval = time.Second
+
+// waitForBackends blocks until one of servers answers its health check, or
+// until timeout when it is not 0, so clients starting alongside the lb on
+// node boot don't get refused connections before any apiserver is up.
+func waitForBackends(client *http.Client, servers []string, timeout time.Duration) {
+	start := time.Now()
+	log.Printf("Waiting for a healthy kube-apiserver before listening")
+	for {
+		for _, server := range servers {
+			resp, err := client.Get(fmt.Sprintf("https://%s/healthz", server))
+			if err != nil {
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				log.Printf("kube-apiserver %s is healthy after %s", server, time.Since(start).Round(time.Millisecond))
+				return
+			}
+		}
+		if timeout > 0 && time.Since(start) >= timeout {
+			log.Printf("No kube-apiserver became healthy within %s, listening anyway", timeout)
+			return
+		}
+		time.Sleep(waitForBackendsInterval)
+	}
+}
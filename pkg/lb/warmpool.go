@@ -0,0 +1,250 @@
+package lb
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWarmPoolMaxAge = 30
+
+	warmPoolRefillPeriod = 1 * time.Second
+	warmPoolDialTimeout  = 5 * time.Second
+)
+
+var (
+	warmPoolIdleGauge = newGauge("warm_pool_connections",
+		"Idle pre-established connections of warm_pool, by backend.", "listener", "backend")
+	warmPoolTakesTotal = newCounter("warm_pool_takes_total",
+		"Client connections that took a warm_pool connection (hit), found none (miss), or found only dead or aged ones (stale).",
+		"listener", "result")
+	warmPoolDialErrorsTotal = newCounter("warm_pool_dial_errors_total",
+		"Connections warm_pool failed to establish ahead of time.", "listener", "backend")
+)
+
+// WarmPoolConfig keeps size connections established to every healthy
+// backend, so a new client is paired with one at once instead of waiting
+// for a dial in the accept path. Connections idle for max_age seconds are
+// replaced, as the backends or the network in between may drop them. With
+// tls, in tls mode reencrypt, the TLS handshake with the backend is done
+// ahead of time too. TCP listeners in mode l4 only.
+type WarmPoolConfig struct {
+	Size   int  `yaml:"size"`
+	MaxAge int  `yaml:"max_age"`
+	TLS    bool `yaml:"tls"`
+}
+
+func (c *WarmPoolConfig) validate() error {
+	if c.Size <= 0 {
+		return errors.New("warm_pool size must be positive")
+	}
+	if c.MaxAge < 0 {
+		return errors.New("warm_pool max_age must not be negative")
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultWarmPoolMaxAge
+	}
+	return nil
+}
+
+type warmConn struct {
+	conn    net.Conn
+	created time.Time
+}
+
+// warmPool holds the idle connections of a listener. take does nothing on a
+// nil warmPool, which is what newWarmPool returns without warm_pool.
+type warmPool struct {
+	lb     *apiServerLb
+	size   int
+	maxAge time.Duration
+	tls    bool
+	// taken wakes up the refill loop early after a take.
+	taken chan struct{}
+
+	mu   sync.Mutex
+	idle map[string][]warmConn
+}
+
+func newWarmPool(lb *apiServerLb, config *WarmPoolConfig) *warmPool {
+	if config == nil {
+		return nil
+	}
+	return &warmPool{
+		lb:     lb,
+		size:   config.Size,
+		maxAge: time.Duration(config.MaxAge) * time.Second,
+		tls:    config.TLS && lb.reencrypt,
+		taken:  make(chan struct{}, 1),
+		idle:   make(map[string][]warmConn),
+	}
+}
+
+// take returns an idle connection to backend that is still alive, or nil.
+// With tls it is a *tls.Conn whose handshake is done.
+func (p *warmPool) take(backend string) net.Conn {
+	if p == nil {
+		return nil
+	}
+	stale := false
+	for {
+		p.mu.Lock()
+		conns := p.idle[backend]
+		if len(conns) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		// The newest connection is the most likely to be alive.
+		warm := conns[len(conns)-1]
+		p.idle[backend] = conns[:len(conns)-1]
+		warmPoolIdleGauge.set(float64(len(conns)-1), p.lb.name, backend)
+		p.mu.Unlock()
+
+		if time.Since(warm.created) < p.maxAge && isIdleConnAlive(warm.conn) {
+			warmPoolTakesTotal.inc(p.lb.name, "hit")
+			p.wake()
+			return warm.conn
+		}
+		stale = true
+		CloseAndLog(warm.conn)
+	}
+	if stale {
+		warmPoolTakesTotal.inc(p.lb.name, "stale")
+	} else {
+		warmPoolTakesTotal.inc(p.lb.name, "miss")
+	}
+	p.wake()
+	return nil
+}
+
+func (p *warmPool) wake() {
+	select {
+	case p.taken <- struct{}{}:
+	default:
+	}
+}
+
+// isIdleConnAlive tells whether conn was neither closed nor sent anything
+// by the backend, which must not talk first on a connection of the pool.
+func isIdleConnAlive(conn net.Conn) bool {
+	err := conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	if err != nil {
+		return false
+	}
+	var b [1]byte
+	_, err = conn.Read(b[:])
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return false
+	}
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
+
+// run refills the pool of every healthy backend and drops the connections
+// of the others, and the aged ones, until stop is closed. It then closes
+// every idle connection.
+func (p *warmPool) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(warmPoolRefillPeriod)
+	defer ticker.Stop()
+	for {
+		p.refill()
+		select {
+		case <-ticker.C:
+		case <-p.taken:
+		case <-stop:
+			p.closeAll()
+			return
+		}
+	}
+}
+
+func (p *warmPool) refill() {
+	wanted := make(map[string]bool)
+	for _, backend := range p.lb.remoteServers() {
+		wanted[backend] = p.lb.state.isHealthy(backend)
+	}
+
+	p.mu.Lock()
+	missing := make(map[string]int)
+	for backend, conns := range p.idle {
+		kept := conns[:0]
+		for _, warm := range conns {
+			if wanted[backend] && time.Since(warm.created) < p.maxAge {
+				kept = append(kept, warm)
+			} else {
+				CloseAndLog(warm.conn)
+			}
+		}
+		p.idle[backend] = kept
+		warmPoolIdleGauge.set(float64(len(kept)), p.lb.name, backend)
+	}
+	for backend, healthy := range wanted {
+		if healthy && len(p.idle[backend]) < p.size {
+			missing[backend] = p.size - len(p.idle[backend])
+		}
+	}
+	p.mu.Unlock()
+
+	var dials sync.WaitGroup
+	for backend, count := range missing {
+		for i := 0; i < count; i++ {
+			dials.Add(1)
+			go func(backend string) {
+				defer dials.Done()
+				conn, err := p.dial(backend)
+				if err != nil {
+					warmPoolDialErrorsTotal.inc(p.lb.name, backend)
+					log.Printf("Error warming a connection to %s: %s", backend, err)
+					return
+				}
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				if len(p.idle[backend]) >= p.size {
+					CloseAndLog(conn)
+					return
+				}
+				p.idle[backend] = append(p.idle[backend], warmConn{conn: conn, created: time.Now()})
+				warmPoolIdleGauge.set(float64(len(p.idle[backend])), p.lb.name, backend)
+			}(backend)
+		}
+	}
+	dials.Wait()
+}
+
+func (p *warmPool) dial(backend string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), warmPoolDialTimeout)
+	defer cancel()
+	conn, err := p.lb.dialer.DialContext(ctx, "tcp", backend)
+	if err != nil || !p.tls {
+		return conn, err
+	}
+	// The connection is a *tls.Conn once taken, too late for
+	// backend_linger.
+	p.lb.forwarders.setLinger(nil, conn)
+	tlsConn := tls.Client(conn, p.lb.tlsStore.backendTLSConfig(backend))
+	tlsConn.SetDeadline(time.Now().Add(warmPoolDialTimeout))
+	err = tlsConn.Handshake()
+	if err != nil {
+		CloseAndLog(conn)
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func (p *warmPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for backend, conns := range p.idle {
+		for _, warm := range conns {
+			CloseAndLog(warm.conn)
+		}
+		delete(p.idle, backend)
+		warmPoolIdleGauge.set(0, p.lb.name, backend)
+	}
+}
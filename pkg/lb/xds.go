@@ -0,0 +1,152 @@
+package lb
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	edsPath    = "/v3/discovery:endpoints"
+	edsTypeURL = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+
+	edsHealthy   = "HEALTHY"
+	edsUnhealthy = "UNHEALTHY"
+)
+
+// The subset of the xDS v3 messages that EDS over REST-JSON needs, encoded
+// with their proto JSON names.
+type discoveryRequest struct {
+	VersionInfo   string   `json:"version_info"`
+	ResourceNames []string `json:"resource_names"`
+	TypeURL       string   `json:"type_url"`
+}
+
+type discoveryResponse struct {
+	VersionInfo string                  `json:"version_info"`
+	Resources   []clusterLoadAssignment `json:"resources"`
+	TypeURL     string                  `json:"type_url"`
+}
+
+type clusterLoadAssignment struct {
+	Type        string               `json:"@type"`
+	ClusterName string               `json:"cluster_name"`
+	Endpoints   []localityLbEndpoint `json:"endpoints"`
+}
+
+type localityLbEndpoint struct {
+	LbEndpoints []lbEndpoint `json:"lb_endpoints"`
+}
+
+type lbEndpoint struct {
+	Endpoint     endpoint `json:"endpoint"`
+	HealthStatus string   `json:"health_status"`
+}
+
+type endpoint struct {
+	Address address `json:"address"`
+}
+
+type address struct {
+	SocketAddress socketAddress `json:"socket_address"`
+}
+
+type socketAddress struct {
+	Address   string `json:"address"`
+	PortValue int    `json:"port_value"`
+}
+
+// serveEDS answers xDS REST-JSON endpoint discovery requests with one
+// ClusterLoadAssignment per bound listener, named after the listener, so
+// Envoy can use the health checks of the lb instead of probing the
+// apiservers itself. A request already at the current version gets a 304,
+// which is how REST xDS says nothing changed.
+func serveEDS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "discovery requests are POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req discoveryRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("decoding discovery request: %s", err), http.StatusBadRequest)
+		return
+	}
+	if req.TypeURL != "" && req.TypeURL != edsTypeURL {
+		http.Error(w, fmt.Sprintf("unsupported type_url %s", req.TypeURL), http.StatusBadRequest)
+		return
+	}
+
+	resp := discoveryResponse{Resources: loadAssignments(req.ResourceNames), TypeURL: edsTypeURL}
+	body, err := json.Marshal(resp.Resources)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hash := fnv.New64a()
+	hash.Write(body)
+	resp.VersionInfo = strconv.FormatUint(hash.Sum64(), 16)
+	if req.VersionInfo == resp.VersionInfo {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// loadAssignments returns the assignments of the listeners in names, or of
+// all of them when names is empty, sorted so versions are stable.
+func loadAssignments(names []string) []clusterLoadAssignment {
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	boundListeners.Lock()
+	states := make(map[string]*lbState)
+	for name, state := range boundListeners.states {
+		if len(wanted) == 0 || wanted[name] {
+			states[name] = state
+		}
+	}
+	boundListeners.Unlock()
+
+	assignments := make([]clusterLoadAssignment, 0, len(states))
+	for name, state := range states {
+		healthy := make(map[string]bool)
+		for _, server := range state.healthyServers() {
+			healthy[server] = true
+		}
+		var endpoints []lbEndpoint
+		for _, server := range state.allServers() {
+			host, portStr, err := net.SplitHostPort(server)
+			if err != nil {
+				continue
+			}
+			port, _ := strconv.Atoi(portStr)
+			status := edsUnhealthy
+			if healthy[server] {
+				status = edsHealthy
+			}
+			endpoints = append(endpoints, lbEndpoint{
+				Endpoint:     endpoint{Address: address{SocketAddress: socketAddress{Address: host, PortValue: port}}},
+				HealthStatus: status,
+			})
+		}
+		assignments = append(assignments, clusterLoadAssignment{
+			Type:        edsTypeURL,
+			ClusterName: name,
+			Endpoints:   []localityLbEndpoint{{LbEndpoints: endpoints}},
+		})
+	}
+	sort.Slice(assignments, func(i, j int) bool {
+		return assignments[i].ClusterName < assignments[j].ClusterName
+	})
+	return assignments
+}
@@ -0,0 +1,208 @@
+// Package lbtest runs an lb in-process in front of fake apiservers, for end
+// to end tests of the lb and of the programs embedding it.
+package lbtest
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lumasepa/kube-apiserver-lb/pkg/lb"
+	"github.com/lumasepa/kube-apiserver-lb/pkg/mockserver"
+)
+
+const (
+	startTimeout = 5 * time.Second
+	stopTimeout  = 10 * time.Second
+	pollInterval = 50 * time.Millisecond
+)
+
+// Harness is an lb on Addr balancing TLS passthrough connections over
+// APIServers.
+type Harness struct {
+	PKI        *mockserver.PKI
+	APIServers []*mockserver.APIServer
+	Addr       string
+	Config     *lb.Configuration
+
+	shutdown chan struct{}
+	done     chan error
+	client   *http.Client
+}
+
+// Start starts apiservers fake apiservers named a, b, c and so on, and an
+// lb in front of them. config is appended to the generated configuration,
+// which sets kube_apiservers, listen_addr, shutdown_timeout and tls, to
+// set the health_check and the other options under test. dir holds the
+// certificates and the configuration file.
+func Start(dir string, apiservers int, config string) (*Harness, error) {
+	return startHarness(dir, apiservers, true, config)
+}
+
+// StartWithoutTLS is Start without the tls block, like the default
+// configuration, so that the health checks don't verify the apiservers.
+func StartWithoutTLS(dir string, apiservers int, config string) (*Harness, error) {
+	return startHarness(dir, apiservers, false, config)
+}
+
+func startHarness(dir string, apiservers int, withTLS bool, config string) (*Harness, error) {
+	pki, err := mockserver.NewPKI(dir)
+	if err != nil {
+		return nil, err
+	}
+	h := &Harness{PKI: pki, shutdown: make(chan struct{}), done: make(chan error, 1)}
+	var servers []string
+	for i := 0; i < apiservers; i++ {
+		server, err := mockserver.NewAPIServer(pki, string(rune('a'+i)))
+		if err != nil {
+			h.closeAPIServers()
+			return nil, err
+		}
+		h.APIServers = append(h.APIServers, server)
+		servers = append(servers, server.Addr)
+	}
+	h.Addr, err = freePort()
+	if err != nil {
+		h.closeAPIServers()
+		return nil, err
+	}
+
+	path := filepath.Join(dir, "config.yaml")
+	data := fmt.Sprintf(`kube_apiservers: [%s]
+listen_addr: %s
+shutdown_timeout: 1
+`, strings.Join(servers, ", "), h.Addr)
+	if withTLS {
+		data += fmt.Sprintf(`tls:
+  ca_file: %s
+  client_cert_file: %s
+  client_key_file: %s
+`, pki.CAFile, pki.ClientCertFile, pki.ClientKeyFile)
+	}
+	data += config + "\n"
+	err = ioutil.WriteFile(path, []byte(data), 0600)
+	if err == nil {
+		h.Config, err = lb.ReadConfiguration(path)
+	}
+	if err != nil {
+		h.closeAPIServers()
+		return nil, err
+	}
+
+	go func() {
+		h.done <- lb.Run(h.Config, lb.Options{}, h.shutdown)
+	}()
+	h.client = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: pki.ClientTLSConfig(), DisableKeepAlives: true},
+		Timeout:   startTimeout,
+	}
+	err = h.waitListening()
+	if err != nil {
+		h.Stop()
+		return nil, err
+	}
+	return h, nil
+}
+
+func freePort() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer listener.Close()
+	return listener.Addr().String(), nil
+}
+
+func (h *Harness) waitListening() error {
+	deadline := time.Now().Add(startTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-h.done:
+			h.done <- err
+			return fmt.Errorf("lb stopped: %v", err)
+		default:
+		}
+		conn, err := net.Dial("tcp", h.Addr)
+		if err == nil {
+			return conn.Close()
+		}
+		time.Sleep(pollInterval)
+	}
+	return fmt.Errorf("lb is not listening on %s after %s", h.Addr, startTimeout)
+}
+
+// APIServer returns the fake apiserver called name, or nil.
+func (h *Harness) APIServer(name string) *mockserver.APIServer {
+	for _, server := range h.APIServers {
+		if server.Name == name {
+			return server
+		}
+	}
+	return nil
+}
+
+// Get requests path through the lb on a new connection and returns the
+// name of the apiserver that answered.
+func (h *Harness) Get(path string) (string, error) {
+	resp, err := h.client.Get(fmt.Sprintf("https://%s%s", h.Addr, path))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP status code : %d", resp.StatusCode)
+	}
+	return resp.Header.Get(mockserver.BackendHeader), nil
+}
+
+// Spread makes n requests and counts them by the apiserver that answered,
+// failed ones under "".
+func (h *Harness) Spread(n int) map[string]int {
+	spread := make(map[string]int)
+	for i := 0; i < n; i++ {
+		name, err := h.Get("/api")
+		if err != nil {
+			name = ""
+		}
+		spread[name]++
+	}
+	return spread
+}
+
+// Eventually polls cond until it holds, returning false if it did not
+// within timeout.
+func (h *Harness) Eventually(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if cond() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Stop shuts the lb down, like SIGTERM does, and then the apiservers.
+func (h *Harness) Stop() error {
+	defer h.closeAPIServers()
+	close(h.shutdown)
+	select {
+	case err := <-h.done:
+		return err
+	case <-time.After(stopTimeout):
+		return errors.New("lb did not stop")
+	}
+}
+
+func (h *Harness) closeAPIServers() {
+	for _, server := range h.APIServers {
+		server.Close()
+	}
+}
@@ -0,0 +1,145 @@
+package lbtest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lumasepa/kube-apiserver-lb/pkg/mockserver"
+)
+
+// settle is how long the lb gets to act on a probe result.
+const settle = 200 * time.Millisecond
+
+// Scenarios are the end to end checks of the lb, by name, to run from a
+// test:
+//
+//	for name, scenario := range lbtest.Scenarios {
+//		t.Run(name, func(t *testing.T) { scenario(t) })
+//	}
+var Scenarios = map[string]func(t testing.TB){
+	"failover":   Failover,
+	"thresholds": Thresholds,
+	"draining":   Draining,
+	"no_ca_file": NoCAFile,
+}
+
+func start(t testing.TB, apiservers int, config string) *Harness {
+	t.Helper()
+	return startWith(t, Start, apiservers, config)
+}
+
+// startWith starts the harness with run, Start or StartWithoutTLS, and
+// stops it at the end of the test.
+func startWith(t testing.TB, run func(dir string, apiservers int, config string) (*Harness, error), apiservers int, config string) *Harness {
+	t.Helper()
+	h, err := run(t.TempDir(), apiservers, config)
+	if err != nil {
+		t.Fatalf("starting the harness: %s", err)
+	}
+	t.Cleanup(func() {
+		err := h.Stop()
+		if err != nil {
+			t.Errorf("stopping the lb: %s", err)
+		}
+	})
+	return h
+}
+
+// waitProbes waits until server answered n more health checks than it had.
+func waitProbes(t testing.TB, h *Harness, server *mockserver.APIServer, n int64) {
+	t.Helper()
+	probes := server.Probes()
+	if !h.Eventually(5*time.Second, func() bool { return server.Probes() >= probes+n }) {
+		t.Fatalf("%s was not probed", server.Name)
+	}
+	time.Sleep(settle)
+}
+
+// Failover checks that the traffic of an apiserver failing its health
+// checks moves to the others and comes back once it passes them again,
+// and that the traffic of one that crashes moves as well.
+func Failover(t testing.TB) {
+	h := start(t, 2, "health_check: {check_period: 1, up_threshold: 1, down_threshold: 1}")
+	if !h.Eventually(5*time.Second, func() bool {
+		spread := h.Spread(10)
+		return spread["a"] > 0 && spread["b"] > 0
+	}) {
+		t.Fatalf("traffic is not spread over a and b")
+	}
+
+	h.APIServer("a").SetHealthz(http.StatusInternalServerError)
+	if !h.Eventually(5*time.Second, func() bool { return h.Spread(10)["b"] == 10 }) {
+		t.Fatalf("traffic did not fail over to b")
+	}
+
+	h.APIServer("a").SetHealthz(http.StatusOK)
+	if !h.Eventually(5*time.Second, func() bool { return h.Spread(10)["a"] > 0 }) {
+		t.Fatalf("traffic did not come back to a")
+	}
+
+	h.APIServer("b").Close()
+	if !h.Eventually(5*time.Second, func() bool { return h.Spread(10)["a"] == 10 }) {
+		t.Fatalf("traffic did not fail over to a after b crashed")
+	}
+}
+
+// Thresholds checks that an apiserver is only taken out after
+// down_threshold failed health checks, and back in after up_threshold
+// passed ones.
+func Thresholds(t testing.TB) {
+	h := start(t, 2, "health_check: {check_period: 1, up_threshold: 2, down_threshold: 3}")
+	a := h.APIServer("a")
+
+	a.SetHealthz(http.StatusInternalServerError)
+	waitProbes(t, h, a, 1)
+	if h.Spread(10)["a"] == 0 {
+		t.Fatalf("a was taken out before down_threshold failures")
+	}
+	if !h.Eventually(5*time.Second, func() bool { return h.Spread(10)["a"] == 0 }) {
+		t.Fatalf("a was not taken out after down_threshold failures")
+	}
+
+	a.SetHealthz(http.StatusOK)
+	waitProbes(t, h, a, 1)
+	if h.Spread(10)["a"] > 0 {
+		t.Fatalf("a came back before up_threshold successes")
+	}
+	if !h.Eventually(5*time.Second, func() bool { return h.Spread(10)["a"] > 0 }) {
+		t.Fatalf("a did not come back after up_threshold successes")
+	}
+}
+
+// Draining checks that with drain_on_shutdown new connections avoid an
+// apiserver in graceful termination, which still passes /healthz.
+func Draining(t testing.TB) {
+	h := start(t, 2, "health_check: {check_period: 1, up_threshold: 1, down_threshold: 1, drain_on_shutdown: true}")
+	a := h.APIServer("a")
+
+	a.SetShuttingDown(true)
+	if !h.Eventually(5*time.Second, func() bool { return h.Spread(10)["b"] == 10 }) {
+		t.Fatalf("new connections still go to a while it shuts down")
+	}
+	a.SetShuttingDown(false)
+	if !h.Eventually(5*time.Second, func() bool { return h.Spread(10)["a"] > 0 }) {
+		t.Fatalf("traffic did not come back to a")
+	}
+}
+
+// NoCAFile checks that without a tls block, as in the default
+// configuration, the health checks of apiservers with a certificate of the
+// cluster CA pass, so an apiserver failing them is still taken out.
+func NoCAFile(t testing.TB) {
+	h := startWith(t, StartWithoutTLS, 2, "health_check: {check_period: 1, up_threshold: 1, down_threshold: 1}")
+	if !h.Eventually(5*time.Second, func() bool {
+		spread := h.Spread(10)
+		return spread["a"] > 0 && spread["b"] > 0
+	}) {
+		t.Fatalf("traffic is not spread over a and b")
+	}
+
+	h.APIServer("a").SetHealthz(http.StatusInternalServerError)
+	if !h.Eventually(5*time.Second, func() bool { return h.Spread(10)["b"] == 10 }) {
+		t.Fatalf("traffic did not fail over to b, the health checks of b fail")
+	}
+}
@@ -0,0 +1,11 @@
+package lbtest
+
+import "testing"
+
+// The scenarios run one after the other, as only one lb serves at a time.
+func TestScenarios(t *testing.T) {
+	for name, scenario := range Scenarios {
+		scenario := scenario
+		t.Run(name, func(t *testing.T) { scenario(t) })
+	}
+}
@@ -0,0 +1,106 @@
+package mockserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// BackendHeader names the fake apiserver that answered a request.
+const BackendHeader = "X-Lbtest-Backend"
+
+// APIServer is a fake kube-apiserver on a local port. /healthz and /readyz
+// answer the status codes set with SetHealthz and SetReadyz, 200 at first,
+// /readyz/shutdown fails while SetShuttingDown is on like during a graceful
+// termination, and every other path answers 200 with the name of the
+// server in the body and in BackendHeader.
+type APIServer struct {
+	Name string
+	Addr string
+
+	server       *http.Server
+	healthz      int32
+	readyz       int32
+	shuttingDown int32
+	requests     int64
+	probes       int64
+}
+
+// NewAPIServer starts name serving the certificate of pki on a free port of
+// 127.0.0.1.
+func NewAPIServer(pki *PKI, name string) (*APIServer, error) {
+	return ListenAPIServer("127.0.0.1:0", pki.ServerTLSConfig(), name)
+}
+
+// ListenAPIServer starts name serving TLS with config on addr.
+func ListenAPIServer(addr string, config *tls.Config, name string) (*APIServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &APIServer{
+		Name:    name,
+		Addr:    listener.Addr().String(),
+		healthz: http.StatusOK,
+		readyz:  http.StatusOK,
+	}
+	s.server = &http.Server{Handler: s}
+	go s.server.Serve(tls.NewListener(listener, config))
+	return s, nil
+}
+
+func (s *APIServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set(BackendHeader, s.Name)
+	switch req.URL.Path {
+	case "/healthz":
+		atomic.AddInt64(&s.probes, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&s.healthz)))
+	case "/readyz":
+		w.WriteHeader(int(atomic.LoadInt32(&s.readyz)))
+	case "/readyz/shutdown":
+		if atomic.LoadInt32(&s.shuttingDown) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	case "/version":
+		fmt.Fprintf(w, `{"major": "1", "minor": "30", "gitVersion": "v1.30.0"}`)
+	default:
+		atomic.AddInt64(&s.requests, 1)
+		fmt.Fprintln(w, s.Name)
+	}
+}
+
+// SetHealthz sets the status code of /healthz.
+func (s *APIServer) SetHealthz(code int) {
+	atomic.StoreInt32(&s.healthz, int32(code))
+}
+
+// SetReadyz sets the status code of /readyz.
+func (s *APIServer) SetReadyz(code int) {
+	atomic.StoreInt32(&s.readyz, int32(code))
+}
+
+// SetShuttingDown makes /readyz/shutdown fail, or succeed again.
+func (s *APIServer) SetShuttingDown(shuttingDown bool) {
+	value := int32(0)
+	if shuttingDown {
+		value = 1
+	}
+	atomic.StoreInt32(&s.shuttingDown, value)
+}
+
+// Requests is the number of requests served besides the health checks.
+func (s *APIServer) Requests() int64 {
+	return atomic.LoadInt64(&s.requests)
+}
+
+// Probes is the number of /healthz requests served.
+func (s *APIServer) Probes() int64 {
+	return atomic.LoadInt64(&s.probes)
+}
+
+// Close stops the server and closes its connections, like a crash.
+func (s *APIServer) Close() error {
+	return s.server.Close()
+}
@@ -0,0 +1,157 @@
+// Package mockserver is a fake kube-apiserver, served by the mockserver
+// command and by the fake apiservers of lbtest.
+package mockserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// scriptStep answers code for duration.
+type scriptStep struct {
+	code     int
+	duration time.Duration
+}
+
+// parseScript parses steps like 200:30s,500:10s.
+func parseScript(script string) ([]scriptStep, error) {
+	var steps []scriptStep
+	for _, step := range strings.Split(script, ",") {
+		parts := strings.SplitN(strings.TrimSpace(step), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("step %q is not code:duration", step)
+		}
+		code, err := strconv.Atoi(parts[0])
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("step %q has an invalid status code", step)
+		}
+		duration, err := time.ParseDuration(parts[1])
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("step %q has an invalid duration", step)
+		}
+		steps = append(steps, scriptStep{code: code, duration: duration})
+	}
+	return steps, nil
+}
+
+// play runs steps through set, over and over unless once.
+func play(endpoint string, steps []scriptStep, once bool, set func(code int)) {
+	for {
+		for _, step := range steps {
+			log.Printf("%s answers %d for %s", endpoint, step.code, step.duration)
+			set(step.code)
+			time.Sleep(step.duration)
+		}
+		if once {
+			log.Printf("%s script done, keeping %d", endpoint, steps[len(steps)-1].code)
+			return
+		}
+	}
+}
+
+// Run serves a fake kube-apiserver over TLS until SIGTERM, for
+// trying out the health check thresholds and failover of an lb locally.
+// The status codes of /healthz, /readyz and /readyz/shutdown follow
+// scripts of code:duration steps, like -healthz 200:30s,500:10s to flap.
+func Run(args []string) {
+	flags := flag.NewFlagSet("mockserver", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:7443", "address to listen on")
+	name := flags.String("name", "mock", "name answered in the body of the requests and the X-Lbtest-Backend header")
+	certFile := flags.String("cert", "", "serving certificate, a throwaway CA and certificates are created otherwise")
+	keyFile := flags.String("key", "", "key of the serving certificate")
+	clientCAFile := flags.String("client-ca", "", "CA verifying the client certificates, when the clients send one")
+	healthz := flags.String("healthz", "", "script of /healthz, like 200:30s,500:10s")
+	readyz := flags.String("readyz", "", "script of /readyz")
+	shutdown := flags.String("shutdown", "", "script of /readyz/shutdown, which fails with 500 during a graceful termination")
+	once := flags.Bool("once", false, "play the scripts once and keep their last step, instead of looping")
+	flags.Parse(args)
+
+	config, err := mockTLSConfig(*certFile, *keyFile, *clientCAFile)
+	if err != nil {
+		log.Fatalf("error loading tls configuration : %s", err)
+	}
+	scripts := []struct {
+		endpoint string
+		script   string
+		set      func(s *APIServer) func(code int)
+	}{
+		{"/healthz", *healthz, func(s *APIServer) func(int) { return s.SetHealthz }},
+		{"/readyz", *readyz, func(s *APIServer) func(int) { return s.SetReadyz }},
+		{"/readyz/shutdown", *shutdown, func(s *APIServer) func(int) {
+			return func(code int) { s.SetShuttingDown(code != http.StatusOK) }
+		}},
+	}
+	steps := make([][]scriptStep, len(scripts))
+	for i, script := range scripts {
+		if script.script == "" {
+			continue
+		}
+		steps[i], err = parseScript(script.script)
+		if err != nil {
+			log.Fatalf("error parsing the %s script : %s", script.endpoint, err)
+		}
+	}
+
+	server, err := ListenAPIServer(*addr, config, *name)
+	if err != nil {
+		log.Fatalf("error listening on %s : %s", *addr, err)
+	}
+	log.Printf("Mock apiserver %s listening on %s", *name, server.Addr)
+	for i, script := range scripts {
+		if steps[i] != nil {
+			go play(script.endpoint, steps[i], *once, script.set(server))
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	<-signals
+	server.Close()
+}
+
+func mockTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" {
+		if keyFile != "" || clientCAFile != "" {
+			return nil, errors.New("-key and -client-ca require -cert")
+		}
+		dir, err := ioutil.TempDir("", "mockserver")
+		if err != nil {
+			return nil, err
+		}
+		pki, err := NewPKI(dir)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Serving a throwaway certificate, CA in %s, client certificate in %s and %s", pki.CAFile, pki.ClientCertFile, pki.ClientKeyFile)
+		return pki.ServerTLSConfig(), nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", clientCAFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
@@ -0,0 +1,140 @@
+package mockserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// PKI is a throwaway CA with a serving certificate for localhost and a
+// client certificate, written to Dir so an lb configuration can refer to
+// them.
+type PKI struct {
+	Dir            string
+	CAFile         string
+	CertFile       string
+	KeyFile        string
+	ClientCertFile string
+	ClientKeyFile  string
+
+	ca         *x509.Certificate
+	caKey      *ecdsa.PrivateKey
+	serving    tls.Certificate
+	client     tls.Certificate
+	clientPool *x509.CertPool
+}
+
+// NewPKI creates the CA and the certificates in dir.
+func NewPKI(dir string) (*PKI, error) {
+	p := &PKI{
+		Dir:            dir,
+		CAFile:         filepath.Join(dir, "ca.crt"),
+		CertFile:       filepath.Join(dir, "server.crt"),
+		KeyFile:        filepath.Join(dir, "server.key"),
+		ClientCertFile: filepath.Join(dir, "client.crt"),
+		ClientKeyFile:  filepath.Join(dir, "client.key"),
+	}
+	var err error
+	p.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "lbtest-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &p.caKey.PublicKey, p.caKey)
+	if err != nil {
+		return nil, err
+	}
+	p.ca, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	err = writePEM(p.CAFile, "CERTIFICATE", der)
+	if err != nil {
+		return nil, err
+	}
+	p.clientPool = x509.NewCertPool()
+	p.clientPool.AddCert(p.ca)
+
+	p.serving, err = p.issue(2, "localhost", x509.ExtKeyUsageServerAuth, p.CertFile, p.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	p.client, err = p.issue(3, "lbtest", x509.ExtKeyUsageClientAuth, p.ClientCertFile, p.ClientKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *PKI) issue(serial int64, name string, usage x509.ExtKeyUsage, certFile string, keyFile string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	err = writePEM(certFile, "CERTIFICATE", der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	err = writePEM(keyFile, "EC PRIVATE KEY", keyDER)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// ServerTLSConfig serves the localhost certificate and verifies the client
+// certificates issued by the CA, when clients send one.
+func (p *PKI) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{p.serving},
+		ClientCAs:    p.clientPool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+}
+
+// ClientTLSConfig trusts the CA and presents the client certificate.
+func (p *PKI) ClientTLSConfig() *tls.Config {
+	return &tls.Config{
+		RootCAs:      p.clientPool,
+		Certificates: []tls.Certificate{p.client},
+	}
+}
+
+func writePEM(path string, kind string, der []byte) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600)
+}